@@ -0,0 +1,89 @@
+package gpkg2osm
+
+import (
+	"context"
+	"io"
+
+	"github.com/lc-dmx/osm-go/osmpbf"
+	"github.com/paulmach/osm"
+	pbfreader "github.com/paulmach/osm/osmpbf"
+	"github.com/paulmach/osm/osmxml"
+)
+
+// Format of an OSM file
+type Format string
+
+const (
+	FormatPBF Format = "pbf"
+	FormatXML Format = "xml"
+	FormatO5M Format = "o5m"
+)
+
+// NewScanner reads the elements of an existing OSM file
+func NewScanner(r io.Reader, format Format) osm.Scanner {
+	switch format {
+	case FormatPBF:
+		return pbfreader.New(context.Background(), r, 1)
+	case FormatO5M:
+		return NewO5MScanner(r)
+	}
+	return osmxml.New(context.Background(), r)
+}
+
+// IDsAfter scans existing OSM data and moves ids past the IDs of each element type that are already used,
+// so new elements cannot collide with the existing ones. A negative generator continues below the lowest
+// negative ID, a positive one above the highest positive ID. If ids is nil a new negative generator is used.
+// If keep is not nil, every node, way and relation is also added to it
+func IDsAfter(s osm.Scanner, ids *IDGenerator, keep *osm.OSM) (*IDGenerator, error) {
+	if ids == nil {
+		ids = &IDGenerator{}
+	}
+	for s.Scan() {
+		switch o := s.Object().(type) {
+		case *osm.Node:
+			ids.skip(&ids.node, int64(o.ID))
+			if keep != nil {
+				keep.Nodes = append(keep.Nodes, o)
+			}
+		case *osm.Way:
+			ids.skip(&ids.way, int64(o.ID))
+			if keep != nil {
+				keep.Ways = append(keep.Ways, o)
+			}
+		case *osm.Relation:
+			ids.skip(&ids.relation, int64(o.ID))
+			if keep != nil {
+				keep.Relations = append(keep.Relations, o)
+			}
+		}
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	return ids, nil
+}
+
+// NewPBFAppendWriter writes PBF data blocks to w without a file header, for adding elements to the end of an
+// existing PBF file. The elements are not merged into the existing blocks, so the result is not sorted
+func NewPBFAppendWriter(w io.Writer, opts *PBFOptions) (*pbfWriter, error) {
+	if err := opts.check(); err != nil {
+		return nil, err
+	}
+	// The osmpbf writer always starts with a header block, throw it away
+	sw := &switchWriter{w: io.Discard}
+	pbf, err := osmpbf.NewWriter(context.Background(), opts.output(sw))
+	if err != nil {
+		return nil, err
+	}
+	sw.w = w
+	return newPBFWriter(pbf, opts), nil
+}
+
+// switchWriter lets the destination change after a writer was created
+type switchWriter struct {
+	w io.Writer
+}
+
+func (s *switchWriter) Write(p []byte) (int, error) {
+	return s.w.Write(p)
+}
@@ -0,0 +1,477 @@
+package gpkg2osm
+
+import (
+	"cmp"
+	"fmt"
+	"log/slog"
+	"math"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/paulmach/osm"
+	"github.com/twpayne/go-geom"
+	"github.com/twpayne/go-geom/xy"
+)
+
+// OSM does not allow ways with more nodes than this
+const DefaultMaxNodesPerWay = 2000
+
+// OSM stores coordinates to 7 decimal places, about 1cm
+const DefaultCoordPrecision = 7
+
+// Keys whose presence makes a closed way an area, after the ones iD uses. A simple polygon only gets area=yes
+// when it has one of these, a closed highway=* or barrier=* without one is a loop
+var DefaultAreaKeys = []string{
+	"aeroway", "amenity", "area:highway", "boundary", "building", "building:part", "craft", "emergency", "golf",
+	"healthcare", "historic", "indoor", "landuse", "leisure", "man_made", "military", "natural", "office", "place",
+	"playground", "power", "public_transport", "shop", "sport", "tourism", "water",
+}
+
+// Winding is the direction polygon exterior rings are written in, holes go the other way
+type Winding string
+
+const (
+	WindingKeep Winding = ""    // Leave the rings as they are in the source
+	WindingCCW  Winding = "ccw" // Counter clockwise exteriors and clockwise holes, as in OGC Simple Features
+	WindingCW   Winding = "cw"  // Clockwise exteriors and counter clockwise holes
+)
+
+// DedupScope is how far untagged way nodes at the same coordinate are shared
+type DedupScope string
+
+const (
+	DedupLayer  DedupScope = "layer"  // Ways of the same layer share nodes, the default
+	DedupGlobal DedupScope = "global" // Ways of every layer and input share nodes
+	DedupNone   DedupScope = "none"   // Every way has nodes of its own
+)
+
+// Builder creates the nodes, ways and relations for features, and holds the state that is shared between them
+type Builder struct {
+	IDs  *IDGenerator
+	Opts *Options
+
+	Split int // Number of source ways that had to be split into several OSM ways
+
+	stable *stableIDs // Hashed IDs, only set for Options.StableIDs and Options.IDFromFID
+	seed   *fidSeed   // The feature being built, nil unless its IDs come from its fid
+
+	wayNodes nodeCache // Untagged way node at each coordinate, nil for DedupNone
+
+	points map[coordKey]osm.NodeID // Point nodes that ways through the same place use, only for Options.MergeCoincidentPoints
+
+	areaKeys map[string]bool // Keys that get simple polygons area=yes, nil for every polygon
+
+	osmIDs map[takenID]bool // Real OSM IDs given to features so far, see Options.OSMIDColumn
+
+	scale float64 // Coordinates are rounded to multiples of 1/scale
+}
+
+func NewBuilder(ids *IDGenerator, opts *Options) *Builder {
+	b := &Builder{
+		IDs:    ids,
+		Opts:   opts,
+		osmIDs: make(map[takenID]bool),
+	}
+	precision := opts.CoordPrecision
+	if precision < 1 || precision > DefaultCoordPrecision {
+		precision = DefaultCoordPrecision
+	}
+	b.scale = math.Pow10(precision)
+	if opts.StableIDs || opts.IDFromFID {
+		b.stable = newStableIDs(ids)
+	}
+	if opts.MergeCoincidentPoints {
+		b.points = make(map[coordKey]osm.NodeID)
+	}
+	b.wayNodes = newNodeCache(opts)
+	keys := opts.AreaKeys
+	if keys == nil {
+		keys = DefaultAreaKeys
+	}
+	if !slices.Contains(keys, "*") {
+		b.areaKeys = make(map[string]bool, len(keys))
+		for _, k := range keys {
+			b.areaKeys[k] = true
+		}
+	}
+	return b
+}
+
+// Whether a closed way with the tags should get area=yes. Keys are looked up without the KeyPrefix
+func (b *Builder) isArea(tags osm.Tags) bool {
+	if b.Opts.NoAreaTag || tags.HasTag(b.Opts.KeyPrefix+"area") {
+		return false
+	}
+	if b.areaKeys == nil {
+		return true
+	}
+	for _, t := range tags {
+		if b.areaKeys[strings.TrimPrefix(t.Key, b.Opts.KeyPrefix)] {
+			return true
+		}
+	}
+	return false
+}
+
+// Called before the features of each layer are built. With DedupLayer the nodes of the layers before are
+// forgotten, so no way shares them
+func (b *Builder) startLayer() {
+	if b.Opts.DedupScope != DedupGlobal {
+		b.wayNodes = newNodeCache(b.Opts)
+	}
+}
+
+func (b *Builder) maxNodesPerWay() int {
+	if b.Opts.MaxNodesPerWay > 1 {
+		return b.Opts.MaxNodesPerWay
+	}
+	return DefaultMaxNodesPerWay
+}
+
+// Called before the elements of each feature are built. With IDFromFID they get IDs from the layer and fid,
+// unless fid is nil
+func (b *Builder) startFeature(layer string, fid *int64) {
+	b.seed = nil
+	if b.Opts.IDFromFID && fid != nil {
+		b.seed = &fidSeed{layer: layer, fid: *fid}
+	}
+}
+
+// The coordinate rounded to Options.CoordPrecision. Nodes are written at the rounded coordinate and their
+// coordKey is made from it, so points that round to the same place share a node and a stable ID
+func (b *Builder) round(c geom.Coord) geom.Coord {
+	return geom.Coord{math.Round(c.X()*b.scale) / b.scale, math.Round(c.Y()*b.scale) / b.scale}
+}
+
+// Create a new untagged node at the given coordinate
+func (b *Builder) node(c geom.Coord) *osm.Node {
+	c = b.round(c)
+	n := &osm.Node{
+		Lon:     c.X(),
+		Lat:     c.Y(),
+		Visible: true,
+	}
+	if b.Opts.StableIDs {
+		n.ID = b.stable.node(newCoordKey(c))
+	} else {
+		n.ID = b.IDs.Node()
+	}
+	return n
+}
+
+// Create the new node that stands for a feature, with an ID from its fid if there is one
+func (b *Builder) featureNode(c geom.Coord) *osm.Node {
+	if b.seed == nil {
+		return b.node(c)
+	}
+	c = b.round(c)
+	n := &osm.Node{
+		ID:      osm.NodeID(b.stable.feature(osm.TypeNode, b.seed.layer, b.seed.fid, b.seed.nodes)),
+		Lon:     c.X(),
+		Lat:     c.Y(),
+		Visible: true,
+	}
+	b.seed.nodes++
+	return n
+}
+
+func (b *Builder) wayID() osm.WayID {
+	if b.seed == nil {
+		return b.IDs.Way()
+	}
+	id := osm.WayID(b.stable.feature(osm.TypeWay, b.seed.layer, b.seed.fid, b.seed.ways))
+	b.seed.ways++
+	return id
+}
+
+func (b *Builder) relationID() osm.RelationID {
+	if b.seed == nil {
+		return b.IDs.Relation()
+	}
+	id := osm.RelationID(b.stable.feature(osm.TypeRelation, b.seed.layer, b.seed.fid, b.seed.relations))
+	b.seed.relations++
+	return id
+}
+
+// Give every element in the file the version, timestamp and user from the options
+func (b *Builder) stamp(file *osm.OSM) {
+	o := b.Opts
+	if o.Version == 0 && o.Timestamp.IsZero() && o.User == "" {
+		return
+	}
+	// Without a version of its own, the elements with a real OSM ID keep the one they have
+	for _, n := range file.Nodes {
+		n.Version, n.Timestamp, n.User = cmp.Or(o.Version, n.Version), o.Timestamp, o.User
+	}
+	for _, w := range file.Ways {
+		w.Version, w.Timestamp, w.User = cmp.Or(o.Version, w.Version), o.Timestamp, o.User
+	}
+	for _, r := range file.Relations {
+		r.Version, r.Timestamp, r.User = cmp.Or(o.Version, r.Version), o.Timestamp, o.User
+	}
+}
+
+// Create the node for a point feature. With MergeCoincidentPoints, ways through the same coordinate that are
+// converted later use this node instead of their own. Only the first point at a coordinate is used like this,
+// and never one where a way node has already been written
+func (b *Builder) pointNode(c geom.Coord) *osm.Node {
+	n := b.featureNode(c)
+	if b.points == nil {
+		return n
+	}
+	c = b.round(c)
+	k := newCoordKey(c)
+	if _, ok := b.points[k]; ok {
+		return n
+	}
+	if b.wayNodes != nil {
+		if _, ok := b.wayNodes.load(k); ok {
+			slog.Debug("not merging point, a way node was already written at the same place", "lon", c.X(), "lat", c.Y())
+			return n
+		}
+	}
+	b.points[k] = n.ID
+	return n
+}
+
+// Add an untagged node for a way to the file, and return its ID. The node is shared with the other ways through
+// the same coordinate in the DedupScope, and only written the first time
+func (b *Builder) wayNode(file *osm.OSM, c geom.Coord) osm.NodeID {
+	c = b.round(c)
+	k := newCoordKey(c)
+	if id, ok := b.points[k]; ok {
+		return id
+	}
+	create := func() osm.NodeID {
+		n := b.node(c)
+		file.Nodes = append(file.Nodes, n)
+		return n.ID
+	}
+	if b.wayNodes == nil {
+		return create()
+	}
+	return b.wayNodes.loadOrCreate(k, create)
+}
+
+// The untagged way node at each coordinate. Both kinds are safe to share between goroutines: create is only
+// called by the first lookup of a coordinate, under the lock for it, so every later lookup gets the ID that first
+// insert was given, however the goroutines are scheduled
+type nodeCache interface {
+	load(k coordKey) (osm.NodeID, bool)
+	loadOrCreate(k coordKey, create func() osm.NodeID) osm.NodeID
+}
+
+// The cache for DedupScope, nil for DedupNone. A conversion with Workers spreads the coordinates over shards with a
+// lock each, the sequential one keeps a single lock, which is never contended
+func newNodeCache(opts *Options) nodeCache {
+	switch {
+	case opts.DedupScope == DedupNone:
+		return nil
+	case opts.Workers > 1:
+		c := &shardedNodeCache{}
+		for i := range c {
+			c[i].nodes = make(map[coordKey]osm.NodeID)
+		}
+		return c
+	default:
+		return &lockedNodeCache{nodes: make(map[coordKey]osm.NodeID)}
+	}
+}
+
+// A single map behind a single lock
+type lockedNodeCache struct {
+	mu    sync.Mutex
+	nodes map[coordKey]osm.NodeID
+}
+
+func (c *lockedNodeCache) load(k coordKey) (osm.NodeID, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	id, ok := c.nodes[k]
+	return id, ok
+}
+
+func (c *lockedNodeCache) loadOrCreate(k coordKey, create func() osm.NodeID) osm.NodeID {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	id, ok := c.nodes[k]
+	if !ok {
+		id = create()
+		c.nodes[k] = id
+	}
+	return id
+}
+
+// Number of shards in a shardedNodeCache, a power of two
+const nodeCacheShards = 64
+
+// Locked maps keyed by a hash of the rounded coordinate, so goroutines looking up different places rarely wait for
+// each other
+type shardedNodeCache [nodeCacheShards]lockedNodeCache
+
+func (c *shardedNodeCache) shard(k coordKey) *lockedNodeCache {
+	h := uint64(k.lon)*0x9e3779b97f4a7c15 ^ uint64(k.lat)*0xc2b2ae3d27d4eb4f
+	return &c[h>>32%nodeCacheShards]
+}
+
+func (c *shardedNodeCache) load(k coordKey) (osm.NodeID, bool) {
+	return c.shard(k).load(k)
+}
+
+func (c *shardedNodeCache) loadOrCreate(k coordKey, create func() osm.NodeID) osm.NodeID {
+	return c.shard(k).loadOrCreate(k, create)
+}
+
+// Add the nodes for the coords to the file, and the untagged ways that connect them. Closed rings reuse the
+// first node. This is normally a single way, but lines with more nodes than the limit are split into several
+// ways that share the nodes where they meet
+func (b *Builder) ways(file *osm.OSM, coords []geom.Coord) []*osm.Way {
+	nodes := make(osm.WayNodes, 0, len(coords))
+	for i, c := range coords {
+		if i > 0 && i == len(coords)-1 && c.Equal(geom.XY, coords[0]) {
+			nodes = append(nodes, nodes[0])
+			break
+		}
+		id := b.wayNode(file, c)
+		if len(nodes) > 0 && nodes[len(nodes)-1].ID == id {
+			continue // Repeated coordinate, only possible when nodes are shared
+		}
+		nodes = append(nodes, osm.WayNode{ID: id})
+	}
+
+	max := b.maxNodesPerWay()
+	if len(nodes) > max {
+		b.Split++
+	}
+	ways := make([]*osm.Way, 0, 1)
+	for start := 0; start == 0 || start < len(nodes)-1; start += max - 1 {
+		w := &osm.Way{
+			ID:      b.wayID(),
+			Nodes:   nodes[start:min(start+max, len(nodes))],
+			Visible: true,
+		}
+		file.Ways = append(file.Ways, w)
+		ways = append(ways, w)
+	}
+	return ways
+}
+
+// The coords of ring i of the polygon, reversed if needed to match the configured winding. Ring 0 is the
+// exterior
+func (b *Builder) ringCoords(p *geom.Polygon, i int) []geom.Coord {
+	r := p.LinearRing(i)
+	coords := r.Coords()
+	if b.Opts.Winding == WindingKeep {
+		return coords
+	}
+	wantCCW := (b.Opts.Winding == WindingCCW) == (i == 0)
+	// Positive for clockwise rings, zero when there is no area to tell the direction by
+	area := xy.SignedArea(r.Layout(), r.FlatCoords())
+	if area != 0 && (area < 0) != wantCCW {
+		slices.Reverse(coords)
+	}
+	return coords
+}
+
+// Add a relation of the given type with the lines as untagged member ways, in the order the lines are in
+func (b *Builder) lineRelation(file *osm.OSM, typ string, tags osm.Tags, g *geom.MultiLineString) {
+	r := &osm.Relation{
+		ID:      b.relationID(),
+		Tags:    append(osm.Tags{{Key: "type", Value: typ}}, tags...),
+		Visible: true,
+	}
+	r.Tags.SortByKeyValue()
+	for i := 0; i < g.NumLineStrings(); i++ {
+		for _, w := range b.ways(file, g.LineString(i).Coords()) {
+			r.Members = append(r.Members, osm.Member{Type: osm.TypeWay, Ref: int64(w.ID)})
+		}
+	}
+	file.Relations = append(file.Relations, r)
+}
+
+// Add a polygon. A simple polygon is just a closed way, anything with holes (or too many nodes for one way) needs
+// a multipolygon
+func (b *Builder) polygon(file *osm.OSM, tags osm.Tags, p *geom.Polygon) {
+	if p.NumLinearRings() != 1 || len(p.LinearRing(0).Coords()) > b.maxNodesPerWay() {
+		b.multipolygon(file, tags, p)
+		return
+	}
+	w := b.ways(file, b.ringCoords(p, 0))[0]
+	w.Tags = tags
+	// Never replace an area tag from the source, it may well be area=no
+	if b.isArea(w.Tags) {
+		w.Tags = append(slices.Clone(tags), osm.Tag{Key: b.Opts.KeyPrefix + "area", Value: "yes"})
+		w.Tags.SortByKeyValue()
+	}
+}
+
+// Add a multipolygon relation with outer ways for each polygon and inner ways for the holes. OSM does not say
+// which outer a hole is in, readers work that out from the geometry, so every ring is simply a member
+func (b *Builder) multipolygon(file *osm.OSM, tags osm.Tags, polys ...*geom.Polygon) {
+	r := &osm.Relation{
+		ID:      b.relationID(),
+		Tags:    append(osm.Tags{{Key: "type", Value: "multipolygon"}}, tags...),
+		Visible: true,
+	}
+	r.Tags.SortByKeyValue()
+	for _, p := range polys {
+		for i := 0; i < p.NumLinearRings(); i++ {
+			role := "inner"
+			if i == 0 {
+				role = "outer"
+			}
+			for _, w := range b.ways(file, b.ringCoords(p, i)) {
+				r.Members = append(r.Members, osm.Member{Type: osm.TypeWay, Ref: int64(w.ID), Role: role})
+			}
+		}
+	}
+	file.Relations = append(file.Relations, r)
+}
+
+// A single point standing in for the whole geometry: the centroid of polygons, and the point halfway along
+// lines (the longest part of a multilinestring), which unlike the centroid is always on the line
+func center(g geom.T) (geom.Coord, error) {
+	switch g := g.(type) {
+	case *geom.LineString:
+		return lineMidpoint(g.Coords()), nil
+	case *geom.MultiLineString:
+		var longest *geom.LineString
+		for i := 0; i < g.NumLineStrings(); i++ {
+			if l := g.LineString(i); longest == nil || l.Length() > longest.Length() {
+				longest = l
+			}
+		}
+		if longest == nil {
+			return nil, fmt.Errorf("empty multilinestring")
+		}
+		return lineMidpoint(longest.Coords()), nil
+	}
+	return xy.Centroid(g)
+}
+
+// The point half the length of the line from its start
+func lineMidpoint(coords []geom.Coord) geom.Coord {
+	if len(coords) == 0 {
+		return geom.Coord{0, 0}
+	}
+	var total float64
+	for i := 1; i < len(coords); i++ {
+		total += segmentLength(coords[i-1], coords[i])
+	}
+	half := total / 2
+	for i := 1; i < len(coords); i++ {
+		l := segmentLength(coords[i-1], coords[i])
+		if l > 0 && half <= l {
+			f := half / l
+			a, b := coords[i-1], coords[i]
+			return geom.Coord{a.X() + (b.X()-a.X())*f, a.Y() + (b.Y()-a.Y())*f}
+		}
+		half -= l
+	}
+	return coords[0]
+}
+
+func segmentLength(a, b geom.Coord) float64 {
+	return math.Hypot(b.X()-a.X(), b.Y()-a.Y())
+}
@@ -0,0 +1,612 @@
+package gpkg2osm
+
+import (
+	"database/sql"
+	"fmt"
+	"math"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/nullmonk/gpkg2osm/internal/gpkg"
+	"github.com/paulmach/osm"
+	"github.com/twpayne/go-geom"
+)
+
+func TestSplitLongWay(t *testing.T) {
+	db := newGeoPackage(t)
+	addLayer(t, db, "rivers", "LINESTRING", "waterway")
+	flat := make([]float64, 0, 2*5000)
+	for i := range 5000 {
+		flat = append(flat, float64(i)*0.001, 0)
+	}
+	insert(t, db, "rivers", line(flat...), map[string]any{"waterway": "river"})
+
+	file, summary := convert(t, db, nil)
+	if len(file.Ways) != 3 {
+		t.Fatalf("got %d ways, want 3", len(file.Ways))
+	}
+	if len(file.Nodes) != 5000 {
+		t.Errorf("got %d nodes, want 5000", len(file.Nodes))
+	}
+	for i, w := range file.Ways {
+		if len(w.Nodes) > DefaultMaxNodesPerWay {
+			t.Errorf("way %d has %d nodes", i, len(w.Nodes))
+		}
+		checkTags(t, w.Tags, "waterway", "river")
+		if i > 0 && w.Nodes[0].ID != file.Ways[i-1].Nodes[len(file.Ways[i-1].Nodes)-1].ID {
+			t.Errorf("way %d does not start at the node way %d ends at", i, i-1)
+		}
+	}
+	if s := summary.Layer("rivers").Split; s != 1 {
+		t.Errorf("summary has %d split ways, want 1", s)
+	}
+}
+
+// A ring too long for one way becomes a multipolygon whose outer ways still close the ring
+func TestSplitLongRing(t *testing.T) {
+	db := newGeoPackage(t)
+	addLayer(t, db, "lakes", "POLYGON", "natural")
+	var ring []float64
+	for i := range 4999 {
+		a := 2 * math.Pi * float64(i) / 4999
+		ring = append(ring, math.Cos(a), math.Sin(a))
+	}
+	ring = append(ring, ring[0], ring[1])
+	insert(t, db, "lakes", polygon(ring), map[string]any{"natural": "water"})
+
+	file, _ := convert(t, db, nil)
+	if len(file.Relations) != 1 {
+		t.Fatalf("got %d relations, want a multipolygon", len(file.Relations))
+	}
+	r := file.Relations[0]
+	checkTags(t, r.Tags, "natural", "water", "type", "multipolygon")
+	ways := make(map[osm.WayID]*osm.Way)
+	for _, w := range file.Ways {
+		ways[w.ID] = w
+	}
+	var first, last osm.NodeID
+	for i, m := range r.Members {
+		w := ways[osm.WayID(m.Ref)]
+		if w == nil || m.Role != "outer" {
+			t.Fatalf("member %d is %v, want an outer way", i, m)
+		}
+		if i == 0 {
+			first = w.Nodes[0].ID
+		} else if w.Nodes[0].ID != last {
+			t.Errorf("member %d does not start where member %d ends", i, i-1)
+		}
+		last = w.Nodes[len(w.Nodes)-1].ID
+	}
+	if len(r.Members) != 3 || first != last {
+		t.Errorf("%d outer ways from node %d to %d, want 3 that close the ring", len(r.Members), first, last)
+	}
+}
+
+// A grid of n×n line features, each sharing its end nodes with the next one, in a layer of its own for every
+// row so that Workers has layers to read ahead
+func gridGeoPackage(b testing.TB, n int) *sql.DB {
+	db := newGeoPackage(b)
+	for row := range n {
+		table := fmt.Sprintf("row%d", row)
+		addLayer(b, db, table, "LINESTRING", "highway")
+		tx, err := db.Begin()
+		if err != nil {
+			b.Fatal(err)
+		}
+		for col := range n {
+			x, y := float64(col)*0.001, float64(row)*0.001
+			if err := gpkg.Insert(tx, table, line(x, y, x+0.0005, y+0.0005, x+0.001, y), wgs84, map[string]any{"highway": "path"}); err != nil {
+				b.Fatal(err)
+			}
+		}
+		if err := tx.Commit(); err != nil {
+			b.Fatal(err)
+		}
+	}
+	return db
+}
+
+// With Workers the layers are read and parsed in parallel and the node cache is sharded, the elements are still
+// built in the order of the layers, so the output is the same
+func BenchmarkConvertWorkers(b *testing.B) {
+	db := gridGeoPackage(b, 50)
+	for _, workers := range []int{1, 8} {
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			for b.Loop() {
+				if _, err := Convert(db, nopWriter{}, &Options{Workers: workers, ReadThreads: 2}); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// Every coordinate is looked up 4 times, as at the crossings of a street grid
+func nodeCacheKeys() []coordKey {
+	keys := make([]coordKey, 0, 4*10000)
+	for i := range 4 * 10000 {
+		keys = append(keys, newCoordKey(geom.Coord{float64(i%10000) * 1e-5, float64(i%100) * 1e-5}))
+	}
+	return keys
+}
+
+// Look up every key, split between the goroutines, and return the number of nodes created
+func fillNodeCache(cache nodeCache, keys []coordKey, goroutines int) int64 {
+	var next atomic.Int64
+	create := func() osm.NodeID { return osm.NodeID(next.Add(-1)) }
+	var wg sync.WaitGroup
+	for g := range goroutines {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := g; i < len(keys); i += goroutines {
+				cache.loadOrCreate(keys[i], create)
+			}
+		}()
+	}
+	wg.Wait()
+	return -next.Load()
+}
+
+// The single lock against the sharded cache, on the sequential path and under --workers=8
+func BenchmarkNodeCache(b *testing.B) {
+	keys := nodeCacheKeys()
+	for _, bb := range []struct {
+		name       string
+		workers    int
+		goroutines int
+	}{
+		{"locked", 1, 1},
+		{"sharded", 8, 1},
+		{"locked-8", 1, 8},
+		{"sharded-8", 8, 8},
+	} {
+		b.Run(bb.name, func(b *testing.B) {
+			for b.Loop() {
+				fillNodeCache(newNodeCache(&Options{Workers: bb.workers}), keys, bb.goroutines)
+			}
+		})
+	}
+}
+
+func TestNodeCache(t *testing.T) {
+	keys := nodeCacheKeys()
+	if _, ok := newNodeCache(&Options{}).(*lockedNodeCache); !ok {
+		t.Error("the sequential path does not use the single lock cache")
+	}
+	if _, ok := newNodeCache(&Options{Workers: 8}).(*shardedNodeCache); !ok {
+		t.Error("--workers does not use the sharded cache")
+	}
+	if c := newNodeCache(&Options{DedupScope: DedupNone, Workers: 8}); c != nil {
+		t.Errorf("got a %T for DedupScope none", c)
+	}
+
+	// Shared by 8 goroutines, every coordinate gets one node, and keeps the ID of the first insert
+	for _, workers := range []int{1, 8} {
+		cache := newNodeCache(&Options{Workers: workers})
+		if n := fillNodeCache(cache, keys, 8); n != 10000 {
+			t.Errorf("workers %d: %d nodes created for 10000 coordinates", workers, n)
+		}
+		ids := make(map[osm.NodeID]bool)
+		for _, k := range keys[:10000] {
+			id, ok := cache.load(k)
+			if !ok {
+				t.Fatalf("workers %d: no node for %v", workers, k)
+			}
+			ids[id] = true
+			if again := cache.loadOrCreate(k, func() osm.NodeID { return 1 }); again != id {
+				t.Fatalf("workers %d: %v changed from node %d to %d", workers, k, id, again)
+			}
+		}
+		if len(ids) != 10000 {
+			t.Errorf("workers %d: %d IDs for 10000 coordinates", workers, len(ids))
+		}
+	}
+}
+
+// Twice the signed area of the closed way, positive when it is counter-clockwise
+func wayArea(file *osm.OSM, w *osm.Way) float64 {
+	at := make(map[osm.NodeID]*osm.Node, len(file.Nodes))
+	for _, n := range file.Nodes {
+		at[n.ID] = n
+	}
+	var area float64
+	for i := 1; i < len(w.Nodes); i++ {
+		a, b := at[w.Nodes[i-1].ID], at[w.Nodes[i].ID]
+		area += a.Lon*b.Lat - b.Lon*a.Lat
+	}
+	return area
+}
+
+func TestWinding(t *testing.T) {
+	db := newGeoPackage(t)
+	addLayer(t, db, "parks", "POLYGON", "leisure")
+	// A clockwise exterior, and a hole that is counter-clockwise like it should not be
+	insert(t, db, "parks", polygon([]float64{0, 0, 0, 4, 4, 4, 4, 0, 0, 0}), map[string]any{"leisure": "park"})
+	insert(t, db, "parks", polygon(
+		[]float64{10, 0, 10, 4, 14, 4, 14, 0, 10, 0},
+		[]float64{11, 1, 12, 1, 12, 2, 11, 1},
+	), map[string]any{"leisure": "park"})
+
+	for _, tt := range []struct {
+		winding      Winding
+		outer, inner float64 // The sign of the area each ring should have
+	}{
+		{WindingKeep, -1, 1},
+		{WindingCCW, 1, -1},
+		{WindingCW, -1, 1},
+	} {
+		file, _ := convert(t, db, &Options{Winding: tt.winding})
+		if len(file.Ways) != 3 || len(file.Relations) != 1 {
+			t.Fatalf("%q: got %d ways and %d relations, want 3 and 1", tt.winding, len(file.Ways), len(file.Relations))
+		}
+		roles := map[osm.WayID]string{file.Ways[0].ID: "outer"}
+		for _, m := range file.Relations[0].Members {
+			roles[osm.WayID(m.Ref)] = m.Role
+		}
+		for _, w := range file.Ways {
+			want := tt.outer
+			if roles[w.ID] == "inner" {
+				want = tt.inner
+			}
+			if a := wayArea(file, w); a*want <= 0 {
+				t.Errorf("%q: %s way %d has the area %v", tt.winding, roles[w.ID], w.ID, a/2)
+			}
+		}
+	}
+}
+
+func TestAreaTag(t *testing.T) {
+	db := newGeoPackage(t)
+	addLayer(t, db, "areas", "POLYGON", "leisure", "area")
+	square := polygon([]float64{0, 0, 1, 0, 1, 1, 0, 1, 0, 0})
+	insert(t, db, "areas", square, map[string]any{"leisure": "park"})
+	insert(t, db, "areas", square, map[string]any{"leisure": "track", "area": "no"})
+
+	file, _ := convert(t, db, nil)
+	checkTags(t, file.Ways[0].Tags, "leisure", "park", "area", "yes")
+	// The source's own area tag is kept
+	checkTags(t, file.Ways[1].Tags, "leisure", "track", "area", "no")
+
+	file, _ = convert(t, db, &Options{NoAreaTag: true})
+	checkTags(t, file.Ways[0].Tags, "leisure", "park")
+	checkTags(t, file.Ways[1].Tags, "leisure", "track", "area", "no")
+}
+
+// A point exactly on a vertex of a line stays a node of its own, unless it is merged into the line
+func TestCoincidentPoint(t *testing.T) {
+	db := newGeoPackage(t)
+	addLayer(t, db, "roads", "LINESTRING", "highway")
+	addLayer(t, db, "crossings", "POINT", "highway")
+	insert(t, db, "roads", line(0, 0, 1, 0, 2, 0), map[string]any{"highway": "residential"})
+	insert(t, db, "crossings", point(1, 0), map[string]any{"highway": "crossing"})
+
+	for _, merge := range []bool{false, true} {
+		file, _ := convert(t, db, &Options{MergeCoincidentPoints: merge})
+		if len(file.Ways) != 1 {
+			t.Fatalf("merge %v: got %d ways, want 1", merge, len(file.Ways))
+		}
+		nodes := make(map[osm.NodeID]*osm.Node)
+		for _, n := range file.Nodes {
+			nodes[n.ID] = n
+		}
+		crossing := taggedNodes(file)
+		if len(crossing) != 1 {
+			t.Fatalf("merge %v: got %d tagged nodes, want the crossing", merge, len(crossing))
+		}
+		vertex := file.Ways[0].Nodes[1].ID
+		if merge {
+			if vertex != crossing[0].ID || len(file.Nodes) != 3 {
+				t.Errorf("the way does not go through the crossing's node, it has %d nodes", len(file.Nodes))
+			}
+			continue
+		}
+		if vertex == crossing[0].ID || len(file.Nodes) != 4 {
+			t.Errorf("the crossing is a vertex of the way, there are %d nodes", len(file.Nodes))
+		}
+		if n := nodes[vertex]; n == nil || len(n.Tags) != 0 {
+			t.Errorf("the way's vertex is %v, want an untagged node", n)
+		}
+	}
+}
+
+// The lines of a multi line are the members of the relation in the order they are stored in, whatever their IDs
+func TestLineRelation(t *testing.T) {
+	db := newGeoPackage(t)
+	addLayer(t, db, "routes", "MULTILINESTRING", "route", "ref")
+	// The second line is further west, so an order by position would put it first
+	insert(t, db, "routes", geom.NewMultiLineStringFlat(geom.XY, []float64{5, 0, 6, 0, 10, 0, 0, 1, 1, 1}, []int{6, 10}),
+		map[string]any{"route": "bus", "ref": "42"})
+
+	file, _ := convert(t, db, nil)
+	if len(file.Ways) != 2 || len(file.Relations) != 0 {
+		t.Fatalf("got %d ways and %d relations by default, want 2 ways", len(file.Ways), len(file.Relations))
+	}
+	for _, w := range file.Ways {
+		checkTags(t, w.Tags, "route", "bus", "ref", "42")
+	}
+
+	file, _ = convert(t, db, &Options{LineRelationType: "route"})
+	if len(file.Ways) != 2 || len(file.Relations) != 1 {
+		t.Fatalf("got %d ways and %d relations, want 2 ways and the route", len(file.Ways), len(file.Relations))
+	}
+	r := file.Relations[0]
+	checkTags(t, r.Tags, "type", "route", "route", "bus", "ref", "42")
+	nodes := make(map[osm.NodeID]*osm.Node)
+	for _, n := range file.Nodes {
+		nodes[n.ID] = n
+	}
+	ways := make(map[int64]*osm.Way)
+	for _, w := range file.Ways {
+		ways[int64(w.ID)] = w
+		if len(w.Tags) != 0 {
+			t.Errorf("member way %d has tags %v", w.ID, w.Tags)
+		}
+	}
+	var starts []float64
+	for _, m := range r.Members {
+		w := ways[m.Ref]
+		if m.Type != osm.TypeWay || m.Role != "" || w == nil {
+			t.Fatalf("member %v is not one of the ways without a role", m)
+		}
+		starts = append(starts, nodes[w.Nodes[0].ID].Lon)
+	}
+	if fmt.Sprint(starts) != "[5 0]" {
+		t.Errorf("members start at longitudes %v, want 5 and then 0", starts)
+	}
+}
+
+// Only polygons with a key that implies an area get area=yes, a closed highway is a loop
+func TestAreaKeys(t *testing.T) {
+	db := newGeoPackage(t)
+	addLayer(t, db, "areas", "POLYGON", "building", "highway", "name")
+	square := polygon([]float64{0, 0, 1, 0, 1, 1, 0, 1, 0, 0})
+	insert(t, db, "areas", square, map[string]any{"building": "yes"})
+	insert(t, db, "areas", square, map[string]any{"highway": "pedestrian"})
+	insert(t, db, "areas", square, map[string]any{"name": "Somewhere"})
+
+	for _, tt := range []struct {
+		keys []string
+		want []bool
+	}{
+		{nil, []bool{true, false, false}},
+		{[]string{"highway"}, []bool{false, true, false}},
+		{[]string{"*"}, []bool{true, true, true}},
+		{[]string{}, []bool{false, false, false}},
+	} {
+		file, _ := convert(t, db, &Options{AreaKeys: tt.keys})
+		for i, w := range file.Ways {
+			if got := w.Tags.Find("area") == "yes"; got != tt.want[i] {
+				t.Errorf("area keys %v: way %v has area=yes %v, want %v", tt.keys, w.Tags, got, tt.want[i])
+			}
+		}
+	}
+	// With a prefix the keys are still matched without it
+	file, _ := convert(t, db, &Options{KeyPrefix: "gpkg:"})
+	checkTags(t, file.Ways[0].Tags, "gpkg:building", "yes", "gpkg:area", "yes")
+	checkTags(t, file.Ways[1].Tags, "gpkg:highway", "pedestrian")
+}
+
+// Every exterior ring of a multipolygon is an outer member and every hole an inner one, in the order of the rings
+func TestMultiPolygonRoles(t *testing.T) {
+	db := newGeoPackage(t)
+	addLayer(t, db, "lakes", "MULTIPOLYGON", "natural")
+	rings := [][]float64{
+		{0, 0, 4, 0, 4, 4, 0, 4, 0, 0}, {1, 1, 2, 1, 2, 2, 1, 1},
+		{10, 0, 14, 0, 14, 4, 10, 4, 10, 0}, {11, 1, 12, 1, 12, 2, 11, 1},
+		{20, 0, 21, 0, 21, 1, 20, 0},
+	}
+	var flat []float64
+	var endss [][]int
+	for i, r := range rings {
+		flat = append(flat, r...)
+		if i%2 == 0 {
+			endss = append(endss, nil)
+		}
+		endss[len(endss)-1] = append(endss[len(endss)-1], len(flat))
+	}
+	insert(t, db, "lakes", geom.NewMultiPolygonFlat(geom.XY, flat, endss), map[string]any{"natural": "water"})
+
+	// The longitude of the first node of each member, which tells the rings apart
+	members := func(file *osm.OSM, r *osm.Relation) string {
+		nodes := make(map[osm.NodeID]*osm.Node)
+		for _, n := range file.Nodes {
+			nodes[n.ID] = n
+		}
+		ways := make(map[int64]*osm.Way)
+		for _, w := range file.Ways {
+			ways[int64(w.ID)] = w
+		}
+		var s []string
+		for _, m := range r.Members {
+			w := ways[m.Ref]
+			if m.Type != osm.TypeWay || w == nil {
+				t.Fatalf("member %v is not one of the ways", m)
+			}
+			s = append(s, fmt.Sprintf("%s@%v", m.Role, nodes[w.Nodes[0].ID].Lon))
+		}
+		return fmt.Sprint(s)
+	}
+
+	file, _ := convert(t, db, nil)
+	if len(file.Relations) != 1 || len(file.Ways) != 5 {
+		t.Fatalf("got %d relations and %d ways, want one relation of 5 ways", len(file.Relations), len(file.Ways))
+	}
+	checkTags(t, file.Relations[0].Tags, "natural", "water", "type", "multipolygon")
+	if got := members(file, file.Relations[0]); got != "[outer@0 inner@1 outer@10 inner@11 outer@20]" {
+		t.Errorf("members %s, want the outer and inner of each polygon, then the last outer", got)
+	}
+
+	file, _ = convert(t, db, &Options{SplitMultiPolygons: true})
+	if len(file.Relations) != 2 || len(file.Ways) != 5 {
+		t.Fatalf("split: got %d relations and %d ways, want 2 relations and 5 ways", len(file.Relations), len(file.Ways))
+	}
+	for i, want := range []string{"[outer@0 inner@1]", "[outer@10 inner@11]"} {
+		checkTags(t, file.Relations[i].Tags, "natural", "water", "type", "multipolygon")
+		if got := members(file, file.Relations[i]); got != want {
+			t.Errorf("split: relation %d has members %s, want %s", i, got, want)
+		}
+	}
+	// The polygon without a hole is a closed way
+	var tagged []*osm.Way
+	for _, w := range file.Ways {
+		if len(w.Tags) > 0 {
+			tagged = append(tagged, w)
+		}
+	}
+	if len(tagged) != 1 || tagged[0].Nodes[0].ID != tagged[0].Nodes[len(tagged[0].Nodes)-1].ID {
+		t.Fatalf("split: tagged ways %v, want the closed way of the last polygon", tagged)
+	}
+	checkTags(t, tagged[0].Tags, "natural", "water", "area", "yes")
+}
+
+func TestClosedLinesAsAreas(t *testing.T) {
+	db := newGeoPackage(t)
+	addLayer(t, db, "outlines", "LINESTRING", "building")
+	insert(t, db, "outlines", line(0, 0, 1, 0, 1, 1, 0, 1, 0, 0), map[string]any{"building": "yes"})
+	insert(t, db, "outlines", line(2, 0, 3, 0, 3, 1), map[string]any{"building": "yes"})
+	// Closed, but too short to go around anything
+	insert(t, db, "outlines", line(4, 0, 5, 0, 4, 0), map[string]any{"building": "yes"})
+
+	for _, areas := range []bool{false, true} {
+		file, _ := convert(t, db, &Options{ClosedLinesAsAreas: areas})
+		if len(file.Ways) != 3 {
+			t.Fatalf("areas %v: got %d ways, want 3", areas, len(file.Ways))
+		}
+		loop := file.Ways[0]
+		if len(loop.Nodes) != 5 || loop.Nodes[0].ID != loop.Nodes[4].ID {
+			t.Errorf("areas %v: the closed line is not a closed way: %v", areas, loop.Nodes)
+		}
+		if areas {
+			checkTags(t, loop.Tags, "building", "yes", "area", "yes")
+		} else {
+			checkTags(t, loop.Tags, "building", "yes")
+		}
+		checkTags(t, file.Ways[1].Tags, "building", "yes")
+		checkTags(t, file.Ways[2].Tags, "building", "yes")
+	}
+}
+
+// Two layers of squares that touch each other, and whose corners are shared with the other layer
+func TestDedupScope(t *testing.T) {
+	db := newGeoPackage(t)
+	addLayer(t, db, "buildings", "POLYGON", "building")
+	addLayer(t, db, "parcels", "POLYGON", "landuse")
+	for table, tags := range map[string]map[string]any{"buildings": {"building": "yes"}, "parcels": {"landuse": "residential"}} {
+		insert(t, db, table, polygon([]float64{0, 0, 1, 0, 1, 1, 0, 1, 0, 0}), tags)
+		insert(t, db, table, polygon([]float64{1, 0, 2, 0, 2, 1, 1, 1, 1, 0}), tags)
+	}
+
+	for _, tt := range []struct {
+		scope DedupScope
+		nodes int
+	}{
+		{DedupNone, 16},  // 4 corners for each of the 4 squares
+		{DedupLayer, 12}, // The 2 squares of a layer share 2 corners
+		{DedupGlobal, 6}, // Every square has its corners in one of 6 places
+		{"", 12},         // The default is the layer
+	} {
+		file, _ := convert(t, db, &Options{DedupScope: tt.scope})
+		if len(file.Nodes) != tt.nodes || len(file.Ways) != 4 {
+			t.Errorf("%q: got %d nodes and %d ways, want %d nodes and 4 ways", tt.scope, len(file.Nodes), len(file.Ways), tt.nodes)
+		}
+	}
+}
+
+// A node for each point of a MULTIPOINT, with the feature's tags, leaving out the empty ones
+func TestMultiPoint(t *testing.T) {
+	db := newGeoPackage(t)
+	addLayer(t, db, "pois", "MULTIPOINT", "amenity")
+	insert(t, db, "pois", geom.NewMultiPointFlat(geom.XY, []float64{0, 0, 1, 0, 2, 0}), map[string]any{"amenity": "bench"})
+	insert(t, db, "pois", geom.NewMultiPointFlat(geom.XY, []float64{5, 5, math.NaN(), math.NaN()}), map[string]any{"amenity": "waste_basket"})
+	insert(t, db, "pois", geom.NewMultiPointFlat(geom.XY, nil), map[string]any{"amenity": "toilets"})
+
+	for _, opts := range []*Options{nil, {CenterPoints: true}} {
+		file, summary := convert(t, db, opts)
+		counts := make(map[string]int)
+		for _, n := range file.Nodes {
+			counts[n.Tags.Find("amenity")]++
+		}
+		if len(file.Nodes) != 4 || counts["bench"] != 3 || counts["waste_basket"] != 1 {
+			t.Errorf("center points %v: got nodes %v, want 3 benches and a waste basket", opts != nil, counts)
+		}
+		if s := summary.Layer("pois"); s.Skipped != 1 {
+			t.Errorf("center points %v: %d features skipped, want the one without points", opts != nil, s.Skipped)
+		}
+	}
+}
+
+// Coordinates are written rounded to CoordPrecision places, and vertices that round to the same place are one node
+func TestCoordPrecision(t *testing.T) {
+	db := newGeoPackage(t)
+	addLayer(t, db, "pois", "POINT", "amenity")
+	addLayer(t, db, "roads", "LINESTRING", "highway")
+	insert(t, db, "pois", point(1.23456789, -1.23456789), map[string]any{"amenity": "bench"})
+	insert(t, db, "roads", line(0, 0, 0.0001, 0, 1, 0), map[string]any{"highway": "path"})
+	insert(t, db, "roads", line(0.0004, 0.0004, 0, 1), map[string]any{"highway": "path"})
+
+	for _, tt := range []struct {
+		precision int
+		lon, lat  float64
+		nodes     []int
+	}{
+		{0, 1.2345679, -1.2345679, []int{3, 2}},
+		{7, 1.2345679, -1.2345679, []int{3, 2}},
+		{9, 1.2345679, -1.2345679, []int{3, 2}},
+		{3, 1.235, -1.235, []int{2, 2}},
+	} {
+		file, _ := convert(t, db, &Options{CoordPrecision: tt.precision})
+		bench := taggedNodes(file)
+		if len(bench) != 1 || bench[0].Lon != tt.lon || bench[0].Lat != tt.lat {
+			t.Errorf("precision %d: the bench is at %v, want %v,%v", tt.precision, bench, tt.lon, tt.lat)
+		}
+		var nodes []int
+		for _, w := range file.Ways {
+			nodes = append(nodes, len(w.Nodes))
+		}
+		if !slices.Equal(nodes, tt.nodes) {
+			t.Errorf("precision %d: the roads have %v nodes, want %v", tt.precision, nodes, tt.nodes)
+		}
+		// At 3 places both roads start at 0,0
+		if shared := file.Ways[0].Nodes[0].ID == file.Ways[1].Nodes[0].ID; shared != (tt.precision == 3) {
+			t.Errorf("precision %d: the roads share their first node: %v", tt.precision, shared)
+		}
+	}
+}
+
+// Z and M are dropped from the coordinates, and EleFromZ keeps the Z of points as an ele tag unless the feature
+// has one of its own
+func TestEleFromZ(t *testing.T) {
+	db := newGeoPackage(t)
+	addLayer(t, db, "peaks", "POINT", "natural", "ele")
+	addLayer(t, db, "trails", "LINESTRING", "highway")
+	insert(t, db, "peaks", geom.NewPointFlat(geom.XYZ, []float64{1, 2, 2962.5}), map[string]any{"natural": "peak"})
+	insert(t, db, "peaks", geom.NewPointFlat(geom.XYZ, []float64{3, 4, 100}), map[string]any{"natural": "peak", "ele": "2000"})
+	insert(t, db, "peaks", geom.NewMultiPointFlat(geom.XYZM, []float64{5, 6, 7, 8}), map[string]any{"natural": "peak"})
+	insert(t, db, "peaks", point(9, 9), map[string]any{"natural": "peak"})
+	insert(t, db, "trails", geom.NewLineStringFlat(geom.XYZM, []float64{0, 0, 10, 1, 1, 1, 20, 2}), map[string]any{"highway": "path"})
+
+	for _, ele := range []bool{false, true} {
+		file, _ := convert(t, db, &Options{EleFromZ: ele})
+		peaks := taggedNodes(file)
+		if len(peaks) != 4 {
+			t.Fatalf("got %d peaks, want 4", len(peaks))
+		}
+		want := [][]string{{"natural", "peak"}, {"natural", "peak", "ele", "2000"}, {"natural", "peak"}, {"natural", "peak"}}
+		if ele {
+			want[0] = append(want[0], "ele", "2962.5")
+			want[2] = append(want[2], "ele", "7")
+		}
+		for i, n := range peaks {
+			checkTags(t, n.Tags, want[i]...)
+		}
+		if n := peaks[2]; n.Lon != 5 || n.Lat != 6 {
+			t.Errorf("the XYZM point is at %v,%v, want 5,6", n.Lon, n.Lat)
+		}
+		if len(file.Ways) != 1 || len(file.Ways[0].Nodes) != 2 || file.Ways[0].Tags.HasTag("ele") {
+			t.Errorf("the trail is %v, want a way of 2 nodes without ele", file.Ways)
+		}
+	}
+}
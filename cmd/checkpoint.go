@@ -0,0 +1,83 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// checkpoint records how far a conversion got, so an interrupted run can be picked up again with the same
+// arguments. Only whole layers are recorded: anything written after the last finished layer is cut off the
+// output and converted again
+type checkpoint struct {
+	file string
+
+	Output string   `json:"output"`
+	Layers []string `json:"layers"` // Finished layers, by their name in the summary
+	Size   int64    `json:"size"`   // Length of the output once the last finished layer was written
+}
+
+// Read the checkpoint for output, or nil if there is none yet
+func loadCheckpoint(file, output string) (*checkpoint, error) {
+	data, err := os.ReadFile(file)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	cp := &checkpoint{file: file}
+	if err := json.Unmarshal(data, cp); err != nil {
+		return nil, fmt.Errorf("bad checkpoint: %w", err)
+	}
+	if cp.Output != output {
+		return nil, fmt.Errorf("checkpoint is for %s, not %s", cp.Output, output)
+	}
+	info, err := os.Stat(output)
+	if err != nil {
+		return nil, err
+	}
+	if info.Size() < cp.Size {
+		return nil, fmt.Errorf("output is shorter than the checkpoint says, it was changed since")
+	}
+	return cp, nil
+}
+
+// Record the current length of the output, and the layer if one was just finished
+func (cp *checkpoint) save(layer string) error {
+	info, err := os.Stat(cp.Output)
+	if err != nil {
+		return err
+	}
+	cp.Size = info.Size()
+	if layer != "" {
+		cp.Layers = append(cp.Layers, layer)
+	}
+	data, err := json.Marshal(cp)
+	if err != nil {
+		return err
+	}
+	// Written next to the real file and renamed over it, so being stopped half way never leaves a broken checkpoint
+	tmp, err := os.CreateTemp(filepath.Dir(cp.file), filepath.Base(cp.file)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), cp.file)
+}
+
+// The finished layers, for Options.SkipLayers
+func (cp *checkpoint) done() map[string]bool {
+	done := make(map[string]bool, len(cp.Layers))
+	for _, l := range cp.Layers {
+		done[l] = true
+	}
+	return done
+}
@@ -1,36 +1,46 @@
 package main
 
 import (
-	"context"
+	"bufio"
+	"compress/zlib"
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log/slog"
+	"math"
 	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
 
-	"github.com/lc-dmx/osm-go/osmpbf"
-	"github.com/lc-dmx/osm-go/osmpbf/entity"
 	_ "github.com/mattn/go-sqlite3" // SQLite driver
+	"github.com/nullmonk/gpkg2osm"
 	"github.com/paulmach/osm"
 	"github.com/spf13/pflag"
-	"github.com/twpayne/go-geom"
-	"github.com/twpayne/go-geom/encoding/wkb"
 )
 
 const (
-	programVersion = "v0.1.0"
+	programVersion = gpkg2osm.Version
 	usageHeader    = `gpkg2osm %s
-Usage: %s [flags] <input.gpkg> [output.osm.pbf|output.osm.xml|-]
+Usage: %s [flags] <input.gpkg|dir|glob> [output.osm.pbf|output.osm.xml|-]
+       %[2]s [flags] diff <old.gpkg|dir|glob> <new.gpkg|dir|glob> <output.osc|->
 
-Converts a GeoPackage file to an OpenStreetMap PBF or XML file.
-Output format is determined by the output file extension (.osm.pbf for PBF, .osm.xml for XML).
+Converts a GeoPackage file to an OpenStreetMap PBF, XML or O5M file.
+Output format is determined by the output file extension (.osm.pbf or .pbf for PBF, .osm.xml, .osm or .xml for XML,
+.o5m for O5M), or by --format.
 
 Arguments:
-  <input.gpkg>       Path to the input GeoPackage file.
+  <input.gpkg>       Path to the input GeoPackage file. A directory or a quoted glob converts every GeoPackage
+                     in it into one output.
   [output.osm.pbf|output.osm.xml|-]   Optional path for the output OSM file.
                      If omitted, the program will print a summary of conversions.
-                     Use '-' for stdout (implies XML output).
+                     Use '-' for stdout (XML unless --format says otherwise).
 
 Flags:
 `
@@ -40,100 +50,297 @@ Examples:
   %s file.gpkg file.osm.pbf              # Convert file.gpkg to file.osm.pbf.
   %s file.gpkg file.osm.xml              # Convert file.gpkg to file.osm.xml.
   %s file.gpkg -                         # Convert file.gpkg to OSM XML and print to stdout.
+  %s --format pbf file.gpkg -            # Convert file.gpkg to PBF and write it to stdout, e.g. for osmium.
+  %s dir/ merged.osm.pbf                 # Convert every .gpkg in dir into merged.osm.pbf.
+  %s diff old.gpkg new.gpkg changes.osc  # Write the changes from old.gpkg to new.gpkg as an osmChange file.
 `
 	summaryHeaderTemplate = `Analyzing GeoPackage: %s
 ---------------------------------------
 Detected Layers and Suggested OSM Tag Mappings:
-`
-	summaryLayerTemplate = `
-Layer: %s (Geometry: %s)
-  Columns: %v
 `
 )
 
-// Gpkg geometry types that we allow
-var valid_geoms = map[string]geom.T{
-	"MULTIPOLYGON":    &geom.MultiPolygon{},
-	"POLYGON":         &geom.Polygon{},
-	"MULTILINESTRING": &geom.MultiLineString{},
-	"LINESTRING":      &geom.LineString{},
-	"POINT":           &geom.Point{},
-}
-
-// ExportLayer holds information about which columns get exported to the OSM file
-type ExportLayer struct {
-	Name          string   // Also Table Name
-	Tags          []string // Columns that directly map to an OSM tag
-	OSMJsonField  bool     // True if this layer has the "osm_tags" JSON column
-	GeometryField string   // Name of geometery colum
-	GeometryType  string
-	SRS           int32
-	Z             sql.NullBool
-	M             sql.NullBool
-}
+// Exit codes, so scripts can tell a partial conversion from a clean one
+const (
+	exitInvalid = 1  // Bad arguments or flag values, or the input or output cannot be opened
+	exitSkipped = 2  // The output was written, but some features were skipped (see --allow-skips)
+	exitUsage   = 3  // The flags cannot be parsed: one is unknown or its value is not of its type, nothing was done
+	exitFailed  = 10 // The conversion failed part way, the output is incomplete
+)
 
-// Get the Query that is used to read elements from this layer
-func (l *ExportLayer) Query() string {
-	// If NO other tag fields exist, its easy, simply return geom and osm_tags
-	if l.OSMJsonField && len(l.Tags) == 0 {
-		return fmt.Sprintf("SELECT %s, osm_tags FROM %s", l.GeometryField, l.Name)
+func main() {
+	// Hidden from the usage, an example input for people working out the schema
+	if len(os.Args) > 1 && os.Args[1] == "gen-sample" {
+		if len(os.Args) != 3 {
+			fmt.Fprintf(os.Stderr, "usage: %s gen-sample <out.gpkg>\n", os.Args[0])
+			os.Exit(exitUsage)
+		}
+		setupLogging("info", "text")
+		if err := genSample(os.Args[2]); err != nil {
+			slog.Error("cannot write the sample GeoPackage", "file", os.Args[2], "err", err)
+			os.Exit(exitInvalid)
+		}
+		slog.Info("wrote sample GeoPackage", "file", os.Args[2])
+		return
 	}
-	// More complicated, we have tags, so we need to get them as JSON
-	cols := make([]string, 0, len(l.Tags)*2)
-	for _, t := range l.Tags {
-		cols = append(cols, "'"+t+"'", t)
+
+	// Define flags using pflag
+	pflag.Usage = func() {
+		fmt.Fprintf(os.Stderr, usageHeader, programVersion, os.Args[0])
+		pflag.PrintDefaults() // pflag has its own PrintDefaults
+		fmt.Fprintf(os.Stderr, usageExamples, os.Args[0], os.Args[0], os.Args[0], os.Args[0], os.Args[0], os.Args[0], os.Args[0])
 	}
-	json_tags := fmt.Sprintf("json_object(%s)", strings.Join(cols, ", "))
-	// Merge the tags with the osm_tags field
-	if l.OSMJsonField {
-		json_tags = fmt.Sprintf("json_patch(%s, osm_tags)", json_tags)
+
+	pointAs := pflag.String("point-as", "node", "How POINT features are written. Only \"node\" (a tagged standalone node) is supported")
+	winding := pflag.String("ring-winding", "keep", "Direction of polygon rings: keep, ccw (counter clockwise exteriors, clockwise holes) or cw")
+	areaTags := pflag.StringSlice("area-tags", nil, "Only add area=yes to simple polygons with one of these keys, or '*' for every polygon (default building, landuse, natural and the other keys that imply an area)")
+	noAreaTag := pflag.Bool("no-area-tag", false, "Do not add area=yes to the closed ways written for simple polygons")
+	closedLines := pflag.Bool("closed-lines-as-areas", false, "Write LINESTRING features that end where they start as polygons, with area tagging")
+	multiPolygonAs := pflag.String("multipolygon-as", "relation", "How MULTIPOLYGON features are written: relation (one multipolygon relation) or split (each polygon on its own, as a POLYGON would be)")
+	multiLineAs := pflag.String("multilinestring-as", "way", "How MULTILINESTRING features are written: way (a tagged way per line) or relation (one tagged relation with the lines as members)")
+	relationType := pflag.String("relation-type", "route", "The type tag of relations made by --multilinestring-as relation")
+	centerPoints := pflag.Bool("center-points", false, "Write lines and polygons as a single node at their center instead of their full shape")
+	eleFromZ := pflag.Bool("ele-from-z", false, "Tag point features that have a Z coordinate with ele, unless they have an ele tag already")
+	approximateCurves := pflag.Bool("approximate-curves", false, "Convert curved geometries (CircularString, CurvePolygon, ...) to lines and polygons instead of skipping them")
+	curveSegments := pflag.Int("curve-segments", gpkg2osm.DefaultCurveSegments, "Straight segments per quarter circle for --approximate-curves")
+	deletedTag := pflag.String("deleted-tag", "", "Write features with this key=value tag as deleted (visible=false), without the tag")
+	pflag.Lookup("deleted-tag").NoOptDefVal = "deleted=yes"
+	skipDeleted := pflag.Bool("skip-deleted", false, "Leave out the features marked by --deleted-tag instead of writing them as deleted")
+	keepUntagged := pflag.Bool("keep-untagged", false, "Write features that have no tags instead of skipping them")
+	geometryOnly := pflag.Bool("geometry-only", false, "Also convert layers without any tag columns, use with --keep-untagged to write their features")
+	layerTag := pflag.String("tag-layer-name", "", "Tag every element with the name of its source layer, using the given key")
+	pflag.Lookup("tag-layer-name").NoOptDefVal = "source:layer"
+	metadataTag := pflag.String("tag-metadata", "", "Tag every element with the plain text gpkg_metadata of its layer, using the given key")
+	pflag.Lookup("tag-metadata").NoOptDefVal = "source"
+	includeMetadata := pflag.Bool("include-metadata", false, "Tag every element with source:date and source from the last_change and description of its layer in gpkg_contents")
+	outputSRS := pflag.Int64("output-srs", 4326, "EPSG code of the coordinates written: 4326, or 3857 or 3395 for consumers that expect them (not valid OSM)")
+	srsTag := pflag.String("tag-srs", "", "With --reproject, tag reprojected features with their original SRS, using the given key")
+	pflag.Lookup("tag-srs").NoOptDefVal = "source:srs"
+	tagPrecedence := pflag.String("tag-precedence", "osm_tags", "Which tags win when the tag columns and osm_tags set the same key: osm_tags (the JSON columns) or columns")
+	tagCase := pflag.String("tag-case", "preserve", "Case of tag keys: preserve them as they are, or lower")
+	prefixKeys := pflag.String("prefix-keys", "", "Put this in front of every tag key, such as 'gpkg:' to review the tags before they become real OSM tags")
+	valueMap := pflag.StringSlice("value-map", nil, "Replace tag values, as key:from=to. Repeat the flag or separate rules with commas")
+	enumColumns := pflag.Bool("enum-columns", false, "Use columns with an enum constraint of the schema extension as tags, even if they are not described as OSM tags")
+	heuristicTags := pflag.Bool("heuristic-tags", false, "For layers without any tag columns, use the columns with common names (name, highway, addr_street, ...) as tags")
+	enumLabels := pflag.Bool("enum-labels", false, "Replace the values of enum constrained tag columns with the descriptions their constraint gives them")
+	stripEmpty := pflag.Bool("strip-empty-values", false, "Drop tags whose value is an empty string")
+	dropTags := pflag.StringSlice("drop-tags", nil, "Remove these keys from every feature, exact or as a glob such as 'shape_*'. '--drop-tags=' keeps every key (default fid, ogc_fid, objectid, gid, shape_length, shape_leng, shape_area)")
+	defaultTags := pflag.StringSlice("default-tags", nil, "Add a constant tag to every feature of a layer, as layer:key=value. The feature's own tags win")
+	relatedTags := pflag.StringSlice("related-tags", nil, "Add the columns of the related row as tags, for these mapping tables of the related tables extension")
+	excludeLayers := pflag.StringSlice("exclude-layers", nil, "Do not convert these layers. Repeat the flag or separate names with commas")
+	geomColumns := pflag.StringSlice("geometry-column", nil, "Read the geometry from this column instead of the one in gpkg_geometry_columns. Use layer=column for a single layer")
+	where := pflag.String("where", "", "Only convert features matching this SQL predicate. References the raw column names, not the OSM keys")
+	appendOutput := pflag.Bool("append", false, "Add the converted elements to an existing output file instead of replacing it")
+	maxNodes := pflag.Int("max-nodes-per-way", gpkg2osm.DefaultMaxNodesPerWay, "Split ways with more nodes than this into several ways")
+	maxSegment := pflag.Float64("max-segment-length", 0, "Add vertices so that no segment of a line or ring is longer than this many meters (0 for no limit)")
+	coordPrecision := pflag.Int("coord-precision", gpkg2osm.DefaultCoordPrecision, "Round coordinates to this many decimal places, from 1 to 7")
+	errorLogFile := pflag.String("error-log", "", "Write a JSON object for every skipped feature to this file, one per line")
+	tagsAsJSON := pflag.Bool("tags-as-json", false, "Write the layer, fid, geometry type and final tags of every feature to stdout as JSON lines, instead of converting")
+	prettySummary := pflag.Bool("pretty-summary", false, "Print a table of the layers to stderr before converting, as is done when there is no output file")
+	jsonSummary := pflag.String("json-summary", "", "Write the detected layers as JSON to this file ('-' for stdout)")
+	pflag.Lookup("json-summary").NoOptDefVal = "-"
+	limit := pflag.Int("limit", 0, "Convert at most this many features per layer (0 for all)")
+	logLevel := pflag.String("log-level", "info", "Minimum level to log: debug, info, warn or error")
+	logFormat := pflag.String("log-format", "text", "Log format: text or json")
+	idStrategy := pflag.String("id-strategy", "negative", "Number new elements counting down from -N (negative) or up from N (positive), where N is --id-start")
+	idStart := pflag.Int64("id-start", 1, "The first ID given to each element type")
+	reproject := pflag.Bool("reproject", false, "Convert layers in EPSG:3857 or EPSG:3395 to EPSG:4326 instead of skipping them")
+	strict := pflag.Bool("strict", false, "Stop with an error on data problems that are otherwise only warned about")
+	allowSkips := pflag.Bool("allow-skips", false, "Exit 0 even if some features were skipped")
+	stableIDs := pflag.Bool("stable-ids", false, "Derive node IDs from their coordinates so the same place always gets the same ID")
+	osmIDColumn := pflag.String("osm-id-column", "", "Give the element of each feature the real OSM ID in this column, such as osm_id, when the layer has it")
+	idFromFID := pflag.Bool("id-from-fid", false, "Derive the IDs of each feature's ways, relations and tagged nodes from its layer and fid, so they are the same every run")
+	dedupScope := pflag.String("dedup-scope", "layer", "Which ways share nodes at the same coordinate: those of the same layer, of every layer (global), or none")
+	mergePoints := pflag.Bool("merge-coincident-points", false, "Use the node of a point feature as the vertex of ways through the same coordinate")
+	setVersion := pflag.Int("set-version", 0, "Give every element this version (0 for none)")
+	setTimestamp := pflag.String("set-timestamp", "", "Give every element this RFC 3339 timestamp, or the current time if no value is given")
+	pflag.Lookup("set-timestamp").NoOptDefVal = "now"
+	setUser := pflag.String("set-user", "", "Give every element this user name")
+	checkpointFile := pflag.String("checkpoint", "", "Record finished layers in this file, and when it exists carry on after them instead of starting over (PBF only)")
+	validateGeometry := pflag.Bool("validate-geometry", false, "Skip features with invalid geometries, such as unclosed or self intersecting rings")
+	fixGeometry := pflag.Bool("fix-geometry", false, "Repair invalid geometries where possible (closing rings, dropping repeated points) before validating them")
+	outputFormat := pflag.String("format", "", "Output format: pbf, xml or o5m. Defaults to the one the output file extension implies, and xml for stdout")
+	overwrite := pflag.Bool("overwrite", false, "Replace the output file if it already exists")
+	pbfBlockSize := pflag.Int("pbf-block-size", gpkg2osm.DefaultPBFBlockSize, "Elements per PBF data block, smaller blocks need less memory and larger ones compress better")
+	sorted := pflag.Bool("sorted", false, "Write all the nodes of a PBF file before the ways, and the ways before the relations")
+	compressLevel := pflag.String("compress-level", "best", "zlib level of PBF blocks: 1 to 9 (smallest), or none, fast (1) or best (9). Levels other than best write more slowly")
+	busyTimeout := pflag.Duration("busy-timeout", 5*time.Second, "How long a query waits for a GeoPackage that another program has locked before it fails")
+	workers := pflag.Int("workers", 1, "Read this many layers at once, each on its own database connection")
+	threadsRead := pflag.Int("threads-read", 1, "Parse the geometries and tags of each layer on this many goroutines while its rows are read")
+	threadsWrite := pflag.Bool("threads-write", false, "Encode and write the output on a goroutine of its own, while the next features are converted")
+	verify := pflag.Bool("verify", false, "Read the output back after writing and check every reference resolves and IDs are unique")
+	// pflag exits with 2 by default, which scripts would read as a conversion with skipped features
+	pflag.CommandLine.Init(os.Args[0], pflag.ContinueOnError)
+	if err := pflag.CommandLine.Parse(os.Args[1:]); err != nil {
+		if errors.Is(err, pflag.ErrHelp) {
+			os.Exit(0) // The usage was already printed
+		}
+		fmt.Fprintf(os.Stderr, "error: %v\n\n", err)
+		pflag.Usage()
+		os.Exit(exitUsage)
 	}
 
-	// Remove NULLs
-	qry := `SELECT %s, COALESCE((SELECT json_group_object(key, value)
-	FROM json_each(%s)
-	WHERE value IS NOT NULL), '{}') AS osm_tags FROM %s`
-	return fmt.Sprintf(qry, l.GeometryField, json_tags, l.Name)
-}
+	if err := setupLogging(*logLevel, *logFormat); err != nil {
+		slog.Error("invalid logging flags", "err", err)
+		os.Exit(exitInvalid)
+	}
 
-// Validate if this is an exportable layer or not
-func (l *ExportLayer) Validate() error {
-	if !l.OSMJsonField && len(l.Tags) == 0 {
-		return fmt.Errorf("no OSM tags")
+	if *maxNodes < 2 {
+		slog.Error("invalid --max-nodes-per-way, must be at least 2", "value", *maxNodes)
+		os.Exit(exitInvalid)
 	}
-	if l.SRS != 4326 {
-		return fmt.Errorf("invalid SRS, must be EPSG:4326")
+	switch *outputSRS {
+	case 4326, 3857, 3395:
+	default:
+		slog.Error("invalid --output-srs, must be 4326, 3857 or 3395", "value", *outputSRS)
+		os.Exit(exitInvalid)
 	}
-	if _, ok := valid_geoms[l.GeometryType]; !ok {
-		return fmt.Errorf("invalid geometry type")
+	if *workers < 1 {
+		slog.Error("invalid --workers, must be at least 1", "value", *workers)
+		os.Exit(exitInvalid)
 	}
-	return nil
-}
-
-// This is all the data that gets written to the xml
-type Feature struct {
-	Layer *ExportLayer
-	Tags  map[string]any
-	G     geom.T
-}
-
-// Create Ways, Nodes, and Relations for the features
-func (f *Feature) AppendToOSM(file *osm.OSM) error {
-	switch f.G.(type) {
-	case *geom.MultiLineString, *geom.MultiPolygon, *geom.LineString, *geom.Polygon:
+	if *maxSegment < 0 || math.IsNaN(*maxSegment) {
+		slog.Error("invalid --max-segment-length, must be a number of meters, 0 for no limit", "value", *maxSegment)
+		os.Exit(exitInvalid)
 	}
-	return nil
-}
-
-func main() {
-	// Define flags using pflag
-	pflag.Usage = func() {
-		slog.Error(usageHeader, programVersion, os.Args[0])
-		pflag.PrintDefaults() // pflag has its own PrintDefaults (will be empty now)
-		slog.Error(usageExamples, os.Args[0], os.Args[0], os.Args[0], os.Args[0])
+	if *coordPrecision < 1 || *coordPrecision > gpkg2osm.DefaultCoordPrecision {
+		slog.Error("invalid --coord-precision, must be 1 to 7", "value", *coordPrecision)
+		os.Exit(exitInvalid)
+	}
+	if *busyTimeout < 0 {
+		slog.Error("invalid --busy-timeout, must not be negative", "value", *busyTimeout)
+		os.Exit(exitInvalid)
+	}
+	if err := gpkg2osm.ValidateWhere(*where); err != nil {
+		slog.Error("invalid --where", "value", *where, "err", err)
+		os.Exit(exitInvalid)
+	}
+	switch gpkg2osm.Format(*outputFormat) {
+	case "", gpkg2osm.FormatPBF, gpkg2osm.FormatXML, gpkg2osm.FormatO5M:
+	default:
+		slog.Error("invalid --format, must be pbf, xml or o5m", "value", *outputFormat)
+		os.Exit(exitInvalid)
+	}
+	if *curveSegments < 1 {
+		slog.Error("invalid --curve-segments, must be at least 1", "value", *curveSegments)
+		os.Exit(exitInvalid)
+	}
+	if *threadsRead < 1 {
+		slog.Error("invalid --threads-read, must be at least 1", "value", *threadsRead)
+		os.Exit(exitInvalid)
+	}
+	if *pbfBlockSize < 1 {
+		slog.Error("invalid --pbf-block-size, must be at least 1", "value", *pbfBlockSize)
+		os.Exit(exitInvalid)
+	}
+	if *sorted && (*appendOutput || *checkpointFile != "") {
+		slog.Error("--sorted cannot be used with --append or --checkpoint, they add to a file that is already written")
+		os.Exit(exitInvalid)
+	}
+	level, err := parseCompressLevel(*compressLevel)
+	if err != nil {
+		slog.Error("invalid --compress-level", "err", err)
+		os.Exit(exitInvalid)
+	}
+	if *limit < 0 {
+		slog.Error("invalid --limit, must not be negative", "value", *limit)
+		os.Exit(exitInvalid)
+	}
+	for _, p := range *dropTags {
+		if _, err := path.Match(p, ""); err != nil {
+			slog.Error("invalid --drop-tags", "pattern", p, "err", err)
+			os.Exit(exitInvalid)
+		}
+	}
+	if *geometryOnly && !*keepUntagged {
+		slog.Warn("--geometry-only without --keep-untagged, the features of layers without tags are skipped as untagged")
+	}
+	var deleted osm.Tag
+	if *deletedTag != "" {
+		var ok bool
+		if deleted.Key, deleted.Value, ok = strings.Cut(*deletedTag, "="); !ok || deleted.Key == "" {
+			slog.Error("invalid --deleted-tag, must be key=value", "value", *deletedTag)
+			os.Exit(exitInvalid)
+		}
+	} else if *skipDeleted {
+		slog.Error("--skip-deleted needs --deleted-tag")
+		os.Exit(exitInvalid)
+	}
+	if *tagPrecedence != string(gpkg2osm.PrecedenceOSMTags) && *tagPrecedence != string(gpkg2osm.PrecedenceColumns) {
+		slog.Error("invalid --tag-precedence, must be osm_tags or columns", "value", *tagPrecedence)
+		os.Exit(exitInvalid)
+	}
+	if *tagCase != "preserve" && *tagCase != "lower" {
+		slog.Error("invalid --tag-case, must be preserve or lower", "value", *tagCase)
+		os.Exit(exitInvalid)
+	}
+	values, err := parseValueMap(*valueMap)
+	if err != nil {
+		slog.Error("invalid --value-map", "err", err)
+		os.Exit(exitInvalid)
+	}
+	if *setVersion < 0 {
+		slog.Error("invalid --set-version, must not be negative", "value", *setVersion)
+		os.Exit(exitInvalid)
+	}
+	var timestamp time.Time
+	switch *setTimestamp {
+	case "":
+	case "now":
+		timestamp = time.Now().UTC().Truncate(time.Second)
+	default:
+		if timestamp, err = time.Parse(time.RFC3339, *setTimestamp); err != nil {
+			slog.Error("invalid --set-timestamp, must be RFC 3339 like 2024-01-02T15:04:05Z", "value", *setTimestamp)
+			os.Exit(exitInvalid)
+		}
+	}
+	defaults, err := parseDefaultTags(*defaultTags)
+	if err != nil {
+		slog.Error("invalid --default-tags", "err", err)
+		os.Exit(exitInvalid)
+	}
+	ids, err := gpkg2osm.NewIDGenerator(gpkg2osm.IDStrategy(*idStrategy), *idStart)
+	if err != nil {
+		slog.Error("invalid --id-strategy or --id-start", "err", err)
+		os.Exit(exitInvalid)
+	}
+	if *osmIDColumn != "" && gpkg2osm.IDStrategy(*idStrategy) == gpkg2osm.IDsPositive {
+		slog.Error("--osm-id-column cannot be used with --id-strategy positive, the new IDs could be the same as the real ones")
+		os.Exit(exitInvalid)
+	}
+	if *winding == "keep" {
+		*winding = string(gpkg2osm.WindingKeep)
+	} else if *winding != string(gpkg2osm.WindingCCW) && *winding != string(gpkg2osm.WindingCW) {
+		slog.Error("invalid --ring-winding, must be keep, ccw or cw", "value", *winding)
+		os.Exit(exitInvalid)
+	}
+	switch gpkg2osm.DedupScope(*dedupScope) {
+	case gpkg2osm.DedupLayer, gpkg2osm.DedupGlobal, gpkg2osm.DedupNone:
+	default:
+		slog.Error("invalid --dedup-scope, must be layer, global or none", "value", *dedupScope)
+		os.Exit(exitInvalid)
+	}
+	lineRelationType := ""
+	switch *multiLineAs {
+	case "way":
+	case "relation":
+		if *relationType == "" {
+			slog.Error("invalid --relation-type, must not be empty")
+			os.Exit(exitInvalid)
+		}
+		lineRelationType = *relationType
+	default:
+		slog.Error("invalid --multilinestring-as, must be way or relation", "value", *multiLineAs)
+		os.Exit(exitInvalid)
+	}
+	if *multiPolygonAs != "relation" && *multiPolygonAs != "split" {
+		slog.Error("invalid --multipolygon-as, must be relation or split", "value", *multiPolygonAs)
+		os.Exit(exitInvalid)
+	}
+	if *pointAs != "node" {
+		slog.Error("invalid --point-as, must be node", "value", *pointAs)
+		os.Exit(exitInvalid)
 	}
-
-	pflag.Parse() // Parse the flags
 
 	// Process arguments
 	args := pflag.Args() // Get non-flag arguments after parsing
@@ -141,61 +348,202 @@ func main() {
 	if len(args) < 1 {
 		slog.Error("missing input file")
 		pflag.Usage()
-		os.Exit(1)
+		os.Exit(exitInvalid)
 	}
 
-	inputGPKG := args[0]
+	// diff old new out.osc compares two inputs instead of converting one, the rest works on the new one
+	var oldPaths []string
+	diffMode := args[0] == "diff"
+	if diffMode {
+		if len(args) != 4 {
+			slog.Error("diff needs the old input, the new input and an output file")
+			pflag.Usage()
+			os.Exit(exitInvalid)
+		}
+		if *appendOutput || *checkpointFile != "" || *verify || *outputFormat != "" || *osmIDColumn != "" {
+			slog.Error("--append, --checkpoint, --verify, --format and --osm-id-column cannot be used with diff")
+			os.Exit(exitInvalid)
+		}
+		var err error
+		if oldPaths, err = findInputs(args[1]); err != nil {
+			slog.Error("cannot read input", "input", args[1], "err", err)
+			os.Exit(exitInvalid)
+		}
+		args = args[2:]
+	}
+
+	inputPaths, err := findInputs(args[0])
+	if err != nil {
+		slog.Error("cannot read input", "input", args[0], "err", err)
+		os.Exit(exitInvalid)
+	}
 	outputFile := ""
+	format := gpkg2osm.FormatXML
 
 	if len(args) > 1 {
 		outputFile = args[1]
-		if outputFile != "-" {
-			if strings.HasSuffix(strings.ToLower(outputFile), ".pbf") {
-			} else {
-				slog.Error("invalid output extension. Must be .pbf or .xml", "file", outputFile)
-				os.Exit(1)
+		if diffMode {
+			if outputFile != "-" && strings.ToLower(filepath.Ext(outputFile)) != ".osc" {
+				slog.Error("invalid output file", "file", outputFile, "err", "the output of diff must be an .osc file")
+				os.Exit(exitInvalid)
 			}
+		} else if *outputFormat != "" {
+			// Over the extension, so a file can be named anything
+			format = gpkg2osm.Format(*outputFormat)
+		} else if outputFile != "-" {
+			if format, err = formatForFile(outputFile); err != nil {
+				slog.Error("invalid output file", "file", outputFile, "err", err)
+				os.Exit(exitInvalid)
+			}
+		}
+	}
+
+	// Nothing is converted, the tags take the place of the output on stdout
+	if *tagsAsJSON {
+		if diffMode || outputFile != "" || *outputFormat != "" {
+			slog.Error("--tags-as-json writes to stdout, it cannot be used with an output file, --format or diff")
+			os.Exit(exitInvalid)
 		}
+		outputFile = "-"
+	}
+
+	if *verify && outputFile == "-" {
+		slog.Error("--verify needs an output file, stdout cannot be read back")
+		os.Exit(exitInvalid)
+	}
+	if *jsonSummary == "-" && outputFile == "-" {
+		slog.Error("--json-summary and the output cannot both be stdout")
+		os.Exit(exitInvalid)
 	}
 
-	// Determine output destination
+	// Resuming appends to what the interrupted run wrote, after cutting off the layer it was in the middle of
+	var cp *checkpoint
+	if *checkpointFile != "" {
+		if format != gpkg2osm.FormatPBF || outputFile == "-" {
+			slog.Error("--checkpoint needs a .pbf output file")
+			os.Exit(exitInvalid)
+		}
+		cp, err = loadCheckpoint(*checkpointFile, outputFile)
+		if err != nil {
+			slog.Error("cannot resume from checkpoint", "file", *checkpointFile, "err", err)
+			os.Exit(exitInvalid)
+		}
+		if cp != nil {
+			if err := os.Truncate(outputFile, cp.Size); err != nil {
+				slog.Error("cannot resume from checkpoint", "file", *checkpointFile, "err", err)
+				os.Exit(exitInvalid)
+			}
+			slog.Info("resuming from checkpoint", "file", *checkpointFile, "layers", len(cp.Layers))
+			*appendOutput = true
+		}
+	}
+
+	// When appending, read what is already there so the new IDs continue past the existing ones.
+	// XML and O5M are rewritten as a whole so we also need to keep the existing elements
+	var appending bool
+	var existing *osm.OSM
+	if *appendOutput && outputFile != "" && outputFile != "-" {
+		appending, existing, err = readExisting(outputFile, format, ids)
+		if err != nil {
+			slog.Error("cannot read existing output", "file", outputFile, "err", err)
+			os.Exit(exitInvalid)
+		}
+	}
+
+	// Never clobber a previous conversion by accident
+	if outputFile != "" && outputFile != "-" && !*appendOutput && !*overwrite {
+		if _, err := os.Stat(outputFile); err == nil {
+			slog.Error("output file already exists, use --overwrite to replace it or --append to add to it", "file", outputFile)
+			os.Exit(exitInvalid)
+		}
+	}
+
+	// The output is only opened once the inputs and the flags that depend on them have been checked, so a bad
+	// run never leaves an empty file behind or clobbers the one that is there. os.Exit skips the deferred calls,
+	// failures after that need to remove the temporary file themselves
 	var outputWriter *os.File
-	if outputFile == "-" {
-		outputWriter = os.Stdout
-	} else if outputFile != "" {
-		// Attempt to create/open the output file
-		var err error
-		outputWriter, err = os.Create(outputFile)
+	var tempOutput string
+	exit := func(code int) {
+		if tempOutput != "" {
+			outputWriter.Close()
+			os.Remove(tempOutput)
+		}
+		os.Exit(code)
+	}
+
+	// The geometry columns are needed while the layers are found, a layer is only kept if its column exists
+	geometryColumns := make(map[string]string, len(*geomColumns))
+	for _, c := range *geomColumns {
+		layer, col, ok := strings.Cut(c, "=")
+		if !ok {
+			layer, col = "", c // Every layer
+		}
+		geometryColumns[layer] = col
+	}
+	layerOpts := &gpkg2osm.LayerOptions{EnumColumns: *enumColumns, GeometryOnly: *geometryOnly, HeuristicTags: *heuristicTags, GeometryColumns: geometryColumns}
+	inputs := make([]gpkg2osm.Input, 0, len(inputPaths))
+	for _, file := range inputPaths {
+		in, err := openInput(file, layerOpts, *busyTimeout)
 		if err != nil {
-			slog.Error("failed to create output file: %s: %s", outputFile, err)
-			os.Exit(1)
+			slog.Error("invalid input", "file", file, "err", err)
+			exit(exitInvalid)
 		}
-		defer outputWriter.Close() // Ensure the file is closed
+		defer in.DB.Close()
+		inputs = append(inputs, in)
+	}
+	inputNames(inputs, inputPaths)
+	oldInputs := make([]gpkg2osm.Input, 0, len(oldPaths))
+	for _, file := range oldPaths {
+		in, err := openInput(file, layerOpts, *busyTimeout)
+		if err != nil {
+			slog.Error("invalid input", "file", file, "err", err)
+			exit(exitInvalid)
+		}
+		defer in.DB.Close()
+		oldInputs = append(oldInputs, in)
 	}
+	inputNames(oldInputs, oldPaths)
 
-	// Open GeoPackage database
-	db, err := sql.Open("sqlite3", inputGPKG)
-	if err != nil {
-		slog.Error("failed to open gpkg: %s: %s", inputGPKG, err)
-		os.Exit(1)
+	for layer := range geometryColumns {
+		found := layer == ""
+		for _, in := range slices.Concat(oldInputs, inputs) {
+			if _, ok := in.Layers[layer]; ok {
+				found = true
+			}
+		}
+		if !found {
+			slog.Error("invalid --geometry-column, no such layer", "layer", layer)
+			exit(exitInvalid)
+		}
+	}
+	if *jsonSummary != "" {
+		if err := writeJSONSummary(*jsonSummary, inputPaths, inputs); err != nil {
+			slog.Error("cannot write json summary", "file", *jsonSummary, "err", err)
+			exit(exitInvalid)
+		}
 	}
-	defer db.Close()
 
-	// Get layer information including OSM tag mappings
-	layers, err := getGeoPackageLayers(db)
-	if err != nil {
-		slog.Error("error querying layers", "err", err)
-		os.Exit(1)
+	// A name that matches nothing is most likely a typo, better to stop than convert a layer that was meant to be left out
+	for _, name := range *excludeLayers {
+		found := false
+		for _, in := range slices.Concat(oldInputs, inputs) {
+			if _, ok := in.Layers[name]; ok {
+				delete(in.Layers, name)
+				found = true
+			}
+		}
+		if !found {
+			slog.Error("invalid --exclude-layers, no such layer", "layer", name)
+			exit(exitInvalid)
+		}
 	}
 
-	// Print layer info
-	for _, layer := range layers {
-		cols := make([]string, len(layer.Tags)+1)
-		i := copy(cols, layer.Tags)
-		if layer.OSMJsonField {
-			cols[i] = "osm_tags"
+	// On stderr with the logs, so it never ends up in output written to stdout
+	if *prettySummary || outputFile == "" {
+		if err := printLayerTable(os.Stderr, inputPaths, inputs, *where); err != nil {
+			slog.Error("cannot summarize the layers", "err", err)
+			exit(exitInvalid)
 		}
-		slog.Info("found layer for export", slog.String("name", layer.Name), slog.String("cols", strings.Join(cols, ",")), slog.String("geometry", layer.GeometryType))
 	}
 
 	// Main logic based on arguments
@@ -205,181 +553,489 @@ func main() {
 		return
 	}
 
-	pbf, err := osmpbf.NewWriter(context.Background(), outputWriter)
-	if err != nil {
-		slog.Error("cannot create osmwriter", "error", err)
-		os.Exit(10)
-	}
-	defer pbf.Close()
-	// Convert here
-	for _, l := range layers {
-		results, err := getResults(db, l)
-		if err != nil {
-			slog.Error("failed to get layer items", "table", l.Name, "err", err)
-			continue
-		}
-		for _, r := range results {
-			fmt.Println(r.Layer.GeometryType, r.Tags)
-			switch r.G.(type) {
-			case *geom.MultiLineString, *geom.MultiPolygon, *geom.LineString, *geom.Polygon:
-				e := entity.NewWay(1)
-				e.SetGeometry(func() geom.T {
-					return r.G
-				})
-				e.SetTags(r.Tags)
-				if err := pbf.WriteEntity(e); err != nil {
-					slog.Error("error writing entitiy", "err", err)
-				}
+	// Determine output destination. XML and O5M are rewritten as a whole when appending. They go to a temporary
+	// file next to the output, which replaces it only once everything is written, so a failed run leaves the
+	// existing file as it was
+	if outputFile == "-" {
+		outputWriter = os.Stdout
+	} else {
+		// Attempt to create/open the output file
+		switch {
+		case appending && format == gpkg2osm.FormatPBF:
+			outputWriter, err = os.OpenFile(outputFile, os.O_WRONLY|os.O_APPEND, 0)
+		case appending:
+			outputWriter, err = os.CreateTemp(filepath.Dir(outputFile), "."+filepath.Base(outputFile)+".*")
+			if err == nil {
+				tempOutput = outputWriter.Name()
 			}
+		default:
+			outputWriter, err = os.Create(outputFile)
 		}
+		if err != nil {
+			slog.Error("failed to create output file", slog.String("file", outputFile), slog.Any("err", err))
+			os.Exit(exitInvalid)
+		}
+		defer outputWriter.Close() // Ensure the file is closed
 	}
-}
 
-// Get each feaeture from the given DB and layer. Extract all the OSM tags that we need
-func getResults(db *sql.DB, layer *ExportLayer) ([]*Feature, error) {
-	res := make([]*Feature, 0, 100)
-	rows, err := db.Query(layer.Query())
-	if err != nil {
-		return nil, err
+	// Buffer file output to avoid lots of tiny writes. Convert closes the OSM writer (which writes out
+	// the last block) before we flush, and the flush happens before the deferred file close
+	var w io.Writer = outputWriter
+	var buf *bufio.Writer
+	if outputFile != "-" {
+		buf = bufio.NewWriterSize(outputWriter, 1<<20)
+		w = buf
 	}
-	fmt.Println(layer.Query())
 
-	for rows.Next() {
-		g := &Feature{
-			Tags: make(map[string]any),
+	var out gpkg2osm.OSMWriter
+	pbfOpts := &gpkg2osm.PBFOptions{BlockSize: *pbfBlockSize, CompressLevel: level, Sorted: *sorted}
+	switch {
+	case diffMode:
+		// Diff writes the change file itself
+	case *tagsAsJSON:
+		// Options.Tagged writes the tags instead
+	case format == gpkg2osm.FormatPBF && appending:
+		out, err = gpkg2osm.NewPBFAppendWriter(w, pbfOpts)
+	case format == gpkg2osm.FormatPBF:
+		out, err = gpkg2osm.NewPBFWriter(w, pbfOpts)
+	default:
+		out, err = gpkg2osm.NewWriter(w, format)
+	}
+	if err != nil {
+		slog.Error("cannot create osmwriter", "error", err)
+		exit(exitFailed)
+	}
+	if existing != nil {
+		if err := out.Write(existing); err != nil {
+			slog.Error("cannot write the existing elements", "file", outputFile, "err", err)
+			exit(exitFailed)
 		}
-		var geo []byte
-		var osm_tags sql.NullString
+	}
 
-		if err := rows.Scan(&geo, &osm_tags); err != nil {
-			slog.Error("bad scan for row", "table", layer.Name, "err", err)
-			continue
+	var skip map[string]bool
+	var layerDone func(string) error
+	if *checkpointFile != "" {
+		if cp == nil {
+			cp = &checkpoint{file: *checkpointFile, Output: outputFile}
+		}
+		skip = cp.done()
+		// Everything is flushed through to the file before each save, so the size covers the whole layer
+		flush := func(layer string) error {
+			if err := out.(interface{ Flush() error }).Flush(); err != nil {
+				return err
+			}
+			if err := buf.Flush(); err != nil {
+				return err
+			}
+			return cp.save(layer)
+		}
+		if err := flush(""); err != nil {
+			slog.Error("cannot write checkpoint", "file", *checkpointFile, "err", err)
+			exit(exitFailed)
 		}
+		layerDone = flush
+	}
 
-		if !osm_tags.Valid {
-			slog.Error("bad row", "table", layer.Name, "err", "no OSM tags data")
-			continue
+	// One JSON object per line, so the file can be read as far as it got even if the conversion stops
+	var skipped func(gpkg2osm.SkippedFeature)
+	var errorLog *bufio.Writer
+	var errorLogErr error
+	if *errorLogFile != "" {
+		f, err := os.Create(*errorLogFile)
+		if err != nil {
+			slog.Error("cannot create error log", "file", *errorLogFile, "err", err)
+			exit(exitInvalid)
 		}
-		if len(geo) == 0 {
-			slog.Error("bad row", "table", layer.Name, "err", "no geometry data")
-			continue
+		defer f.Close()
+		errorLog = bufio.NewWriter(f)
+		enc := json.NewEncoder(errorLog)
+		skipped = func(s gpkg2osm.SkippedFeature) {
+			if err := enc.Encode(s); err != nil && errorLogErr == nil {
+				errorLogErr = err
+			}
 		}
+	}
 
-		if err := json.Unmarshal([]byte(osm_tags.String), &g.Tags); err != nil {
-			slog.Error("bad osm_tags", "table", layer.Name, "err", err, "data", osm_tags.String)
-			continue
+	var tagged func(gpkg2osm.TaggedFeature) error
+	if *tagsAsJSON {
+		buf = bufio.NewWriter(w)
+		enc := json.NewEncoder(buf)
+		tagged = func(f gpkg2osm.TaggedFeature) error {
+			return enc.Encode(f)
 		}
+	}
 
-		g.G, err = parseGpkgGeom(geo)
-		if err != nil {
-			slog.Error("bad geo data", "table", layer.Name, "err", err)
-			continue
+	opts := &gpkg2osm.Options{
+		KeepUntagged:          *keepUntagged,
+		GeometryOnly:          *geometryOnly,
+		LayerTagKey:           *layerTag,
+		MetadataTagKey:        *metadataTag,
+		IncludeMetadata:       *includeMetadata,
+		SRSTagKey:             *srsTag,
+		Where:                 *where,
+		Limit:                 *limit,
+		ValueMap:              values,
+		EnumLabels:            *enumLabels,
+		StripEmptyValues:      *stripEmpty,
+		DropTags:              *dropTags,
+		DefaultTags:           defaults,
+		RelatedTags:           *relatedTags,
+		LowercaseKeys:         *tagCase == "lower",
+		KeyPrefix:             *prefixKeys,
+		TagPrecedence:         gpkg2osm.TagPrecedence(*tagPrecedence),
+		Strict:                *strict,
+		Reproject:             *reproject,
+		OutputSRS:             *outputSRS,
+		CenterPoints:          *centerPoints,
+		EleFromZ:              *eleFromZ,
+		ApproximateCurves:     *approximateCurves,
+		CurveSegments:         *curveSegments,
+		LineRelationType:      lineRelationType,
+		SplitMultiPolygons:    *multiPolygonAs == "split",
+		ClosedLinesAsAreas:    *closedLines,
+		NoAreaTag:             *noAreaTag,
+		AreaKeys:              *areaTags,
+		Winding:               gpkg2osm.Winding(*winding),
+		MaxNodesPerWay:        *maxNodes,
+		MaxSegmentLength:      *maxSegment,
+		CoordPrecision:        *coordPrecision,
+		IDs:                   ids,
+		StableIDs:             *stableIDs,
+		IDFromFID:             *idFromFID,
+		OSMIDColumn:           *osmIDColumn,
+		DedupScope:            gpkg2osm.DedupScope(*dedupScope),
+		MergeCoincidentPoints: *mergePoints,
+		DeletedTag:            deleted,
+		SkipDeleted:           *skipDeleted,
+		Version:               *setVersion,
+		Timestamp:             timestamp,
+		User:                  *setUser,
+		ValidateGeometry:      *validateGeometry,
+		FixGeometry:           *fixGeometry,
+		SkipLayers:            skip,
+		LayerDone:             layerDone,
+		Skipped:               skipped,
+		Tagged:                tagged,
+		Workers:               *workers,
+		ReadThreads:           *threadsRead,
+		WriteThread:           *threadsWrite,
+	}
+	var summary *gpkg2osm.Summary
+	var changes *gpkg2osm.DiffSummary
+	if diffMode {
+		if changes, err = gpkg2osm.Diff(oldInputs, inputs, w, opts); err == nil {
+			summary = changes.New
+		}
+	} else {
+		summary, err = gpkg2osm.ConvertAll(inputs, out, opts)
+	}
+	if errorLog != nil {
+		if err := errorLog.Flush(); err != nil && errorLogErr == nil {
+			errorLogErr = err
+		}
+		if errorLogErr != nil {
+			slog.Error("cannot write error log", "file", *errorLogFile, "err", errorLogErr)
+		}
+	}
+	if err != nil {
+		slog.Error("conversion failed", "input", args[0], "err", err)
+		exit(exitFailed)
+	}
+	if buf != nil {
+		if err := buf.Flush(); err != nil {
+			slog.Error("error writing output", "file", outputFile, "err", err)
+			exit(exitFailed)
 		}
-		g.Layer = layer
-		n := &osm.Way{
-			Tags:    make(osm.Tags, 0, len(g.Tags)),
-			Visible: true,
+	}
+	if tempOutput != "" {
+		if err := replaceOutput(outputWriter, outputFile); err != nil {
+			slog.Error("error writing output", "file", outputFile, "err", err)
+			exit(exitFailed)
+		}
+	}
+	summary.Log()
+	if changes != nil {
+		changes.Log()
+	}
+	if cp != nil {
+		// Finished, a new run should start from scratch
+		if err := os.Remove(*checkpointFile); err != nil {
+			slog.Warn("cannot remove checkpoint", "file", *checkpointFile, "err", err)
+		}
+	}
+
+	if *verify {
+		outputWriter.Close()
+		if err := verifyOutput(outputFile, format); err != nil {
+			slog.Error("verification failed", "file", outputFile, "err", err)
+			os.Exit(exitFailed)
 		}
-		res = append(res, g)
+		slog.Info("output verified", "file", outputFile)
+	}
+
+	skippedFeatures := summary.Total().Skipped
+	if changes != nil {
+		// Skipped on either side, the diff is off for those features
+		skippedFeatures += changes.Old.Total().Skipped
+	}
+	if skippedFeatures > 0 && !*allowSkips {
+		slog.Error("some features could not be converted", "skipped", skippedFeatures)
+		os.Exit(exitSkipped)
 	}
-	return res, nil
 }
 
-// getGeoPackageLayers queries the GeoPackage for its feature tables and their column information,
-// determining OSM tag mappings based on specific rules.
-func getGeoPackageLayers(db *sql.DB) (map[string]*ExportLayer, error) {
-	layers := make(map[string]*ExportLayer, 5)
-	sqlite_geom_qry := "SELECT table_name, column_name, geometry_type_name, srs_id, z, m FROM gpkg_geometry_columns"
+// The output format for a file name: .osm.pbf or .pbf for PBF, .osm.xml, .osm or .xml for XML, and .o5m for O5M
+func formatForFile(name string) (gpkg2osm.Format, error) {
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".pbf":
+		return gpkg2osm.FormatPBF, nil
+	case ".osm", ".xml":
+		return gpkg2osm.FormatXML, nil
+	case ".o5m":
+		return gpkg2osm.FormatO5M, nil
+	}
+	return "", fmt.Errorf("unknown extension %q, must be .osm.pbf, .pbf, .osm.xml, .osm, .xml or .o5m", filepath.Ext(name))
+}
+
+// Read an existing output file for --append, moving ids past the IDs it uses. Returns false if the file
+// does not exist yet, in which case it is created like normal
+func readExisting(file string, format gpkg2osm.Format, ids *gpkg2osm.IDGenerator) (bool, *osm.OSM, error) {
+	f, err := os.Open(file)
+	if os.IsNotExist(err) {
+		return false, nil, nil
+	} else if err != nil {
+		return false, nil, err
+	}
+	defer f.Close()
+
+	var existing *osm.OSM
+	if format != gpkg2osm.FormatPBF {
+		existing = &osm.OSM{}
+	}
+	s := gpkg2osm.NewScanner(f, format)
+	defer s.Close()
+	if _, err := gpkg2osm.IDsAfter(s, ids, existing); err != nil {
+		return false, nil, err
+	}
+	return true, existing, nil
+}
 
-	rows, err := db.Query(sqlite_geom_qry)
+// Move the finished temporary file over the output it was appended from, with the output's permissions
+func replaceOutput(temp *os.File, file string) error {
+	info, err := os.Stat(file)
 	if err != nil {
-		return nil, err
-	}
-
-	for rows.Next() {
-		// The GeoPackage specification defines the columns for gpkg_geometry_columns.
-		// These are the common ones, but you might need to adjust based on your specific GeoPackage version/data.
-		// Refer to the GeoPackage specification for the exact table schema.
-		l := ExportLayer{}
-		var geo_type sql.NullString
-
-		err := rows.Scan(
-			&l.Name,
-			&l.GeometryField,
-			&geo_type,
-			&l.SRS,
-			&l.Z,
-			&l.M,
-		)
-
-		// Convert the geo_type to the proper enum
-		l.GeometryType = geo_type.String
+		return err
+	}
+	if err := temp.Chmod(info.Mode().Perm()); err != nil {
+		return err
+	}
+	if err := temp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(temp.Name(), file)
+}
+
+// Write the detected layers as JSON so pipelines can decide what to convert. Several inputs are written as a list
+// with an entry for each
+func writeJSONSummary(file string, paths []string, inputs []gpkg2osm.Input) error {
+	type fileSummary struct {
+		File   string                  `json:"file"`
+		Layers []*gpkg2osm.ExportLayer `json:"layers"`
+	}
+	summaries := make([]fileSummary, 0, len(inputs))
+	for i, in := range inputs {
+		summary := fileSummary{
+			File:   paths[i],
+			Layers: make([]*gpkg2osm.ExportLayer, 0, len(in.Layers)),
+		}
+		for _, l := range in.Layers {
+			summary.Layers = append(summary.Layers, l)
+		}
+		sort.Slice(summary.Layers, func(i, j int) bool { return summary.Layers[i].Name < summary.Layers[j].Name })
+		summaries = append(summaries, summary)
+	}
+
+	w := os.Stdout
+	if file != "-" {
+		f, err := os.Create(file)
 		if err != nil {
-			slog.Error("error scanning geometry column", "err", err)
-			continue
+			return err
 		}
-		layers[l.Name] = &l
+		defer f.Close()
+		w = f
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if len(summaries) == 1 {
+		return enc.Encode(summaries[0])
 	}
+	return enc.Encode(summaries)
+}
 
-	// Now get column information for the layer
-	// We only care about layers tag OSM Tag or the "osm_tag" layer that is JSON
-	sqlite_col_qry := "SELECT table_name, column_name, description, mime_type FROM gpkg_data_columns"
-	rows, err = db.Query(sqlite_col_qry)
-	if err != nil {
-		return nil, err
+// The GeoPackages to convert. A directory means every .gpkg file in it, and anything else that is not a file
+// is tried as a glob, as the shell does not expand quoted patterns
+func findInputs(input string) ([]string, error) {
+	info, err := os.Stat(input)
+	if err == nil && !info.IsDir() {
+		return []string{input}, nil
+	}
+	pattern := input
+	if err == nil {
+		pattern = filepath.Join(input, "*.gpkg")
+	}
+	files, globErr := filepath.Glob(pattern)
+	if globErr != nil {
+		return nil, globErr
 	}
-	var table, col, desc, mime_type sql.NullString
-	for rows.Next() {
-		if err := rows.Scan(&table, &col, &desc, &mime_type); err != nil {
-			slog.Error("error scanning data column", "error", err)
-			continue
+	if len(files) == 0 {
+		if err != nil {
+			// sqlite will happily create a new empty database, so the input has to exist
+			return nil, err
 		}
-		l, ok := layers[table.String]
-		if !ok {
-			slog.Warn("not a geometry layer", "name", table.String)
-			continue
+		return nil, fmt.Errorf("no .gpkg files in %s", input)
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+// Open a GeoPackage and find its layers. Queries wait up to busyTimeout for locks held by other programs
+func openInput(file string, opts *gpkg2osm.LayerOptions, busyTimeout time.Duration) (gpkg2osm.Input, error) {
+	db, err := sql.Open("sqlite3", fmt.Sprintf("%s?_busy_timeout=%d", file, busyTimeout.Milliseconds()))
+	if err != nil {
+		return gpkg2osm.Input{}, err
+	}
+	if err := gpkg2osm.CheckGeoPackage(db); err != nil {
+		db.Close()
+		return gpkg2osm.Input{}, err
+	}
+	layers, err := gpkg2osm.GetGeoPackageLayersWith(db, opts)
+	if err != nil {
+		db.Close()
+		return gpkg2osm.Input{}, fmt.Errorf("error querying layers: %w", err)
+	}
+	return gpkg2osm.Input{DB: db, Layers: layers}, nil
+}
+
+// Name the inputs after their files without the extension, or the whole path if two files have the same name.
+// A single input is left unnamed so its summary looks the same as always
+func inputNames(inputs []gpkg2osm.Input, paths []string) {
+	if len(inputs) < 2 {
+		return
+	}
+	base := func(p string) string { return strings.TrimSuffix(filepath.Base(p), filepath.Ext(p)) }
+	seen := make(map[string]int)
+	for _, p := range paths {
+		seen[base(p)]++
+	}
+	for i, p := range paths {
+		inputs[i].Name = base(p)
+		if seen[inputs[i].Name] > 1 {
+			inputs[i].Name = p
 		}
+	}
+}
 
-		if col.String == "osm_tags" && mime_type.String == "application/json" {
-			// valid OSM tags field
-			l.OSMJsonField = true
-			continue
+// Parse the --value-map rules. Keys may contain ':' themselves (addr:street:1=Main), so the key ends at the
+// last ':' before the '='
+func parseValueMap(rules []string) (map[string]map[string]string, error) {
+	if len(rules) == 0 {
+		return nil, nil
+	}
+	values := make(map[string]map[string]string)
+	for _, r := range rules {
+		lhs, to, ok := strings.Cut(r, "=")
+		i := strings.LastIndex(lhs, ":")
+		if !ok || i < 1 {
+			return nil, fmt.Errorf("rule %q must be key:from=to", r)
 		}
-		if strings.Contains(strings.ToLower(desc.String), "osm tag") {
-			l.Tags = append(l.Tags, col.String)
+		key, from := lhs[:i], lhs[i+1:]
+		if values[key] == nil {
+			values[key] = make(map[string]string)
 		}
+		values[key][from] = to
 	}
+	return values, nil
+}
 
-	// Validate that the layer is exportable
-	for name, l := range layers {
-		if err := l.Validate(); err != nil {
-			slog.Warn("bad layer", "name", name, "reason", err.Error())
-			delete(layers, name)
+// Parse --compress-level into a PBFOptions.CompressLevel. 0 means no compression here, not the default
+func parseCompressLevel(s string) (int, error) {
+	switch s {
+	case "none", "0":
+		return gpkg2osm.PBFUncompressed, nil
+	case "fast":
+		return zlib.BestSpeed, nil
+	case "best":
+		return zlib.BestCompression, nil
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n < zlib.BestSpeed || n > zlib.BestCompression {
+		return 0, fmt.Errorf("%q must be 0 to 9, none, fast or best", s)
+	}
+	return n, nil
+}
+
+// Parse layer:key=value rules. The layer ends at the first ":", so keys like addr:city work
+func parseDefaultTags(rules []string) (map[string]map[string]string, error) {
+	if len(rules) == 0 {
+		return nil, nil
+	}
+	tags := make(map[string]map[string]string)
+	for _, r := range rules {
+		lhs, value, ok := strings.Cut(r, "=")
+		layer, key, _ := strings.Cut(lhs, ":")
+		if !ok || layer == "" || key == "" {
+			return nil, fmt.Errorf("rule %q must be layer:key=value", r)
 		}
+		if tags[layer] == nil {
+			tags[layer] = make(map[string]string)
+		}
+		tags[layer][key] = value
 	}
-	return layers, nil
+	return tags, nil
 }
 
-// Parse the encode geometry from a gpkg
-func parseGpkgGeom(data []byte) (geom.T, error) {
-	if data[0] != 'G' && data[1] != 'P' {
-		return nil, fmt.Errorf("bad header")
-	}
-	// version := data[2] // Dont care
-	// only reading one flag so just pull it
-	// https://www.geopackage.org/spec/#gpb_format
-	env_size := 0
-	switch (data[3] >> 1) & 0b111 {
-	case 1:
-		env_size = 32
-	case 2, 3:
-		env_size = 48
-	case 4:
-		env_size = 64
+// Configure the default slog logger. Logs always go to stderr so they never mix with output on stdout
+func setupLogging(level, format string) error {
+	var lvl slog.Level
+	if err := lvl.UnmarshalText([]byte(level)); err != nil {
+		return err
+	}
+	opts := &slog.HandlerOptions{Level: lvl}
+	switch format {
+	case "text":
+		slog.SetDefault(slog.New(slog.NewTextHandler(os.Stderr, opts)))
+	case "json":
+		slog.SetDefault(slog.New(slog.NewJSONHandler(os.Stderr, opts)))
 	default:
-		return nil, fmt.Errorf("invalid envelope type: %d", (data[3]>>1)&0b111)
+		return fmt.Errorf("unknown log format %q, must be text or json", format)
+	}
+	return nil
+}
+
+// Read the output back and log every problem found with it
+func verifyOutput(file string, format gpkg2osm.Format) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
 	}
-	// skip srs for now
-	// skip envelope
-	return wkb.Unmarshal(data[8+env_size:])
+	defer f.Close()
+	s := gpkg2osm.NewScanner(f, format)
+	defer s.Close()
+
+	problems, err := gpkg2osm.Verify(s)
+	if err != nil {
+		return err
+	}
+	const maxLogged = 20
+	for i, p := range problems {
+		if i == maxLogged {
+			slog.Error("too many problems, not logging the rest", "remaining", len(problems)-maxLogged)
+			break
+		}
+		slog.Error("invalid output", "err", p)
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("%d problems found", len(problems))
+	}
+	return nil
 }
@@ -0,0 +1,871 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nullmonk/gpkg2osm"
+	"github.com/paulmach/osm"
+)
+
+// The tests run the command in a child process, which is the test binary itself with this set
+const runMain = "GPKG2OSM_TEST_MAIN"
+
+func TestMain(m *testing.M) {
+	if os.Getenv(runMain) != "" {
+		main()
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// Run the command with the arguments in dir, and return its exit code and what it logged
+func run(t *testing.T, dir string, args ...string) (int, string) {
+	t.Helper()
+	code, _, log := runOutput(t, dir, args...)
+	return code, log
+}
+
+// The same as run, and also return what the command wrote to stdout
+func runOutput(t *testing.T, dir string, args ...string) (int, []byte, string) {
+	t.Helper()
+	exe, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmd := exec.Command(exe, args...)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), runMain+"=1")
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	err = cmd.Run()
+	var exit *exec.ExitError
+	if errors.As(err, &exit) {
+		return exit.ExitCode(), stdout.Bytes(), stderr.String()
+	} else if err != nil {
+		t.Fatal(err)
+	}
+	return 0, stdout.Bytes(), stderr.String()
+}
+
+// A directory with the sample GeoPackage in it as sample.gpkg
+func sampleDir(t *testing.T) string {
+	t.Helper()
+	dir := t.TempDir()
+	if err := genSample(filepath.Join(dir, "sample.gpkg")); err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func readFile(t *testing.T, file string) *osm.OSM {
+	t.Helper()
+	format, err := formatForFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	o := &osm.OSM{}
+	if _, err := gpkg2osm.IDsAfter(gpkg2osm.NewScanner(f, format), nil, o); err != nil {
+		t.Fatal(err)
+	}
+	return o
+}
+
+// The IDs of the elements, by type
+func elementIDs(o *osm.OSM) map[osm.Type][]int64 {
+	ids := make(map[osm.Type][]int64)
+	for _, n := range o.Nodes {
+		ids[osm.TypeNode] = append(ids[osm.TypeNode], int64(n.ID))
+	}
+	for _, w := range o.Ways {
+		ids[osm.TypeWay] = append(ids[osm.TypeWay], int64(w.ID))
+	}
+	for _, r := range o.Relations {
+		ids[osm.TypeRelation] = append(ids[osm.TypeRelation], int64(r.ID))
+	}
+	return ids
+}
+
+func TestAppend(t *testing.T) {
+	for _, name := range []string{"out.osm", "out.o5m", "out.osm.pbf"} {
+		t.Run(name, func(t *testing.T) {
+			dir := sampleDir(t)
+			out := filepath.Join(dir, name)
+			if code, log := run(t, dir, "sample.gpkg", name); code != 0 {
+				t.Fatalf("first conversion exited with %d:\n%s", code, log)
+			}
+			first := readFile(t, out)
+			if code, log := run(t, dir, "sample.gpkg", name, "--append"); code != 0 {
+				t.Fatalf("appending exited with %d:\n%s", code, log)
+			}
+			both := readFile(t, out)
+
+			// Both conversions are there, and the second one did not reuse the IDs of the first
+			firstIDs, bothIDs := elementIDs(first), elementIDs(both)
+			for typ, ids := range firstIDs {
+				if len(bothIDs[typ]) != 2*len(ids) {
+					t.Errorf("%d %ss after appending, want %d", len(bothIDs[typ]), typ, 2*len(ids))
+				}
+				seen := make(map[int64]bool)
+				for _, id := range bothIDs[typ] {
+					if seen[id] {
+						t.Errorf("%s/%d is used twice", typ, id)
+					}
+					seen[id] = true
+				}
+			}
+			entries, _ := os.ReadDir(dir)
+			if len(entries) != 2 {
+				t.Errorf("the directory has %d files, want the input and the output", len(entries))
+			}
+		})
+	}
+}
+
+// A failed append leaves the existing file as it was
+func TestAppendFailed(t *testing.T) {
+	dir := sampleDir(t)
+	if code, log := run(t, dir, "sample.gpkg", "out.osm"); code != 0 {
+		t.Fatalf("first conversion exited with %d:\n%s", code, log)
+	}
+	before, err := os.ReadFile(filepath.Join(dir, "out.osm"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A point among the roads stops a strict conversion part way through
+	execFile(t, filepath.Join(dir, "sample.gpkg"), "INSERT INTO roads (geom, highway) VALUES (X'47500001E6100000010100000000000000000000000000000000000000', 'path')")
+	if code, _ := run(t, dir, "sample.gpkg", "out.osm", "--append", "--strict"); code != exitFailed {
+		t.Errorf("exited with %d, want %d", code, exitFailed)
+	}
+	after, err := os.ReadFile(filepath.Join(dir, "out.osm"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(before, after) {
+		t.Error("the output changed")
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 2 {
+		t.Errorf("the directory has %d files, want the input and the output", len(entries))
+	}
+}
+
+func TestOverwrite(t *testing.T) {
+	dir := sampleDir(t)
+	out := filepath.Join(dir, "out.osm")
+	if err := os.WriteFile(out, []byte("previous conversion"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	code, log := run(t, dir, "sample.gpkg", "out.osm")
+	if code != exitInvalid || !strings.Contains(log, "output file already exists") {
+		t.Errorf("exited with %d, want %d and an error:\n%s", code, exitInvalid, log)
+	}
+	if data, _ := os.ReadFile(out); string(data) != "previous conversion" {
+		t.Error("the existing file was changed")
+	}
+
+	if code, log := run(t, dir, "sample.gpkg", "out.osm", "--overwrite"); code != 0 {
+		t.Fatalf("--overwrite exited with %d:\n%s", code, log)
+	}
+	if o := readFile(t, out); len(o.Nodes) == 0 {
+		t.Error("the file was not replaced with the conversion")
+	}
+	// The inputs are opened first, a bad one leaves the file alone
+	before, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code, _ := run(t, dir, "missing.gpkg", "out.osm", "--overwrite"); code != exitInvalid {
+		t.Errorf("a missing input exited with %d, want %d", code, exitInvalid)
+	}
+	if after, _ := os.ReadFile(out); !bytes.Equal(before, after) {
+		t.Error("a missing input replaced the file")
+	}
+	// Stdout can always be written to
+	if code, log := run(t, dir, "sample.gpkg", "-"); code != 0 {
+		t.Errorf("writing to stdout exited with %d:\n%s", code, log)
+	}
+}
+
+// Run SQL on a GeoPackage on disk
+func execFile(t *testing.T, file, query string) {
+	t.Helper()
+	db, err := sql.Open("sqlite3", file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if _, err := db.Exec(query); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestExitCodes(t *testing.T) {
+	dir := sampleDir(t)
+	if err := os.WriteFile(filepath.Join(dir, "broken.gpkg"), []byte("not sqlite at all"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	// One road without tags, one whose geometry is cut short, and one that is a point
+	for name, row := range map[string]string{
+		"untagged.gpkg":   "INSERT INTO roads (geom) VALUES (X'47500001E6100000010100000000000000000000000000000000000000')",
+		"damaged.gpkg":    "INSERT INTO roads (geom, highway) VALUES (X'47500001E61000000102', 'path')",
+		"mismatched.gpkg": "INSERT INTO roads (geom, highway) VALUES (X'47500001E6100000010100000000000000000000000000000000000000', 'path')",
+	} {
+		if err := genSample(filepath.Join(dir, name)); err != nil {
+			t.Fatal(err)
+		}
+		execFile(t, filepath.Join(dir, name), row)
+	}
+
+	for _, tt := range []struct {
+		name string
+		args []string
+		code int
+	}{
+		{"clean", []string{"sample.gpkg", "-"}, 0},
+		{"untagged", []string{"untagged.gpkg", "-"}, exitSkipped},
+		{"untagged kept", []string{"untagged.gpkg", "-", "--keep-untagged"}, 0},
+		{"damaged geometry", []string{"damaged.gpkg", "-"}, exitSkipped},
+		{"skips allowed", []string{"damaged.gpkg", "-", "--allow-skips"}, 0},
+		{"missing input", []string{"missing.gpkg", "-"}, exitInvalid},
+		{"not a GeoPackage", []string{"broken.gpkg", "-"}, exitInvalid},
+		{"negative segment length", []string{"sample.gpkg", "-", "--max-segment-length=-5"}, exitInvalid},
+		{"OSM IDs with positive IDs", []string{"sample.gpkg", "-", "--osm-id-column", "osm_id", "--id-strategy", "positive"}, exitInvalid},
+		{"sorted append", []string{"sample.gpkg", "out.osm.pbf", "--sorted", "--append"}, exitInvalid},
+		{"OSM IDs in a diff", []string{"diff", "sample.gpkg", "sample.gpkg", "out.osc", "--osm-id-column", "osm_id"}, exitInvalid},
+		{"unknown id strategy", []string{"sample.gpkg", "-", "--id-strategy", "sideways"}, exitInvalid},
+		{"flag value of the wrong type", []string{"sample.gpkg", "-", "--limit", "abc"}, exitUsage},
+		{"unknown flag", []string{"sample.gpkg", "-", "--no-such-flag"}, exitUsage},
+		{"bad where", []string{"sample.gpkg", "-", "--where", "1; DROP TABLE roads"}, exitInvalid},
+		{"fatal", []string{"mismatched.gpkg", "-", "--strict"}, exitFailed},
+	} {
+		if code, log := run(t, dir, tt.args...); code != tt.code {
+			t.Errorf("%s: exited with %d, want %d:\n%s", tt.name, code, tt.code, log)
+		}
+	}
+}
+
+func TestGeometryColumnFlag(t *testing.T) {
+	dir := sampleDir(t)
+	execFile(t, filepath.Join(dir, "sample.gpkg"), "ALTER TABLE roads RENAME COLUMN geom TO shape")
+	for _, tt := range []struct {
+		args []string
+		code int
+	}{
+		{[]string{"--geometry-column", "roads=nope"}, exitInvalid},
+		{[]string{"--geometry-column", "trails=shape"}, exitInvalid},
+		// The other layers have no shape column
+		{[]string{"--geometry-column", "shape"}, exitInvalid},
+		{[]string{"--geometry-column", "roads=shape"}, 0},
+	} {
+		if code, log := run(t, dir, append([]string{"sample.gpkg", "out.osm", "--overwrite"}, tt.args...)...); code != tt.code {
+			t.Errorf("%v: exited with %d, want %d:\n%s", tt.args, code, tt.code, log)
+		}
+	}
+	if o := readFile(t, filepath.Join(dir, "out.osm")); len(o.Ways) != 3 {
+		t.Errorf("got %d ways, want the 2 roads and the building", len(o.Ways))
+	}
+}
+
+// Two copies of the sample in a directory become one output, with the layers told apart by their file
+func TestMultipleInputs(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.Mkdir(filepath.Join(dir, "in"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"a.gpkg", "b.gpkg"} {
+		if err := genSample(filepath.Join(dir, "in", name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if code, log := run(t, dir, "in/a.gpkg", "single.osm"); code != 0 {
+		t.Fatalf("converting one file exited with %d:\n%s", code, log)
+	}
+	single := readFile(t, filepath.Join(dir, "single.osm"))
+
+	for _, input := range []string{"in", "in/*.gpkg"} {
+		code, log := run(t, dir, input, "merged.osm", "--overwrite", "--tag-layer-name", "--dedup-scope", "global")
+		if code != 0 {
+			t.Fatalf("%s: exited with %d:\n%s", input, code, log)
+		}
+		for _, name := range []string{"a", "b"} {
+			if !strings.Contains(log, `msg="input summary" name=`+name+" ") {
+				t.Errorf("%s: no summary for %s:\n%s", input, name, log)
+			}
+		}
+		merged := readFile(t, filepath.Join(dir, "merged.osm"))
+		if len(merged.Ways) != 2*len(single.Ways) {
+			t.Errorf("%s: got %d ways, want %d", input, len(merged.Ways), 2*len(single.Ways))
+		}
+		// The ways of both files are in the same place, so they share their nodes. The points each keep their own
+		points := 0
+		for _, n := range single.Nodes {
+			if len(n.Tags) > 0 {
+				points++
+			}
+		}
+		if want := len(single.Nodes) + points; len(merged.Nodes) != want {
+			t.Errorf("%s: got %d nodes, want %d", input, len(merged.Nodes), want)
+		}
+		layers := make(map[string]int)
+		for _, w := range merged.Ways {
+			layers[w.Tags.Find("source:layer")]++
+		}
+		if layers["a/roads"] != 2 || layers["b/roads"] != 2 {
+			t.Errorf("%s: ways by layer %v, want 2 roads of a/roads and of b/roads", input, layers)
+		}
+		for typ, ids := range elementIDs(merged) {
+			seen := make(map[int64]bool)
+			for _, id := range ids {
+				if seen[id] {
+					t.Errorf("%s: %s/%d is used twice", input, typ, id)
+				}
+				seen[id] = true
+			}
+		}
+	}
+}
+
+// A conversion that stops in the second layer is finished by running it again, without converting the first one twice
+func TestCheckpoint(t *testing.T) {
+	dir := sampleDir(t)
+	sample := filepath.Join(dir, "sample.gpkg")
+	if code, log := run(t, dir, "sample.gpkg", "whole.osm.pbf"); code != 0 {
+		t.Fatalf("converting without a checkpoint exited with %d:\n%s", code, log)
+	}
+	whole := readFile(t, filepath.Join(dir, "whole.osm.pbf"))
+
+	// Layers are converted in name order, so buildings is finished when reading roads fails on malformed JSON
+	execFile(t, sample, `ALTER TABLE roads RENAME TO roads_data;
+		CREATE VIEW roads AS SELECT fid, geom, json('{') AS highway, name, maxspeed FROM roads_data`)
+	args := []string{"sample.gpkg", "out.osm.pbf", "--checkpoint", "checkpoint.json"}
+	if code, log := run(t, dir, args...); code != exitFailed {
+		t.Fatalf("the broken conversion exited with %d, want %d:\n%s", code, exitFailed, log)
+	}
+	data, err := os.ReadFile(filepath.Join(dir, "checkpoint.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), `"layers":["buildings"]`) {
+		t.Errorf("checkpoint %s, want buildings finished", data)
+	}
+
+	execFile(t, sample, "DROP VIEW roads; ALTER TABLE roads_data RENAME TO roads")
+	code, log := run(t, dir, args...)
+	if code != 0 {
+		t.Fatalf("resuming exited with %d:\n%s", code, log)
+	}
+	if !strings.Contains(log, "resuming from checkpoint") || strings.Contains(log, `msg="layer summary" name=buildings`) {
+		t.Errorf("buildings was converted again:\n%s", log)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "checkpoint.json")); !os.IsNotExist(err) {
+		t.Error("the checkpoint was not removed once the conversion finished")
+	}
+	resumed := readFile(t, filepath.Join(dir, "out.osm.pbf"))
+	wholeIDs, resumedIDs := elementIDs(whole), elementIDs(resumed)
+	for _, typ := range []osm.Type{osm.TypeNode, osm.TypeWay, osm.TypeRelation} {
+		if len(resumedIDs[typ]) != len(wholeIDs[typ]) {
+			t.Errorf("got %d %ss, want %d", len(resumedIDs[typ]), typ, len(wholeIDs[typ]))
+		}
+		seen := make(map[int64]bool)
+		for _, id := range resumedIDs[typ] {
+			if seen[id] {
+				t.Errorf("%s/%d is used twice", typ, id)
+			}
+			seen[id] = true
+		}
+	}
+}
+
+func TestExcludeLayers(t *testing.T) {
+	dir := sampleDir(t)
+	out := filepath.Join(dir, "out.osm")
+	for _, tt := range []struct {
+		args  []string
+		nodes int // Tagged nodes, the shops
+		ways  int // The 2 roads and the building
+	}{
+		{[]string{"--exclude-layers", "roads"}, 2, 1},
+		{[]string{"--exclude-layers", "roads,shops"}, 0, 1},
+		{[]string{"--exclude-layers", "shops", "--exclude-layers", "buildings"}, 0, 2},
+	} {
+		if code, log := run(t, dir, append([]string{"sample.gpkg", "out.osm", "--overwrite"}, tt.args...)...); code != 0 {
+			t.Fatalf("%v: exited with %d:\n%s", tt.args, code, log)
+		}
+		o := readFile(t, out)
+		tagged := 0
+		for _, n := range o.Nodes {
+			if len(n.Tags) > 0 {
+				tagged++
+			}
+		}
+		if tagged != tt.nodes || len(o.Ways) != tt.ways {
+			t.Errorf("%v: got %d tagged nodes and %d ways, want %d and %d", tt.args, tagged, len(o.Ways), tt.nodes, tt.ways)
+		}
+		for _, w := range o.Ways {
+			if w.Tags.Find("highway") != "" && strings.Contains(tt.args[1], "roads") {
+				t.Errorf("%v: the excluded road %d was converted", tt.args, w.ID)
+			}
+		}
+	}
+	code, log := run(t, dir, "sample.gpkg", "-", "--exclude-layers", "raods")
+	if code != exitInvalid || !strings.Contains(log, "no such layer") {
+		t.Errorf("a misspelled layer exited with %d, want %d and an error:\n%s", code, exitInvalid, log)
+	}
+}
+
+func TestFormatForFile(t *testing.T) {
+	for _, tt := range []struct {
+		file   string
+		format gpkg2osm.Format // Empty for an error
+	}{
+		{"out.osm.pbf", gpkg2osm.FormatPBF},
+		{"out.pbf", gpkg2osm.FormatPBF},
+		{"dir.d/OUT.OSM.PBF", gpkg2osm.FormatPBF},
+		{"out.osm.xml", gpkg2osm.FormatXML},
+		{"out.osm", gpkg2osm.FormatXML},
+		{"out.xml", gpkg2osm.FormatXML},
+		{"out.Osm", gpkg2osm.FormatXML},
+		{"out.o5m", gpkg2osm.FormatO5M},
+		{"out.osm.gz", ""},
+		{"out.pbf.txt", ""},
+		{"out.gpkg", ""},
+		{"out", ""},
+		{"out.", ""},
+		{"osm", ""},
+	} {
+		format, err := formatForFile(tt.file)
+		if tt.format == "" {
+			if err == nil {
+				t.Errorf("%s: got %s, want an error", tt.file, format)
+			}
+		} else if err != nil || format != tt.format {
+			t.Errorf("%s: got %q and %v, want %s", tt.file, format, err, tt.format)
+		}
+	}
+}
+
+// A mistyped flag prints what is wrong and the usage, and converts nothing
+func TestBadFlag(t *testing.T) {
+	dir := sampleDir(t)
+	for _, tt := range []struct {
+		args  []string
+		error string
+	}{
+		{[]string{"--strip-empty-vals"}, "error: unknown flag: --strip-empty-vals"},
+		{[]string{"--limit", "ten"}, `error: invalid argument "ten" for "--limit"`},
+		{[]string{"-z"}, "error: unknown shorthand flag: 'z' in -z"},
+	} {
+		code, log := run(t, dir, append([]string{"sample.gpkg", "out.osm"}, tt.args...)...)
+		if code != exitUsage {
+			t.Errorf("%v: exited with %d, want %d", tt.args, code, exitUsage)
+		}
+		if !strings.HasPrefix(log, tt.error) {
+			t.Errorf("%v: output does not start with %q:\n%s", tt.args, tt.error, log)
+		}
+		for _, want := range []string{"Usage:", "Flags:", "--strip-empty-values", "Examples:"} {
+			if !strings.Contains(log, want) {
+				t.Errorf("%v: the usage has no %q", tt.args, want)
+			}
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, "out.osm")); !os.IsNotExist(err) {
+		t.Error("an output file was created")
+	}
+	if code, log := run(t, dir, "--help"); code != 0 || !strings.Contains(log, "Usage:") {
+		t.Errorf("--help exited with %d:\n%s", code, log)
+	}
+}
+
+// One JSON line for every skipped feature, with the row it came from
+func TestErrorLog(t *testing.T) {
+	dir := sampleDir(t)
+	execFile(t, filepath.Join(dir, "sample.gpkg"), `
+		INSERT INTO roads (fid, geom) VALUES (10, X'47500001E6100000010100000000000000000000000000000000000000');
+		INSERT INTO roads (fid, geom, highway) VALUES (11, NULL, 'path');
+		INSERT INTO roads (fid, geom, highway) VALUES (12, X'', 'path');
+		INSERT INTO roads (fid, geom, highway) VALUES (13, X'47500001E61000000102', 'path');
+		UPDATE buildings SET osm_tags = '{"building":'`)
+	code, log := run(t, dir, "sample.gpkg", "out.osm", "--error-log", "skipped.jsonl", "--allow-skips")
+	if code != 0 {
+		t.Fatalf("exited with %d:\n%s", code, log)
+	}
+	data, err := os.ReadFile(filepath.Join(dir, "skipped.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, line := range strings.Split(strings.TrimSuffix(string(data), "\n"), "\n") {
+		var s gpkg2osm.SkippedFeature
+		if err := json.Unmarshal([]byte(line), &s); err != nil {
+			t.Fatalf("%q: %v", line, err)
+		}
+		fid := "-"
+		if s.FID != nil {
+			fid = fmt.Sprint(*s.FID)
+		}
+		got = append(got, fmt.Sprintf("%s/%s:%s", s.Layer, fid, s.Reason))
+	}
+	slices.Sort(got)
+	want := []string{"buildings/1:tags_json", "roads/10:untagged", "roads/11:null_geometry", "roads/12:no_geometry", "roads/13:geometry"}
+	if !slices.Equal(got, want) {
+		t.Errorf("error log has\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+	if !strings.Contains(log, fmt.Sprintf(`msg="conversion complete" features=4 skipped=%d `, len(want))) {
+		t.Errorf("the summary does not count %d skipped features:\n%s", len(want), log)
+	}
+}
+
+func TestGenSample(t *testing.T) {
+	dir := t.TempDir()
+	if code, log := run(t, dir, "gen-sample", "sample.gpkg"); code != 0 {
+		t.Fatalf("gen-sample exited with %d:\n%s", code, log)
+	}
+	if code, log := run(t, dir, "sample.gpkg", "sample.osm"); code != 0 {
+		t.Fatalf("converting the sample exited with %d:\n%s", code, log)
+	}
+	o := readFile(t, filepath.Join(dir, "sample.osm"))
+
+	// Every layer is converted: 2 shops, 2 roads and a building
+	var shops int
+	for _, n := range o.Nodes {
+		if n.Tags.Find("shop") != "" {
+			shops++
+		}
+	}
+	if shops != 2 || len(o.Ways) != 3 {
+		t.Errorf("got %d shops and %d ways, want 2 shops and 3 ways", shops, len(o.Ways))
+	}
+	for _, w := range o.Ways {
+		if w.Tags.Find("survey_notes") != "" {
+			t.Errorf("way/%d has the survey_notes column, which is not described as a tag", w.ID)
+		}
+		if w.Tags.Find("building") != "" && (w.Tags.Find("building:levels") != "3" || w.Tags.Find("building") != "retail") {
+			t.Errorf("the building has tags %v, want the column and osm_tags together", w.Tags)
+		}
+	}
+
+	// The sample is never written over, and needs the file name
+	if code, _ := run(t, dir, "gen-sample", "sample.gpkg"); code != 1 {
+		t.Errorf("gen-sample over an existing file exited with %d, want 1", code)
+	}
+	if code, _ := run(t, dir, "gen-sample"); code != 3 {
+		t.Errorf("gen-sample without a file exited with %d, want 3", code)
+	}
+}
+
+// Another program holds the GeoPackage locked while the command starts
+func TestBusyTimeout(t *testing.T) {
+	dir := sampleDir(t)
+	lock := func() func() {
+		db, err := sql.Open("sqlite3", filepath.Join(dir, "sample.gpkg"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn, err := db.Conn(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := conn.ExecContext(context.Background(), "BEGIN EXCLUSIVE"); err != nil {
+			t.Fatal(err)
+		}
+		return func() {
+			conn.ExecContext(context.Background(), "COMMIT")
+			conn.Close()
+			db.Close()
+		}
+	}
+
+	unlock := lock()
+	code, log := run(t, dir, "sample.gpkg", "-", "--busy-timeout", "0")
+	unlock()
+	if code != exitInvalid || !strings.Contains(log, "database is locked") {
+		t.Errorf("without a timeout: exited with %d, want %d:\n%s", code, exitInvalid, log)
+	}
+
+	// The lock goes away well before the timeout
+	unlock = lock()
+	time.AfterFunc(300*time.Millisecond, unlock)
+	if code, log := run(t, dir, "sample.gpkg", "out.osm", "--busy-timeout", "10s"); code != 0 {
+		t.Errorf("with a timeout: exited with %d:\n%s", code, log)
+	}
+
+	if code, _ := run(t, dir, "sample.gpkg", "-", "--busy-timeout", "-1s"); code != exitInvalid {
+		t.Errorf("negative timeout: exited with %d, want %d", code, exitInvalid)
+	}
+}
+
+func TestLayerTable(t *testing.T) {
+	dir := sampleDir(t)
+	file := filepath.Join(dir, "sample.gpkg")
+	in, err := openInput(file, &gpkg2osm.LayerOptions{}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer in.DB.Close()
+	var buf bytes.Buffer
+	if err := printLayerTable(&buf, []string{"a.gpkg", "b.gpkg"}, []gpkg2osm.Input{in, in}, "fid > 1"); err != nil {
+		t.Fatal(err)
+	}
+	table := `LAYER      GEOMETRY    SRS   TAG COLUMNS  OSM_TAGS  FEATURES
+buildings  POLYGON     4326  2            yes       0
+roads      LINESTRING  4326  3            no        1
+shops      POINT       4326  1            yes       1
+`
+	want := fmt.Sprintf(summaryHeaderTemplate, "a.gpkg") + table + "\n" + fmt.Sprintf(summaryHeaderTemplate, "b.gpkg") + table
+	if buf.String() != want {
+		t.Errorf("got\n%s\nwant\n%s", buf.String(), want)
+	}
+
+	if err := printLayerTable(&buf, []string{file}, []gpkg2osm.Input{in}, "no_such_column = 1"); err == nil {
+		t.Error("no error for a bad --where")
+	}
+	buf.Reset()
+	if err := printLayerTable(&buf, []string{file}, []gpkg2osm.Input{in}, "1); SELECT 99 WHERE (1"); err == nil {
+		t.Errorf("no error for a --where that adds a statement:\n%s", buf.String())
+	}
+	code, log := run(t, dir, "sample.gpkg", "--where", "1); SELECT 99 WHERE (1")
+	if code != exitInvalid || strings.Contains(log, "FEATURES") {
+		t.Errorf("a --where that adds a statement exited with %d, want %d:\n%s", code, exitInvalid, log)
+	}
+
+	// With an output the table is only printed when asked for, and never to stdout
+	for _, tt := range []struct {
+		args  []string
+		table bool
+	}{
+		{[]string{"sample.gpkg"}, true},
+		{[]string{"sample.gpkg", "-"}, false},
+		{[]string{"sample.gpkg", "-", "--pretty-summary"}, true},
+	} {
+		code, stdout, log := runOutput(t, dir, tt.args...)
+		if code != 0 {
+			t.Fatalf("%v: exited with %d:\n%s", tt.args, code, log)
+		}
+		if got := strings.Contains(log, "roads      LINESTRING  4326  3            no        2"); got != tt.table {
+			t.Errorf("%v: table printed = %v, want %v:\n%s", tt.args, got, tt.table, log)
+		}
+		if bytes.Contains(stdout, []byte("LAYER")) {
+			t.Errorf("%v: the table is on stdout", tt.args)
+		}
+	}
+}
+
+func TestFormatFlag(t *testing.T) {
+	dir := sampleDir(t)
+	if code, log := run(t, dir, "sample.gpkg", "sample.osm"); code != 0 {
+		t.Fatalf("exited with %d:\n%s", code, log)
+	}
+	want := readFile(t, filepath.Join(dir, "sample.osm"))
+	for _, format := range []gpkg2osm.Format{gpkg2osm.FormatPBF, gpkg2osm.FormatXML, gpkg2osm.FormatO5M} {
+		code, stdout, log := runOutput(t, dir, "sample.gpkg", "-", "--format", string(format))
+		if code != 0 {
+			t.Fatalf("%s: exited with %d:\n%s", format, code, log)
+		}
+		o := &osm.OSM{}
+		if _, err := gpkg2osm.IDsAfter(gpkg2osm.NewScanner(bytes.NewReader(stdout), format), nil, o); err != nil {
+			t.Fatalf("%s: stdout is not %s: %v", format, format, err)
+		}
+		if fmt.Sprint(elementIDs(o)) != fmt.Sprint(elementIDs(want)) {
+			t.Errorf("%s: got elements %v, want %v", format, elementIDs(o), elementIDs(want))
+		}
+	}
+
+	// The flag wins over the extension
+	if code, log := run(t, dir, "sample.gpkg", "out.osm", "--format", "o5m"); code != 0 {
+		t.Fatalf("exited with %d:\n%s", code, log)
+	}
+	data, err := os.ReadFile(filepath.Join(dir, "out.osm"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.HasPrefix(data, []byte("<?xml")) || data[0] != 0xff {
+		t.Errorf("out.osm is not O5M, it starts with %q", data[:min(len(data), 8)])
+	}
+
+	for _, args := range [][]string{
+		{"sample.gpkg", "-", "--format", "osc"},
+		{"sample.gpkg", "-", "--format", "PBF"},
+		{"diff", "sample.gpkg", "sample.gpkg", "out.osc", "--format", "xml"},
+	} {
+		if code, _ := run(t, dir, args...); code != exitInvalid {
+			t.Errorf("%v: exited with %d, want %d", args, code, exitInvalid)
+		}
+	}
+}
+
+func TestTagsAsJSON(t *testing.T) {
+	dir := sampleDir(t)
+	code, stdout, log := runOutput(t, dir, "sample.gpkg", "--tags-as-json")
+	if code != 0 {
+		t.Fatalf("exited with %d:\n%s", code, log)
+	}
+	layers := map[string]int{}
+	dec := json.NewDecoder(bytes.NewReader(stdout))
+	for dec.More() {
+		var f gpkg2osm.TaggedFeature
+		if err := dec.Decode(&f); err != nil {
+			t.Fatalf("stdout is not JSON lines: %v\n%s", err, stdout)
+		}
+		if f.FID == nil || f.Geometry == "" || len(f.Tags) == 0 {
+			t.Errorf("feature %+v has no fid, geometry or tags", f)
+		}
+		layers[f.Layer]++
+	}
+	if want := map[string]int{"buildings": 1, "roads": 2, "shops": 2}; fmt.Sprint(layers) != fmt.Sprint(want) {
+		t.Errorf("features by layer %v, want %v", layers, want)
+	}
+	if strings.Contains(log, "LAYER") {
+		t.Error("the layer table was printed, as if there were no output")
+	}
+
+	for _, args := range [][]string{
+		{"sample.gpkg", "out.osm", "--tags-as-json"},
+		{"sample.gpkg", "--tags-as-json", "--format", "xml"},
+	} {
+		if code, _ := run(t, dir, args...); code != exitInvalid {
+			t.Errorf("%v: exited with %d, want %d", args, code, exitInvalid)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, "out.osm")); !os.IsNotExist(err) {
+		t.Error("an output file was created")
+	}
+}
+
+// Output larger than the buffer of the file is written in full, the same as on stdout
+func TestBufferedOutput(t *testing.T) {
+	dir := sampleDir(t)
+	execFile(t, filepath.Join(dir, "sample.gpkg"), `
+		WITH RECURSIVE n(i) AS (SELECT 1 UNION ALL SELECT i + 1 FROM n WHERE i < 20000)
+		INSERT INTO shops (geom, osm_tags) SELECT X'47500001E6100000010100000000000000000000000000000000000000', json_object('name', 'shop ' || i) FROM n`)
+
+	for _, name := range []string{"out.osm", "out.osm.pbf"} {
+		if code, log := run(t, dir, "sample.gpkg", name); code != 0 {
+			t.Fatalf("%s: exited with %d:\n%s", name, code, log)
+		}
+		if o := readFile(t, filepath.Join(dir, name)); len(o.Nodes) != 20010 {
+			t.Errorf("%s: got %d nodes, want 20010", name, len(o.Nodes))
+		}
+	}
+	data, err := os.ReadFile(filepath.Join(dir, "out.osm"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) <= 1<<20 {
+		t.Fatalf("the output is %d bytes, it has to be larger than the buffer", len(data))
+	}
+	code, stdout, log := runOutput(t, dir, "sample.gpkg", "-")
+	if code != 0 {
+		t.Fatalf("stdout: exited with %d:\n%s", code, log)
+	}
+	if !bytes.Equal(data, stdout) {
+		t.Errorf("the file (%d bytes) is not what is written to stdout (%d bytes)", len(data), len(stdout))
+	}
+}
+
+func TestLogFlags(t *testing.T) {
+	dir := sampleDir(t)
+	// A geometry that is cut short, a problem with one row
+	execFile(t, filepath.Join(dir, "sample.gpkg"), "INSERT INTO roads (geom, highway) VALUES (X'47500001E61000000102', 'path')")
+
+	code, log := run(t, dir, "sample.gpkg", "-", "--allow-skips", "--log-format", "json", "--log-level", "debug")
+	if code != 0 {
+		t.Fatalf("exited with %d:\n%s", code, log)
+	}
+	levels := map[string]int{}
+	for _, line := range strings.Split(strings.TrimSpace(log), "\n") {
+		var rec struct{ Level, Msg string }
+		if err := json.Unmarshal([]byte(line), &rec); err != nil || rec.Msg == "" {
+			t.Fatalf("%q is not a JSON log record: %v", line, err)
+		}
+		levels[rec.Level]++
+	}
+	// The bad row is a warning, it does not stop the conversion
+	if levels["DEBUG"] == 0 || levels["INFO"] == 0 || levels["WARN"] == 0 || levels["ERROR"] != 0 {
+		t.Errorf("records by level %v, want debug, info and warnings and no errors", levels)
+	}
+
+	code, log = run(t, dir, "sample.gpkg", "-", "--allow-skips", "--log-level", "warn")
+	if code != 0 {
+		t.Fatalf("exited with %d:\n%s", code, log)
+	}
+	if !strings.Contains(log, "level=WARN") || strings.Contains(log, "level=INFO") {
+		t.Errorf("--log-level warn logged:\n%s", log)
+	}
+	if code, log := run(t, dir, "sample.gpkg", "-", "--allow-skips", "--log-level", "error"); code != 0 || log != "" {
+		t.Errorf("--log-level error exited with %d and logged:\n%s", code, log)
+	}
+
+	for _, args := range [][]string{{"--log-level", "loud"}, {"--log-format", "xml"}} {
+		if code, _ := run(t, dir, append([]string{"sample.gpkg", "-"}, args...)...); code != exitInvalid {
+			t.Errorf("%v: exited with %d, want %d", args, code, exitInvalid)
+		}
+	}
+}
+
+// The usage and the errors are formatted, not printed with the verbs and arguments of a printf format left over
+func TestLogFormatting(t *testing.T) {
+	dir := sampleDir(t)
+	for _, tt := range []struct {
+		args []string
+		want string
+	}{
+		{[]string{"--help"}, "Usage: "},
+		{[]string{"sample.gpkg", "nodir/out.osm"}, `msg="failed to create output file" file=nodir/out.osm err=`},
+		{[]string{"missing.gpkg", "-"}, `msg="cannot read input" input=missing.gpkg err=`},
+	} {
+		_, log := run(t, dir, tt.args...)
+		if !strings.Contains(log, tt.want) {
+			t.Errorf("%v: the output has no %q:\n%s", tt.args, tt.want, log)
+		}
+		for _, bad := range []string{"%s", "%v", "%!", "!BADKEY"} {
+			if strings.Contains(log, bad) {
+				t.Errorf("%v: the output has %q:\n%s", tt.args, bad, log)
+			}
+		}
+	}
+}
+
+// A --where that is not a single expression is rejected before the output is opened, so nothing is left behind
+// and an existing file is kept
+func TestWhereFlag(t *testing.T) {
+	dir := sampleDir(t)
+	for _, where := range []string{"1; DROP TABLE roads", "highway = 'path' OR (", "name = 'open"} {
+		code, log := run(t, dir, "sample.gpkg", "out.osm", "--where", where)
+		if code != exitInvalid || !strings.Contains(log, "invalid --where") {
+			t.Errorf("%q: exited with %d, want %d and an error:\n%s", where, code, exitInvalid, log)
+		}
+		if _, err := os.Stat(filepath.Join(dir, "out.osm")); !os.IsNotExist(err) {
+			t.Fatalf("%q: the output file was left behind", where)
+		}
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, "out.osm"), []byte("previous conversion"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if code, _ := run(t, dir, "sample.gpkg", "out.osm", "--overwrite", "--where", "1; DROP TABLE roads"); code != exitInvalid {
+		t.Errorf("--overwrite: exited with %d, want %d", code, exitInvalid)
+	}
+	if data, _ := os.ReadFile(filepath.Join(dir, "out.osm")); string(data) != "previous conversion" {
+		t.Error("the existing file was replaced")
+	}
+
+	if code, log := run(t, dir, "sample.gpkg", "-", "--where", "fid = 1"); code != 0 {
+		t.Errorf("a good --where exited with %d:\n%s", code, log)
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/nullmonk/gpkg2osm/internal/gpkg"
+	"github.com/twpayne/go-geom"
+)
+
+// The layers of the sample, one for each way of storing tags, on top of gpkg.Schema
+const sampleLayers = `
+-- Tags as a JSON object, in a column named osm_tags with the JSON MIME type
+CREATE TABLE shops (fid INTEGER PRIMARY KEY AUTOINCREMENT, geom POINT, osm_tags TEXT);
+INSERT INTO gpkg_contents (table_name, data_type, identifier, description, min_x, min_y, max_x, max_y, srs_id)
+	VALUES ('shops', 'features', 'shops', 'Shops, tagged with an osm_tags JSON column', 13.3777, 52.5161, 13.3889, 52.5186, 4326);
+INSERT INTO gpkg_geometry_columns VALUES ('shops', 'geom', 'POINT', 4326, 0, 0);
+INSERT INTO gpkg_data_columns (table_name, column_name, name, description, mime_type)
+	VALUES ('shops', 'osm_tags', 'osm_tags', 'OSM tags of the feature as a JSON object', 'application/json');
+
+-- Each tag in a column of its own, the key is the column name and the description marks it as an OSM tag
+CREATE TABLE roads (fid INTEGER PRIMARY KEY AUTOINCREMENT, geom LINESTRING, highway TEXT, name TEXT, maxspeed INTEGER, survey_notes TEXT);
+INSERT INTO gpkg_contents (table_name, data_type, identifier, description, min_x, min_y, max_x, max_y, srs_id)
+	VALUES ('roads', 'features', 'roads', 'Roads, tagged with one column per key', 13.3757, 52.5145, 13.3925, 52.5170, 4326);
+INSERT INTO gpkg_geometry_columns VALUES ('roads', 'geom', 'LINESTRING', 4326, 0, 0);
+INSERT INTO gpkg_data_columns (table_name, column_name, name, description) VALUES
+	('roads', 'highway', 'highway', 'OSM tag'),
+	('roads', 'name', 'name', 'OSM tag'),
+	('roads', 'maxspeed', 'maxspeed', 'OSM tag'),
+	('roads', 'survey_notes', 'survey_notes', 'Not described as a tag, so it is not converted');
+
+-- Both at once: the tag columns first, then osm_tags on top
+CREATE TABLE buildings (fid INTEGER PRIMARY KEY AUTOINCREMENT, geom POLYGON, building TEXT, osm_tags TEXT);
+INSERT INTO gpkg_contents (table_name, data_type, identifier, description, min_x, min_y, max_x, max_y, srs_id)
+	VALUES ('buildings', 'features', 'buildings', 'Buildings, tagged with a column and osm_tags together', 13.3770, 52.5160, 13.3780, 52.5166, 4326);
+INSERT INTO gpkg_geometry_columns VALUES ('buildings', 'geom', 'POLYGON', 4326, 0, 0);
+INSERT INTO gpkg_data_columns (table_name, column_name, name, description, mime_type) VALUES
+	('buildings', 'building', 'building', 'OSM tag', NULL),
+	('buildings', 'osm_tags', 'osm_tags', 'OSM tags of the feature as a JSON object', 'application/json');
+`
+
+// The features of the sample, the geometry is bound to geom
+var sampleFeatures = []struct {
+	query string
+	geom  geom.T
+	args  []any
+}{
+	{"INSERT INTO shops (geom, osm_tags) VALUES (?, ?)", geom.NewPointFlat(geom.XY, []float64{13.3777, 52.5163}),
+		[]any{`{"shop": "bakery", "name": "Brot & Butter", "opening_hours": "Mo-Sa 07:00-18:00"}`}},
+	{"INSERT INTO shops (geom, osm_tags) VALUES (?, ?)", geom.NewPointFlat(geom.XY, []float64{13.3889, 52.5186}),
+		[]any{`{"shop": "books", "name": "Seitenweise"}`}},
+	{"INSERT INTO roads (geom, highway, name, maxspeed, survey_notes) VALUES (?, ?, ?, ?, ?)",
+		geom.NewLineStringFlat(geom.XY, []float64{13.3757, 52.5163, 13.3800, 52.5165, 13.3850, 52.5170}),
+		[]any{"residential", "Linden Street", 30, "resurfaced 2023"}},
+	{"INSERT INTO roads (geom, highway, name, maxspeed, survey_notes) VALUES (?, ?, ?, ?, ?)",
+		geom.NewLineStringFlat(geom.XY, []float64{13.3850, 52.5170, 13.3925, 52.5145}),
+		[]any{"service", nil, nil, nil}},
+	{"INSERT INTO buildings (geom, building, osm_tags) VALUES (?, ?, ?)",
+		geom.NewPolygonFlat(geom.XY, []float64{13.3770, 52.5160, 13.3780, 52.5160, 13.3780, 52.5166, 13.3770, 52.5166, 13.3770, 52.5160}, []int{10}),
+		[]any{"retail", `{"building:levels": "3", "addr:housenumber": "12"}`}},
+}
+
+// Write a small GeoPackage with a layer for each way of storing tags, as an example of what gpkg2osm reads
+func genSample(path string) error {
+	if _, err := os.Stat(path); err == nil {
+		return fmt.Errorf("%s already exists", path)
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(gpkg.Schema + sampleLayers); err != nil {
+		return err
+	}
+	for _, f := range sampleFeatures {
+		g, err := gpkg.Geometry(f.geom, 4326)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(f.query, append([]any{g}, f.args...)...); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"slices"
+	"sort"
+	"text/tabwriter"
+
+	"github.com/nullmonk/gpkg2osm"
+)
+
+// Print the layers of every input as an aligned table, one row per layer, for --pretty-summary. Features are
+// counted with the --where predicate, when there is one
+func printLayerTable(w io.Writer, paths []string, inputs []gpkg2osm.Input, where string) error {
+	for i, in := range inputs {
+		if i > 0 {
+			fmt.Fprintln(w)
+		}
+		fmt.Fprintf(w, summaryHeaderTemplate, paths[i])
+		names := make([]string, 0, len(in.Layers))
+		for name := range in.Layers {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, "LAYER\tGEOMETRY\tSRS\tTAG COLUMNS\tOSM_TAGS\tFEATURES")
+		for _, name := range names {
+			l := in.Layers[name]
+			l.Where = where
+			count, err := l.Count(in.DB)
+			if err != nil {
+				return fmt.Errorf("layer %s: %w", name, err)
+			}
+			osmTags := "no"
+			if slices.Contains(l.JSONTags, "osm_tags") {
+				osmTags = "yes"
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%d\t%d\t%s\t%d\n", name, l.GeometryType, l.SRS, len(l.Tags)+len(l.JSONTags), osmTags, count)
+		}
+		if err := tw.Flush(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
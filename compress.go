@@ -0,0 +1,120 @@
+package gpkg2osm
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"github.com/lc-dmx/osm-go/osmpbf/model_pb"
+	"google.golang.org/protobuf/proto"
+)
+
+// PBFUncompressed stores the PBF blocks without compression, for PBFOptions.CompressLevel
+const PBFUncompressed = -1
+
+// The level the osmpbf writer compresses every block with
+const defaultCompressLevel = zlib.BestCompression
+
+func (o *PBFOptions) check() error {
+	if o != nil && (o.CompressLevel < PBFUncompressed || o.CompressLevel > zlib.BestCompression) {
+		return fmt.Errorf("invalid pbf compression level %d", o.CompressLevel)
+	}
+	return nil
+}
+
+// The writer the osmpbf writer should write to. It always compresses at the best level and the level cannot
+// be passed to it, so for any other level the blocks it writes are decompressed and compressed again. That only
+// adds to the time the best level takes, so other levels are for the size of the output, they never save time
+func (o *PBFOptions) output(w io.Writer) io.Writer {
+	if o == nil || o.CompressLevel == 0 || o.CompressLevel == defaultCompressLevel {
+		return w
+	}
+	return &recompressWriter{w: w, level: o.CompressLevel}
+}
+
+// recompressWriter reads the blocks of a PBF stream as they are written, and writes each one out again at its
+// own compression level. Every block is inflated, and deflated again unless it is stored raw
+type recompressWriter struct {
+	w     io.Writer
+	level int // A zlib level, or PBFUncompressed for raw blocks
+	buf   []byte
+}
+
+func (r *recompressWriter) Write(p []byte) (int, error) {
+	r.buf = append(r.buf, p...)
+	for {
+		// Each block is the length of its header, the BlobHeader, then the Blob of the size in the header
+		if len(r.buf) < 4 {
+			break
+		}
+		headerEnd := 4 + int(binary.BigEndian.Uint32(r.buf))
+		if len(r.buf) < headerEnd {
+			break
+		}
+		header := &model_pb.BlobHeader{}
+		if err := proto.Unmarshal(r.buf[4:headerEnd], header); err != nil {
+			return 0, fmt.Errorf("pbf block header: %w", err)
+		}
+		end := headerEnd + int(header.GetDatasize())
+		if len(r.buf) < end {
+			break
+		}
+		if err := r.writeBlock(header, r.buf[headerEnd:end]); err != nil {
+			return 0, err
+		}
+		r.buf = r.buf[:copy(r.buf, r.buf[end:])]
+	}
+	return len(p), nil
+}
+
+func (r *recompressWriter) writeBlock(header *model_pb.BlobHeader, data []byte) error {
+	blob := &model_pb.Blob{}
+	if err := proto.Unmarshal(data, blob); err != nil {
+		return fmt.Errorf("pbf block: %w", err)
+	}
+	zr, err := zlib.NewReader(bytes.NewReader(blob.GetZlibData()))
+	if err != nil {
+		return fmt.Errorf("pbf block: %w", err)
+	}
+	raw, err := io.ReadAll(zr)
+	if err != nil {
+		return fmt.Errorf("pbf block: %w", err)
+	}
+
+	out := &model_pb.Blob{RawSize: proto.Int32(int32(len(raw)))}
+	if r.level == PBFUncompressed {
+		out.Data = &model_pb.Blob_Raw{Raw: raw}
+	} else {
+		var z bytes.Buffer
+		zw, err := zlib.NewWriterLevel(&z, r.level)
+		if err != nil {
+			return err
+		}
+		if _, err := zw.Write(raw); err != nil {
+			return err
+		}
+		if err := zw.Close(); err != nil {
+			return err
+		}
+		out.Data = &model_pb.Blob_ZlibData{ZlibData: z.Bytes()}
+	}
+	blobBytes, err := proto.Marshal(out)
+	if err != nil {
+		return err
+	}
+	header.Datasize = proto.Int32(int32(len(blobBytes)))
+	headerBytes, err := proto.Marshal(header)
+	if err != nil {
+		return err
+	}
+
+	size := binary.BigEndian.AppendUint32(nil, uint32(len(headerBytes)))
+	for _, b := range [][]byte{size, headerBytes, blobBytes} {
+		if _, err := r.w.Write(b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,75 @@
+package gpkg2osm
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/json"
+	"fmt"
+	"io"
+	"testing"
+)
+
+// Every level writes the same elements, and only the size of the file changes
+func TestCompressLevel(t *testing.T) {
+	db := gridGeoPackage(t, 30)
+	convertPBF := func(level int) []byte {
+		var buf bytes.Buffer
+		w, err := NewPBFWriter(&buf, &PBFOptions{CompressLevel: level, BlockSize: 500})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := Convert(db, w, nil); err != nil {
+			t.Fatal(err)
+		}
+		return buf.Bytes()
+	}
+
+	elements := func(data []byte) string {
+		j, err := json.Marshal(readOSM(t, data, FormatPBF))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(j)
+	}
+	best := convertPBF(0)
+	want := elements(best)
+	sizes := make(map[int]int)
+	for _, level := range []int{PBFUncompressed, zlib.BestSpeed, 6, zlib.BestCompression} {
+		data := convertPBF(level)
+		if elements(data) != want {
+			t.Errorf("level %d: the elements differ from the default level", level)
+		}
+		sizes[level] = len(data)
+	}
+	if sizes[zlib.BestCompression] != len(best) {
+		t.Errorf("level 9 wrote %d bytes, the default %d", sizes[zlib.BestCompression], len(best))
+	}
+	if sizes[PBFUncompressed] < 2*sizes[zlib.BestSpeed] {
+		t.Errorf("uncompressed blocks take %d bytes, level 1 %d", sizes[PBFUncompressed], sizes[zlib.BestSpeed])
+	}
+
+	for _, level := range []int{-2, 10} {
+		if _, err := NewPBFWriter(&bytes.Buffer{}, &PBFOptions{CompressLevel: level}); err == nil {
+			t.Errorf("level %d was accepted", level)
+		}
+	}
+}
+
+// Any level but the default one decompresses every block the PBF library wrote and compresses it again, which
+// costs time on top of the compression at the best level
+func BenchmarkCompressLevel(b *testing.B) {
+	db := gridGeoPackage(b, 50)
+	for _, level := range []int{0, zlib.BestSpeed, PBFUncompressed} {
+		b.Run(fmt.Sprintf("level=%d", level), func(b *testing.B) {
+			for b.Loop() {
+				w, err := NewPBFWriter(io.Discard, &PBFOptions{CompressLevel: level})
+				if err != nil {
+					b.Fatal(err)
+				}
+				if _, err := Convert(db, w, nil); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,327 @@
+package gpkg2osm
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+
+	"github.com/twpayne/go-geom"
+)
+
+// Straight segments per quarter circle when approximating arcs, as PostGIS does by default
+const DefaultCurveSegments = 32
+
+// The extended WKB types that approximateCurve can turn into lines and polygons
+const (
+	wkbLineString     = 2
+	wkbPolygon        = 3
+	wkbCircularString = 8
+	wkbCompoundCurve  = 9
+	wkbCurvePolygon   = 10
+	wkbMultiCurve     = 11
+	wkbMultiSurface   = 12
+)
+
+// Decode a CircularString, CompoundCurve, CurvePolygon, MultiCurve or MultiSurface, with every arc replaced by
+// segments straight lines per quarter circle. The result is the LineString, Polygon, MultiLineString or
+// MultiPolygon it approximates, in XY: OSM has no use for Z or M
+func approximateCurve(body []byte, segments int) (geom.T, error) {
+	r := &curveReader{b: body, segments: segments}
+	t, dims, err := r.header()
+	if err != nil {
+		return nil, err
+	}
+	switch t {
+	case wkbCircularString, wkbCompoundCurve:
+		flat, err := r.curve(t, dims)
+		if err != nil {
+			return nil, err
+		}
+		return geom.NewLineStringFlat(geom.XY, flat), nil
+	case wkbCurvePolygon:
+		flat, ends, err := r.surface(t, dims)
+		if err != nil {
+			return nil, err
+		}
+		return geom.NewPolygonFlat(geom.XY, flat, ends), nil
+	case wkbMultiCurve:
+		n, err := r.count()
+		if err != nil {
+			return nil, err
+		}
+		var flat []float64
+		var ends []int
+		for range n {
+			t, dims, err := r.header()
+			if err != nil {
+				return nil, err
+			}
+			part, err := r.curve(t, dims)
+			if err != nil {
+				return nil, err
+			}
+			flat = append(flat, part...)
+			ends = append(ends, len(flat))
+		}
+		return geom.NewMultiLineStringFlat(geom.XY, flat, ends), nil
+	case wkbMultiSurface:
+		n, err := r.count()
+		if err != nil {
+			return nil, err
+		}
+		var flat []float64
+		var endss [][]int
+		for range n {
+			t, dims, err := r.header()
+			if err != nil {
+				return nil, err
+			}
+			part, ends, err := r.surface(t, dims)
+			if err != nil {
+				return nil, err
+			}
+			for i := range ends {
+				ends[i] += len(flat)
+			}
+			flat = append(flat, part...)
+			endss = append(endss, ends)
+		}
+		return geom.NewMultiPolygonFlat(geom.XY, flat, endss), nil
+	}
+	return nil, fmt.Errorf("wkb type %d is not a curve", t)
+}
+
+// Whether approximateCurve can decode the WKB
+func isCurve(body []byte) bool {
+	t, ok := wkbType(body)
+	return ok && t >= wkbCircularString && t <= wkbMultiSurface
+}
+
+// The geometry type code of the WKB, without the Z and M flags
+func wkbType(body []byte) (uint32, bool) {
+	if len(body) < 5 {
+		return 0, false
+	}
+	var order binary.ByteOrder = binary.BigEndian
+	if body[0] == 1 {
+		order = binary.LittleEndian
+	}
+	// ISO WKB adds 1000/2000/3000 for Z/M/ZM, EWKB uses the high bits instead
+	return (order.Uint32(body[1:5]) & 0x0fffffff) % 1000, true
+}
+
+// curveReader reads the parts of an extended WKB geometry one after another. Every part has its own byte order
+type curveReader struct {
+	b        []byte
+	order    binary.ByteOrder
+	segments int
+}
+
+func (r *curveReader) need(n int) error {
+	if n < 0 || len(r.b) < n {
+		return fmt.Errorf("wkb: unexpected end of curve")
+	}
+	return nil
+}
+
+func (r *curveReader) uint32() (uint32, error) {
+	if err := r.need(4); err != nil {
+		return 0, err
+	}
+	v := r.order.Uint32(r.b)
+	r.b = r.b[4:]
+	return v, nil
+}
+
+// The number of parts or points that comes next. Nothing is allocated for them up front, so a bad count just
+// runs out of data
+func (r *curveReader) count() (int, error) {
+	n, err := r.uint32()
+	return int(n), err
+}
+
+// Read the byte order and type of the next part, and the number of values in each of its points
+func (r *curveReader) header() (uint32, int, error) {
+	if err := r.need(5); err != nil {
+		return 0, 0, err
+	}
+	switch r.b[0] {
+	case 0:
+		r.order = binary.BigEndian
+	case 1:
+		r.order = binary.LittleEndian
+	default:
+		return 0, 0, fmt.Errorf("wkb: invalid byte order %d", r.b[0])
+	}
+	r.b = r.b[1:]
+	raw, _ := r.uint32()
+	dims := 2
+	switch {
+	case raw&0xe0000000 != 0:
+		// EWKB flags for Z, M and an SRID before the data
+		if raw&0x80000000 != 0 {
+			dims++
+		}
+		if raw&0x40000000 != 0 {
+			dims++
+		}
+		if raw&0x20000000 != 0 {
+			if _, err := r.uint32(); err != nil {
+				return 0, 0, err
+			}
+		}
+	case (raw&0x0fffffff)/1000 == 1, (raw&0x0fffffff)/1000 == 2:
+		dims++
+	case (raw&0x0fffffff)/1000 == 3:
+		dims += 2
+	}
+	return (raw & 0x0fffffff) % 1000, dims, nil
+}
+
+// Read the XY of n points, skipping any Z and M
+func (r *curveReader) points(n, dims int) ([]float64, error) {
+	if err := r.need(n * dims * 8); err != nil {
+		return nil, err
+	}
+	flat := make([]float64, 0, 2*n)
+	for i := range n {
+		p := r.b[i*dims*8:]
+		flat = append(flat, math.Float64frombits(r.order.Uint64(p)), math.Float64frombits(r.order.Uint64(p[8:])))
+	}
+	r.b = r.b[n*dims*8:]
+	return flat, nil
+}
+
+// Read a LineString, CircularString or CompoundCurve whose header has been read, as the flat XY of its line
+func (r *curveReader) curve(t uint32, dims int) ([]float64, error) {
+	switch t {
+	case wkbLineString, wkbCircularString:
+		n, err := r.count()
+		if err != nil {
+			return nil, err
+		}
+		flat, err := r.points(n, dims)
+		if err != nil || t == wkbLineString {
+			return flat, err
+		}
+		return arcs(flat, r.segments)
+	case wkbCompoundCurve:
+		n, err := r.count()
+		if err != nil {
+			return nil, err
+		}
+		var flat []float64
+		for i := range n {
+			t, dims, err := r.header()
+			if err != nil {
+				return nil, err
+			}
+			if t != wkbLineString && t != wkbCircularString {
+				return nil, fmt.Errorf("wkb: compound curve with a part of type %d", t)
+			}
+			part, err := r.curve(t, dims)
+			if err != nil {
+				return nil, err
+			}
+			// Each part starts where the one before ended
+			if i > 0 && len(part) >= 2 {
+				part = part[2:]
+			}
+			flat = append(flat, part...)
+		}
+		return flat, nil
+	}
+	return nil, fmt.Errorf("wkb: type %d is not a curve", t)
+}
+
+// Read a Polygon or CurvePolygon whose header has been read, as the flat XY of its rings and where each ends
+func (r *curveReader) surface(t uint32, dims int) ([]float64, []int, error) {
+	if t != wkbPolygon && t != wkbCurvePolygon {
+		return nil, nil, fmt.Errorf("wkb: type %d is not a surface", t)
+	}
+	n, err := r.count()
+	if err != nil {
+		return nil, nil, err
+	}
+	var flat []float64
+	var ends []int
+	for range n {
+		// The rings of a plain Polygon have no header of their own
+		var ring []float64
+		if t == wkbPolygon {
+			m, err := r.count()
+			if err != nil {
+				return nil, nil, err
+			}
+			ring, err = r.points(m, dims)
+			if err != nil {
+				return nil, nil, err
+			}
+		} else {
+			rt, rdims, err := r.header()
+			if err != nil {
+				return nil, nil, err
+			}
+			if ring, err = r.curve(rt, rdims); err != nil {
+				return nil, nil, err
+			}
+		}
+		flat = append(flat, ring...)
+		ends = append(ends, len(flat))
+	}
+	return flat, ends, nil
+}
+
+// Replace the arcs of a circular string, each from a point through the next to the one after, with straight
+// segments. Every arc ends where the next starts
+func arcs(flat []float64, segments int) ([]float64, error) {
+	n := len(flat) / 2
+	if n == 0 {
+		return flat, nil
+	}
+	if n < 3 || n%2 == 0 {
+		return nil, fmt.Errorf("wkb: circular string with %d points", n)
+	}
+	out := []float64{flat[0], flat[1]}
+	for i := 0; i+2 < n; i += 2 {
+		p := flat[2*i : 2*i+6]
+		out = arc(out, p[0], p[1], p[2], p[3], p[4], p[5], segments)
+	}
+	return out, nil
+}
+
+// Add the points of the arc from (x0, y0) through (x1, y1) to (x2, y2) to out, after the first
+func arc(out []float64, x0, y0, x1, y1, x2, y2 float64, segments int) []float64 {
+	// Twice the signed area of the triangle, zero when the points are on a line
+	d := 2 * (x0*(y1-y2) + x1*(y2-y0) + x2*(y0-y1))
+	var cx, cy, sweep float64
+	switch {
+	case x0 == x2 && y0 == y2:
+		// A full circle, the middle point is across from the start
+		cx, cy = (x0+x1)/2, (y0+y1)/2
+		sweep = 2 * math.Pi
+	case d == 0:
+		return append(out, x1, y1, x2, y2)
+	default:
+		s0, s1, s2 := x0*x0+y0*y0, x1*x1+y1*y1, x2*x2+y2*y2
+		cx = (s0*(y1-y2) + s1*(y2-y0) + s2*(y0-y1)) / d
+		cy = (s0*(x2-x1) + s1*(x0-x2) + s2*(x1-x0)) / d
+		// Counter clockwise when the area is positive
+		a0, a2 := math.Atan2(y0-cy, x0-cx), math.Atan2(y2-cy, x2-cx)
+		sweep = a2 - a0
+		if d > 0 && sweep <= 0 {
+			sweep += 2 * math.Pi
+		} else if d < 0 && sweep >= 0 {
+			sweep -= 2 * math.Pi
+		}
+	}
+	r := math.Hypot(x0-cx, y0-cy)
+	a0 := math.Atan2(y0-cy, x0-cx)
+	steps := max(int(math.Ceil(math.Abs(sweep)/(math.Pi/2)*float64(segments))), 1)
+	for i := 1; i < steps; i++ {
+		a := a0 + sweep*float64(i)/float64(steps)
+		out = append(out, cx+r*math.Cos(a), cy+r*math.Sin(a))
+	}
+	// The end is exactly where the source says, so the next arc and closed rings join up
+	return append(out, x2, y2)
+}
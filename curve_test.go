@@ -0,0 +1,137 @@
+package gpkg2osm
+
+import (
+	"encoding/binary"
+	"math"
+	"testing"
+
+	"github.com/twpayne/go-geom"
+)
+
+// Little endian WKB of a type with a list of points, dims coordinates each
+func wkbPoints(typ uint32, dims int, coords ...float64) []byte {
+	b := binary.LittleEndian.AppendUint32([]byte{1}, typ)
+	b = binary.LittleEndian.AppendUint32(b, uint32(len(coords)/dims))
+	for _, c := range coords {
+		b = binary.LittleEndian.AppendUint64(b, math.Float64bits(c))
+	}
+	return b
+}
+
+// Little endian WKB of a type made of other geometries
+func wkbParts(typ uint32, parts ...[]byte) []byte {
+	b := binary.LittleEndian.AppendUint32([]byte{1}, typ)
+	b = binary.LittleEndian.AppendUint32(b, uint32(len(parts)))
+	for _, p := range parts {
+		b = append(b, p...)
+	}
+	return b
+}
+
+// Fail unless every point of flat is r from the center
+func checkOnCircle(t *testing.T, flat []float64, cx, cy, r float64) {
+	t.Helper()
+	for i := 0; i < len(flat); i += 2 {
+		if d := math.Hypot(flat[i]-cx, flat[i+1]-cy); math.Abs(d-r) > 1e-9 {
+			t.Errorf("point %v,%v is %v from the center, want %v", flat[i], flat[i+1], d, r)
+		}
+	}
+}
+
+func TestApproximateCurve(t *testing.T) {
+	halfCircle := wkbPoints(wkbCircularString, 2, 1, 0, 0, 1, -1, 0)
+	fullCircle := wkbPoints(wkbCircularString, 2, 1, 0, -1, 0, 1, 0)
+
+	g, err := approximateCurve(halfCircle, 8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	flat := g.(*geom.LineString).FlatCoords()
+	if len(flat) != 2*17 || flat[0] != 1 || flat[1] != 0 || flat[32] != -1 || flat[33] != 0 {
+		t.Fatalf("half circle of 8 segments per quarter = %v, want 16 segments from 1,0 to -1,0", flat)
+	}
+	checkOnCircle(t, flat, 0, 0, 1)
+	for i := 1; i < len(flat); i += 2 {
+		if flat[i] < 0 {
+			t.Errorf("the half circle goes below the middle, through %v", flat[i])
+		}
+	}
+
+	// Z and M are dropped, and so is the point where the parts of a compound curve join
+	compound := wkbParts(wkbCompoundCurve,
+		wkbPoints(wkbLineString, 2, 3, 0, 1, 0),
+		wkbPoints(1000+wkbCircularString, 3, 1, 0, 5, 0, 1, 5, -1, 0, 5),
+	)
+	g, err = approximateCurve(compound, 8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if flat := g.(*geom.LineString).FlatCoords(); len(flat) != 2*18 || flat[0] != 3 || flat[2] != 1 || flat[4] == 1 {
+		t.Errorf("compound curve = %v, want the line from 3,0 and then the half circle", flat)
+	}
+
+	// A full circle is a closed ring
+	g, err = approximateCurve(wkbParts(wkbCurvePolygon, fullCircle), 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	flat = g.(*geom.Polygon).FlatCoords()
+	if len(flat) != 2*17 || flat[0] != flat[32] || flat[1] != flat[33] {
+		t.Errorf("circle polygon of 4 segments per quarter = %v, want a closed ring of 16 segments", flat)
+	}
+	checkOnCircle(t, flat, 0, 0, 1)
+
+	// Plain polygons can be part of a multi surface as well. Their ring has no header, just the points
+	square := binary.LittleEndian.AppendUint32(binary.LittleEndian.AppendUint32([]byte{1}, wkbPolygon), 1)
+	square = append(square, wkbPoints(wkbLineString, 2, 5, 5, 6, 5, 6, 6, 5, 5)[5:]...)
+	g, err = approximateCurve(wkbParts(wkbMultiSurface, wkbParts(wkbCurvePolygon, fullCircle), square), 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mp := g.(*geom.MultiPolygon); mp.NumPolygons() != 2 || mp.Polygon(1).NumCoords() != 4 {
+		t.Errorf("multi surface = %v, want the circle and the square", mp.FlatCoords())
+	}
+
+	g, err = approximateCurve(wkbParts(wkbMultiCurve, halfCircle, wkbPoints(wkbLineString, 2, 0, 0, 1, 1)), 8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ml := g.(*geom.MultiLineString); ml.NumLineStrings() != 2 || ml.LineString(1).NumCoords() != 2 {
+		t.Errorf("multi curve = %v, want the half circle and the line", ml.FlatCoords())
+	}
+
+	for name, body := range map[string][]byte{
+		"even points":    wkbPoints(wkbCircularString, 2, 0, 0, 1, 1),
+		"polygon part":   wkbParts(wkbCompoundCurve, square),
+		"short":          halfCircle[:20],
+		"no coordinates": wkbPoints(wkbCircularString, 2, 0, 0)[:9],
+	} {
+		if g, err := approximateCurve(body, 8); err == nil {
+			t.Errorf("%s: approximateCurve = %v, want an error", name, g)
+		}
+	}
+}
+
+// Curves are skipped as unsupported, unless they are approximated
+func TestApproximateCurvesOption(t *testing.T) {
+	db := newGeoPackage(t)
+	addLayer(t, db, "roundabouts", "CURVEPOLYGON", "junction")
+	blob := binary.LittleEndian.AppendUint32([]byte{'G', 'P', 0, 1}, wgs84)
+	blob = append(blob, wkbParts(wkbCurvePolygon, wkbPoints(wkbCircularString, 2, 1, 0, -1, 0, 1, 0))...)
+	exec(t, db, "INSERT INTO roundabouts (geom, junction) VALUES (?, 'roundabout')", blob)
+
+	file, summary := convert(t, db, nil)
+	if s := summary.Layer("roundabouts"); len(file.Ways) != 0 || s.Unsupported != 1 {
+		t.Errorf("got %d ways and %d unsupported without approximating, want 0 and 1", len(file.Ways), s.Unsupported)
+	}
+	for _, tt := range []struct{ segments, nodes int }{{0, 4 * DefaultCurveSegments}, {2, 8}} {
+		file, summary = convert(t, db, &Options{ApproximateCurves: true, CurveSegments: tt.segments})
+		if len(file.Ways) != 1 || len(file.Nodes) != tt.nodes || summary.Layer("roundabouts").Mismatched != 0 {
+			t.Errorf("%d segments: got %d ways and %d nodes, want a way of %d nodes", tt.segments, len(file.Ways), len(file.Nodes), tt.nodes)
+			continue
+		}
+		if w := file.Ways[0]; w.Nodes[0].ID != w.Nodes[len(w.Nodes)-1].ID {
+			t.Errorf("%d segments: the way is not closed", tt.segments)
+		}
+	}
+}
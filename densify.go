@@ -0,0 +1,79 @@
+package gpkg2osm
+
+import (
+	"math"
+
+	"github.com/twpayne/go-geom"
+)
+
+// The mean radius of the earth in meters, for distances along its surface
+const earthRadius = 6371008.8
+
+// The great circle distance in meters between two WGS 84 longitude and latitude pairs
+func haversine(lon1, lat1, lon2, lat2 float64) float64 {
+	p1, p2 := lat1*math.Pi/180, lat2*math.Pi/180
+	dp, dl := p2-p1, (lon2-lon1)*math.Pi/180
+	a := math.Sin(dp/2)*math.Sin(dp/2) + math.Cos(p1)*math.Cos(p2)*math.Sin(dl/2)*math.Sin(dl/2)
+	return 2 * earthRadius * math.Asin(math.Min(1, math.Sqrt(a)))
+}
+
+// Add vertices to the lines and rings of a WGS 84 geometry so that no segment is longer than maxLen meters.
+// Each long segment is cut into equal pieces, in degrees: the added vertices are on the straight line between
+// the ends as it is drawn on a map, not on the great circle. Points are returned as they are
+func densify(g geom.T, maxLen float64) geom.T {
+	switch g := g.(type) {
+	case *geom.LineString:
+		flat, _ := densifyFlat(g.FlatCoords(), nil, g.Stride(), maxLen)
+		return geom.NewLineStringFlat(g.Layout(), flat)
+	case *geom.MultiLineString:
+		flat, ends := densifyFlat(g.FlatCoords(), g.Ends(), g.Stride(), maxLen)
+		return geom.NewMultiLineStringFlat(g.Layout(), flat, ends)
+	case *geom.Polygon:
+		flat, ends := densifyFlat(g.FlatCoords(), g.Ends(), g.Stride(), maxLen)
+		return geom.NewPolygonFlat(g.Layout(), flat, ends)
+	case *geom.MultiPolygon:
+		var flat []float64
+		endss := make([][]int, g.NumPolygons())
+		for i := range endss {
+			p := g.Polygon(i)
+			part, ends := densifyFlat(p.FlatCoords(), p.Ends(), p.Stride(), maxLen)
+			for j := range ends {
+				ends[j] += len(flat)
+			}
+			flat = append(flat, part...)
+			endss[i] = ends
+		}
+		return geom.NewMultiPolygonFlat(g.Layout(), flat, endss)
+	}
+	return g
+}
+
+// Densify the flat coordinates of lines that end at ends, or of a single line when ends is nil, and return
+// where the densified lines end. Z and M are interpolated along with X and Y
+func densifyFlat(flat []float64, ends []int, stride int, maxLen float64) ([]float64, []int) {
+	if ends == nil {
+		ends = []int{len(flat)}
+	}
+	out := make([]float64, 0, len(flat))
+	outEnds := make([]int, 0, len(ends))
+	start := 0
+	for _, end := range ends {
+		for i := start; i < end; i += stride {
+			if i > start {
+				a, b := flat[i-stride:i], flat[i:i+stride]
+				// Not a number for coordinates that are not, which adds nothing
+				n := math.Ceil(haversine(a[0], a[1], b[0], b[1]) / maxLen)
+				for k := 1.0; k < n; k++ {
+					t := k / n
+					for j := range stride {
+						out = append(out, a[j]+(b[j]-a[j])*t)
+					}
+				}
+			}
+			out = append(out, flat[i:i+stride]...)
+		}
+		outEnds = append(outEnds, len(out))
+		start = end
+	}
+	return out, outEnds
+}
@@ -0,0 +1,132 @@
+package gpkg2osm
+
+import (
+	"math"
+	"testing"
+
+	"github.com/twpayne/go-geom"
+)
+
+func TestHaversine(t *testing.T) {
+	for _, tt := range []struct {
+		lon1, lat1, lon2, lat2, want float64
+	}{
+		{0, 0, 0, 1, 111195},
+		{0, 0, 1, 0, 111195},
+		{0, 60, 1, 60, 55597}, // Half as far at 60°
+		{13.4, 52.5, 13.4, 52.5, 0},
+		{0, 0, 180, 0, math.Pi * earthRadius},
+	} {
+		if got := haversine(tt.lon1, tt.lat1, tt.lon2, tt.lat2); math.Abs(got-tt.want) > 1 {
+			t.Errorf("haversine(%v, %v, %v, %v) = %.0f, want %.0f", tt.lon1, tt.lat1, tt.lon2, tt.lat2, got, tt.want)
+		}
+	}
+}
+
+// Fail when a segment of the lines is longer than maxLen, or a vertex of the original ones is missing
+func checkDensified(t *testing.T, flat, orig []float64, stride int, maxLen float64) {
+	t.Helper()
+	for i := stride; i < len(flat); i += stride {
+		if d := haversine(flat[i-stride], flat[i-stride+1], flat[i], flat[i+1]); d > maxLen {
+			t.Errorf("segment %d is %.0fm, longer than %.0fm", i/stride, d, maxLen)
+		}
+	}
+	j := 0
+	for i := 0; i < len(flat) && j < len(orig); i += stride {
+		if flat[i] == orig[j] && flat[i+1] == orig[j+1] {
+			j += stride
+		}
+	}
+	if j < len(orig) {
+		t.Errorf("vertex %v is missing from %v", orig[j:j+2], flat)
+	}
+}
+
+func TestDensify(t *testing.T) {
+	t.Run("line", func(t *testing.T) {
+		// 111km, cut into 6 pieces of 18.5km
+		g := densify(line(0, 0, 1, 0), 20000).(*geom.LineString)
+		if g.NumCoords() != 7 {
+			t.Fatalf("got %d vertices, want 7: %v", g.NumCoords(), g.FlatCoords())
+		}
+		for i := range 7 {
+			if c := g.Coord(i); math.Abs(c.X()-float64(i)/6) > 1e-12 || c.Y() != 0 {
+				t.Errorf("vertex %d at %v, want %v,0", i, c, float64(i)/6)
+			}
+		}
+	})
+	t.Run("short segments", func(t *testing.T) {
+		if g := densify(line(0, 0, 0.001, 0.001, 0.002, 0), 1000); g.(*geom.LineString).NumCoords() != 3 {
+			t.Errorf("got %v, want the line as it was", g.FlatCoords())
+		}
+	})
+	t.Run("Z", func(t *testing.T) {
+		g := densify(geom.NewLineStringFlat(geom.XYZ, []float64{0, 0, 100, 0, 1, 200}), 60000).(*geom.LineString)
+		want := []float64{0, 0, 100, 0, 0.5, 150, 0, 1, 200}
+		got := g.FlatCoords()
+		if len(got) != len(want) {
+			t.Fatalf("got %v, want %v", got, want)
+		}
+		for i := range want {
+			if math.Abs(got[i]-want[i]) > 1e-9 {
+				t.Errorf("got %v, want %v", got, want)
+				break
+			}
+		}
+		if g.Layout() != geom.XYZ {
+			t.Errorf("layout %v, want XYZ", g.Layout())
+		}
+	})
+	t.Run("polygon", func(t *testing.T) {
+		outer := []float64{0, 0, 1, 0, 1, 1, 0, 1, 0, 0}
+		hole := []float64{0.4, 0.4, 0.6, 0.4, 0.6, 0.6, 0.4, 0.4}
+		g := densify(polygon(outer, hole), 10000).(*geom.Polygon)
+		if g.NumLinearRings() != 2 {
+			t.Fatalf("got %d rings, want 2", g.NumLinearRings())
+		}
+		for i, orig := range [][]float64{outer, hole} {
+			r := g.LinearRing(i).FlatCoords()
+			checkDensified(t, r, orig, 2, 10000)
+			if r[0] != r[len(r)-2] || r[1] != r[len(r)-1] {
+				t.Errorf("ring %d is not closed any more", i)
+			}
+		}
+	})
+	t.Run("multipolygon", func(t *testing.T) {
+		a := []float64{0, 0, 1, 0, 1, 1, 0, 0}
+		b := []float64{10, 0, 10.001, 0, 10.001, 0.001, 10, 0}
+		g := densify(geom.NewMultiPolygonFlat(geom.XY, append(append([]float64{}, a...), b...), [][]int{{len(a)}, {len(a) + len(b)}}), 50000).(*geom.MultiPolygon)
+		if g.NumPolygons() != 2 {
+			t.Fatalf("got %d polygons, want 2", g.NumPolygons())
+		}
+		checkDensified(t, g.Polygon(0).FlatCoords(), a, 2, 50000)
+		// Too small to need any
+		if got := g.Polygon(1).FlatCoords(); len(got) != len(b) || got[0] != 10 {
+			t.Errorf("second polygon is %v, want %v", got, b)
+		}
+	})
+	t.Run("point", func(t *testing.T) {
+		p := point(1, 2)
+		if g := densify(p, 1); g != geom.T(p) {
+			t.Errorf("got %v, want the point as it was", g)
+		}
+	})
+}
+
+func TestMaxSegmentLength(t *testing.T) {
+	db := newGeoPackage(t)
+	addLayer(t, db, "roads", "LINESTRING", "highway")
+	insert(t, db, "roads", line(0, 0, 1, 0), map[string]any{"highway": "track"})
+
+	file, _ := convert(t, db, nil)
+	if len(file.Ways) != 1 || len(file.Ways[0].Nodes) != 2 {
+		t.Fatalf("without the option: got %d ways, want one of 2 nodes", len(file.Ways))
+	}
+	file, summary := convert(t, db, &Options{MaxSegmentLength: 20000})
+	if len(file.Ways) != 1 || len(file.Ways[0].Nodes) != 7 {
+		t.Fatalf("got %d ways, want one of 7 nodes", len(file.Ways))
+	}
+	if summary.Layer("roads").Nodes != 7 {
+		t.Errorf("counted %d nodes, want 7", summary.Layer("roads").Nodes)
+	}
+}
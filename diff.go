@@ -0,0 +1,249 @@
+package gpkg2osm
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"log/slog"
+	"slices"
+
+	"github.com/paulmach/osm"
+)
+
+// ChangeCounts is the number of elements of each type in one section of a change file
+type ChangeCounts struct {
+	Nodes     int
+	Ways      int
+	Relations int
+}
+
+// DiffSummary counts what Diff wrote, along with the summaries of converting each side
+type DiffSummary struct {
+	Create, Modify, Delete ChangeCounts
+
+	Old, New *Summary
+}
+
+func (s *DiffSummary) Log() {
+	for _, c := range []struct {
+		action string
+		counts ChangeCounts
+	}{{"create", s.Create}, {"modify", s.Modify}, {"delete", s.Delete}} {
+		slog.Info("changes", "action", c.action, "nodes", c.counts.Nodes, "ways", c.counts.Ways, "relations", c.counts.Relations)
+	}
+}
+
+// Diff converts the old and the new GeoPackages and writes an OSM change file (osmChange XML) to w, with the
+// elements that were added, changed or removed between them. Applying it to the conversion of old gives the
+// conversion of new.
+//
+// Elements are matched by ID, so both sides are converted with IDFromFID and StableIDs: a feature is the same
+// feature when it has the same fid in a layer of the same name, and untagged way nodes are the same node when
+// they are at the same place. Every ID is positive, whichever way opts.IDs counts: a negative placeholder ID
+// could not be modified or deleted. Features of layers without an integer primary key cannot be matched, they
+// are counted and will mostly show up as deleted and created again. Elements the conversion marks as deleted
+// (Options.DeletedTag) count as not being there. Options.Tagged is ignored, and Options.OSMIDColumn cannot be
+// used: the real IDs could be the same as the positive ones. Both sides are held in memory
+func Diff(old, new []Input, w io.Writer, opts *Options) (*DiffSummary, error) {
+	o := Options{}
+	if opts != nil {
+		o = *opts
+	}
+	if o.OSMIDColumn != "" {
+		return nil, fmt.Errorf("an OSM ID column cannot be used for a diff, its IDs could be the same as the new ones")
+	}
+	o.IDFromFID, o.StableIDs = true, true
+	o.LayerDone, o.SkipLayers, o.Tagged = nil, nil, nil
+	ids := IDGenerator{}
+	if o.IDs != nil {
+		ids = *o.IDs
+	}
+	// Negative IDs are placeholders for elements that are not in the database yet, a change can create them but
+	// not modify or delete them. So the IDs count up instead, from the start a negative generator has
+	if ids.step <= 0 {
+		ids = IDGenerator{node: -ids.node, way: -ids.way, relation: -ids.relation, step: 1}
+	}
+
+	s := &DiffSummary{}
+	var sides [2]*elementSet
+	for i, inputs := range [][]Input{old, new} {
+		// Each side starts from the same IDs, for the layers that are counted
+		sideIDs := ids
+		o.IDs = &sideIDs
+		set := newElementSet()
+		summary, err := ConvertAll(inputs, set, &o)
+		if err != nil {
+			if i == 0 {
+				return nil, fmt.Errorf("old: %w", err)
+			}
+			return nil, fmt.Errorf("new: %w", err)
+		}
+		sides[i] = set
+		if i == 0 {
+			s.Old = summary
+		} else {
+			s.New = summary
+		}
+	}
+
+	// Not the Append methods of osm.Change, they cannot take negative IDs
+	change := &osm.Change{Version: "0.6", Generator: "gpkg2osm " + Version, Create: &osm.OSM{}, Modify: &osm.OSM{}, Delete: &osm.OSM{}}
+	before, after := sides[0], sides[1]
+	for _, n := range after.nodes {
+		if b, ok := before.node[n.ID]; !ok {
+			change.Create.Nodes = append(change.Create.Nodes, n)
+			s.Create.Nodes++
+		} else if !nodesEqual(b, n) {
+			change.Modify.Nodes = append(change.Modify.Nodes, n)
+			s.Modify.Nodes++
+		}
+	}
+	for _, wy := range after.ways {
+		if b, ok := before.way[wy.ID]; !ok {
+			change.Create.Ways = append(change.Create.Ways, wy)
+			s.Create.Ways++
+		} else if !waysEqual(b, wy) {
+			change.Modify.Ways = append(change.Modify.Ways, wy)
+			s.Modify.Ways++
+		}
+	}
+	for _, r := range after.relations {
+		if b, ok := before.relation[r.ID]; !ok {
+			change.Create.Relations = append(change.Create.Relations, r)
+			s.Create.Relations++
+		} else if !relationsEqual(b, r) {
+			change.Modify.Relations = append(change.Modify.Relations, r)
+			s.Modify.Relations++
+		}
+	}
+	for _, n := range before.nodes {
+		if _, ok := after.node[n.ID]; !ok {
+			change.Delete.Nodes = append(change.Delete.Nodes, n)
+			s.Delete.Nodes++
+		}
+	}
+	for _, wy := range before.ways {
+		if _, ok := after.way[wy.ID]; !ok {
+			change.Delete.Ways = append(change.Delete.Ways, wy)
+			s.Delete.Ways++
+		}
+	}
+	for _, r := range before.relations {
+		if _, ok := after.relation[r.ID]; !ok {
+			change.Delete.Relations = append(change.Delete.Relations, r)
+			s.Delete.Relations++
+		}
+	}
+
+	if err := writeChange(w, change); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Write the change as osmChange XML. The create and modify sections list nodes, then ways, then relations, so
+// every element comes after the ones it uses; delete is the other way around, so nothing is deleted while
+// something still uses it
+func writeChange(w io.Writer, change *osm.Change) error {
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	start := xml.StartElement{Name: xml.Name{Local: "osmChange"}, Attr: []xml.Attr{
+		{Name: xml.Name{Local: "version"}, Value: change.Version},
+		{Name: xml.Name{Local: "generator"}, Value: change.Generator},
+	}}
+	if err := enc.EncodeToken(start); err != nil {
+		return err
+	}
+	for _, section := range []struct {
+		name string
+		file *osm.OSM
+	}{{"create", change.Create}, {"modify", change.Modify}, {"delete", change.Delete}} {
+		t := xml.StartElement{Name: xml.Name{Local: section.name}}
+		if err := enc.EncodeToken(t); err != nil {
+			return err
+		}
+		elements := []any{section.file.Nodes, section.file.Ways, section.file.Relations}
+		if section.name == "delete" {
+			slices.Reverse(elements)
+		}
+		for _, e := range elements {
+			if err := enc.Encode(e); err != nil {
+				return err
+			}
+		}
+		if err := enc.EncodeToken(t.End()); err != nil {
+			return err
+		}
+	}
+	if err := enc.EncodeToken(start.End()); err != nil {
+		return err
+	}
+	if err := enc.Flush(); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\n")
+	return err
+}
+
+// elementSet is an OSMWriter that keeps the visible elements, in the order they were written and by ID
+type elementSet struct {
+	nodes     []*osm.Node
+	ways      []*osm.Way
+	relations []*osm.Relation
+
+	node     map[osm.NodeID]*osm.Node
+	way      map[osm.WayID]*osm.Way
+	relation map[osm.RelationID]*osm.Relation
+}
+
+func newElementSet() *elementSet {
+	return &elementSet{
+		node:     make(map[osm.NodeID]*osm.Node),
+		way:      make(map[osm.WayID]*osm.Way),
+		relation: make(map[osm.RelationID]*osm.Relation),
+	}
+}
+
+func (e *elementSet) Write(file *osm.OSM) error {
+	for _, n := range file.Nodes {
+		if n.Visible {
+			e.nodes = append(e.nodes, n)
+			e.node[n.ID] = n
+		}
+	}
+	for _, w := range file.Ways {
+		if w.Visible {
+			e.ways = append(e.ways, w)
+			e.way[w.ID] = w
+		}
+	}
+	for _, r := range file.Relations {
+		if r.Visible {
+			e.relations = append(e.relations, r)
+			e.relation[r.ID] = r
+		}
+	}
+	return nil
+}
+
+func (e *elementSet) Close() error {
+	return nil
+}
+
+// Elements are the same when what they say is, the metadata is not compared. Tags are always sorted
+func nodesEqual(a, b *osm.Node) bool {
+	return a.Lat == b.Lat && a.Lon == b.Lon && slices.Equal(a.Tags, b.Tags)
+}
+
+func waysEqual(a, b *osm.Way) bool {
+	return slices.Equal(a.Tags, b.Tags) && slices.EqualFunc(a.Nodes, b.Nodes, func(x, y osm.WayNode) bool { return x.ID == y.ID })
+}
+
+func relationsEqual(a, b *osm.Relation) bool {
+	return slices.Equal(a.Tags, b.Tags) && slices.EqualFunc(a.Members, b.Members, func(x, y osm.Member) bool {
+		return x.Type == y.Type && x.Ref == y.Ref && x.Role == y.Role
+	})
+}
@@ -0,0 +1,139 @@
+package gpkg2osm
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/xml"
+	"fmt"
+	"slices"
+	"testing"
+
+	"github.com/paulmach/osm"
+)
+
+// The data both sides of a diff start from: points, roads and a park with a hole, which is a relation
+func diffGeoPackage(t *testing.T) *sql.DB {
+	t.Helper()
+	db := newGeoPackage(t)
+	addLayer(t, db, "pois", "POINT", "amenity")
+	addLayer(t, db, "roads", "LINESTRING", "highway")
+	addLayer(t, db, "parks", "POLYGON", "leisure")
+	for i, amenity := range []string{"bench", "cafe", "toilets"} {
+		insert(t, db, "pois", point(float64(i), 0), map[string]any{"amenity": amenity})
+	}
+	insert(t, db, "roads", line(0, 1, 1, 1, 2, 1), map[string]any{"highway": "path"})
+	insert(t, db, "roads", line(0, 2, 1, 2), map[string]any{"highway": "track"})
+	insert(t, db, "parks", polygon([]float64{10, 0, 14, 0, 14, 4, 10, 4, 10, 0}, []float64{11, 1, 12, 1, 12, 2, 11, 1}), map[string]any{"leisure": "park"})
+	return db
+}
+
+// The elements of each type in the section of the change, in the order they are listed
+func changeSections(t *testing.T, data []byte) map[string][]string {
+	t.Helper()
+	sections := make(map[string][]string)
+	dec := xml.NewDecoder(bytes.NewReader(data))
+	var section string
+	for {
+		tok, err := dec.Token()
+		if err != nil {
+			break
+		}
+		switch tok := tok.(type) {
+		case xml.StartElement:
+			switch tok.Name.Local {
+			case "create", "modify", "delete":
+				section = tok.Name.Local
+			case "node", "way", "relation":
+				sections[section] = append(sections[section], tok.Name.Local)
+			}
+		}
+	}
+	return sections
+}
+
+// The tags and nodes or members of each element by type and ID, to compare whole files
+func elementsByID(file *osm.OSM) map[string]string {
+	m := make(map[string]string)
+	for _, n := range file.Nodes {
+		m[fmt.Sprint("node/", n.ID)] = fmt.Sprint(n.Lon, n.Lat, n.Tags)
+	}
+	for _, w := range file.Ways {
+		m[fmt.Sprint("way/", w.ID)] = fmt.Sprint(w.Nodes.NodeIDs(), w.Tags)
+	}
+	for _, r := range file.Relations {
+		m[fmt.Sprint("relation/", r.ID)] = fmt.Sprintf("%v %v", r.Members, r.Tags)
+	}
+	return m
+}
+
+// A feature added, one changed and some removed. Applying the change to the conversion of the old data gives the
+// conversion of the new one, every ID is positive, and deletes come relations first
+func TestDiff(t *testing.T) {
+	old, new := diffGeoPackage(t), diffGeoPackage(t)
+	exec(t, new, "UPDATE pois SET amenity = 'restaurant' WHERE amenity = 'cafe'")
+	exec(t, new, "DELETE FROM pois WHERE amenity = 'toilets'")
+	exec(t, new, "DELETE FROM roads WHERE highway = 'track'")
+	exec(t, new, "DELETE FROM parks")
+	insert(t, new, "pois", point(5, 5), map[string]any{"amenity": "shelter"})
+
+	ids, err := NewIDGenerator(IDsNegative, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	s, err := Diff([]Input{{DB: old}}, []Input{{DB: new}}, &buf, &Options{IDs: ids})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := DiffSummary{
+		Create: ChangeCounts{Nodes: 1},
+		Modify: ChangeCounts{Nodes: 1},
+		// The toilets, the track and its 2 nodes, the park's 7 nodes, its 2 rings and its relation
+		Delete: ChangeCounts{Nodes: 10, Ways: 3, Relations: 1},
+	}
+	if s.Create != want.Create || s.Modify != want.Modify || s.Delete != want.Delete {
+		t.Errorf("summary create %+v, modify %+v, delete %+v, want %+v, %+v, %+v", s.Create, s.Modify, s.Delete, want.Create, want.Modify, want.Delete)
+	}
+
+	sections := changeSections(t, buf.Bytes())
+	if got := slices.Compact(slices.Clone(sections["delete"])); !slices.Equal(got, []string{"relation", "way", "node"}) {
+		t.Errorf("deletes are in the order %v, want relations, ways and then nodes", got)
+	}
+
+	change := &osm.Change{}
+	if err := xml.Unmarshal(buf.Bytes(), change); err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range []*osm.OSM{change.Create, change.Modify, change.Delete} {
+		for typ, ids := range elementIDs(file) {
+			for _, id := range ids {
+				if id <= 0 {
+					t.Errorf("%s/%d is in the change, IDs must be positive", typ, id)
+				}
+			}
+		}
+	}
+
+	// What the change is applied to must have the same IDs
+	opts := func() *Options {
+		ids, err := NewIDGenerator(IDsPositive, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return &Options{IDs: ids, IDFromFID: true, StableIDs: true}
+	}
+	before, _ := convert(t, old, opts())
+	after, _ := convert(t, new, opts())
+	applied := elementsByID(before)
+	for id := range elementsByID(change.Delete) {
+		delete(applied, id)
+	}
+	for _, file := range []*osm.OSM{change.Create, change.Modify} {
+		for id, e := range elementsByID(file) {
+			applied[id] = e
+		}
+	}
+	if got, want := fmt.Sprint(applied), fmt.Sprint(elementsByID(after)); got != want {
+		t.Errorf("the old conversion with the change applied is\n%s\nwant\n%s", got, want)
+	}
+}
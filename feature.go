@@ -0,0 +1,459 @@
+package gpkg2osm
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/paulmach/osm"
+	"github.com/twpayne/go-geom"
+)
+
+// This is all the data that gets written to the xml
+type Feature struct {
+	Layer *ExportLayer
+	FID   *int64 // Primary key of the row, nil if the layer has none
+	OSMID *OSMID // The OSM element the row was made from, nil unless the layer has an OSMIDColumn with a value
+	Tags  map[string]any
+	G     geom.T
+	SRS   int32 // srs_id of the geometry, from its header or the layer when the header does not say
+
+	Conflicts []*TagConflictError // Keys that more than one tag column set, with different values
+
+	Deleted bool // Written with visible=false, see Options.DeletedTag
+}
+
+// OSMTags converts the feature tags into OSM tags, coercing every value to a string.
+// Nested objects are flattened into colon joined keys ({"addr":{"city":"X"}} becomes addr:city=X).
+// Tags are sorted by key so the output is reproducible
+func (f *Feature) OSMTags() osm.Tags {
+	if tags, ok := stringTags(f.Tags); ok {
+		return tags
+	}
+	return coercedTags(f.Tags)
+}
+
+// The general case of OSMTags, for values of any JSON type
+func coercedTags(values map[string]any) osm.Tags {
+	m := newTagMerger(nil, false)
+	m.addAll("osm_tags", values)
+	tags := make(osm.Tags, 0, len(m.tags))
+	for k, v := range m.tags {
+		tags = append(tags, osm.Tag{Key: k, Value: tagValue(v)})
+	}
+	tags.SortByKeyValue()
+	return tags
+}
+
+// The usual case of tags that are all strings already, which need no flattening or coercion. Returns false as
+// soon as a value is anything else
+func stringTags(m map[string]any) (osm.Tags, bool) {
+	tags := make(osm.Tags, 0, len(m))
+	for k, v := range m {
+		s, ok := v.(string)
+		if !ok {
+			return nil, false
+		}
+		tags = append(tags, osm.Tag{Key: k, Value: s})
+	}
+	tags.SortByKeyValue()
+	return tags, true
+}
+
+// Create Ways, Nodes, and Relations for the features. Everything is visible unless the feature is Deleted, then
+// its tagged nodes, its ways and its relations are not. Untagged way nodes stay visible either way, other ways
+// may share them
+func (f *Feature) AppendToOSM(file *osm.OSM, b *Builder) error {
+	nodes, ways, relations := len(file.Nodes), len(file.Ways), len(file.Relations)
+	if err := f.appendElements(file, b); err != nil {
+		return err
+	}
+	if f.Deleted {
+		for _, n := range file.Nodes[nodes:] {
+			n.Visible = len(n.Tags) == 0
+		}
+		for _, w := range file.Ways[ways:] {
+			w.Visible = false
+		}
+		for _, r := range file.Relations[relations:] {
+			r.Visible = false
+		}
+	}
+	return nil
+}
+
+// The node of a point of the feature. A deleted point is never merged into ways, they would use a node that is
+// not there
+func (f *Feature) pointNode(b *Builder, c geom.Coord) *osm.Node {
+	if f.Deleted {
+		return b.featureNode(c)
+	}
+	return b.pointNode(c)
+}
+
+// The tags of the node of a point, with an ele tag from its Z for Options.EleFromZ. An ele tag of the feature's
+// own wins
+func (f *Feature) pointTags(b *Builder, tags osm.Tags, c geom.Coord) osm.Tags {
+	z := f.G.Layout().ZIndex()
+	if !b.Opts.EleFromZ || z < 0 || len(c) <= z || math.IsNaN(c[z]) || tags.HasTag("ele") {
+		return tags
+	}
+	tags = append(slices.Clone(tags), osm.Tag{Key: "ele", Value: strconv.FormatFloat(c[z], 'f', -1, 64)})
+	tags.SortByKeyValue()
+	return tags
+}
+
+func (f *Feature) appendElements(file *osm.OSM, b *Builder) error {
+	tags := f.OSMTags()
+	if !isPoints(f.G) && b.Opts.CenterPoints {
+		c, err := center(f.G)
+		if err != nil {
+			return fmt.Errorf("cannot find the center: %w", err)
+		}
+		n := b.featureNode(c)
+		n.Tags = tags
+		file.Nodes = append(file.Nodes, n)
+		return nil
+	}
+	switch g := f.G.(type) {
+	case *geom.Point:
+		n := f.pointNode(b, g.Coords())
+		n.Tags = f.pointTags(b, tags, g.Coords())
+		file.Nodes = append(file.Nodes, n)
+	case *geom.MultiPoint:
+		// A node for each point, all with the feature's tags. OSM has no use for a relation grouping them. WKB
+		// has no empty point, writers use NaN coordinates for the empty members instead
+		var n int
+		for i := 0; i < g.NumPoints(); i++ {
+			if p := g.Point(i); !p.Empty() && !math.IsNaN(p.X()) && !math.IsNaN(p.Y()) {
+				node := f.pointNode(b, p.Coords())
+				node.Tags = f.pointTags(b, tags, p.Coords())
+				file.Nodes = append(file.Nodes, node)
+				n++
+			}
+		}
+		if n == 0 {
+			return fmt.Errorf("multipoint has no points")
+		}
+	case *geom.LineString:
+		if b.Opts.ClosedLinesAsAreas && isClosed(g) {
+			p, err := geom.NewPolygon(g.Layout()).SetCoords([][]geom.Coord{g.Coords()})
+			if err != nil {
+				return err
+			}
+			b.polygon(file, tags, p)
+			break
+		}
+		for _, w := range b.ways(file, g.Coords()) {
+			w.Tags = tags
+		}
+	case *geom.MultiLineString:
+		if b.Opts.LineRelationType != "" {
+			b.lineRelation(file, b.Opts.LineRelationType, tags, g)
+			break
+		}
+		for i := 0; i < g.NumLineStrings(); i++ {
+			for _, w := range b.ways(file, g.LineString(i).Coords()) {
+				w.Tags = tags
+			}
+		}
+	case *geom.Polygon:
+		b.polygon(file, tags, g)
+	case *geom.MultiPolygon:
+		polys := make([]*geom.Polygon, g.NumPolygons())
+		for i := range polys {
+			polys[i] = g.Polygon(i)
+		}
+		if b.Opts.SplitMultiPolygons {
+			for _, p := range polys {
+				b.polygon(file, tags, p)
+			}
+			break
+		}
+		b.multipolygon(file, tags, polys...)
+	default:
+		return fmt.Errorf("unsupported geometry: %T", f.G)
+	}
+	return nil
+}
+
+// Points are already nodes, they have no center to find
+func isPoints(g geom.T) bool {
+	switch g.(type) {
+	case *geom.Point, *geom.MultiPoint:
+		return true
+	}
+	return false
+}
+
+// A line that ends where it starts, with enough points to go around something
+func isClosed(l *geom.LineString) bool {
+	n := l.NumCoords()
+	return n >= 4 && l.Coord(0).Equal(l.Layout(), l.Coord(n-1))
+}
+
+// Convert a JSON tag value to the string OSM expects
+func tagValue(v any) string {
+	switch v := v.(type) {
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case bool:
+		if v {
+			return "yes"
+		}
+		return "no"
+	case []any:
+		// OSM uses ; to seperate multiple values
+		vals := make([]string, len(v))
+		for i := range v {
+			vals[i] = tagValue(v[i])
+		}
+		return strings.Join(vals, ";")
+	}
+	b, _ := json.Marshal(v)
+	return string(b)
+}
+
+// readError is returned when a layer fails part way through reading it, which means the file is damaged. Unlike a
+// query that cannot start, the features read so far are not the whole layer
+type readError struct {
+	Table string
+	Err   error
+}
+
+func (e *readError) Error() string {
+	return fmt.Sprintf("reading layer %s: %v", e.Table, e.Err)
+}
+
+func (e *readError) Unwrap() error {
+	return e.Err
+}
+
+// A row of a layer as it was scanned, before its tags and geometry are parsed. Rows that are already known to
+// be skipped have the reason set
+type row struct {
+	fid    *int64
+	osmID  *OSMID
+	geo    []byte
+	cols   [][]byte
+	reason string
+	err    error
+}
+
+// The feature a row became, or why it was skipped
+type decoded struct {
+	f      *Feature
+	fid    *int64
+	reason string
+	err    error
+}
+
+// Times a layer is read again when another process has the database locked, waiting busyBackoff before the
+// first and twice as long before each one after. This is on top of the busy timeout of the connection
+const busyRetries = 5
+
+var busyBackoff = 100 * time.Millisecond
+
+// Get each feaeture from the given DB and layer. Extract all the OSM tags that we need.
+// Rows that cannot be used are counted in the layer summary, and passed to skip. With more than one thread the
+// rows are parsed by that many goroutines while the next are read, the results are the same
+func getResults(db queryer, layer *ExportLayer, ls *LayerSummary, skip skipper, threads int) ([]*Feature, error) {
+	wait := busyBackoff
+	for try := 1; ; try++ {
+		res, read, err := readResults(db, layer, ls, skip, threads)
+		// Before the first row nothing has been counted or skipped yet, so the layer can start over
+		if err == nil || read > 0 || !isBusy(err) {
+			return res, err
+		}
+		if try > busyRetries {
+			return nil, fmt.Errorf("layer %s: the database is locked by another process, gave up after %d tries: %w", layer.Name, try, err)
+		}
+		slog.Warn("database is locked, trying again", "table", layer.Name, "wait", wait, "err", err)
+		time.Sleep(wait)
+		wait *= 2
+	}
+}
+
+// Read the layer once, see getResults. Also returns the number of rows that were read
+func readResults(db queryer, layer *ExportLayer, ls *LayerSummary, skip skipper, threads int) ([]*Feature, int, error) {
+	rows, err := db.QueryContext(context.Background(), layer.Query())
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+	slog.Debug("reading layer", "table", layer.Name, "query", layer.Query())
+
+	sources := layer.tagSources()
+	var res []*Feature
+	var read int
+	if threads > 1 {
+		res, read = decodeRows(rows, layer, sources, ls, skip, threads)
+	} else {
+		res = make([]*Feature, 0, 100)
+		for rows.Next() {
+			res = addResult(res, layer.decodeRow(sources, layer.scanRow(rows, len(sources))), ls, skip)
+			read++
+		}
+	}
+	// Next stops at the first error too, without this a read error part way through looks like the end of the layer
+	if err := rows.Err(); err != nil {
+		return nil, read, &readError{Table: layer.Name, Err: err}
+	}
+	return res, read, nil
+}
+
+// Whether the error is SQLITE_BUSY or SQLITE_LOCKED, a lock held by another connection. Told by the message, so
+// any sqlite driver will do
+func isBusy(err error) bool {
+	msg := err.Error()
+	for _, s := range []string{"database is locked", "database table is locked", "SQLITE_BUSY", "SQLITE_LOCKED"} {
+		if strings.Contains(msg, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// Scan the current row, with one tag column for each source
+func (l *ExportLayer) scanRow(rows *sql.Rows, sources int) row {
+	var geo sql.Null[[]byte]
+	var fid sql.NullInt64
+	var osmID, version sql.NullString
+	// Scanned as bytes, as some tools store the JSON as a BLOB rather than TEXT. NULL is left as nil
+	cols := make([][]byte, sources)
+	dest := []any{&geo}
+	if l.FIDColumn != "" {
+		dest = append(dest, &fid)
+	}
+	if l.OSMIDColumn != "" {
+		dest = append(dest, &osmID)
+	}
+	if l.VersionColumn != "" {
+		dest = append(dest, &version)
+	}
+	for i := range cols {
+		dest = append(dest, &cols[i])
+	}
+
+	if err := rows.Scan(dest...); err != nil {
+		slog.Warn("bad scan for row", "table", l.Name, "err", err)
+		return row{reason: SkipScan, err: err}
+	}
+	r := row{geo: geo.V, cols: cols}
+	if fid.Valid {
+		r.fid = &fid.Int64
+	}
+	// A bad ID only costs the feature its real ID, it is converted all the same
+	if osmID.Valid && strings.TrimSpace(osmID.String) != "" {
+		if id, err := parseOSMID(osmID.String); err != nil {
+			slog.Warn("bad OSM ID, the feature gets a new one", "table", l.Name, "column", l.OSMIDColumn, "err", err)
+		} else {
+			// A version that is not a number is as good as none
+			id.Version, _ = strconv.Atoi(strings.TrimSpace(version.String))
+			r.osmID = &id
+		}
+	}
+
+	// NULL is allowed by the spec for features without a location, a zero-length blob is not a geometry at all
+	if !geo.Valid {
+		slog.Debug("skipping feature with a NULL geometry", "table", l.Name)
+		r.reason = SkipNullGeometry
+	} else if len(geo.V) == 0 {
+		slog.Warn("bad row", "table", l.Name, "err", "zero-length geometry blob")
+		r.reason = SkipNoGeometry
+	}
+	return r
+}
+
+// Parse the tags and the geometry of a row. This only reads the layer, so rows can be decoded at the same time
+func (l *ExportLayer) decodeRow(sources []string, r row) decoded {
+	if r.reason != "" {
+		return decoded{fid: r.fid, reason: r.reason, err: r.err}
+	}
+	g := &Feature{FID: r.fid, OSMID: r.osmID}
+
+	// Merge the tag columns in order, noting every key that a later column overrides
+	m := newTagMerger(l.ValueMap, l.LowercaseKeys)
+	for i, c := range r.cols {
+		// A NULL or empty column has no tags, the feature is still read and Convert decides what to do
+		// with it when no column has any
+		c = bytes.TrimPrefix(c, []byte("\xef\xbb\xbf")) // A UTF-8 BOM is not valid JSON
+		if len(bytes.TrimSpace(c)) == 0 {
+			continue
+		}
+		source := sources[i]
+		if source == relatedSource {
+			source = l.Related.Table
+		}
+		tags, err := parseTagsJSON(c)
+		if err != nil {
+			slog.Warn("bad tags json", "table", l.Name, "column", source, "err", err, "data", string(c))
+			return decoded{fid: g.FID, reason: SkipTagsJSON, err: fmt.Errorf("column %s: %w", source, err)}
+		}
+		if sources[i] == "" {
+			// The descriptive columns, each key is its own column. A NULL column has no tag, rather than
+			// removing the one from the related table
+			for _, col := range l.Tags {
+				if v := tags[col]; v != nil {
+					m.add(col, l.tagKey(col), v)
+				}
+			}
+			continue
+		}
+		m.addAll(source, tags)
+	}
+	g.Tags = m.tags
+	g.Conflicts = m.conflicts
+
+	var err error
+	g.G, g.SRS, err = parseGpkgGeom(r.geo, l.CurveSegments)
+	if g.SRS == 0 {
+		g.SRS = l.SRS
+	}
+	if err != nil {
+		if errors.Is(err, ErrEmptyGeometry) {
+			slog.Debug("skipping feature with an empty geometry", "table", l.Name)
+			return decoded{fid: g.FID, reason: SkipEmptyGeometry}
+		}
+		reason := SkipGeometry
+		var unsupported *UnsupportedGeometryError
+		if errors.As(err, &unsupported) {
+			reason = SkipUnsupportedGeometry
+		}
+		slog.Warn("bad geo data", "table", l.Name, "err", err)
+		return decoded{fid: g.FID, reason: reason, err: err}
+	}
+	g.Layer = l
+	return decoded{f: g, fid: g.FID}
+}
+
+// Keep the feature of a decoded row, or count why it was skipped. Rows must be added in order, and only from
+// one goroutine at a time
+func addResult(res []*Feature, d decoded, ls *LayerSummary, skip skipper) []*Feature {
+	if d.f != nil {
+		return append(res, d.f)
+	}
+	switch d.reason {
+	case SkipNullGeometry:
+		ls.Null++
+	case SkipNoGeometry:
+		ls.NoData++
+	case SkipUnsupportedGeometry:
+		ls.Unsupported++
+	case SkipEmptyGeometry:
+		ls.Empty++
+	}
+	skip.skip(ls, d.fid, d.reason, d.err)
+	return res
+}
@@ -0,0 +1,363 @@
+package gpkg2osm
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nullmonk/gpkg2osm/internal/gpkg"
+	"github.com/paulmach/osm"
+	"github.com/twpayne/go-geom"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+func TestPointTagsOnNode(t *testing.T) {
+	db := newGeoPackage(t)
+	addLayer(t, db, "pois", "POINT", "amenity", "name")
+	insert(t, db, "pois", point(13.4, 52.5), map[string]any{"amenity": "cafe", "name": "Kaffee"})
+
+	file, _ := convert(t, db, nil)
+	if len(file.Nodes) != 1 || len(file.Ways) != 0 || len(file.Relations) != 0 {
+		t.Fatalf("got %d nodes, %d ways, %d relations, want a single node", len(file.Nodes), len(file.Ways), len(file.Relations))
+	}
+	n := file.Nodes[0]
+	if n.Lon != 13.4 || n.Lat != 52.5 {
+		t.Errorf("node at %v,%v, want 13.4,52.5", n.Lon, n.Lat)
+	}
+	checkTags(t, n.Tags, "amenity", "cafe", "name", "Kaffee")
+}
+
+// Tags come out sorted by key whatever order the map gives them in, so the same input gives the same bytes.
+// Run with -update to rewrite testdata/sorted_tags.osm
+func TestSortedTags(t *testing.T) {
+	db := newGeoPackage(t)
+	addLayer(t, db, "pois", "POINT", "wheelchair", "name", "cuisine", "amenity", "opening_hours")
+	addLayer(t, db, "parks", "POLYGON", "name", "leisure", "access")
+	insert(t, db, "pois", point(1, 2), map[string]any{
+		"amenity": "cafe", "cuisine": "coffee", "name": "A", "opening_hours": "24/7", "wheelchair": "yes",
+	})
+	insert(t, db, "parks", polygon([]float64{0, 0, 1, 0, 1, 1, 0, 0}), map[string]any{
+		"access": "yes", "leisure": "park", "name": "B",
+	})
+
+	golden := filepath.Join("testdata", "sorted_tags.osm")
+	got, _ := convertTo(t, db, FormatXML, nil)
+	for range 5 {
+		if again, _ := convertTo(t, db, FormatXML, nil); !bytes.Equal(again, got) {
+			t.Fatalf("converting the same input again gave different bytes:\n%s\nthen\n%s", got, again)
+		}
+	}
+	// The PBF string table is built in the order tags are seen
+	pbf, _ := convertTo(t, db, FormatPBF, nil)
+	if again, _ := convertTo(t, db, FormatPBF, nil); !bytes.Equal(again, pbf) {
+		t.Error("converting the same input to PBF again gave different bytes")
+	}
+
+	if *update {
+		if err := os.WriteFile(golden, got, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want, err := os.ReadFile(golden)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("output differs from %s:\n%s", golden, got)
+	}
+}
+
+func TestCenterPoints(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		gtype    string
+		g        geom.T
+		lon, lat float64
+	}{
+		{"square", "POLYGON", polygon([]float64{0, 0, 2, 0, 2, 2, 0, 2, 0, 0}), 1, 1},
+		// The centroid is weighted by area, not the average of the vertices
+		{"L shape", "POLYGON", polygon([]float64{0, 0, 3, 0, 3, 1, 1, 1, 1, 3, 0, 3, 0, 0}), 1.1, 1.1},
+		// Halfway along the line, which is the vertex here
+		{"bent line", "LINESTRING", line(0, 0, 2, 0, 2, 2), 2, 0},
+		{"line", "LINESTRING", line(0, 0, 4, 0, 4, 1), 2.5, 0},
+		{"multiline", "MULTILINESTRING", geom.NewMultiLineStringFlat(geom.XY, []float64{0, 0, 1, 0, 5, 5, 5, 9}, []int{4, 8}), 5, 7},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			db := newGeoPackage(t)
+			addLayer(t, db, "things", tt.gtype, "name")
+			insert(t, db, "things", tt.g, map[string]any{"name": tt.name})
+
+			file, _ := convert(t, db, &Options{CenterPoints: true})
+			if len(file.Nodes) != 1 || len(file.Ways) != 0 || len(file.Relations) != 0 {
+				t.Fatalf("got %d nodes, %d ways and %d relations, want a single node", len(file.Nodes), len(file.Ways), len(file.Relations))
+			}
+			n := file.Nodes[0]
+			if math.Abs(n.Lon-tt.lon) > 1e-7 || math.Abs(n.Lat-tt.lat) > 1e-7 {
+				t.Errorf("node at %v,%v, want %v,%v", n.Lon, n.Lat, tt.lon, tt.lat)
+			}
+			checkTags(t, n.Tags, "name", tt.name)
+		})
+	}
+}
+
+// A view whose third row fails with malformed JSON, so the query stops with an error after two rows were read
+func TestReadErrorPartWay(t *testing.T) {
+	db := newGeoPackage(t)
+	addLayer(t, db, "roads", "LINESTRING", "highway")
+	for i := range 4 {
+		insert(t, db, "roads", line(0, float64(i), 1, float64(i)), map[string]any{"highway": "path"})
+	}
+	exec(t, db, `CREATE VIEW broken AS SELECT fid, geom, CASE fid WHEN 3 THEN json('{') ELSE highway END AS highway FROM roads;
+		DELETE FROM gpkg_data_columns;
+		UPDATE gpkg_contents SET table_name = 'broken', identifier = 'broken';
+		UPDATE gpkg_geometry_columns SET table_name = 'broken';
+		INSERT INTO gpkg_data_columns (table_name, column_name, description) VALUES ('broken', 'highway', 'OSM tag')`)
+
+	layers, err := GetGeoPackageLayers(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = getResults(db, layers["broken"], &LayerSummary{}, nil, 1)
+	var re *readError
+	if !errors.As(err, &re) || re.Table != "broken" {
+		t.Errorf("getResults: err = %v, want a read error", err)
+	}
+	if _, err := Convert(db, nopWriter{}, nil); !errors.As(err, &re) {
+		t.Errorf("Convert: err = %v, want a read error", err)
+	}
+	// The same with the rows parsed in parallel
+	if _, err := Convert(db, nopWriter{}, &Options{ReadThreads: 4}); !errors.As(err, &re) {
+		t.Errorf("Convert with 4 threads: err = %v, want a read error", err)
+	}
+}
+
+// Tags that are all strings take a shortcut past the coercion, which must give the same tags
+func TestStringTags(t *testing.T) {
+	for _, m := range []map[string]any{
+		{},
+		{"amenity": "cafe"},
+		{"name": "Café", "amenity": "cafe", "addr:street": "Main Street", "opening_hours": "Mo-Fr 08:00-18:00"},
+		{"b": "2", "a": "1", "c": ""},
+	} {
+		fast, ok := stringTags(m)
+		if !ok {
+			t.Errorf("%v: not all strings", m)
+		}
+		if slow := coercedTags(m); fmt.Sprint(fast) != fmt.Sprint(slow) {
+			t.Errorf("%v: got %v, the coercion gives %v", m, fast, slow)
+		}
+	}
+	for _, m := range []map[string]any{
+		{"amenity": "cafe", "seats": 12.0},
+		{"addr": map[string]any{"city": "X"}},
+		{"wheelchair": true, "name": "A"},
+	} {
+		if _, ok := stringTags(m); ok {
+			t.Errorf("%v: all strings", m)
+		}
+	}
+}
+
+// The tags of a typical POI, all strings as most osm_tags columns hold them
+func BenchmarkOSMTags(b *testing.B) {
+	poi := map[string]any{
+		"amenity": "restaurant", "name": "Zur Letzten Instanz", "cuisine": "german", "addr:street": "Waisenstraße",
+		"addr:housenumber": "14", "addr:postcode": "10179", "addr:city": "Berlin", "opening_hours": "Mo-Sa 12:00-23:00",
+		"website": "https://example.com", "wheelchair": "limited", "outdoor_seating": "yes",
+	}
+	b.Run("strings", func(b *testing.B) {
+		for b.Loop() {
+			stringTags(poi)
+		}
+	})
+	b.Run("coerced", func(b *testing.B) {
+		for b.Loop() {
+			coercedTags(poi)
+		}
+	})
+}
+
+// Features with the DeletedTag lose it and are written with visible=false, except the untagged nodes of their
+// ways, or are left out with SkipDeleted
+func TestDeletedTag(t *testing.T) {
+	db := newGeoPackage(t)
+	addLayer(t, db, "pois", "POINT", "amenity", "osm_tags")
+	addLayer(t, db, "roads", "LINESTRING", "highway", "deleted")
+	insert(t, db, "pois", point(0, 0), map[string]any{"amenity": "bench", "osm_tags": `{"deleted": true}`})
+	insert(t, db, "pois", point(1, 0), map[string]any{"amenity": "bench", "osm_tags": `{"deleted": false}`})
+	insert(t, db, "roads", line(0, 1, 1, 1), map[string]any{"highway": "path", "deleted": "yes"})
+	insert(t, db, "roads", line(0, 2, 1, 2), map[string]any{"highway": "path"})
+	marker := osm.Tag{Key: "deleted", Value: "yes"}
+
+	file, summary := convert(t, db, &Options{DeletedTag: marker})
+	var hidden []string
+	for _, n := range file.Nodes {
+		if !n.Visible {
+			if len(n.Tags) == 0 {
+				t.Errorf("node/%d is an untagged way node, but deleted", n.ID)
+			}
+			hidden = append(hidden, "node")
+			checkTags(t, n.Tags, "amenity", "bench")
+		} else if n.Tags.Find("deleted") != "" && n.Tags.Find("deleted") != "no" {
+			t.Errorf("node/%d is visible with %v", n.ID, n.Tags)
+		}
+	}
+	for _, w := range file.Ways {
+		if !w.Visible {
+			hidden = append(hidden, "way")
+			checkTags(t, w.Tags, "highway", "path")
+		}
+	}
+	if !slices.Equal(hidden, []string{"node", "way"}) {
+		t.Errorf("deleted elements %v, want the first bench and the first road", hidden)
+	}
+	if d := summary.Total().Deleted; d != 2 {
+		t.Errorf("summary has %d deleted features, want 2", d)
+	}
+
+	file, summary = convert(t, db, &Options{DeletedTag: marker, SkipDeleted: true})
+	if len(taggedNodes(file)) != 1 || len(file.Ways) != 1 {
+		t.Errorf("got %d tagged nodes and %d ways without the deleted features, want 1 of each", len(taggedNodes(file)), len(file.Ways))
+	}
+	if s := summary.Total(); s.Deleted != 2 || s.Skipped != 0 {
+		t.Errorf("summary has %d deleted and %d skipped features, want 2 and 0", s.Deleted, s.Skipped)
+	}
+}
+
+// Reading a layer only decodes the rows into Features, the elements are built later by AppendToOSM. The
+// allocations per feature are reported, they are what a large layer costs before anything is written
+func BenchmarkGetResults(b *testing.B) {
+	db := gridGeoPackage(b, 100)
+	layers, err := GetGeoPackageLayers(db)
+	if err != nil {
+		b.Fatal(err)
+	}
+	layer := layers["row0"]
+	b.ReportAllocs()
+	var features int
+	for b.Loop() {
+		res, err := getResults(db, layer, &LayerSummary{}, nil, 1)
+		if err != nil {
+			b.Fatal(err)
+		}
+		features += len(res)
+	}
+	b.ReportMetric(float64(features)/float64(b.N), "features/op")
+}
+
+// Every kind of geometry gives the same elements as it always has. Run with -update to rewrite
+// testdata/geometries.osm
+func TestGeometriesGolden(t *testing.T) {
+	db := newGeoPackage(t)
+	addLayer(t, db, "features", "GEOMETRY", "name")
+	insert(t, db, "features", point(1, 1), map[string]any{"name": "point"})
+	insert(t, db, "features", line(0, 0, 1, 0, 2, 1), map[string]any{"name": "line"})
+	insert(t, db, "features", polygon([]float64{0, 0, 3, 0, 3, 3, 0, 3, 0, 0}), map[string]any{"name": "polygon"})
+	insert(t, db, "features", polygon(
+		[]float64{10, 0, 14, 0, 14, 4, 10, 4, 10, 0},
+		[]float64{11, 1, 12, 1, 12, 2, 11, 1},
+	), map[string]any{"name": "polygon with a hole"})
+	insert(t, db, "features", geom.NewMultiPointFlat(geom.XY, []float64{5, 5, 6, 6}), map[string]any{"name": "multipoint"})
+	insert(t, db, "features", geom.NewMultiLineStringFlat(geom.XY, []float64{0, 5, 1, 5, 0, 6, 1, 6}, []int{4, 8}), map[string]any{"name": "multilinestring"})
+	insert(t, db, "features", geom.NewMultiPolygonFlat(geom.XY,
+		[]float64{20, 0, 21, 0, 21, 1, 20, 0, 22, 0, 23, 0, 23, 1, 22, 0}, [][]int{{8}, {16}}),
+		map[string]any{"name": "multipolygon"})
+
+	golden := filepath.Join("testdata", "geometries.osm")
+	got, _ := convertTo(t, db, FormatXML, nil)
+	if *update {
+		if err := os.WriteFile(golden, got, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want, err := os.ReadFile(golden)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("output differs from %s:\n%s", golden, got)
+	}
+}
+
+// A GeoPackage on disk with one road, opened without a busy timeout so a lock fails a query at once, and a
+// connection of its own that holds the database locked until unlock is called
+func lockedGeoPackage(t *testing.T) (db *sql.DB, layer *ExportLayer, unlock func()) {
+	t.Helper()
+	file := filepath.Join(t.TempDir(), "locked.gpkg")
+	db, err := sql.Open("sqlite3", file+"?_busy_timeout=0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	exec(t, db, gpkg.Schema)
+	addLayer(t, db, "roads", "LINESTRING", "highway")
+	insert(t, db, "roads", line(0, 0, 1, 1), map[string]any{"highway": "path"})
+	layers, err := GetGeoPackageLayers(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	other, err := sql.Open("sqlite3", file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { other.Close() })
+	conn, err := other.Conn(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.ExecContext(context.Background(), "BEGIN EXCLUSIVE"); err != nil {
+		t.Fatal(err)
+	}
+	var once sync.Once
+	unlock = func() {
+		once.Do(func() {
+			conn.ExecContext(context.Background(), "COMMIT")
+			conn.Close()
+		})
+	}
+	t.Cleanup(unlock)
+	return db, layers["roads"], unlock
+}
+
+func TestBusyRetry(t *testing.T) {
+	prev := busyBackoff
+	busyBackoff = 20 * time.Millisecond
+	t.Cleanup(func() { busyBackoff = prev })
+
+	t.Run("lock released", func(t *testing.T) {
+		db, layer, unlock := lockedGeoPackage(t)
+		logs := captureLogs(t)
+		time.AfterFunc(50*time.Millisecond, unlock)
+		ls := &LayerSummary{}
+		res, err := getResults(db, layer, ls, nil, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(res) != 1 || ls.Skipped != 0 {
+			t.Errorf("got %d features and %d skipped, want 1 and none", len(res), ls.Skipped)
+		}
+		if !strings.Contains(logs.String(), "database is locked, trying again") {
+			t.Errorf("the retry was not logged:\n%s", logs)
+		}
+	})
+	t.Run("gave up", func(t *testing.T) {
+		db, layer, _ := lockedGeoPackage(t)
+		_, err := getResults(db, layer, &LayerSummary{}, nil, 4)
+		if err == nil || !isBusy(err) || !strings.Contains(err.Error(), fmt.Sprintf("gave up after %d tries", busyRetries+1)) {
+			t.Errorf("err = %v, want one that gave up", err)
+		}
+	})
+}
@@ -0,0 +1,172 @@
+package gpkg2osm
+
+import (
+	"bytes"
+	"database/sql"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/nullmonk/gpkg2osm/internal/gpkg"
+	"github.com/paulmach/osm"
+	"github.com/twpayne/go-geom"
+)
+
+// Feature level problems are logged as warnings, which would drown the test output
+func TestMain(m *testing.M) {
+	slog.SetDefault(slog.New(slog.NewTextHandler(io.Discard, nil)))
+	os.Exit(m.Run())
+}
+
+var memoryDBs atomic.Int64
+
+// A new empty GeoPackage in memory, closed when the test ends
+func newGeoPackage(t testing.TB) *sql.DB {
+	t.Helper()
+	name := fmt.Sprintf("%s-%d", strings.NewReplacer("/", "-", " ", "-").Replace(t.Name()), memoryDBs.Add(1))
+	db, err := gpkg.OpenMemory(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+// Add a feature table in EPSG:4326, see gpkg.AddLayer
+func addLayer(t testing.TB, db *sql.DB, table, geometryType string, columns ...string) {
+	t.Helper()
+	if err := gpkg.AddLayer(db, table, geometryType, wgs84, columns...); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Add a feature in EPSG:4326, see gpkg.Insert
+func insert(t testing.TB, db *sql.DB, table string, g geom.T, values map[string]any) {
+	t.Helper()
+	if err := gpkg.Insert(db, table, g, wgs84, values); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func exec(t testing.TB, db *sql.DB, query string, args ...any) {
+	t.Helper()
+	if _, err := db.Exec(query, args...); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func point(x, y float64) *geom.Point {
+	return geom.NewPointFlat(geom.XY, []float64{x, y})
+}
+
+func line(flat ...float64) *geom.LineString {
+	return geom.NewLineStringFlat(geom.XY, flat)
+}
+
+// A polygon of closed rings, the exterior first
+func polygon(rings ...[]float64) *geom.Polygon {
+	var flat []float64
+	var ends []int
+	for _, r := range rings {
+		flat = append(flat, r...)
+		ends = append(ends, len(flat))
+	}
+	return geom.NewPolygonFlat(geom.XY, flat, ends)
+}
+
+// Convert the GeoPackage to the format in memory, and return the output
+func convertTo(t testing.TB, db *sql.DB, format Format, opts *Options) ([]byte, *Summary) {
+	t.Helper()
+	var buf bytes.Buffer
+	w, err := NewWriter(&buf, format)
+	if err != nil {
+		t.Fatal(err)
+	}
+	summary, err := Convert(db, w, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes(), summary
+}
+
+// Convert the GeoPackage to XML and read back the elements that were written
+func convert(t testing.TB, db *sql.DB, opts *Options) (*osm.OSM, *Summary) {
+	t.Helper()
+	data, summary := convertTo(t, db, FormatXML, opts)
+	return readOSM(t, data, FormatXML), summary
+}
+
+func readOSM(t testing.TB, data []byte, format Format) *osm.OSM {
+	t.Helper()
+	file := &osm.OSM{}
+	s := NewScanner(bytes.NewReader(data), format)
+	for s.Scan() {
+		switch o := s.Object().(type) {
+		case *osm.Node:
+			file.Nodes = append(file.Nodes, o)
+		case *osm.Way:
+			file.Ways = append(file.Ways, o)
+		case *osm.Relation:
+			file.Relations = append(file.Relations, o)
+		}
+	}
+	if err := s.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+// The nodes that have tags, which are the ones that stand for point features
+func taggedNodes(file *osm.OSM) osm.Nodes {
+	var nodes osm.Nodes
+	for _, n := range file.Nodes {
+		if len(n.Tags) > 0 {
+			nodes = append(nodes, n)
+		}
+	}
+	return nodes
+}
+
+// Fail unless the tags are exactly the ones given, as key, value pairs
+func checkTags(t testing.TB, tags osm.Tags, want ...string) {
+	t.Helper()
+	w := make(osm.Tags, 0, len(want)/2)
+	for i := 0; i+1 < len(want); i += 2 {
+		w = append(w, osm.Tag{Key: want[i], Value: want[i+1]})
+	}
+	w.SortByKeyValue()
+	got := append(osm.Tags(nil), tags...)
+	got.SortByKeyValue()
+	if fmt.Sprint(got) != fmt.Sprint(w) {
+		t.Errorf("tags = %v, want %v", got, w)
+	}
+}
+
+// The IDs of the elements of each type, in the order they were written
+func elementIDs(file *osm.OSM) map[osm.Type][]int64 {
+	ids := make(map[osm.Type][]int64)
+	for _, n := range file.Nodes {
+		ids[osm.TypeNode] = append(ids[osm.TypeNode], int64(n.ID))
+	}
+	for _, w := range file.Ways {
+		ids[osm.TypeWay] = append(ids[osm.TypeWay], int64(w.ID))
+	}
+	for _, r := range file.Relations {
+		ids[osm.TypeRelation] = append(ids[osm.TypeRelation], int64(r.ID))
+	}
+	return ids
+}
+
+// Record everything that is logged until the test ends, as text
+func captureLogs(t testing.TB) *bytes.Buffer {
+	t.Helper()
+	var buf bytes.Buffer
+	prev := slog.Default()
+	slog.SetDefault(slog.New(slog.NewTextHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug})))
+	t.Cleanup(func() { slog.SetDefault(prev) })
+	return &buf
+}
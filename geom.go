@@ -0,0 +1,123 @@
+package gpkg2osm
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/twpayne/go-geom"
+	"github.com/twpayne/go-geom/encoding/wkb"
+)
+
+// Parse the encode geometry from a gpkg, returning it with the srs_id from its header. With curveSegments
+// above 0, curves are approximated with that many segments per quarter circle, otherwise they are unsupported
+func parseGpkgGeom(data []byte, curveSegments int) (geom.T, int32, error) {
+	if len(data) < 8 {
+		return nil, 0, fmt.Errorf("bad header: %d bytes is too short", len(data))
+	}
+	if data[0] != 'G' || data[1] != 'P' {
+		return nil, 0, fmt.Errorf("bad header")
+	}
+	// Only version 0 (GeoPackage 1.0 and later) is defined, the flags and envelope of any other could mean
+	// something else entirely
+	// https://www.geopackage.org/spec/#gpb_format
+	if data[2] != 0 {
+		return nil, 0, fmt.Errorf("unsupported geometry header version %d", data[2])
+	}
+	env_size := 0
+	switch (data[3] >> 1) & 0b111 {
+	case 0:
+		// No envelope, common for points
+	case 1:
+		env_size = 32
+	case 2, 3:
+		env_size = 48
+	case 4:
+		env_size = 64
+	default:
+		return nil, 0, fmt.Errorf("invalid envelope type: %d", (data[3]>>1)&0b111)
+	}
+	var order binary.ByteOrder = binary.BigEndian
+	if data[3]&1 == 1 {
+		order = binary.LittleEndian
+	}
+	srsID := int32(order.Uint32(data[4:8]))
+	// An empty geometry may have no WKB at all (or NaN coordinates, for points), either way there is nothing
+	// to convert
+	if data[3]&0b10000 != 0 {
+		return nil, srsID, ErrEmptyGeometry
+	}
+	if len(data) < 8+env_size {
+		return nil, 0, fmt.Errorf("bad header: envelope type %d does not fit in %d bytes", (data[3]>>1)&0b111, len(data))
+	}
+	// skip envelope
+	body := data[8+env_size:]
+	if curveSegments > 0 && isCurve(body) {
+		g, err := approximateCurve(body, curveSegments)
+		return g, srsID, err
+	}
+	if err := checkExtendedType(body); err != nil {
+		return nil, 0, err
+	}
+	g, err := wkb.Unmarshal(body)
+	return g, srsID, err
+}
+
+// ErrEmptyGeometry is returned for geometries with the empty flag set in their header
+var ErrEmptyGeometry = errors.New("empty geometry")
+
+// WKB geometry type codes that GeoPackage allows, but go-geom cannot decode
+var extendedGeomTypes = map[uint32]string{
+	8:  "CircularString",
+	9:  "CompoundCurve",
+	10: "CurvePolygon",
+	11: "MultiCurve",
+	12: "MultiSurface",
+	13: "Curve",
+	14: "Surface",
+	15: "PolyhedralSurface",
+	16: "TIN",
+	17: "Triangle",
+}
+
+// UnsupportedGeometryError is returned for geometries that are valid in a GeoPackage but cannot be converted
+type UnsupportedGeometryError struct {
+	Type string
+}
+
+func (e *UnsupportedGeometryError) Error() string {
+	return "unsupported extended geometry: " + e.Type
+}
+
+// Look at the WKB type code before decoding, so curves get a clear error instead of a decoder failure
+func checkExtendedType(body []byte) error {
+	t, ok := wkbType(body)
+	if !ok {
+		return nil // let wkb report it
+	}
+	if name, ok := extendedGeomTypes[t]; ok {
+		return &UnsupportedGeometryError{Type: name}
+	}
+	return nil
+}
+
+// The GeoPackage name of a decoded geometry's type, as used in gpkg_geometry_columns
+func geomTypeName(g geom.T) string {
+	switch g.(type) {
+	case *geom.Point:
+		return "POINT"
+	case *geom.LineString:
+		return "LINESTRING"
+	case *geom.Polygon:
+		return "POLYGON"
+	case *geom.MultiPoint:
+		return "MULTIPOINT"
+	case *geom.MultiLineString:
+		return "MULTILINESTRING"
+	case *geom.MultiPolygon:
+		return "MULTIPOLYGON"
+	case *geom.GeometryCollection:
+		return "GEOMETRYCOLLECTION"
+	}
+	return fmt.Sprintf("%T", g)
+}
@@ -0,0 +1,233 @@
+package gpkg2osm
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/nullmonk/gpkg2osm/internal/gpkg"
+	"github.com/twpayne/go-geom"
+)
+
+// A GeoPackage geometry blob of an extended WKB type, which go-geom cannot encode. Curves have the layout of a
+// LineString, the number of points and then their coordinates, dims of them per point
+func extendedBlob(order binary.AppendByteOrder, wkbType uint32, dims int, coords ...float64) []byte {
+	var flag byte
+	if order == binary.LittleEndian {
+		flag = 1
+	}
+	b := order.AppendUint32([]byte{'G', 'P', 0, flag}, 4326)
+	b = order.AppendUint32(append(b, flag), wkbType)
+	b = order.AppendUint32(b, uint32(len(coords)/dims))
+	for _, c := range coords {
+		b = order.AppendUint64(b, math.Float64bits(c))
+	}
+	return b
+}
+
+func TestExtendedGeometryType(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		blob    []byte
+		typ     string
+		segment int
+	}{
+		{"little endian", extendedBlob(binary.LittleEndian, 8, 2, 0, 0, 1, 1, 2, 0), "CircularString", 0},
+		{"big endian", extendedBlob(binary.BigEndian, 8, 2, 0, 0, 1, 1, 2, 0), "CircularString", 0},
+		{"ISO Z", extendedBlob(binary.LittleEndian, 1008, 3, 0, 0, 5, 1, 1, 5, 2, 0, 5), "CircularString", 0},
+		{"EWKB Z", extendedBlob(binary.LittleEndian, 0x80000000|8, 3, 0, 0, 5, 1, 1, 5, 2, 0, 5), "CircularString", 0},
+		{"TIN", extendedBlob(binary.LittleEndian, 16, 2), "TIN", 0},
+		// Only curves can be approximated
+		{"TIN approximated", extendedBlob(binary.LittleEndian, 16, 2), "TIN", DefaultCurveSegments},
+	} {
+		_, _, err := parseGpkgGeom(tt.blob, tt.segment)
+		var unsupported *UnsupportedGeometryError
+		if !errors.As(err, &unsupported) || unsupported.Type != tt.typ {
+			t.Errorf("%s: err = %v, want an unsupported %s", tt.name, err, tt.typ)
+		} else if err.Error() != "unsupported extended geometry: "+tt.typ {
+			t.Errorf("%s: err = %q", tt.name, err)
+		}
+	}
+}
+
+func TestUnsupportedCounted(t *testing.T) {
+	db := newGeoPackage(t)
+	addLayer(t, db, "roads", "GEOMETRY", "highway")
+	exec(t, db, "INSERT INTO roads (geom, highway) VALUES (?, 'primary')", extendedBlob(binary.LittleEndian, 8, 2, 0, 0, 1, 1, 2, 0))
+	insert(t, db, "roads", line(0, 0, 1, 1), map[string]any{"highway": "service"})
+
+	file, summary := convert(t, db, nil)
+	if len(file.Ways) != 1 || file.Ways[0].Tags.Find("highway") != "service" {
+		t.Errorf("got %d ways, want just the line", len(file.Ways))
+	}
+	s := summary.Layer("roads")
+	if s.Unsupported != 1 || s.Skipped != 1 || s.Features != 1 {
+		t.Errorf("summary has %d features, %d skipped and %d unsupported, want 1 of each", s.Features, s.Skipped, s.Unsupported)
+	}
+}
+
+func TestMismatchedGeometryType(t *testing.T) {
+	db := newGeoPackage(t)
+	addLayer(t, db, "pois", "POINT", "amenity")
+	insert(t, db, "pois", point(1, 2), map[string]any{"amenity": "bench"})
+	insert(t, db, "pois", line(0, 0, 1, 1), map[string]any{"amenity": "bench"})
+
+	file, summary := convert(t, db, nil)
+	// Still converted, just counted
+	if len(file.Ways) != 1 || len(taggedNodes(file)) != 1 {
+		t.Errorf("got %d ways and %d tagged nodes, want 1 of each", len(file.Ways), len(taggedNodes(file)))
+	}
+	if s := summary.Layer("pois"); s.Mismatched != 1 || s.Features != 2 {
+		t.Errorf("summary has %d features and %d mismatched, want 2 and 1", s.Features, s.Mismatched)
+	}
+
+	_, err := Convert(db, nopWriter{}, &Options{Strict: true})
+	if err == nil || err.Error() != "layer pois: feature has geometry type LINESTRING, the layer is declared as POINT" {
+		t.Errorf("strict: err = %v", err)
+	}
+}
+
+func TestEmptyGeometryFlag(t *testing.T) {
+	// Just the header, with the empty bit and the little endian bit. Some writers add a WKB with NaN
+	// coordinates after it, which is not read either
+	empty := []byte{'G', 'P', 0, 0b10001, 0xE6, 0x10, 0, 0}
+	nanPoint := append(append([]byte(nil), empty...), 1, 1, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0xF8, 0x7F, 0, 0, 0, 0, 0, 0, 0xF8, 0x7F)
+	for _, blob := range [][]byte{empty, nanPoint} {
+		if _, srs, err := parseGpkgGeom(blob, 0); !errors.Is(err, ErrEmptyGeometry) || srs != wgs84 {
+			t.Errorf("parseGpkgGeom(%x) = %d, %v, want an empty geometry in EPSG:4326", blob, srs, err)
+		}
+	}
+
+	db := newGeoPackage(t)
+	addLayer(t, db, "pois", "POINT", "amenity")
+	exec(t, db, "INSERT INTO pois (geom, amenity) VALUES (?, 'bench'), (?, 'bench')", empty, nanPoint)
+	insert(t, db, "pois", point(1, 2), map[string]any{"amenity": "bench"})
+	file, summary := convert(t, db, nil)
+	if len(file.Nodes) != 1 {
+		t.Errorf("got %d nodes, want 1", len(file.Nodes))
+	}
+	if s := summary.Layer("pois"); s.Empty != 2 || s.Skipped != 2 {
+		t.Errorf("summary has %d empty and %d skipped, want 2 of each", s.Empty, s.Skipped)
+	}
+}
+
+// A NULL geometry, a zero-length blob and an empty geometry are counted and logged apart
+func TestMissingGeometryKinds(t *testing.T) {
+	db := newGeoPackage(t)
+	addLayer(t, db, "pois", "POINT", "amenity")
+	insert(t, db, "pois", nil, map[string]any{"amenity": "bench"})
+	insert(t, db, "pois", nil, map[string]any{"amenity": "bench"})
+	exec(t, db, "INSERT INTO pois (geom, amenity) VALUES (X'', 'bench'), (?, 'bench')", []byte{'G', 'P', 0, 0b10001, 0xE6, 0x10, 0, 0})
+	insert(t, db, "pois", point(1, 2), map[string]any{"amenity": "bench"})
+	logs := captureLogs(t)
+
+	var reasons []string
+	file, summary := convert(t, db, &Options{Skipped: func(s SkippedFeature) { reasons = append(reasons, s.Reason) }})
+	if len(file.Nodes) != 1 {
+		t.Errorf("got %d nodes, want 1", len(file.Nodes))
+	}
+	s := summary.Layer("pois")
+	if s.Null != 2 || s.NoData != 1 || s.Empty != 1 || s.Skipped != 4 {
+		t.Errorf("summary has %d null, %d no data, %d empty and %d skipped, want 2, 1, 1 and 4", s.Null, s.NoData, s.Empty, s.Skipped)
+	}
+	slices.Sort(reasons)
+	if want := []string{SkipEmptyGeometry, SkipNoGeometry, SkipNullGeometry, SkipNullGeometry}; !slices.Equal(reasons, want) {
+		t.Errorf("skipped for %v, want %v", reasons, want)
+	}
+	for _, msg := range []string{"with a NULL geometry", "zero-length geometry blob", "with an empty geometry"} {
+		if !strings.Contains(logs.String(), msg) {
+			t.Errorf("nothing logged about a %s:\n%s", msg, logs)
+		}
+	}
+}
+
+// One warning for a layer that has rows, but not one of the type it declares
+func TestNoDeclaredGeometryType(t *testing.T) {
+	db := newGeoPackage(t)
+	addLayer(t, db, "buildings", "POLYGON", "building")
+	addLayer(t, db, "missing", "POLYGON", "building")
+	addLayer(t, db, "parks", "POLYGON", "leisure")
+	addLayer(t, db, "empty", "POLYGON", "leisure")
+	insert(t, db, "buildings", point(1, 2), map[string]any{"building": "yes"})
+	insert(t, db, "missing", nil, map[string]any{"building": "yes"})
+	insert(t, db, "parks", point(1, 2), map[string]any{"leisure": "park"})
+	insert(t, db, "parks", polygon([]float64{0, 0, 1, 0, 1, 1, 0, 0}), map[string]any{"leisure": "park"})
+	logs := captureLogs(t)
+
+	convert(t, db, nil)
+	var warned []string
+	for _, line := range strings.Split(logs.String(), "\n") {
+		if strings.Contains(line, "no feature of the layer has its declared geometry type") {
+			_, table, _ := strings.Cut(line, "table=")
+			warned = append(warned, strings.Fields(table)[0])
+		}
+	}
+	if !slices.Equal(warned, []string{"buildings", "missing"}) {
+		t.Errorf("warned about %v, want buildings and missing", warned)
+	}
+}
+
+// Headers that are not GeoPackage binary version 0, or too short for what they declare, are errors and not
+// guessed at
+func TestBadGeometryHeader(t *testing.T) {
+	good, err := gpkg.Geometry(point(1, 2), wgs84)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, srs, err := parseGpkgGeom(good, 0); err != nil || srs != wgs84 {
+		t.Fatalf("parseGpkgGeom(%x) = %d, %v, want a point in EPSG:4326", good, srs, err)
+	}
+	with := func(i int, b byte) []byte {
+		bad := slices.Clone(good)
+		bad[i] = b
+		return bad
+	}
+	for _, tt := range []struct {
+		name string
+		blob []byte
+	}{
+		{"short", good[:7]},
+		{"magic G", with(0, 'X')},
+		{"magic P", with(1, 'X')},
+		{"version", with(2, 1)},
+		{"envelope too long", with(3, good[3]|1<<1)},
+		{"envelope type", with(3, good[3]|5<<1)},
+	} {
+		if g, _, err := parseGpkgGeom(tt.blob, 0); err == nil {
+			t.Errorf("%s: parseGpkgGeom(%x) = %v, want an error", tt.name, tt.blob, g)
+		}
+	}
+
+	db := newGeoPackage(t)
+	addLayer(t, db, "pois", "POINT", "amenity")
+	exec(t, db, "INSERT INTO pois (geom, amenity) VALUES (?, 'bench')", with(2, 1))
+	insert(t, db, "pois", point(1, 2), map[string]any{"amenity": "bench"})
+	if file, summary := convert(t, db, nil); len(file.Nodes) != 1 || summary.Layer("pois").Skipped != 1 {
+		t.Errorf("got %d nodes and %d skipped, want 1 of each", len(file.Nodes), summary.Layer("pois").Skipped)
+	}
+}
+
+// A GEOMETRY layer converts each feature by its own type, with none of them mismatched, and skips collections
+func TestGeometryLayer(t *testing.T) {
+	db := newGeoPackage(t)
+	addLayer(t, db, "mixed", "GEOMETRY", "name")
+	insert(t, db, "mixed", point(1, 1), map[string]any{"name": "point"})
+	insert(t, db, "mixed", line(0, 0, 1, 0), map[string]any{"name": "line"})
+	insert(t, db, "mixed", polygon([]float64{10, 0, 14, 0, 14, 4, 10, 4, 10, 0}, []float64{11, 1, 12, 1, 12, 2, 11, 1}), map[string]any{"name": "polygon"})
+	insert(t, db, "mixed", geom.NewGeometryCollection().MustPush(point(5, 5)), map[string]any{"name": "collection"})
+	logs := captureLogs(t)
+
+	file, summary := convert(t, db, nil)
+	if len(taggedNodes(file)) != 1 || len(file.Ways) != 3 || len(file.Relations) != 1 {
+		t.Errorf("got %d tagged nodes, %d ways and %d relations, want 1, 3 and 1", len(taggedNodes(file)), len(file.Ways), len(file.Relations))
+	}
+	if s := summary.Layer("mixed"); s.Mismatched != 0 || s.Skipped != 1 {
+		t.Errorf("summary has %d mismatched and %d skipped, want 0 and 1", s.Mismatched, s.Skipped)
+	}
+	if strings.Contains(logs.String(), "declared geometry type") {
+		t.Errorf("warned about the declared type:\n%s", logs)
+	}
+}
@@ -8,10 +8,12 @@ require (
 	github.com/paulmach/osm v0.8.0
 	github.com/spf13/pflag v1.0.6
 	github.com/twpayne/go-geom v1.6.1
+	google.golang.org/protobuf v1.33.0
 )
 
 require (
 	github.com/apache/thrift v0.17.0 // indirect
+	github.com/datadog/czlib v0.0.0-20160811164712-4bc9a24e37f2 // indirect
 	github.com/paulmach/orb v0.1.3 // indirect
-	google.golang.org/protobuf v1.33.0 // indirect
+	github.com/paulmach/protoscan v0.2.1 // indirect
 )
@@ -0,0 +1,653 @@
+// Package gpkg2osm converts the feature layers of a GeoPackage into OpenStreetMap elements.
+//
+// The conversion works on a *sql.DB that the caller has already opened, so the GeoPackage may live anywhere
+// sqlite can reach (a file, a temp-extracted archive member, a custom VFS). Opening the database with the
+// right driver and VFS, and closing it afterwards, is the caller's responsibility.
+package gpkg2osm
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sort"
+	"time"
+
+	"github.com/paulmach/osm"
+)
+
+const Version = "v0.1.0"
+
+// Options control how the features are converted
+type Options struct {
+	KeepUntagged bool   // Write features that have no tags instead of skipping them
+	LayerTagKey  string // If set, every element gets this tag with the name of the layer it came from
+	Where        string // SQL predicate on the raw columns, only matching features are converted
+	Limit        int    // Convert at most this many features per layer, 0 for no limit
+
+	// Convert geometries in other coordinate systems to WGS 84. Without it, layers that are not EPSG:4326
+	// are skipped. Each geometry is converted from the srs_id in its own header
+	Reproject bool
+
+	// EPSG code of the coordinates that are written, 4326 (WGS 84) by default. Only EPSG:3857 and EPSG:3395 are
+	// supported besides. Anything but WGS 84 is not valid OSM data, it is only for consumers that expect it
+	OutputSRS int64
+
+	// If set, features that were reprojected get this tag with the coordinate system they were in, such as
+	// EPSG:3857, unless they already have the tag
+	SRSTagKey string
+
+	// Replace tag values while reading, keyed by the tag key and then the value to replace. Used to turn
+	// coded attributes into OSM values, e.g. {"class": {"1": "motorway"}}. Values are matched after being
+	// converted to strings, unmapped values are kept
+	ValueMap map[string]map[string]string
+
+	// Use the columns with an enum constraint of the schema extension (gpkg_data_column_constraints) as tags, even
+	// if they are not described as OSM tags. Only used when the layers are found by ConvertAll
+	EnumColumns bool
+
+	// Replace the values of enum constrained tag columns with the description the constraint gives them, for
+	// GeoPackages that store codes. ValueMap rules for the same key and value win
+	EnumLabels bool
+
+	// Convert the layers without any tag columns too, see LayerOptions.GeometryOnly. Only used when the layers
+	// are found by ConvertAll
+	GeometryOnly bool
+
+	// Guess the tag columns of layers without any from their names, see LayerOptions.HeuristicTags. Only used
+	// when the layers are found by ConvertAll
+	HeuristicTags bool
+
+	// Lowercase the tag keys read from the GeoPackage, so NAME and Name both become name. This happens before
+	// duplicate keys are looked for and before ValueMap is applied, so its keys must be lowercase too
+	LowercaseKeys bool
+
+	// Put this in front of every key of the feature tags, such as gpkg: for gpkg:highway, to keep converted
+	// tags apart from real OSM tags while they are reviewed. It is added last, so DropTags, DeletedTag and the
+	// other options all see the plain keys, but before the layer and metadata tags, whose keys are used as
+	// they are. The area tag of simple polygons gets the prefix too, the type tag of relations does not
+	KeyPrefix string
+
+	// Which tags win when the descriptive columns and the JSON columns (osm_tags) set the same key. Defaults to
+	// PrecedenceOSMTags
+	TagPrecedence TagPrecedence
+
+	// Drop tags whose value is an empty string, which OSM treats the same as not having the tag. This happens
+	// before DefaultTags are added, so a default replaces an empty value
+	StripEmptyValues bool
+
+	// Keys to remove from every feature, exact or as a glob (shape_*), compared without regard to case. This
+	// happens after TagTransform, so it sees the final keys, but before the layer and metadata tags are added.
+	// Defaults to DefaultDropTags, an empty slice keeps every key
+	DropTags []string
+
+	// Constant tags for every feature of a layer, keyed by the layer name and then the tag key. The feature's
+	// own tags win over these, e.g. {"hydrants": {"emergency": "fire_hydrant"}}
+	DefaultTags map[string]map[string]string
+
+	// Called for every feature with the name of its layer and its tags, and the tags it returns are used
+	// instead. It may change the map it is given and return it. This runs right after the tag columns have
+	// been parsed and merged, before anything else is done to the tags: StripEmptyValues, DefaultTags,
+	// DeletedTag and DropTags all see what it returns, and the values are still the JSON types. A feature left
+	// with no tags counts as untagged, unless DefaultTags give it some
+	TagTransform func(layer string, tags map[string]any) map[string]any
+
+	// Mapping tables of the related tables extension (gpkgext_relations) to read extra tags from. Each feature
+	// of the relation's base table gets the columns of its related row as tags, the feature's own tags win.
+	// Only one relation per layer, and one related row per feature, is used
+	RelatedTags []string
+
+	// Stop with an error on data problems that are otherwise only warned about, such as two tag columns
+	// setting the same key or a feature with a different geometry type than its layer
+	Strict bool
+
+	// If set, every element gets this tag with the plain text gpkg_metadata of its layer (or of the whole
+	// GeoPackage), unless the feature already has the tag. Used to keep the source or attribution of the data
+	MetadataTagKey string
+
+	// Tag every element with source:date, the day its layer was last changed, and source, the description of
+	// the layer, from gpkg_contents. Tags the feature already has (or MetadataTagKey added) are kept
+	IncludeMetadata bool
+
+	// Do not add area=yes to the closed ways written for simple polygons
+	NoAreaTag bool
+
+	// Simple polygons only get area=yes when they have one of these keys. Defaults to DefaultAreaKeys, "*"
+	// gives it to every polygon
+	AreaKeys []string
+
+	// Direction to write polygon rings in, exterior rings one way and holes the other. Defaults to leaving
+	// them as they are
+	Winding Winding
+
+	// Write LINESTRING features that end where they start as polygons, so they get area=yes like any other
+	// simple polygon. By default they are ways that happen to loop
+	ClosedLinesAsAreas bool
+
+	// Write each polygon of a MULTIPOLYGON feature as if it were a POLYGON feature with the same tags: a closed
+	// way, or a multipolygon relation of its own if it has holes. By default a MULTIPOLYGON is one relation with
+	// the exterior rings of every polygon as outer members and all the holes as inner members
+	SplitMultiPolygons bool
+
+	// If set, MULTILINESTRING features become a relation of this type (such as route) with the tags of the
+	// feature and its lines as member ways, in order. By default each line is a way with the feature's tags
+	LineRelationType string
+
+	// Convert CircularString, CompoundCurve, CurvePolygon, MultiCurve and MultiSurface geometries to the lines
+	// and polygons they approximate, with CurveSegments straight segments per quarter circle (DefaultCurveSegments
+	// when 0). Without it they are skipped as unsupported
+	ApproximateCurves bool
+	CurveSegments     int
+
+	// Write every feature as a single tagged node: the centroid of polygons and the midpoint of lines. This
+	// throws away the shape of the features
+	CenterPoints bool
+
+	// Tag the nodes of POINT and MULTIPOINT features that have a Z with ele, the Z as it is. Only X and Y are
+	// ever written as the coordinate, Z and M are otherwise dropped
+	EleFromZ bool
+
+	// Ways with more nodes than this are split into several ways. Defaults to DefaultMaxNodesPerWay
+	MaxNodesPerWay int
+
+	// Add vertices to lines and polygon rings so that no segment is longer than this many meters, measured on
+	// the WGS 84 coordinates before any OutputSRS. 0 leaves the segments as they are
+	MaxSegmentLength float64
+
+	// Round coordinates to this many decimal places, from 1 to 7. Defaults to DefaultCoordPrecision, the
+	// precision OSM stores. Fewer places make smaller files and let ways share more nodes
+	CoordPrecision int
+
+	// Derive node IDs from a hash of their coordinate instead of counting, so the same place gets the same ID in
+	// every run and file. IDs is still used for ways and relations, and for the sign of the node IDs
+	StableIDs bool
+
+	// Derive the IDs of the elements that stand for a feature (its tagged nodes, ways and relations) from a hash
+	// of its layer's name in the summary and its fid, so converting again gives them the same IDs. Untagged way
+	// nodes are still counted, or hashed with StableIDs. Layers without an integer primary key are counted too
+	IDFromFID bool
+
+	// Give the element that stands for a feature the ID in this column, for GeoPackages exported from OSM, so
+	// the data can go back to where it came from. The version is read from an osm_version column beside it, and
+	// is 1 without one. Every other element, and the features without an ID, get IDs as usual, so IDs must count
+	// down: ConvertAll fails with a positive IDs generator. Column names are matched ignoring case, and layers
+	// without the column are converted as usual. See parseOSMID for the values that are understood
+	OSMIDColumn string
+
+	// Which ways share their untagged nodes at the same coordinate: those of the same layer, of every layer, or
+	// none. Defaults to DedupLayer, so a building corner is not joined to a road of another layer by accident
+	DedupScope DedupScope
+
+	// Merge POINT features into the ways that pass through the same coordinate: the way uses the point's tagged
+	// node as its vertex instead of a node of its own. Layers of points are converted first so their nodes
+	// exist before the ways. Without it a point and a way vertex at the same place are always separate nodes
+	MergeCoincidentPoints bool
+
+	// Features with this tag are written as deleted, with visible=false on their elements, and without the tag.
+	// Values are compared as OSM strings, so {Key: "deleted", Value: "yes"} matches a JSON true as well. An empty
+	// Key turns this off
+	DeletedTag osm.Tag
+
+	// Leave out the features marked by DeletedTag instead of writing them as deleted
+	SkipDeleted bool
+
+	// Metadata given to every element written, for consumers that expect it to be set. Left at the zero values
+	// (no version, timestamp or user) by default
+	Version   int
+	Timestamp time.Time
+	User      string
+
+	// Layers to leave out because they were already converted, by the name they have in the summary. Together
+	// with LayerDone this lets an interrupted conversion carry on where it stopped
+	SkipLayers map[string]bool
+
+	// Called with every feature that is skipped and why, for keeping a record of them beside the logs. With
+	// Workers it is called from several goroutines, though never at the same time
+	Skipped func(SkippedFeature)
+
+	// Called with every feature and the tags it would be written with, instead of converting it, for checking the
+	// tag mapping before a real conversion. Nothing is written to out, which may be nil. The tags are final, only
+	// the area=yes and type tags that polygons and relations get are not there yet. An error stops the conversion
+	Tagged func(TaggedFeature) error
+
+	// Called once every feature of a layer has been passed to the writer, with the layer's name in the summary.
+	// An error stops the conversion
+	LayerDone func(layer string) error
+
+	// Check every geometry before converting it, and skip the ones that would make broken OSM elements:
+	// unclosed or self intersecting rings, lines without two distinct points and coordinates that are not
+	// numbers. FixGeometry repairs what has an obvious repair (closing rings, dropping repeated points) instead
+	// of skipping, and implies ValidateGeometry
+	ValidateGeometry bool
+	FixGeometry      bool
+
+	// Number of layers to read from the database at once, each on a connection of its own, while the layers
+	// before them are converted. The output is the same however many there are. Defaults to 1, reading each
+	// layer when it is converted. Every connection must see the same database, so this does not work with
+	// ":memory:" databases
+	Workers int
+
+	// Number of goroutines parsing the geometry and tags of each layer's rows while the next rows are read.
+	// Defaults to 1, parsing each row as it is read. With Workers, every layer being read has this many
+	ReadThreads int
+
+	// Pass the converted elements to the writer on a goroutine of its own, so encoding and compressing them
+	// overlaps with converting the features after them. out is then used from that goroutine
+	WriteThread bool
+
+	// Allocates the element IDs. Defaults to a new generator starting at -1, use IDsAfter to continue
+	// after existing data
+	IDs *IDGenerator
+
+	// The layers to convert, keyed by name. Defaults to every exportable layer found by GetGeoPackageLayers.
+	// Only used by Convert, ConvertAll gets them from each Input
+	Layers map[string]*ExportLayer
+}
+
+// Convert all the exportable layers in the GeoPackage and write them to out. The writer is closed once
+// every layer has been written. Feature level problems are logged and counted in the summary, an error
+// is only returned if the conversion cannot continue
+func Convert(db *sql.DB, out OSMWriter, opts *Options) (*Summary, error) {
+	var layers map[string]*ExportLayer
+	if opts != nil {
+		layers = opts.Layers
+	}
+	return ConvertAll([]Input{{DB: db, Layers: layers}}, out, opts)
+}
+
+// Input is one of the GeoPackages converted by ConvertAll
+type Input struct {
+	Name string // Identifies the input in the summary and in layer names that are in several inputs
+	DB   *sql.DB
+
+	// The layers to convert, keyed by name. Defaults to every exportable layer found by GetGeoPackageLayers.
+	// Only used by Convert, ConvertAll gets them from each Input
+	Layers map[string]*ExportLayer
+}
+
+// ConvertAll converts several GeoPackages into a single output, as if they were one. Every input uses the same
+// IDs and, with DedupGlobal, shares nodes at the same coordinate. A layer name that is in more than one input is
+// written and summarized as "input/layer" so they can be told apart. Options.Layers is ignored, each input has
+// its own
+func ConvertAll(inputs []Input, out OSMWriter, opts *Options) (*Summary, error) {
+	if opts == nil {
+		opts = &Options{}
+	}
+	if opts.Tagged != nil {
+		out = nopWriter{}
+	}
+	if opts.Where != "" {
+		if err := ValidateWhere(opts.Where); err != nil {
+			return nil, fmt.Errorf("invalid where predicate %q: %w", opts.Where, err)
+		}
+	}
+	switch opts.Winding {
+	case WindingKeep, WindingCCW, WindingCW:
+	default:
+		return nil, fmt.Errorf("invalid winding %q, must be ccw or cw", opts.Winding)
+	}
+	dropPatterns := opts.DropTags
+	if dropPatterns == nil {
+		dropPatterns = DefaultDropTags
+	}
+	dropper, err := newTagDropper(dropPatterns)
+	if err != nil {
+		return nil, fmt.Errorf("invalid drop tags: %w", err)
+	}
+	switch opts.TagPrecedence {
+	case "", PrecedenceOSMTags, PrecedenceColumns:
+	default:
+		return nil, fmt.Errorf("invalid tag precedence %q, must be osm_tags or columns", opts.TagPrecedence)
+	}
+	switch opts.DedupScope {
+	case "", DedupLayer, DedupGlobal, DedupNone:
+	default:
+		return nil, fmt.Errorf("invalid dedup scope %q, must be layer, global or none", opts.DedupScope)
+	}
+	if opts.OSMIDColumn != "" && opts.IDs != nil && opts.IDs.step > 0 {
+		return nil, fmt.Errorf("an OSM ID column needs negative new IDs, positive ones could be the same as the real IDs")
+	}
+	var outProj projection
+	if opts.OutputSRS != 0 && opts.OutputSRS != wgs84 {
+		var ok bool
+		if outProj, ok = outputProjections[opts.OutputSRS]; !ok {
+			return nil, fmt.Errorf("unsupported output SRS EPSG:%d, must be 4326, 3857 or 3395", opts.OutputSRS)
+		}
+		slog.Warn("writing coordinates that are not WGS 84, this is not valid OSM data and most OSM tools will misread it", "srs", fmt.Sprintf("EPSG:%d", opts.OutputSRS))
+		if w, ok := out.(srsWriter); ok {
+			w.setSRS(opts.OutputSRS)
+		}
+	}
+	counts := make(map[string]int) // Number of inputs each layer name is in
+	for i := range inputs {
+		in := &inputs[i]
+		if in.Layers == nil {
+			if err := CheckGeoPackage(in.DB); err != nil {
+				return nil, inputError(in, err)
+			}
+
+			// Get layer information including OSM tag mappings
+			var err error
+			in.Layers, err = GetGeoPackageLayersWith(in.DB, &LayerOptions{EnumColumns: opts.EnumColumns, GeometryOnly: opts.GeometryOnly, HeuristicTags: opts.HeuristicTags})
+			if err != nil {
+				return nil, inputError(in, fmt.Errorf("error querying layers: %w", err))
+			}
+		}
+		for name := range in.Layers {
+			counts[name]++
+		}
+	}
+	for name := range opts.DefaultTags {
+		if counts[name] == 0 {
+			slog.Warn("default tags for a layer that is not being converted", "table", name)
+		}
+	}
+
+	ids := opts.IDs
+	if ids == nil {
+		ids = &IDGenerator{}
+	}
+	var async *asyncWriter
+	if opts.WriteThread {
+		async = newAsyncWriter(out)
+		defer async.stop()
+		out = async
+	}
+	b := NewBuilder(ids, opts)
+	summary := NewSummary()
+	if opts.OutputSRS != 0 {
+		summary.SRS = opts.OutputSRS
+	}
+	skips := &skipReport{fn: opts.Skipped}
+	for _, in := range inputs {
+		// Layers are converted in name order so IDs are the same every run
+		names := make([]string, 0, len(in.Layers))
+		for name := range in.Layers {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		if opts.MergeCoincidentPoints {
+			sort.SliceStable(names, func(i, j int) bool {
+				return in.Layers[names[i]].isPoints() && !in.Layers[names[j]].isPoints()
+			})
+		}
+
+		db := in.DB
+		rp := newReprojector(db)
+		related, err := readRelations(db, opts.RelatedTags)
+		if err != nil {
+			return nil, inputError(&in, err)
+		}
+		var done []string // Summary names of the layers of this input
+		var reads []*layerRead
+		for _, name := range names {
+			l := in.Layers[name]
+			key := l.Name
+			if counts[name] > 1 {
+				key = in.Name + "/" + l.Name
+			}
+			if opts.SkipLayers[key] {
+				slog.Info("skipping layer, it was already converted", "table", key)
+				continue
+			}
+			// Layers found by GetGeoPackageLayers are checked already, this is for the ones the caller made
+			if err := l.checkGeometryColumn(db, l.GeometryField == ""); err != nil {
+				slog.Error("skipping layer, cannot find its geometry column", "table", l.Name, "err", err)
+				continue
+			}
+			if l.SRS != wgs84 && !opts.Reproject {
+				slog.Error("skipping layer, the SRS must be EPSG:4326 unless reprojecting", "table", l.Name, "srs", l.SRS)
+				continue
+			}
+			l.Where = opts.Where
+			l.Limit = opts.Limit
+			l.ValueMap = opts.ValueMap
+			if opts.EnumLabels && len(l.EnumLabels) > 0 {
+				l.ValueMap = l.enumValueMap(opts.ValueMap, opts.LowercaseKeys)
+			}
+			l.LowercaseKeys = opts.LowercaseKeys
+			if opts.ApproximateCurves {
+				l.CurveSegments = opts.CurveSegments
+				if l.CurveSegments < 1 {
+					l.CurveSegments = DefaultCurveSegments
+				}
+			}
+			l.ColumnsWin = opts.TagPrecedence == PrecedenceColumns
+			l.Related = related[l.Name]
+			if l.FIDColumn == "" {
+				if err := l.findFIDColumn(db); err != nil {
+					slog.Warn("cannot find the primary key", "table", l.Name, "err", err)
+				}
+			}
+			if opts.IDFromFID && l.FIDColumn == "" {
+				slog.Warn("layer has no fid, its element IDs are counted", "table", l.Name)
+			}
+			if opts.OSMIDColumn != "" {
+				if err := l.findOSMIDColumn(db, opts.OSMIDColumn); err != nil {
+					slog.Warn("cannot look for the OSM ID column", "table", l.Name, "err", err)
+				}
+			}
+			reads = append(reads, &layerRead{layer: l, key: key, ls: summary.Layer(key), skip: skips.layer(key)})
+			done = append(done, key)
+		}
+
+		reader := newLayerReader(db, reads, opts.Workers, opts.ReadThreads)
+		defer reader.close()
+		for _, lr := range reads {
+			l, key, ls, skip := lr.layer, lr.key, lr.ls, lr.skip
+			var meta string
+			if opts.MetadataTagKey != "" {
+				var err error
+				if meta, err = layerMetadata(db, l.Name); err != nil {
+					slog.Warn("cannot read metadata", "table", l.Name, "err", err)
+				}
+			}
+			var contents map[string]string
+			if opts.IncludeMetadata {
+				contents = l.contentsTags()
+			}
+			b.startLayer()
+			results, err := reader.wait(lr)
+			if err != nil {
+				// The file is damaged, carrying on would write part of the layer as if it were all of it
+				var re *readError
+				if errors.As(err, &re) {
+					return nil, inputError(&in, err)
+				}
+				if l.Where != "" {
+					err = fmt.Errorf("query failed, check the where predicate %q: %w", l.Where, err)
+				}
+				slog.Error("failed to get layer items", "table", l.Name, "err", err)
+				continue
+			}
+			declared := 0 // Features with the geometry type the layer declares
+			for _, r := range results {
+				if l.declares(r.G) {
+					declared++
+				}
+				for _, c := range r.Conflicts {
+					if opts.Strict {
+						return nil, fmt.Errorf("layer %s: %w", l.Name, c)
+					}
+					slog.Warn("duplicate tag key", "table", l.Name, "key", c.Key, "source", c.Source, "overridden", c.Overridden)
+					ls.TagConflicts++
+				}
+				if opts.Reproject {
+					code, err := rp.toWGS84(r.G, r.SRS)
+					if err != nil {
+						slog.Warn("cannot reproject feature", "table", l.Name, "err", err)
+						skip.skip(ls, r.FID, SkipReproject, err)
+						continue
+					}
+					if _, ok := r.Tags[opts.SRSTagKey]; opts.SRSTagKey != "" && code != wgs84 && !ok {
+						r.Tags[opts.SRSTagKey] = fmt.Sprintf("EPSG:%d", code)
+					}
+				}
+				if opts.MaxSegmentLength > 0 {
+					r.G = densify(r.G, opts.MaxSegmentLength)
+				}
+				if outProj != nil {
+					// The mercators have no room for the poles
+					if err := toOutputSRS(r.G, outProj); err != nil {
+						slog.Warn("cannot project feature to the output SRS", "table", l.Name, "err", err)
+						skip.skip(ls, r.FID, SkipReproject, err)
+						continue
+					}
+				}
+				if opts.ValidateGeometry || opts.FixGeometry {
+					g, fixed, err := checkGeometry(r.G, opts.FixGeometry)
+					if err != nil {
+						slog.Warn("skipping feature", "table", l.Name, "err", err)
+						ls.Invalid++
+						skip.skip(ls, r.FID, SkipInvalidGeometry, err)
+						continue
+					}
+					if fixed {
+						slog.Debug("fixed feature geometry", "table", l.Name)
+						ls.Fixed++
+					}
+					r.G = g
+				}
+				// Usually a sign the data is not what the layer claims, the feature is still converted
+				if t := geomTypeName(r.G); !l.declares(r.G) {
+					if opts.Strict {
+						return nil, fmt.Errorf("layer %s: feature has geometry type %s, the layer is declared as %s", l.Name, t, l.GeometryType)
+					}
+					slog.Warn("geometry type does not match the layer", "table", l.Name, "type", t, "declared", l.GeometryType)
+					ls.Mismatched++
+				}
+				if opts.TagTransform != nil {
+					r.Tags = opts.TagTransform(l.Name, r.Tags)
+					if r.Tags == nil {
+						r.Tags = make(map[string]any)
+					}
+				}
+				if opts.StripEmptyValues {
+					for k, v := range r.Tags {
+						if tagValue(v) == "" {
+							delete(r.Tags, k)
+						}
+					}
+				}
+				for k, v := range opts.DefaultTags[l.Name] {
+					if _, ok := r.Tags[k]; !ok {
+						r.Tags[k] = v
+					}
+				}
+				if v, ok := r.Tags[opts.DeletedTag.Key]; ok && opts.DeletedTag.Key != "" && tagValue(v) == opts.DeletedTag.Value {
+					delete(r.Tags, opts.DeletedTag.Key)
+					ls.Deleted++
+					if opts.SkipDeleted {
+						slog.Debug("skipping deleted feature", "table", l.Name)
+						continue
+					}
+					r.Deleted = true
+				}
+				dropper.drop(r.Tags)
+				if len(r.Tags) == 0 && !opts.KeepUntagged {
+					slog.Debug("skipping feature with no tags", "table", l.Name)
+					ls.Untagged++
+					skip.skip(ls, r.FID, SkipUntagged, nil)
+					continue
+				}
+				if opts.KeyPrefix != "" {
+					r.Tags = prefixKeys(r.Tags, opts.KeyPrefix)
+				}
+				if _, ok := r.Tags[opts.MetadataTagKey]; meta != "" && !ok {
+					r.Tags[opts.MetadataTagKey] = meta
+				}
+				for k, v := range contents {
+					if _, ok := r.Tags[k]; !ok {
+						r.Tags[k] = v
+					}
+				}
+				// Set last so nothing from the source can overwrite it
+				if opts.LayerTagKey != "" {
+					r.Tags[opts.LayerTagKey] = key
+				}
+				if opts.Tagged != nil {
+					if err := opts.Tagged(r.tagged(key)); err != nil {
+						return nil, fmt.Errorf("layer %s: %w", key, err)
+					}
+					ls.Features++
+					continue
+				}
+				file := &osm.OSM{}
+				split := b.Split
+				b.startFeature(key, r.FID)
+				if err := r.AppendToOSM(file, b); err != nil {
+					slog.Warn("cannot convert feature", "table", l.Name, "err", err)
+					skip.skip(ls, r.FID, SkipConvert, err)
+					continue
+				}
+				if r.OSMID != nil {
+					if err := b.useOSMID(file, r.OSMID); err != nil {
+						slog.Warn("cannot use the OSM ID, the feature gets new IDs", "table", l.Name, "err", err)
+					}
+				}
+				b.stamp(file)
+				if err := out.Write(file); err != nil {
+					return nil, fmt.Errorf("error writing entitiy: %w", err)
+				}
+				summary.Add(key, file)
+				ls.Split += b.Split - split
+			}
+			// The layer has rows, but not one of them is what the layer says it holds: the wrong type is declared,
+			// or the geometries are all missing
+			if declared == 0 && (len(results) > 0 || ls.Skipped > 0) {
+				slog.Warn("no feature of the layer has its declared geometry type", "table", l.Name, "declared", l.GeometryType, "skipped", ls.Skipped, "mismatched", ls.Mismatched)
+			}
+			if opts.LayerDone != nil {
+				// Everything of the layer has to be with the writer itself, LayerDone may flush it
+				if async != nil {
+					if err := async.sync(); err != nil {
+						return nil, fmt.Errorf("error writing output: %w", err)
+					}
+				}
+				if err := opts.LayerDone(key); err != nil {
+					return nil, fmt.Errorf("layer %s: %w", key, err)
+				}
+			}
+		}
+
+		if in.Name != "" {
+			summary.AddInput(in.Name, done)
+		}
+	}
+
+	if err := out.Close(); err != nil {
+		return nil, fmt.Errorf("error writing output: %w", err)
+	}
+	return summary, nil
+}
+
+func inputError(in *Input, err error) error {
+	if in.Name == "" {
+		return err
+	}
+	return fmt.Errorf("%s: %w", in.Name, err)
+}
+
+// GeoPackage application_id, "GPKG" in ASCII
+const gpkgApplicationID = 0x47504B47
+
+// CheckGeoPackage makes sure the database is actually a GeoPackage before we go looking for layers
+func CheckGeoPackage(db *sql.DB) error {
+	var appID int64
+	if err := db.QueryRow("PRAGMA application_id").Scan(&appID); err != nil {
+		// sqlite3 fails here when the file is not a database at all
+		return fmt.Errorf("not a GeoPackage: %w", err)
+	}
+	if appID != gpkgApplicationID {
+		return fmt.Errorf("not a GeoPackage: application_id is 0x%08X, expected 0x%08X", appID, gpkgApplicationID)
+	}
+
+	var n int
+	if err := db.QueryRow("SELECT count(*) FROM sqlite_master WHERE type IN ('table', 'view') AND name = 'gpkg_contents'").Scan(&n); err != nil {
+		return fmt.Errorf("not a GeoPackage: %w", err)
+	}
+	if n == 0 {
+		return fmt.Errorf("not a GeoPackage: missing gpkg_contents table")
+	}
+	return nil
+}
@@ -0,0 +1,188 @@
+package gpkg2osm
+
+import (
+	"database/sql"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/nullmonk/gpkg2osm/internal/gpkg"
+	"github.com/paulmach/osm"
+)
+
+func TestCheckGeoPackage(t *testing.T) {
+	plain, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer plain.Close()
+	plain.SetMaxOpenConns(1)
+	exec(t, plain, "CREATE TABLE things (id INTEGER PRIMARY KEY, name TEXT)")
+	if err := CheckGeoPackage(plain); err == nil || !strings.Contains(err.Error(), "not a GeoPackage: application_id is 0x00000000") {
+		t.Errorf("plain SQLite database: err = %v", err)
+	}
+	if _, err := Convert(plain, nopWriter{}, nil); err == nil || !strings.Contains(err.Error(), "not a GeoPackage") {
+		t.Errorf("converting a plain SQLite database: err = %v", err)
+	}
+
+	// The right application_id is not enough without the tables
+	exec(t, plain, "PRAGMA application_id = 1196444487")
+	if err := CheckGeoPackage(plain); err == nil || !strings.Contains(err.Error(), "missing gpkg_contents") {
+		t.Errorf("without gpkg_contents: err = %v", err)
+	}
+
+	if err := CheckGeoPackage(newGeoPackage(t)); err != nil {
+		t.Errorf("GeoPackage: %v", err)
+	}
+}
+
+// Convert reads from whatever database the caller opened, here a private :memory: one rather than a file
+func TestConvertOpenDB(t *testing.T) {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	// Every connection to :memory: is a database of its own
+	db.SetMaxOpenConns(1)
+	exec(t, db, gpkg.Schema)
+	addLayer(t, db, "pois", "POINT", "amenity")
+	insert(t, db, "pois", point(1, 2), map[string]any{"amenity": "bench"})
+
+	file, summary := convert(t, db, nil)
+	if len(file.Nodes) != 1 {
+		t.Fatalf("got %d nodes, want 1", len(file.Nodes))
+	}
+	checkTags(t, file.Nodes[0].Tags, "amenity", "bench")
+	if summary.Total().Features != 1 {
+		t.Errorf("summary has %d features, want 1", summary.Total().Features)
+	}
+}
+
+func TestLayerTag(t *testing.T) {
+	db := newGeoPackage(t)
+	addLayer(t, db, "pois", "POINT", "amenity", "source:layer")
+	addLayer(t, db, "roads", "LINESTRING", "highway")
+	insert(t, db, "pois", point(1, 2), map[string]any{"amenity": "bench", "source:layer": "from the data"})
+	insert(t, db, "roads", line(0, 0, 1, 1), map[string]any{"highway": "path"})
+
+	file, _ := convert(t, db, &Options{LayerTagKey: "source:layer"})
+	if len(file.Nodes) != 3 || len(file.Ways) != 1 {
+		t.Fatalf("got %d nodes and %d ways, want 3 and 1", len(file.Nodes), len(file.Ways))
+	}
+	checkTags(t, taggedNodes(file)[0].Tags, "amenity", "bench", "source:layer", "pois")
+	checkTags(t, file.Ways[0].Tags, "highway", "path", "source:layer", "roads")
+}
+
+// What the command's exit code is made from: the skipped count, untagged features included, and the error
+func TestSkippedCounts(t *testing.T) {
+	db := newGeoPackage(t)
+	addLayer(t, db, "roads", "LINESTRING", "highway")
+	insert(t, db, "roads", line(0, 0, 1, 1), map[string]any{"highway": "path"})
+	clean, _ := Convert(db, nopWriter{}, nil)
+	if s := clean.Total(); s.Skipped != 0 || s.Features != 1 {
+		t.Errorf("clean: %d features and %d skipped, want 1 and 0", s.Features, s.Skipped)
+	}
+
+	insert(t, db, "roads", line(1, 1, 2, 2), nil)
+	exec(t, db, "INSERT INTO roads (geom, highway) VALUES (X'47500001E61000000102', 'path')")
+	var reasons []string
+	partial, err := Convert(db, nopWriter{}, &Options{Skipped: func(s SkippedFeature) { reasons = append(reasons, s.Reason) }})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := partial.Total(); s.Skipped != 2 || s.Untagged != 1 || s.Features != 1 {
+		t.Errorf("partial: %d features, %d skipped and %d untagged, want 1, 2 and 1", s.Features, s.Skipped, s.Untagged)
+	}
+	slices.Sort(reasons)
+	if !slices.Equal(reasons, []string{SkipGeometry, SkipUntagged}) {
+		t.Errorf("skipped for %v", reasons)
+	}
+	kept, _ := Convert(db, nopWriter{}, &Options{KeepUntagged: true})
+	if s := kept.Total(); s.Skipped != 1 || s.Features != 2 {
+		t.Errorf("keeping untagged: %d features and %d skipped, want 2 and 1", s.Features, s.Skipped)
+	}
+
+	if _, err := Convert(db, nopWriter{}, &Options{Winding: "sideways"}); err == nil {
+		t.Error("fatal: no error")
+	}
+}
+
+// A feature whose tag columns are all NULL or empty still has its geometry, it is untagged and not a bad row
+func TestAllNullTags(t *testing.T) {
+	db := newGeoPackage(t)
+	addLayer(t, db, "buildings", "POLYGON", "building", "osm_tags")
+	square := polygon([]float64{0, 0, 1, 0, 1, 1, 0, 1, 0, 0})
+	insert(t, db, "buildings", square, map[string]any{"building": nil, "osm_tags": nil})
+	insert(t, db, "buildings", square, map[string]any{"building": nil, "osm_tags": "{}"})
+
+	logs := captureLogs(t)
+	file, summary := convert(t, db, nil)
+	if len(file.Ways) != 0 {
+		t.Errorf("got %d ways, want none", len(file.Ways))
+	}
+	if s := summary.Layer("buildings"); s.Untagged != 2 || s.Skipped != 2 {
+		t.Errorf("summary has %d untagged and %d skipped, want 2 of each", s.Untagged, s.Skipped)
+	}
+	if strings.Contains(logs.String(), "level=WARN") || strings.Contains(logs.String(), "level=ERROR") {
+		t.Errorf("untagged features were logged as problems:\n%s", logs)
+	}
+
+	file, summary = convert(t, db, &Options{KeepUntagged: true})
+	if len(file.Ways) != 2 || summary.Layer("buildings").Skipped != 0 {
+		t.Errorf("keeping untagged: got %d ways and %d skipped, want 2 and 0", len(file.Ways), summary.Layer("buildings").Skipped)
+	}
+	for _, w := range file.Ways {
+		if len(w.Tags) != 0 {
+			t.Errorf("way %d has the tags %v", w.ID, w.Tags)
+		}
+	}
+}
+
+func TestKeepUntagged(t *testing.T) {
+	db := newGeoPackage(t)
+	addLayer(t, db, "footprints", "GEOMETRY", "building")
+	insert(t, db, "footprints", polygon([]float64{0, 0, 1, 0, 1, 1, 0, 1, 0, 0}), nil)
+	insert(t, db, "footprints", line(2, 2, 3, 3), nil)
+	insert(t, db, "footprints", point(5, 5), nil)
+	insert(t, db, "footprints", polygon([]float64{10, 0, 11, 0, 11, 1, 10, 0}), map[string]any{"building": "yes"})
+
+	file, summary := convert(t, db, nil)
+	if len(file.Nodes) != 3 || len(file.Ways) != 1 {
+		t.Errorf("got %d nodes and %d ways, want only the building", len(file.Nodes), len(file.Ways))
+	}
+	if s := summary.Layer("footprints"); s.Untagged != 3 || s.Skipped != 3 {
+		t.Errorf("%d untagged and %d skipped, want 3 of each", s.Untagged, s.Skipped)
+	}
+
+	file, summary = convert(t, db, &Options{KeepUntagged: true})
+	if s := summary.Layer("footprints"); s.Features != 4 || s.Skipped != 0 || s.Untagged != 0 {
+		t.Errorf("keeping untagged: %d features, %d skipped and %d untagged, want 4, 0 and 0", s.Features, s.Skipped, s.Untagged)
+	}
+	if len(file.Ways) != 3 {
+		t.Fatalf("got %d ways, want 3", len(file.Ways))
+	}
+	// Without an area key the closed way gets no area=yes, see AreaKeys
+	checkTags(t, file.Ways[0].Tags)
+	checkTags(t, file.Ways[1].Tags)
+	checkTags(t, file.Ways[2].Tags, "building", "yes", "area", "yes")
+	// The point is a node of its own that no way uses
+	used := map[osm.NodeID]bool{}
+	for _, w := range file.Ways {
+		for _, n := range w.Nodes {
+			used[n.ID] = true
+		}
+	}
+	var points int
+	for _, n := range file.Nodes {
+		if !used[n.ID] {
+			points++
+			if n.Lon != 5 || n.Lat != 5 || len(n.Tags) != 0 {
+				t.Errorf("point node %v, want an untagged node at 5,5", n)
+			}
+		}
+	}
+	if points != 1 {
+		t.Errorf("got %d nodes outside the ways, want the point", points)
+	}
+}
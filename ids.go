@@ -0,0 +1,75 @@
+package gpkg2osm
+
+import (
+	"fmt"
+
+	"github.com/paulmach/osm"
+)
+
+// IDStrategy picks the direction IDs are handed out in
+type IDStrategy string
+
+const (
+	// New elements count down from -1, the convention for data that has not been uploaded to OSM
+	IDsNegative IDStrategy = "negative"
+	// New elements count up from 1, useful for giving several converted files their own ID ranges
+	IDsPositive IDStrategy = "positive"
+)
+
+// IDGenerator hands out IDs for new elements. By default new elements get negative IDs as they do not exist
+// in OSM yet. Nodes, ways and relations are numbered separately, as OSM IDs are only unique per type
+type IDGenerator struct {
+	node     int64
+	way      int64
+	relation int64
+
+	step int64 // Added to get the next ID, 0 counts down like -1
+}
+
+// NewIDGenerator returns a generator whose first ID of each type is start (or -start for IDsNegative)
+func NewIDGenerator(strategy IDStrategy, start int64) (*IDGenerator, error) {
+	if start < 1 {
+		return nil, fmt.Errorf("invalid ID start %d, must be at least 1", start)
+	}
+	var step int64
+	switch strategy {
+	case IDsNegative, "":
+		step = -1
+		start = -start
+	case IDsPositive:
+		step = 1
+	default:
+		return nil, fmt.Errorf("unknown ID strategy %q, must be negative or positive", strategy)
+	}
+	last := start - step
+	return &IDGenerator{node: last, way: last, relation: last, step: step}, nil
+}
+
+func (g *IDGenerator) next(last *int64) int64 {
+	if g.step == 0 {
+		g.step = -1
+	}
+	*last += g.step
+	return *last
+}
+
+// Move past an existing ID so it is never handed out. IDs on the other side of zero are ignored
+func (g *IDGenerator) skip(last *int64, id int64) {
+	if g.step > 0 {
+		*last = max(*last, id)
+	} else {
+		*last = min(*last, id)
+	}
+}
+
+func (g *IDGenerator) Node() osm.NodeID {
+	return osm.NodeID(g.next(&g.node))
+}
+
+func (g *IDGenerator) Way() osm.WayID {
+	return osm.WayID(g.next(&g.way))
+}
+
+func (g *IDGenerator) Relation() osm.RelationID {
+	return osm.RelationID(g.next(&g.relation))
+}
@@ -0,0 +1,47 @@
+package gpkg2osm
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/paulmach/osm"
+)
+
+func TestIDStrategies(t *testing.T) {
+	db := newGeoPackage(t)
+	addLayer(t, db, "roads", "LINESTRING", "highway")
+	insert(t, db, "roads", line(0, 0, 1, 1), map[string]any{"highway": "path"})
+	insert(t, db, "roads", line(2, 2, 3, 3), map[string]any{"highway": "path"})
+
+	for _, tt := range []struct {
+		strategy IDStrategy
+		start    int64
+		nodes    []int64
+		ways     []int64
+	}{
+		{IDsNegative, 1, []int64{-1, -2, -3, -4}, []int64{-1, -2}},
+		{IDsNegative, 100, []int64{-100, -101, -102, -103}, []int64{-100, -101}},
+		{IDsPositive, 1, []int64{1, 2, 3, 4}, []int64{1, 2}},
+		{IDsPositive, 5000, []int64{5000, 5001, 5002, 5003}, []int64{5000, 5001}},
+	} {
+		ids, err := NewIDGenerator(tt.strategy, tt.start)
+		if err != nil {
+			t.Fatal(err)
+		}
+		file, _ := convert(t, db, &Options{IDs: ids})
+		got := elementIDs(file)
+		// Every type is numbered on its own
+		if !slices.Equal(got[osm.TypeNode], tt.nodes) || !slices.Equal(got[osm.TypeWay], tt.ways) {
+			t.Errorf("%s from %d: nodes %v and ways %v, want %v and %v", tt.strategy, tt.start, got[osm.TypeNode], got[osm.TypeWay], tt.nodes, tt.ways)
+		}
+	}
+
+	for _, tt := range []struct {
+		strategy IDStrategy
+		start    int64
+	}{{IDsNegative, 0}, {IDsPositive, -1}, {"random", 1}} {
+		if _, err := NewIDGenerator(tt.strategy, tt.start); err == nil {
+			t.Errorf("NewIDGenerator(%q, %d) did not fail", tt.strategy, tt.start)
+		}
+	}
+}
@@ -0,0 +1,166 @@
+// Package gpkg writes small GeoPackages: the sample the command line generates, and the fixtures of the tests
+package gpkg
+
+import (
+	"database/sql"
+	"encoding/binary"
+	"fmt"
+	"slices"
+	"strings"
+
+	_ "github.com/mattn/go-sqlite3" // SQLite driver
+	"github.com/twpayne/go-geom"
+	"github.com/twpayne/go-geom/encoding/wkb"
+)
+
+// Schema has the tables of a minimal GeoPackage, with the data columns extension the tag columns are described in
+const Schema = `
+PRAGMA application_id = 1196444487;
+PRAGMA user_version = 10400;
+CREATE TABLE gpkg_spatial_ref_sys (
+	srs_name TEXT NOT NULL,
+	srs_id INTEGER PRIMARY KEY,
+	organization TEXT NOT NULL,
+	organization_coordsys_id INTEGER NOT NULL,
+	definition TEXT NOT NULL,
+	description TEXT
+);
+INSERT INTO gpkg_spatial_ref_sys VALUES
+	('Undefined cartesian SRS', -1, 'NONE', -1, 'undefined', NULL),
+	('Undefined geographic SRS', 0, 'NONE', 0, 'undefined', NULL),
+	('WGS 84 geodetic', 4326, 'EPSG', 4326, 'GEOGCS["WGS 84",DATUM["WGS_1984",SPHEROID["WGS 84",6378137,298.257223563]],PRIMEM["Greenwich",0],UNIT["degree",0.0174532925199433]]', 'longitude/latitude coordinates in decimal degrees on the WGS 84 spheroid');
+CREATE TABLE gpkg_contents (
+	table_name TEXT NOT NULL PRIMARY KEY,
+	data_type TEXT NOT NULL,
+	identifier TEXT UNIQUE,
+	description TEXT DEFAULT '',
+	last_change DATETIME NOT NULL DEFAULT (strftime('%Y-%m-%dT%H:%M:%fZ','now')),
+	min_x DOUBLE, min_y DOUBLE, max_x DOUBLE, max_y DOUBLE,
+	srs_id INTEGER REFERENCES gpkg_spatial_ref_sys(srs_id)
+);
+CREATE TABLE gpkg_geometry_columns (
+	table_name TEXT NOT NULL,
+	column_name TEXT NOT NULL,
+	geometry_type_name TEXT NOT NULL,
+	srs_id INTEGER NOT NULL REFERENCES gpkg_spatial_ref_sys(srs_id),
+	z TINYINT NOT NULL,
+	m TINYINT NOT NULL,
+	PRIMARY KEY (table_name, column_name)
+);
+CREATE TABLE gpkg_extensions (
+	table_name TEXT,
+	column_name TEXT,
+	extension_name TEXT NOT NULL,
+	definition TEXT NOT NULL,
+	scope TEXT NOT NULL
+);
+INSERT INTO gpkg_extensions VALUES
+	('gpkg_data_columns', NULL, 'gpkg_schema', 'http://www.geopackage.org/spec/#extension_schema', 'read-write'),
+	('gpkg_data_column_constraints', NULL, 'gpkg_schema', 'http://www.geopackage.org/spec/#extension_schema', 'read-write');
+CREATE TABLE gpkg_data_columns (
+	table_name TEXT NOT NULL,
+	column_name TEXT NOT NULL,
+	name TEXT,
+	title TEXT,
+	description TEXT,
+	mime_type TEXT,
+	constraint_name TEXT,
+	PRIMARY KEY (table_name, column_name)
+);
+CREATE TABLE gpkg_data_column_constraints (
+	constraint_name TEXT NOT NULL,
+	constraint_type TEXT NOT NULL,
+	value TEXT,
+	min NUMERIC, min_is_inclusive BOOLEAN,
+	max NUMERIC, max_is_inclusive BOOLEAN,
+	description TEXT
+);
+`
+
+// Execer is a *sql.DB or a *sql.Tx
+type Execer interface {
+	Exec(query string, args ...any) (sql.Result, error)
+}
+
+// Geometry encodes a geometry as a GeoPackage binary: the header (little endian, no envelope) and then the WKB
+func Geometry(g geom.T, srs int32) ([]byte, error) {
+	body, err := wkb.Marshal(g, binary.LittleEndian)
+	if err != nil {
+		return nil, err
+	}
+	b := []byte{'G', 'P', 0, 0b00000001}
+	b = binary.LittleEndian.AppendUint32(b, uint32(srs))
+	return append(b, body...), nil
+}
+
+// OpenMemory creates an empty GeoPackage in memory. Every connection of the pool sees the same database, which
+// is there until the last of them is closed, so the name must be unique while it is open
+func OpenMemory(name string) (*sql.DB, error) {
+	db, err := sql.Open("sqlite3", "file:"+name+"?mode=memory&cache=shared")
+	if err != nil {
+		return nil, err
+	}
+	if _, err := db.Exec(Schema); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+// AddLayer creates a feature table with a geom column of the type and TEXT columns, and registers it. Columns
+// named osm_tags hold a JSON object of tags, the others are described as OSM tags
+func AddLayer(db Execer, table, geometryType string, srs int32, columns ...string) error {
+	defs := []string{"fid INTEGER PRIMARY KEY AUTOINCREMENT", "geom " + geometryType}
+	for _, c := range columns {
+		defs = append(defs, quote(c)+" TEXT")
+	}
+	if _, err := db.Exec(fmt.Sprintf("CREATE TABLE %s (%s)", quote(table), strings.Join(defs, ", "))); err != nil {
+		return err
+	}
+	if _, err := db.Exec("INSERT INTO gpkg_contents (table_name, data_type, identifier, srs_id) VALUES (?, 'features', ?, ?)", table, table, srs); err != nil {
+		return err
+	}
+	if _, err := db.Exec("INSERT INTO gpkg_geometry_columns VALUES (?, 'geom', ?, ?, 0, 0)", table, geometryType, srs); err != nil {
+		return err
+	}
+	for _, c := range columns {
+		var err error
+		if c == "osm_tags" {
+			_, err = db.Exec("INSERT INTO gpkg_data_columns (table_name, column_name, mime_type) VALUES (?, ?, 'application/json')", table, c)
+		} else {
+			_, err = db.Exec("INSERT INTO gpkg_data_columns (table_name, column_name, description) VALUES (?, ?, 'OSM tag')", table, c)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Insert adds a feature to a table, with the geometry in the srs and the values by column. A nil geometry is
+// stored as NULL
+func Insert(db Execer, table string, g geom.T, srs int32, values map[string]any) error {
+	var blob any
+	if g != nil {
+		b, err := Geometry(g, srs)
+		if err != nil {
+			return err
+		}
+		blob = b
+	}
+	cols, marks, args := []string{"geom"}, []string{"?"}, []any{blob}
+	keys := make([]string, 0, len(values))
+	for k := range values {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	for _, k := range keys {
+		cols, marks, args = append(cols, quote(k)), append(marks, "?"), append(args, values[k])
+	}
+	_, err := db.Exec(fmt.Sprintf("INSERT INTO %s (%s) VALUES (%s)", quote(table), strings.Join(cols, ", "), strings.Join(marks, ", ")), args...)
+	return err
+}
+
+func quote(name string) string {
+	return `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
+}
@@ -0,0 +1,682 @@
+package gpkg2osm
+
+import (
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/twpayne/go-geom"
+)
+
+// Gpkg geometry types that we allow
+var valid_geoms = map[string]geom.T{
+	"MULTIPOLYGON":    &geom.MultiPolygon{},
+	"POLYGON":         &geom.Polygon{},
+	"MULTILINESTRING": &geom.MultiLineString{},
+	"LINESTRING":      &geom.LineString{},
+	"MULTIPOINT":      &geom.MultiPoint{},
+	"POINT":           &geom.Point{},
+
+	// Curves are only converted with Options.ApproximateCurves, to the linear type they approximate
+	"CIRCULARSTRING": &geom.LineString{},
+	"COMPOUNDCURVE":  &geom.LineString{},
+	"CURVEPOLYGON":   &geom.Polygon{},
+	"MULTICURVE":     &geom.MultiLineString{},
+	"MULTISURFACE":   &geom.MultiPolygon{},
+
+	// Any of the types above, every feature is converted by the type it has
+	"GEOMETRY": nil,
+}
+
+// ExportLayer holds information about which columns get exported to the OSM file
+type ExportLayer struct {
+	Name          string                       `json:"name"`             // Also Table Name
+	Tags          []string                     `json:"tag_columns"`      // Columns that directly map to an OSM tag
+	JSONTags      []string                     `json:"json_tag_columns"` // Columns holding a JSON object of tags, later columns take precedence
+	GeometryField string                       `json:"geometry_column"`  // Name of geometery colum
+	FIDColumn     string                       `json:"-"`                // Integer primary key, "" if the table has none
+	OSMIDColumn   string                       `json:"-"`                // Column with the ID of the OSM element of each row, see Options.OSMIDColumn
+	VersionColumn string                       `json:"-"`                // Column with the version to that ID, "" if there is none
+	GeometryType  string                       `json:"geometry_type"`
+	SRS           int32                        `json:"srs"`
+	Description   string                       `json:"description,omitempty"` // From gpkg_contents
+	LastChange    string                       `json:"last_change,omitempty"` // From gpkg_contents, when the layer was last changed
+	TagKeys       map[string]string            `json:"tag_keys,omitempty"`    // OSM key of the Tags columns that are not named after it
+	Z             sql.NullBool                 `json:"-"`
+	M             sql.NullBool                 `json:"-"`
+	Where         string                       `json:"-"` // Optional SQL predicate (on the raw columns) limiting which features are read
+	Limit         int                          `json:"-"` // Read at most this many features, 0 for all of them
+	ValueMap      map[string]map[string]string `json:"-"` // Replacement tag values by key, see Options.ValueMap
+	LowercaseKeys bool                         `json:"-"` // Lowercase every tag key that is read
+	ColumnsWin    bool                         `json:"-"` // Merge the descriptive columns after the JSON columns, see Options.TagPrecedence
+	EnumLabels    map[string]map[string]string `json:"-"` // Description of each value of the enum constrained tag columns, by column
+	Related       *RelatedTable                `json:"-"` // Table whose related row adds tags to each feature, see Options.RelatedTags
+	CurveSegments int                          `json:"-"` // Segments per quarter circle for approximating curves, 0 skips them
+}
+
+// Get the Query that is used to read elements from this layer. Rows are read in the order of the FIDColumn, so
+// every run meets the features in the same order whatever plan sqlite picks; views have none and are read as
+// sqlite returns them
+func (l *ExportLayer) Query() string {
+	qry := l.selectQuery()
+	if l.Where != "" {
+		qry += " WHERE (" + l.Where + ")"
+	}
+	if l.FIDColumn != "" {
+		qry += " ORDER BY " + quoteIdent(l.FIDColumn)
+	}
+	if l.Limit > 0 {
+		qry += fmt.Sprintf(" LIMIT %d", l.Limit)
+	}
+	return qry
+}
+
+// Count the rows of the layer that match its Where, regardless of its Limit
+func (l *ExportLayer) Count(db *sql.DB) (int64, error) {
+	qry := "SELECT count(*) FROM " + quoteIdent(l.Name)
+	if l.Where != "" {
+		if err := ValidateWhere(l.Where); err != nil {
+			return 0, err
+		}
+		qry += " WHERE (" + l.Where + ")"
+	}
+	var n int64
+	err := db.QueryRow(qry).Scan(&n)
+	return n, err
+}
+
+// The SELECT that reads the geometry, the primary key and the OSM ID and version if there are any, and then one JSON object of tags for each of the tagSources. The
+// objects are merged in Go rather than with json_patch so we can tell when a column overrides another
+func (l *ExportLayer) selectQuery() string {
+	cols := []string{quoteIdent(l.GeometryField)}
+	if l.FIDColumn != "" {
+		cols = append(cols, quoteIdent(l.FIDColumn))
+	}
+	if l.OSMIDColumn != "" {
+		cols = append(cols, quoteIdent(l.OSMIDColumn))
+	}
+	if l.VersionColumn != "" {
+		cols = append(cols, quoteIdent(l.VersionColumn))
+	}
+	for _, src := range l.tagSources() {
+		if src == relatedSource {
+			cols = append(cols, l.Related.query(l.Name))
+			continue
+		}
+		if src != "" {
+			cols = append(cols, quoteIdent(src))
+			continue
+		}
+		// The descriptive columns are gathered into a single object keyed by column, decodeRow maps them to their
+		// keys so columns that share one are reported rather than lost in json_object
+		pairs := make([]string, 0, len(l.Tags)*2)
+		for _, t := range l.Tags {
+			pairs = append(pairs, quoteLiteral(t), quoteIdent(t))
+		}
+		cols = append(cols, fmt.Sprintf("json_object(%s)", strings.Join(pairs, ", ")))
+	}
+	return fmt.Sprintf("SELECT %s FROM %s", strings.Join(cols, ", "), quoteIdent(l.Name))
+}
+
+// The tag columns in the order they are merged, later ones take precedence. The related table comes first so the
+// feature's own columns win, then the descriptive tag columns as a single source named "" and the JSON columns,
+// or the other way around with ColumnsWin
+func (l *ExportLayer) tagSources() []string {
+	sources := make([]string, 0, len(l.JSONTags)+2)
+	if l.Related != nil {
+		sources = append(sources, relatedSource)
+	}
+	if len(l.Tags) > 0 && !l.ColumnsWin {
+		sources = append(sources, "")
+	}
+	sources = append(sources, l.JSONTags...)
+	if len(l.Tags) > 0 && l.ColumnsWin {
+		sources = append(sources, "")
+	}
+	return sources
+}
+
+// Quote a table or column name so reserved words and odd characters are safe in a query
+func quoteIdent(name string) string {
+	return `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
+}
+
+// Quote a string literal for a query
+func quoteLiteral(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", "''") + "'"
+}
+
+// ValidateWhere checks that a user supplied predicate can be appended to the layer query as a single
+// expression. This is not a SQL parser, it only stops the predicate from breaking out of the query;
+// anything else wrong with it is reported by sqlite when the query runs
+func ValidateWhere(pred string) error {
+	depth := 0
+	var quote rune
+	runes := []rune(pred)
+	for i, c := range runes {
+		if quote != 0 {
+			// Doubled quotes ('it''s') just close and reopen the string
+			if c == quote {
+				quote = 0
+			}
+			continue
+		}
+		switch c {
+		case '\'', '"', '`':
+			quote = c
+		case '[':
+			quote = ']'
+		case '(':
+			depth++
+		case ')':
+			depth--
+			if depth < 0 {
+				return fmt.Errorf("unbalanced parentheses")
+			}
+		case ';':
+			return fmt.Errorf("must be a single expression, found ';'")
+		case '-', '/':
+			if i+1 < len(runes) && (runes[i+1] == '-' && c == '-' || runes[i+1] == '*' && c == '/') {
+				return fmt.Errorf("comments are not allowed")
+			}
+		}
+	}
+	if quote != 0 {
+		return fmt.Errorf("unterminated quote %q", quote)
+	}
+	if depth != 0 {
+		return fmt.Errorf("unbalanced parentheses")
+	}
+	return nil
+}
+
+// srsID scans an srs_id column. The spec makes it an INTEGER, but some writers store it as text such as '4326',
+// ' 4326' or 'EPSG:4326', which is read as well and noted in Text so it can be warned about
+type srsID struct {
+	ID   int32
+	Text string // The value as it was stored, if it was text
+}
+
+func (s *srsID) Scan(v any) error {
+	switch v := v.(type) {
+	case nil:
+		return nil
+	case int64:
+		if v < math.MinInt32 || v > math.MaxInt32 {
+			return fmt.Errorf("srs_id %d is out of range", v)
+		}
+		s.ID = int32(v)
+		return nil
+	case float64:
+		return s.setFloat(v, v)
+	case []byte:
+		return s.setText(string(v))
+	case string:
+		return s.setText(v)
+	}
+	return fmt.Errorf("cannot use %T as an srs_id", v)
+}
+
+func (s *srsID) setText(v string) error {
+	s.Text = v
+	t := strings.TrimSpace(v)
+	if len(t) > 5 && strings.EqualFold(t[:5], "EPSG:") {
+		t = t[5:]
+	}
+	if id, err := strconv.ParseInt(t, 10, 32); err == nil {
+		s.ID = int32(id)
+		return nil
+	}
+	f, err := strconv.ParseFloat(t, 64)
+	if err != nil {
+		return fmt.Errorf("srs_id %q is not a number", v)
+	}
+	return s.setFloat(f, v)
+}
+
+// REAL srs_ids are only taken if they are whole
+func (s *srsID) setFloat(f float64, v any) error {
+	if f != math.Trunc(f) || f < math.MinInt32 || f > math.MaxInt32 {
+		return fmt.Errorf("srs_id %v is not a valid ID", v)
+	}
+	s.ID = int32(f)
+	return nil
+}
+
+// Warn about an srs_id that was not stored as the INTEGER the spec requires
+func (s *srsID) check(table, source string) {
+	if s.Text != "" {
+		slog.Warn("srs_id is stored as text, it should be an integer", "table", table, "source", source, "value", s.Text, "srs", s.ID)
+	}
+}
+
+// Add the features tables listed in gpkg_geometry_columns to layers
+func readGeometryColumns(db *sql.DB, layers map[string]*ExportLayer, ignored map[string]bool) error {
+	sqlite_geom_qry := `SELECT g.table_name, g.column_name, g.geometry_type_name, g.srs_id, g.z, g.m, c.data_type, c.description, CAST(c.last_change AS TEXT)
+	FROM gpkg_geometry_columns g LEFT JOIN gpkg_contents c ON c.table_name = g.table_name`
+	rows, err := db.Query(sqlite_geom_qry)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		// The GeoPackage specification defines the columns for gpkg_geometry_columns.
+		// These are the common ones, but you might need to adjust based on your specific GeoPackage version/data.
+		// Refer to the GeoPackage specification for the exact table schema.
+		l := ExportLayer{Tags: []string{}, JSONTags: []string{}}
+		var geo_type, data_type, desc, changed sql.NullString
+		var srs srsID
+
+		err := rows.Scan(
+			&l.Name,
+			&l.GeometryField,
+			&geo_type,
+			&srs,
+			&l.Z,
+			&l.M,
+			&data_type,
+			&desc,
+			&changed,
+		)
+
+		// Convert the geo_type to the proper enum
+		l.GeometryType = geo_type.String
+		l.Description, l.LastChange = desc.String, changed.String
+		l.SRS = srs.ID
+		if err != nil {
+			slog.Warn("error scanning geometry column", "err", err)
+			continue
+		}
+		if ignored[l.Name] {
+			continue
+		}
+		if data_type.String != "features" {
+			slog.Debug("skipping geometry table that is missing from gpkg_contents", "name", l.Name)
+			ignored[l.Name] = true
+			continue
+		}
+		srs.check(l.Name, "gpkg_geometry_columns")
+		layers[l.Name] = &l
+	}
+	return rows.Err()
+}
+
+// Check that the geometry column exists, and if not (and fallback is set), look for a column that is declared with
+// a geometry type instead. The type of that column becomes the geometry type of the layer if none is known
+func (l *ExportLayer) checkGeometryColumn(db *sql.DB, fallback bool) error {
+	rows, err := db.Query("SELECT name, upper(type) FROM pragma_table_info(?)", l.Name)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	var found, foundType string
+	for rows.Next() {
+		var name, typ string
+		if err := rows.Scan(&name, &typ); err != nil {
+			return err
+		}
+		if l.GeometryField != "" && strings.EqualFold(name, l.GeometryField) {
+			l.GeometryField = name
+			if _, ok := geometryColumnTypes[typ]; ok && l.GeometryType == "" {
+				l.GeometryType = typ
+			}
+			return nil
+		}
+		if _, ok := geometryColumnTypes[typ]; ok && found == "" {
+			found, foundType = name, typ
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if !fallback {
+		return fmt.Errorf("column %q does not exist", l.GeometryField)
+	}
+	if found == "" {
+		if l.GeometryField == "" {
+			return fmt.Errorf("no column is declared with a geometry type")
+		}
+		return fmt.Errorf("column %q does not exist, and no other column is declared with a geometry type", l.GeometryField)
+	}
+	slog.Warn("using the geometry column declared in the table", "name", l.Name, "column", found, "registered", l.GeometryField)
+	l.GeometryField = found
+	if l.GeometryType == "" {
+		l.GeometryType = foundType
+	}
+	return nil
+}
+
+// The OSM key of a tag column
+func (l *ExportLayer) tagKey(column string) string {
+	if key, ok := l.TagKeys[column]; ok {
+		return key
+	}
+	return column
+}
+
+// Take the columns with common attribute names as tags, for a layer that has no tag columns described as such.
+// See HeuristicTagColumns
+func (l *ExportLayer) guessTagColumns(db *sql.DB) error {
+	rows, err := db.Query("SELECT name FROM pragma_table_info(?)", l.Name)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return err
+		}
+		key, ok := heuristicKey(name)
+		if !ok || name == l.GeometryField {
+			continue
+		}
+		l.Tags = append(l.Tags, name)
+		if key != name {
+			if l.TagKeys == nil {
+				l.TagKeys = make(map[string]string)
+			}
+			l.TagKeys[name] = key
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if len(l.Tags) > 0 {
+		slog.Info("guessed tag columns from their names", "table", l.Name, "columns", strings.Join(l.Tags, ","))
+	}
+	return nil
+}
+
+// Find the integer primary key of the table, the fid column in a GeoPackage. Views and tables with a key of
+// several columns have none
+func (l *ExportLayer) findFIDColumn(db *sql.DB) error {
+	rows, err := db.Query("SELECT name FROM pragma_table_info(?) WHERE pk > 0 AND upper(type) = 'INTEGER'", l.Name)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	var keys []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return err
+		}
+		keys = append(keys, name)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	var n int
+	if err := db.QueryRow("SELECT count(*) FROM pragma_table_info(?) WHERE pk > 0", l.Name).Scan(&n); err != nil {
+		return err
+	}
+	if len(keys) == 1 && n == 1 {
+		l.FIDColumn = keys[0]
+	}
+	return nil
+}
+
+// Column types a GeoPackage declares geometry columns with
+var geometryColumnTypes = map[string]bool{
+	"GEOMETRY":           true,
+	"POINT":              true,
+	"LINESTRING":         true,
+	"POLYGON":            true,
+	"MULTIPOINT":         true,
+	"MULTILINESTRING":    true,
+	"MULTIPOLYGON":       true,
+	"GEOMETRYCOLLECTION": true,
+}
+
+// Check a table exists in the database
+func tableExists(db *sql.DB, name string) (bool, error) {
+	var n int
+	err := db.QueryRow("SELECT count(*) FROM sqlite_master WHERE type IN ('table', 'view') AND name = ?", name).Scan(&n)
+	return n > 0, err
+}
+
+// Whether the layer is declared to hold points, which become nodes
+func (l *ExportLayer) isPoints() bool {
+	return l.GeometryType == "POINT" || l.GeometryType == "MULTIPOINT"
+}
+
+// The type the features of the layer are converted as, the declared type unless it is a curve
+func (l *ExportLayer) linearType() string {
+	if g, ok := valid_geoms[l.GeometryType]; ok && g != nil {
+		return geomTypeName(g)
+	}
+	return l.GeometryType
+}
+
+// Whether a decoded geometry has the type the layer declares. A GEOMETRY layer can hold any type
+func (l *ExportLayer) declares(g geom.T) bool {
+	return l.GeometryType == "GEOMETRY" || geomTypeName(g) == l.linearType()
+}
+
+// Validate if this is an exportable layer or not
+func (l *ExportLayer) Validate() error {
+	return l.validate(true)
+}
+
+// Validate, but with requireTags false a layer without any tag columns is exportable too
+func (l *ExportLayer) validate(requireTags bool) error {
+	if requireTags && len(l.JSONTags) == 0 && len(l.Tags) == 0 {
+		return fmt.Errorf("no OSM tags")
+	}
+	if l.GeometryField == "" {
+		return fmt.Errorf("no geometry column")
+	}
+	if _, ok := valid_geoms[l.GeometryType]; !ok {
+		return fmt.Errorf("invalid geometry type")
+	}
+	return nil
+}
+
+// Only "features" tables hold vector data, anything else (tiles, attributes, ...) is not for us. Attribute
+// tables have no geometry so they would never be found, but mark everything explicitly so the logs say why a
+// table was left out
+func readIgnoredTables(db *sql.DB, ignored map[string]bool) error {
+	rows, err := db.Query("SELECT table_name, data_type FROM gpkg_contents WHERE data_type IS NOT 'features'")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var name, data_type sql.NullString
+		if err := rows.Scan(&name, &data_type); err != nil {
+			slog.Warn("error scanning contents", "err", err)
+			continue
+		}
+		slog.Debug("skipping table that is not a features table", "name", name.String, "data_type", data_type.String)
+		ignored[name.String] = true
+	}
+	return rows.Err()
+}
+
+// Add the features tables that gpkg_geometry_columns does not list. They can still be read if the table declares
+// a geometry column itself
+func readContents(db *sql.DB, layers map[string]*ExportLayer, ignored map[string]bool) error {
+	rows, err := db.Query("SELECT table_name, srs_id, description, CAST(last_change AS TEXT) FROM gpkg_contents WHERE data_type = 'features'")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var name string
+		var srs srsID
+		var desc, changed sql.NullString
+		if err := rows.Scan(&name, &srs, &desc, &changed); err != nil {
+			slog.Warn("error scanning contents", "err", err)
+			continue
+		}
+		if _, ok := layers[name]; ok || ignored[name] {
+			continue
+		}
+		srs.check(name, "gpkg_contents")
+		l := &ExportLayer{Name: name, Tags: []string{}, JSONTags: []string{}, SRS: srs.ID, Description: desc.String, LastChange: changed.String}
+		layers[name] = l
+	}
+	return rows.Err()
+}
+
+// Find the tag columns of the layers. We only care about columns described as an OSM Tag, and JSON columns that
+// are either "osm_tags" or described as OSM tags. JSON columns are merged in the order they are listed. With
+// enumColumns, columns with an enum constraint of the schema extension are tags as well
+func readDataColumns(db *sql.DB, layers map[string]*ExportLayer, ignored map[string]bool, enumColumns bool) error {
+	enums, err := readEnumConstraints(db)
+	if err != nil {
+		return err
+	}
+	// Only asked for when there are constraints, files without the extension may not even have the column
+	constraintColumn := "NULL"
+	if len(enums) > 0 {
+		constraintColumn = "constraint_name"
+	}
+	rows, err := db.Query("SELECT table_name, column_name, description, mime_type, " + constraintColumn + " FROM gpkg_data_columns ORDER BY rowid")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	var table, col, desc, mime_type, constraint sql.NullString
+	for rows.Next() {
+		if err := rows.Scan(&table, &col, &desc, &mime_type, &constraint); err != nil {
+			slog.Warn("error scanning data column", "error", err)
+			continue
+		}
+		l, ok := layers[table.String]
+		if !ok {
+			if !ignored[table.String] {
+				slog.Warn("not a geometry layer", "name", table.String)
+			}
+			continue
+		}
+
+		isTag := strings.Contains(strings.ToLower(desc.String), "osm tag")
+		if mime_type.String == "application/json" && (col.String == "osm_tags" || isTag) {
+			// valid JSON tags field
+			l.JSONTags = append(l.JSONTags, col.String)
+			continue
+		}
+		labels, isEnum := enums[constraint.String]
+		if isEnum && enumColumns && !isTag {
+			slog.Info("using enumerated column as a tag", "table", l.Name, "column", col.String, "constraint", constraint.String)
+			isTag = true
+		}
+		if isTag {
+			l.Tags = append(l.Tags, col.String)
+			if isEnum && len(labels) > 0 {
+				if l.EnumLabels == nil {
+					l.EnumLabels = make(map[string]map[string]string)
+				}
+				l.EnumLabels[col.String] = labels
+			}
+		}
+	}
+	return rows.Err()
+}
+
+// GetGeoPackageLayers queries the GeoPackage for its feature tables and their column information,
+// determining OSM tag mappings based on specific rules.
+func GetGeoPackageLayers(db *sql.DB) (map[string]*ExportLayer, error) {
+	return GetGeoPackageLayersWith(db, nil)
+}
+
+// LayerOptions change how GetGeoPackageLayersWith finds the tag columns
+type LayerOptions struct {
+	// Use columns with an enum constraint (gpkg_data_column_constraints) as tags, even if their description does
+	// not mark them as OSM tags
+	EnumColumns bool
+
+	// Keep the layers that have no tag columns at all, for converting just their geometry. Their features have
+	// no tags, so they are only written with Options.KeepUntagged
+	GeometryOnly bool
+
+	// For layers without any tag columns, take the columns with common attribute names (name, highway,
+	// addr_street, ...) as tags, see HeuristicTagColumns. Layers with tag columns are left as they are
+	HeuristicTags bool
+
+	// Geometry column to use instead of the one in gpkg_geometry_columns, by layer name. The "" entry is for
+	// every layer not listed. It is an error if a layer does not have the column
+	GeometryColumns map[string]string
+}
+
+// GetGeoPackageLayersWith is GetGeoPackageLayers with options, nil for the defaults
+func GetGeoPackageLayersWith(db *sql.DB, opts *LayerOptions) (map[string]*ExportLayer, error) {
+	if opts == nil {
+		opts = &LayerOptions{}
+	}
+	layers := make(map[string]*ExportLayer, 5)
+	ignored := make(map[string]bool) // Tables that are not exported, no need to warn about their data columns
+
+	if err := readIgnoredTables(db, ignored); err != nil {
+		return nil, err
+	}
+
+	// Broken files may lack gpkg_geometry_columns, every table then has to be found from gpkg_contents below
+	hasGeomCols, err := tableExists(db, "gpkg_geometry_columns")
+	if err != nil {
+		return nil, err
+	}
+	if hasGeomCols {
+		if err := readGeometryColumns(db, layers, ignored); err != nil {
+			return nil, err
+		}
+	} else {
+		slog.Warn("missing gpkg_geometry_columns, looking for geometry columns in the tables instead")
+	}
+
+	if err := readContents(db, layers, ignored); err != nil {
+		return nil, err
+	}
+	for name, l := range layers {
+		col, ok := opts.GeometryColumns[name]
+		if !ok {
+			col, ok = opts.GeometryColumns[""]
+		}
+		if ok {
+			l.GeometryField = col
+			if err := l.checkGeometryColumn(db, false); err != nil {
+				return nil, fmt.Errorf("geometry column of layer %s: %w", name, err)
+			}
+		} else if err := l.checkGeometryColumn(db, true); err != nil {
+			slog.Warn("cannot find geometry column", "name", name, "err", err)
+		}
+	}
+
+	if err := readDataColumns(db, layers, ignored, opts.EnumColumns); err != nil {
+		return nil, err
+	}
+	if opts.HeuristicTags {
+		for name, l := range layers {
+			if len(l.Tags) > 0 || len(l.JSONTags) > 0 {
+				continue
+			}
+			if err := l.guessTagColumns(db); err != nil {
+				slog.Warn("cannot read the columns of the layer", "name", name, "err", err)
+			}
+		}
+	}
+	// osm_tags is always merged last
+	for _, l := range layers {
+		sort.SliceStable(l.JSONTags, func(i, j int) bool { return l.JSONTags[j] == "osm_tags" && l.JSONTags[i] != "osm_tags" })
+	}
+
+	// Validate that the layer is exportable
+	for name, l := range layers {
+		if err := l.validate(!opts.GeometryOnly); err != nil {
+			slog.Warn("bad layer", "name", name, "reason", err.Error())
+			delete(layers, name)
+		}
+	}
+
+	for _, layer := range layers {
+		cols := append(append([]string{}, layer.Tags...), layer.JSONTags...)
+		slog.Info("found layer for export", slog.String("name", layer.Name), slog.String("cols", strings.Join(cols, ",")), slog.String("geometry", layer.GeometryType))
+	}
+	return layers, nil
+}
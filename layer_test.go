@@ -0,0 +1,397 @@
+package gpkg2osm
+
+import (
+	"bytes"
+	"encoding/json"
+	"maps"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nullmonk/gpkg2osm/internal/gpkg"
+)
+
+func TestWhere(t *testing.T) {
+	db := newGeoPackage(t)
+	addLayer(t, db, "roads", "LINESTRING", "highway", "name")
+	for i, hw := range []string{"motorway", "residential", "primary", "residential"} {
+		insert(t, db, "roads", line(0, float64(i), 1, float64(i)), map[string]any{"highway": hw, "name": string(rune('A' + i))})
+	}
+
+	file, summary := convert(t, db, &Options{Where: "highway IN ('motorway', 'primary')"})
+	var names []string
+	for _, w := range file.Ways {
+		names = append(names, w.Tags.Find("name"))
+	}
+	if !slices.Equal(names, []string{"A", "C"}) {
+		t.Errorf("converted %v, want the ways A and C", names)
+	}
+	if n := summary.Total().Features; n != 2 {
+		t.Errorf("summary has %d features, want 2", n)
+	}
+
+	for _, pred := range []string{"1); DROP TABLE roads; --", "highway = 'motorway", "(1", "1 -- everything"} {
+		if _, err := Convert(db, nopWriter{}, &Options{Where: pred}); err == nil {
+			t.Errorf("where %q: no error", pred)
+		}
+	}
+}
+
+func TestValidateWhere(t *testing.T) {
+	for _, pred := range []string{
+		"highway = 'motorway'",
+		"name = 'it''s; fine'",
+		`"order" > 2 AND (lanes IS NULL OR lanes < 4)`,
+		"[weird;name] = 1",
+		"a - b / 2 > 0",
+	} {
+		if err := ValidateWhere(pred); err != nil {
+			t.Errorf("ValidateWhere(%q) = %v", pred, err)
+		}
+	}
+	for _, pred := range []string{"1; DELETE FROM roads", "(1", "1)", "x = 'open", "1 /* x */", "1 --"} {
+		if err := ValidateWhere(pred); err == nil {
+			t.Errorf("ValidateWhere(%q) passed", pred)
+		}
+	}
+}
+
+// Names are quoted, so reserved words and quotes in them neither break the query nor get into it
+func TestQuotedNames(t *testing.T) {
+	db := newGeoPackage(t)
+	table := `it's a "layer"`
+	addLayer(t, db, table, "POINT", "order", `name'), 'x`, `say "hi"`, "with space")
+	insert(t, db, table, point(1, 2), map[string]any{
+		"order": "1", `name'), 'x`: "quote", `say "hi"`: "double", "with space": "space",
+	})
+
+	file, _ := convert(t, db, nil)
+	if len(file.Nodes) != 1 {
+		t.Fatalf("got %d nodes, want 1", len(file.Nodes))
+	}
+	checkTags(t, file.Nodes[0].Tags, "order", "1", `name'), 'x`, "quote", `say "hi"`, "double", "with space", "space")
+}
+
+// The layers are written as they are for --json-summary
+func TestLayerJSON(t *testing.T) {
+	db := newGeoPackage(t)
+	addLayer(t, db, "pois", "POINT", "amenity", "name", "osm_tags")
+	addLayer(t, db, "roads", "LINESTRING", "highway")
+	exec(t, db, "UPDATE gpkg_contents SET last_change = '2024-05-01T00:00:00Z'")
+	exec(t, db, "UPDATE gpkg_contents SET description = 'Main roads' WHERE table_name = 'roads'")
+
+	layers, err := GetGeoPackageLayers(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := json.Marshal(layers)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got, want any
+	if err := json.Unmarshal(data, &got); err != nil {
+		t.Fatal(err)
+	}
+	json.Unmarshal([]byte(`{
+		"pois": {
+			"name": "pois",
+			"tag_columns": ["amenity", "name"],
+			"json_tag_columns": ["osm_tags"],
+			"geometry_column": "geom",
+			"geometry_type": "POINT",
+			"srs": 4326,
+			"last_change": "2024-05-01T00:00:00Z"
+		},
+		"roads": {
+			"name": "roads",
+			"tag_columns": ["highway"],
+			"json_tag_columns": [],
+			"geometry_column": "geom",
+			"geometry_type": "LINESTRING",
+			"srs": 4326,
+			"description": "Main roads",
+			"last_change": "2024-05-01T00:00:00Z"
+		}
+	}`), &want)
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("layers as JSON:\n%s", data)
+	}
+}
+
+// Rows are read in the order of their fid, even when sqlite would rather walk an index, so a resumed or limited
+// conversion meets the features in the same order as the first
+func TestQueryOrder(t *testing.T) {
+	db := newGeoPackage(t)
+	addLayer(t, db, "roads", "LINESTRING", "highway", "name")
+	for i, hw := range []string{"secondary", "primary", "tertiary", "motorway"} {
+		insert(t, db, "roads", line(0, float64(i), 1, float64(i)), map[string]any{"highway": hw, "name": string(rune('A' + i))})
+	}
+	exec(t, db, "CREATE INDEX roads_highway ON roads (highway)")
+
+	for _, opts := range []*Options{{Where: "highway > 'a'"}, {Where: "highway > 'a'", Limit: 2}} {
+		file, _ := convert(t, db, opts)
+		var names []string
+		for _, w := range file.Ways {
+			names = append(names, w.Tags.Find("name"))
+		}
+		if want := []string{"A", "B", "C", "D"}[:len(file.Ways)]; len(names) == 0 || !slices.Equal(names, want) {
+			t.Errorf("where %q limit %d: converted %v, want %v", opts.Where, opts.Limit, names, want)
+		}
+	}
+}
+
+func TestLimit(t *testing.T) {
+	db := newGeoPackage(t)
+	addLayer(t, db, "pois", "POINT", "amenity")
+	addLayer(t, db, "shops", "POINT", "shop")
+	for i := range 10 {
+		amenity := "bench"
+		if i%3 == 0 {
+			amenity = "cafe"
+		}
+		insert(t, db, "pois", point(float64(i), 0), map[string]any{"amenity": amenity})
+		insert(t, db, "shops", point(float64(i), 1), map[string]any{"shop": "bakery"})
+	}
+
+	// The limit is for each layer
+	for limit, want := range map[int]int{0: 10, 3: 3, 20: 10} {
+		file, summary := convert(t, db, &Options{Limit: limit})
+		if p, s := summary.Layer("pois").Features, summary.Layer("shops").Features; p != want || s != want {
+			t.Errorf("limit %d: %d pois and %d shops, want %d of each", limit, p, s, want)
+		}
+		if len(file.Nodes) != 2*want {
+			t.Errorf("limit %d: %d nodes written, want %d", limit, len(file.Nodes), 2*want)
+		}
+	}
+
+	// and counts the features that match the predicate
+	file, _ := convert(t, db, &Options{Limit: 2, Where: "fid > 3"})
+	var got []string
+	for _, n := range file.Nodes {
+		got = append(got, n.Tags.Find("amenity")+n.Tags.Find("shop"))
+	}
+	if !slices.Equal(got, []string{"cafe", "bench", "bakery", "bakery"}) {
+		t.Errorf("limit 2 of fid > 3: %v", got)
+	}
+}
+
+// Only the tables gpkg_contents says are features are layers, even if gpkg_geometry_columns lists others
+func TestMixedContents(t *testing.T) {
+	db := newGeoPackage(t)
+	addLayer(t, db, "pois", "POINT", "amenity")
+	insert(t, db, "pois", point(1, 2), map[string]any{"amenity": "bench"})
+	exec(t, db, "CREATE TABLE tiles (id INTEGER PRIMARY KEY, zoom_level INTEGER, tile_column INTEGER, tile_row INTEGER, tile_data BLOB, geom BLOB)")
+	exec(t, db, "INSERT INTO gpkg_contents (table_name, data_type, identifier, srs_id) VALUES ('tiles', 'tiles', 'tiles', 4326)")
+	exec(t, db, "INSERT INTO gpkg_geometry_columns VALUES ('tiles', 'geom', 'POINT', 4326, 0, 0)")
+	exec(t, db, "CREATE TABLE notes (id INTEGER PRIMARY KEY, amenity TEXT)")
+	exec(t, db, "INSERT INTO gpkg_contents (table_name, data_type, identifier) VALUES ('notes', 'attributes', 'notes')")
+	exec(t, db, "INSERT INTO gpkg_data_columns (table_name, column_name, description) VALUES ('notes', 'amenity', 'OSM tag')")
+
+	layers, err := GetGeoPackageLayers(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(layers) != 1 || layers["pois"] == nil {
+		t.Errorf("got the layers %v, want just pois", slices.Sorted(maps.Keys(layers)))
+	}
+	file, _ := convert(t, db, nil)
+	if len(file.Nodes) != 1 {
+		t.Errorf("got %d nodes, want 1", len(file.Nodes))
+	}
+}
+
+// Attribute tables are left out on purpose, which is only worth a debug message
+func TestAttributesSkipped(t *testing.T) {
+	db := newGeoPackage(t)
+	addLayer(t, db, "pois", "POINT", "amenity")
+	insert(t, db, "pois", point(1, 2), map[string]any{"amenity": "bench"})
+	exec(t, db, "CREATE TABLE opening_hours (id INTEGER PRIMARY KEY, poi INTEGER, opening_hours TEXT)")
+	exec(t, db, "INSERT INTO opening_hours (poi, opening_hours) VALUES (1, '24/7')")
+	exec(t, db, "INSERT INTO gpkg_contents (table_name, data_type, identifier) VALUES ('opening_hours', 'attributes', 'opening_hours')")
+	exec(t, db, "INSERT INTO gpkg_data_columns (table_name, column_name, description) VALUES ('opening_hours', 'opening_hours', 'OSM tag')")
+
+	logs := captureLogs(t)
+	file, summary := convert(t, db, nil)
+	if len(file.Nodes) != 1 || len(summary.Layers) != 1 {
+		t.Errorf("got %d nodes from %d layers, want just the pois", len(file.Nodes), len(summary.Layers))
+	}
+	if strings.Contains(logs.String(), "level=WARN") {
+		t.Errorf("warned about the attributes table:\n%s", logs)
+	}
+	if !strings.Contains(logs.String(), `msg="skipping table that is not a features table" name=opening_hours data_type=attributes`) {
+		t.Errorf("the skip was not logged:\n%s", logs)
+	}
+}
+
+// gpkg_geometry_columns names the_geom, the table has shape instead, declared as a plain BLOB so it cannot be
+// found without being told
+func TestGeometryColumnOverride(t *testing.T) {
+	db := newGeoPackage(t)
+	exec(t, db, "CREATE TABLE roads (fid INTEGER PRIMARY KEY, shape BLOB, highway TEXT)")
+	exec(t, db, "INSERT INTO gpkg_contents (table_name, data_type, identifier, srs_id) VALUES ('roads', 'features', 'roads', 4326)")
+	exec(t, db, "INSERT INTO gpkg_geometry_columns VALUES ('roads', 'the_geom', 'LINESTRING', 4326, 0, 0)")
+	exec(t, db, "INSERT INTO gpkg_data_columns (table_name, column_name, description) VALUES ('roads', 'highway', 'OSM tag')")
+	addLayer(t, db, "pois", "POINT", "amenity")
+	shape, err := gpkg.Geometry(line(0, 0, 1, 1), wgs84)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exec(t, db, "INSERT INTO roads (shape, highway) VALUES (?, 'path')", shape)
+
+	if _, summary := convert(t, db, nil); summary.Layer("roads").Ways != 0 {
+		t.Error("roads was converted without its geometry column")
+	}
+
+	layers, err := GetGeoPackageLayersWith(db, &LayerOptions{GeometryColumns: map[string]string{"roads": "SHAPE"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l := layers["roads"]; l == nil || l.GeometryField != "shape" || layers["pois"].GeometryField != "geom" {
+		t.Fatalf("layers %v, want roads with its shape column and pois as it is", layers)
+	}
+	summary, err := ConvertAll([]Input{{DB: db, Layers: layers}}, nopWriter{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := summary.Layer("roads").Ways; n != 1 {
+		t.Errorf("got %d ways from roads, want 1", n)
+	}
+
+	// The column has to be there in every layer it is given for
+	for _, columns := range []map[string]string{{"roads": "geometry"}, {"": "shape"}} {
+		if _, err := GetGeoPackageLayersWith(db, &LayerOptions{GeometryColumns: columns}); err == nil {
+			t.Errorf("geometry columns %v: no error", columns)
+		}
+	}
+}
+
+// A result set left open holds its connection, so with a single connection the next query would wait forever
+func TestLayersCloseRows(t *testing.T) {
+	db := newGeoPackage(t)
+	db.SetMaxOpenConns(1)
+	addLayer(t, db, "roads", "LINESTRING", "highway")
+	insert(t, db, "roads", line(0, 0, 1, 1), map[string]any{"highway": "path"})
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for range 50 {
+			if _, err := GetGeoPackageLayers(db); err != nil {
+				t.Error(err)
+				return
+			}
+			var buf bytes.Buffer
+			if _, err := Convert(db, NewXMLWriter(&buf), nil); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(30 * time.Second):
+		t.Fatal("conversions are stuck waiting for a connection")
+	}
+	if n := db.Stats().InUse; n != 0 {
+		t.Errorf("%d connections are still in use", n)
+	}
+}
+
+// srs_ids stored as text or REAL are read, anything that is not a whole number is an error
+func TestSRSIDScan(t *testing.T) {
+	for _, tt := range []struct {
+		v    any
+		id   int32
+		text bool
+		ok   bool
+	}{
+		{nil, 0, false, true},
+		{int64(4326), 4326, false, true},
+		{float64(3857), 3857, false, true},
+		{"4326", 4326, true, true},
+		{[]byte(" 4326 "), 4326, true, true},
+		{"EPSG:3857", 3857, true, true},
+		{"epsg:4326", 4326, true, true},
+		{"4326.0", 4326, true, true},
+		{"4326.5", 0, true, false},
+		{"WGS 84", 0, true, false},
+		{int64(1) << 40, 0, false, false},
+		{true, 0, false, false},
+	} {
+		var s srsID
+		err := s.Scan(tt.v)
+		if (err == nil) != tt.ok || (tt.ok && s.ID != tt.id) || (s.Text != "") != tt.text {
+			t.Errorf("Scan(%#v) = %+v, %v", tt.v, s, err)
+		}
+	}
+}
+
+// Layers whose srs_id is stored as text are converted, with a warning. gpkg_contents is only read for the layers
+// that gpkg_geometry_columns does not list
+func TestSRSIDText(t *testing.T) {
+	db := newGeoPackage(t)
+	addLayer(t, db, "pois", "POINT", "amenity")
+	addLayer(t, db, "shops", "POINT", "shop")
+	insert(t, db, "pois", point(1, 2), map[string]any{"amenity": "bench"})
+	insert(t, db, "shops", point(2, 2), map[string]any{"shop": "bakery"})
+	exec(t, db, "UPDATE gpkg_geometry_columns SET srs_id = 'EPSG:4326' WHERE table_name = 'pois'")
+	exec(t, db, "DELETE FROM gpkg_geometry_columns WHERE table_name = 'shops'")
+	exec(t, db, "UPDATE gpkg_contents SET srs_id = 'epsg:4326' WHERE table_name = 'shops'")
+	logs := captureLogs(t)
+
+	if file, _ := convert(t, db, nil); len(file.Nodes) != 2 {
+		t.Errorf("got %d nodes, want 2", len(file.Nodes))
+	}
+	for _, source := range []string{"table=pois source=gpkg_geometry_columns", "table=shops source=gpkg_contents"} {
+		if !strings.Contains(logs.String(), "srs_id is stored as text, it should be an integer\" "+source) {
+			t.Errorf("no warning for %s:\n%s", source, logs)
+		}
+	}
+}
+
+func TestGeometryOnly(t *testing.T) {
+	db := newGeoPackage(t)
+	addLayer(t, db, "footprints", "POLYGON")
+	addLayer(t, db, "roads", "LINESTRING", "highway")
+	insert(t, db, "footprints", polygon([]float64{0, 0, 1, 0, 1, 1, 0, 0}), nil)
+	insert(t, db, "footprints", polygon([]float64{2, 0, 3, 0, 3, 1, 2, 0}), nil)
+	insert(t, db, "roads", line(5, 5, 6, 6), map[string]any{"highway": "path"})
+
+	// Without tag columns the layer is not found at all
+	layers, err := GetGeoPackageLayers(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := layers["footprints"]; ok || layers["roads"] == nil {
+		t.Fatalf("got layers %v, want only roads", slices.Sorted(maps.Keys(layers)))
+	}
+	file, summary := convert(t, db, nil)
+	if len(file.Ways) != 1 || summary.Layers["footprints"] != nil {
+		t.Errorf("got %d ways and footprints %v, want only the road", len(file.Ways), summary.Layers["footprints"])
+	}
+
+	// Found, but its features have no tags
+	_, summary = convert(t, db, &Options{GeometryOnly: true})
+	if s := summary.Layer("footprints"); s.Untagged != 2 || s.Features != 0 {
+		t.Errorf("footprints: %d untagged and %d features, want 2 and none", s.Untagged, s.Features)
+	}
+
+	file, summary = convert(t, db, &Options{GeometryOnly: true, KeepUntagged: true})
+	if len(file.Ways) != 3 || summary.Layer("footprints").Features != 2 {
+		t.Fatalf("got %d ways and %d footprints, want 3 and 2", len(file.Ways), summary.Layer("footprints").Features)
+	}
+	checkTags(t, file.Ways[0].Tags)
+	checkTags(t, file.Ways[2].Tags, "highway", "path")
+
+	// Default tags make the features tagged, the layer tag is only added to what is written anyway
+	file, _ = convert(t, db, &Options{GeometryOnly: true, DefaultTags: map[string]map[string]string{"footprints": {"building": "yes"}}})
+	if len(file.Ways) != 3 {
+		t.Fatalf("with default tags: got %d ways, want 3", len(file.Ways))
+	}
+	checkTags(t, file.Ways[0].Tags, "building", "yes", "area", "yes")
+	if file, _ = convert(t, db, &Options{GeometryOnly: true, LayerTagKey: "source:layer"}); len(file.Ways) != 1 {
+		t.Errorf("with a layer tag: got %d ways, want only the road", len(file.Ways))
+	}
+}
@@ -0,0 +1,69 @@
+package gpkg2osm
+
+import (
+	"database/sql"
+	"strings"
+	"time"
+)
+
+// Find the plain text metadata that describes a layer, for tagging where its data came from. Metadata that
+// references the table itself is used over metadata for the whole GeoPackage, several entries are joined
+// with ";". Other kinds of metadata (ISO 19115 XML and so on) cannot be a tag value and are ignored.
+// Returns "" if there is none, or the GeoPackage has no metadata tables
+func layerMetadata(db *sql.DB, table string) (string, error) {
+	var n int
+	if err := db.QueryRow("SELECT count(*) FROM sqlite_master WHERE type IN ('table', 'view') AND name IN ('gpkg_metadata', 'gpkg_metadata_reference')").Scan(&n); err != nil {
+		return "", err
+	}
+	if n < 2 {
+		return "", nil
+	}
+
+	rows, err := db.Query(`SELECT m.metadata, r.reference_scope
+	FROM gpkg_metadata_reference r JOIN gpkg_metadata m ON m.id = r.md_file_id
+	WHERE m.mime_type = 'text/plain' AND (r.reference_scope = 'geopackage' OR (r.reference_scope = 'table' AND r.table_name = ?))
+	ORDER BY m.id`, table)
+	if err != nil {
+		return "", err
+	}
+	defer rows.Close()
+
+	var layer, all []string
+	for rows.Next() {
+		var md, scope sql.NullString
+		if err := rows.Scan(&md, &scope); err != nil {
+			return "", err
+		}
+		v := strings.TrimSpace(md.String)
+		if v == "" {
+			continue
+		}
+		if scope.String == "table" {
+			layer = append(layer, v)
+		} else {
+			all = append(all, v)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return "", err
+	}
+	if len(layer) > 0 {
+		return strings.Join(layer, ";"), nil
+	}
+	return strings.Join(all, ";"), nil
+}
+
+// The tags from the gpkg_contents row of the layer: source:date with the day it was last changed, and source with
+// its description. A last_change that does not start with a date is left out
+func (l *ExportLayer) contentsTags() map[string]string {
+	tags := make(map[string]string, 2)
+	if len(l.LastChange) >= 10 {
+		if _, err := time.Parse(time.DateOnly, l.LastChange[:10]); err == nil {
+			tags["source:date"] = l.LastChange[:10]
+		}
+	}
+	if d := strings.TrimSpace(l.Description); d != "" {
+		tags["source"] = d
+	}
+	return tags
+}
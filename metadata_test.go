@@ -0,0 +1,79 @@
+package gpkg2osm
+
+import "testing"
+
+// The tables of the metadata extension, as the spec defines them
+const metadataSchema = `
+CREATE TABLE gpkg_metadata (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	md_scope TEXT NOT NULL DEFAULT 'dataset',
+	md_standard_uri TEXT NOT NULL,
+	mime_type TEXT NOT NULL DEFAULT 'text/xml',
+	metadata TEXT NOT NULL DEFAULT ''
+);
+CREATE TABLE gpkg_metadata_reference (
+	reference_scope TEXT NOT NULL,
+	table_name TEXT,
+	column_name TEXT,
+	row_id_value INTEGER,
+	timestamp DATETIME NOT NULL DEFAULT (strftime('%Y-%m-%dT%H:%M:%fZ','now')),
+	md_file_id INTEGER NOT NULL,
+	md_parent_id INTEGER
+);`
+
+func TestMetadataTag(t *testing.T) {
+	db := newGeoPackage(t)
+	addLayer(t, db, "roads", "LINESTRING", "highway")
+	addLayer(t, db, "pois", "POINT", "amenity", "source")
+	insert(t, db, "roads", line(0, 0, 1, 1), map[string]any{"highway": "path"})
+	insert(t, db, "pois", point(1, 2), map[string]any{"amenity": "bench"})
+	insert(t, db, "pois", point(2, 2), map[string]any{"amenity": "bench", "source": "survey"})
+
+	// Without the metadata tables there is nothing to add
+	file, _ := convert(t, db, &Options{MetadataTagKey: "source"})
+	checkTags(t, file.Ways[0].Tags, "highway", "path")
+
+	exec(t, db, metadataSchema)
+	exec(t, db, `INSERT INTO gpkg_metadata (md_standard_uri, mime_type, metadata) VALUES
+		('http://www.isotc211.org/2005/gmd', 'text/xml', '<gmd:MD_Metadata/>'),
+		('http://example.com', 'text/plain', ' City of Example '),
+		('http://example.com', 'text/plain', 'Road survey 2023'),
+		('http://example.com', 'text/plain', 'CC-BY 4.0')`)
+	exec(t, db, `INSERT INTO gpkg_metadata_reference (reference_scope, table_name, md_file_id) VALUES
+		('geopackage', NULL, 1),
+		('geopackage', NULL, 2),
+		('table', 'roads', 3),
+		('table', 'roads', 4)`)
+
+	file, _ = convert(t, db, &Options{MetadataTagKey: "source"})
+	// The layer's own metadata over the GeoPackage's, and the feature's own tag over both
+	checkTags(t, file.Ways[0].Tags, "highway", "path", "source", "Road survey 2023;CC-BY 4.0")
+	nodes := taggedNodes(file)
+	checkTags(t, nodes[0].Tags, "amenity", "bench", "source", "City of Example")
+	checkTags(t, nodes[1].Tags, "amenity", "bench", "source", "survey")
+}
+
+// source:date and source come from the gpkg_contents row of each layer
+func TestIncludeMetadata(t *testing.T) {
+	db := newGeoPackage(t)
+	addLayer(t, db, "roads", "LINESTRING", "highway", "source")
+	addLayer(t, db, "pois", "POINT", "amenity")
+	exec(t, db, `UPDATE gpkg_contents SET last_change = '2023-06-30T08:15:00.000Z', description = ' City survey 2023 ' WHERE table_name = 'roads';
+		UPDATE gpkg_contents SET last_change = 'yesterday', description = '' WHERE table_name = 'pois'`)
+	insert(t, db, "roads", line(0, 0, 1, 1), map[string]any{"highway": "path"})
+	insert(t, db, "roads", line(0, 1, 1, 2), map[string]any{"highway": "path", "source": "gps"})
+	insert(t, db, "pois", point(1, 2), map[string]any{"amenity": "bench"})
+
+	file, _ := convert(t, db, &Options{IncludeMetadata: true})
+	if len(file.Ways) != 2 || len(taggedNodes(file)) != 1 {
+		t.Fatalf("got %d ways and %d tagged nodes, want 2 and 1", len(file.Ways), len(taggedNodes(file)))
+	}
+	checkTags(t, file.Ways[0].Tags, "highway", "path", "source:date", "2023-06-30", "source", "City survey 2023")
+	// The feature's own source is kept
+	checkTags(t, file.Ways[1].Tags, "highway", "path", "source:date", "2023-06-30", "source", "gps")
+	// Nothing usable in the contents row
+	checkTags(t, taggedNodes(file)[0].Tags, "amenity", "bench")
+
+	file, _ = convert(t, db, nil)
+	checkTags(t, file.Ways[0].Tags, "highway", "path")
+}
@@ -0,0 +1,512 @@
+package gpkg2osm
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"time"
+
+	"github.com/paulmach/osm"
+)
+
+// O5M datasets, see https://wiki.openstreetmap.org/wiki/O5m
+const (
+	o5mNode     = 0x10
+	o5mWay      = 0x11
+	o5mRelation = 0x12
+	o5mHeader   = 0xe0
+	o5mEnd      = 0xfe
+	o5mReset    = 0xff // Starts the delta coding and the string table over
+)
+
+const (
+	o5mTableSize = 15000 // Strings a reference can go back
+	o5mMaxString = 250   // Longer strings are never added to the table
+)
+
+// o5mState is the delta coding and string table of an O5M stream, which a reset clears. Element IDs, coordinates,
+// timestamps and changesets are written as the difference from the previous one, and way and relation members
+// as the difference from the previous member of the same type
+type o5mState struct {
+	id, timestamp, changeset, lon, lat int64
+	refs                               [3]int64 // Node, way and relation members
+
+	// Strings added to the table so far. The encoder finds them by content and the decoder by how many strings
+	// ago they were added
+	count   int
+	written map[string]int // Encoder only
+	table   [][]byte       // Decoder only, a ring of o5mTableSize strings
+}
+
+// The index of member references for an element type, and the character that marks it in a role
+func o5mRefIndex(t osm.Type) int {
+	switch t {
+	case osm.TypeNode:
+		return 0
+	case osm.TypeWay:
+		return 1
+	}
+	return 2
+}
+
+// o5mWriter writes elements as an O5M file. The format wants all the nodes first, then the ways, then the
+// relations, so nodes are written as they come and the ways and relations are held, already encoded, until
+// Close. They are kept in memory until they outgrow spoolMemory, then in a temporary file.
+// Coordinates are stored in units of 1e-7 degrees like PBF. O5M only has a timestamp and user when there is a
+// version, so they are left out of elements without one
+type o5mWriter struct {
+	w         io.Writer
+	started   bool
+	nodes     o5mEncoder
+	ways      o5mEncoder
+	relations o5mEncoder
+	wayBuf    spool
+	relBuf    spool
+}
+
+func NewO5MWriter(w io.Writer) *o5mWriter {
+	return &o5mWriter{w: w}
+}
+
+// Write the file header, which also resets the stream for the nodes
+func (o *o5mWriter) start() error {
+	if o.started {
+		return nil
+	}
+	o.started = true
+	_, err := o.w.Write([]byte{o5mReset, o5mHeader, 0x04, 'o', '5', 'm', '2'})
+	return err
+}
+
+func (o *o5mWriter) Write(file *osm.OSM) error {
+	if err := o.start(); err != nil {
+		return err
+	}
+	for _, n := range file.Nodes {
+		if !finite(n.Lon) || !finite(n.Lat) {
+			return fmt.Errorf("node %d has an invalid coordinate %v,%v", n.ID, n.Lon, n.Lat)
+		}
+		o.nodes.node(n)
+		if err := o.nodes.flush(o.w, o5mNode); err != nil {
+			return err
+		}
+	}
+	for _, w := range file.Ways {
+		o.ways.way(w)
+		if err := o.ways.flush(&o.wayBuf, o5mWay); err != nil {
+			return err
+		}
+	}
+	for _, r := range file.Relations {
+		o.relations.relation(r)
+		if err := o.relations.flush(&o.relBuf, o5mRelation); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close writes the held ways and relations after the nodes, each after a reset, and ends the file
+func (o *o5mWriter) Close() error {
+	if err := o.start(); err != nil {
+		return err
+	}
+	for _, b := range []*spool{&o.wayBuf, &o.relBuf} {
+		if b.Len() == 0 {
+			continue
+		}
+		if _, err := o.w.Write([]byte{o5mReset}); err != nil {
+			return err
+		}
+		if _, err := b.WriteTo(o.w); err != nil {
+			return err
+		}
+	}
+	_, err := o.w.Write([]byte{o5mEnd})
+	return err
+}
+
+// o5mEncoder builds the datasets of one element type, each starting from the state the last one left
+type o5mEncoder struct {
+	o5mState
+	body []byte
+}
+
+// Write the dataset that was built and start the next one
+func (e *o5mEncoder) flush(w io.Writer, typ byte) error {
+	head := binary.AppendUvarint([]byte{typ}, uint64(len(e.body)))
+	if _, err := w.Write(head); err != nil {
+		return err
+	}
+	_, err := w.Write(e.body)
+	e.body = e.body[:0]
+	return err
+}
+
+func (e *o5mEncoder) node(n *osm.Node) {
+	e.delta(&e.id, int64(n.ID))
+	e.info(n.Version, n.Timestamp, n.ChangesetID, n.UserID, n.User)
+	if !n.Visible {
+		return // A deleted node has no coordinates
+	}
+	e.delta(&e.lon, int64(math.Round(n.Lon*1e7)))
+	e.delta(&e.lat, int64(math.Round(n.Lat*1e7)))
+	e.tags(n.Tags)
+}
+
+func (e *o5mEncoder) way(w *osm.Way) {
+	e.delta(&e.id, int64(w.ID))
+	e.info(w.Version, w.Timestamp, w.ChangesetID, w.UserID, w.User)
+	if !w.Visible {
+		return
+	}
+	// The node references are a section of their own, prefixed with its length
+	refs := e.body
+	e.body = nil
+	for _, n := range w.Nodes {
+		e.delta(&e.refs[0], int64(n.ID))
+	}
+	section := e.body
+	e.body = append(binary.AppendUvarint(refs, uint64(len(section))), section...)
+	e.tags(w.Tags)
+}
+
+func (e *o5mEncoder) relation(r *osm.Relation) {
+	e.delta(&e.id, int64(r.ID))
+	e.info(r.Version, r.Timestamp, r.ChangesetID, r.UserID, r.User)
+	if !r.Visible {
+		return
+	}
+	refs := e.body
+	e.body = nil
+	for _, m := range r.Members {
+		i := o5mRefIndex(m.Type)
+		e.delta(&e.refs[i], m.Ref)
+		// The member type is the first character of the role
+		e.string(append([]byte{byte('0' + i)}, m.Role...), false)
+	}
+	section := e.body
+	e.body = append(binary.AppendUvarint(refs, uint64(len(section))), section...)
+	e.tags(r.Tags)
+}
+
+// The version, and if there is one the timestamp, and if there is one of those the changeset and user
+func (e *o5mEncoder) info(version int, ts time.Time, changeset osm.ChangesetID, uid osm.UserID, user string) {
+	e.body = binary.AppendUvarint(e.body, uint64(version))
+	if version == 0 {
+		return
+	}
+	var t int64
+	if !ts.IsZero() {
+		t = ts.Unix()
+	}
+	e.delta(&e.timestamp, t)
+	if t == 0 {
+		return
+	}
+	e.delta(&e.changeset, int64(changeset))
+	// The uid is a varint in place of the first string, and 0 is written as an empty string
+	var id []byte
+	if uid != 0 {
+		id = binary.AppendUvarint(nil, uint64(uid))
+	}
+	e.string(append(append(id, 0), user...), true)
+}
+
+func (e *o5mEncoder) tags(tags osm.Tags) {
+	for _, t := range tags {
+		e.string([]byte(t.Key+"\x00"+t.Value), true)
+	}
+}
+
+// Write a signed value as the difference from the previous one
+func (e *o5mEncoder) delta(prev *int64, v int64) {
+	e.body = binary.AppendVarint(e.body, v-*prev)
+	*prev = v
+}
+
+// Write a string, or string pair joined by a 0 byte, as a reference if it was written recently. Only strings of
+// up to o5mMaxString bytes are added to the table
+func (e *o5mEncoder) string(s []byte, pair bool) {
+	if i, ok := e.written[string(s)]; ok && e.count-i <= o5mTableSize {
+		e.body = binary.AppendUvarint(e.body, uint64(e.count-i))
+		return
+	}
+	e.body = append(append(append(e.body, 0), s...), 0)
+	if o5mStringSize(s, pair) > o5mMaxString {
+		return
+	}
+	if e.written == nil {
+		e.written = make(map[string]int)
+	}
+	e.written[string(s)] = e.count
+	e.count++
+}
+
+// o5mScanner reads the elements of an O5M file, as an osm.Scanner
+type o5mScanner struct {
+	r    *bufio.Reader
+	st   o5mState
+	obj  osm.Object
+	err  error
+	done bool
+}
+
+func NewO5MScanner(r io.Reader) *o5mScanner {
+	return &o5mScanner{r: bufio.NewReader(r)}
+}
+
+func (s *o5mScanner) Scan() bool {
+	for !s.done && s.err == nil {
+		typ, err := s.r.ReadByte()
+		if err == io.EOF {
+			// Without the end marker the file was cut off
+			s.err = fmt.Errorf("o5m: %w", io.ErrUnexpectedEOF)
+			return false
+		}
+		if err != nil {
+			s.err = err
+			return false
+		}
+		switch {
+		case typ == o5mEnd:
+			s.done = true
+			return false
+		case typ == o5mReset:
+			s.st = o5mState{}
+			continue
+		case typ >= 0xf0:
+			continue // Other datasets without a length
+		}
+		n, err := binary.ReadUvarint(s.r)
+		if err != nil {
+			s.err = fmt.Errorf("o5m: %w", err)
+			return false
+		}
+		body := make([]byte, n)
+		if _, err := io.ReadFull(s.r, body); err != nil {
+			s.err = fmt.Errorf("o5m: %w", err)
+			return false
+		}
+		d := &o5mDecoder{st: &s.st, b: body}
+		switch typ {
+		case o5mNode:
+			s.obj = d.node()
+		case o5mWay:
+			s.obj = d.way()
+		case o5mRelation:
+			s.obj = d.relation()
+		case o5mHeader:
+			if string(body) != "o5m2" {
+				s.err = fmt.Errorf("o5m: unsupported header %q", body)
+			}
+			continue
+		default:
+			continue // Bounding box, file timestamp, or something newer we can skip
+		}
+		if d.err != nil {
+			s.err = fmt.Errorf("o5m: %w", d.err)
+			return false
+		}
+		return true
+	}
+	return false
+}
+
+func (s *o5mScanner) Object() osm.Object { return s.obj }
+func (s *o5mScanner) Err() error         { return s.err }
+func (s *o5mScanner) Close() error       { return nil }
+
+var errO5MTruncated = errors.New("dataset is cut short")
+
+// o5mDecoder reads one dataset
+type o5mDecoder struct {
+	st  *o5mState
+	b   []byte
+	err error
+}
+
+func (d *o5mDecoder) node() *osm.Node {
+	n := &osm.Node{ID: osm.NodeID(d.delta(&d.st.id))}
+	n.Version, n.Timestamp, n.ChangesetID, n.UserID, n.User = d.info()
+	if len(d.b) == 0 {
+		return n
+	}
+	n.Visible = true
+	n.Lon = float64(d.delta(&d.st.lon)) / 1e7
+	n.Lat = float64(d.delta(&d.st.lat)) / 1e7
+	n.Tags = d.tags()
+	return n
+}
+
+func (d *o5mDecoder) way() *osm.Way {
+	w := &osm.Way{ID: osm.WayID(d.delta(&d.st.id))}
+	w.Version, w.Timestamp, w.ChangesetID, w.UserID, w.User = d.info()
+	if len(d.b) == 0 {
+		return w
+	}
+	w.Visible = true
+	refs := d.section()
+	for len(refs.b) > 0 && refs.err == nil {
+		w.Nodes = append(w.Nodes, osm.WayNode{ID: osm.NodeID(refs.delta(&d.st.refs[0]))})
+	}
+	if refs.err != nil {
+		d.err = refs.err
+	}
+	w.Tags = d.tags()
+	return w
+}
+
+func (d *o5mDecoder) relation() *osm.Relation {
+	r := &osm.Relation{ID: osm.RelationID(d.delta(&d.st.id))}
+	r.Version, r.Timestamp, r.ChangesetID, r.UserID, r.User = d.info()
+	if len(d.b) == 0 {
+		return r
+	}
+	r.Visible = true
+	refs := d.section()
+	for len(refs.b) > 0 && refs.err == nil {
+		// The reference comes before the type that says which delta it is from
+		ref := refs.varint()
+		role := refs.string(false)
+		if refs.err != nil {
+			break
+		}
+		if len(role) == 0 || role[0] < '0' || role[0] > '2' {
+			refs.err = fmt.Errorf("invalid member type %q", role)
+			break
+		}
+		m := osm.Member{Type: []osm.Type{osm.TypeNode, osm.TypeWay, osm.TypeRelation}[role[0]-'0'], Role: string(role[1:])}
+		prev := &d.st.refs[role[0]-'0']
+		*prev += ref
+		m.Ref = *prev
+		r.Members = append(r.Members, m)
+	}
+	if refs.err != nil {
+		d.err = refs.err
+	}
+	r.Tags = d.tags()
+	return r
+}
+
+func (d *o5mDecoder) info() (int, time.Time, osm.ChangesetID, osm.UserID, string) {
+	version := int(d.uvarint())
+	if version == 0 {
+		return 0, time.Time{}, 0, 0, ""
+	}
+	t := d.delta(&d.st.timestamp)
+	if t == 0 {
+		return version, time.Time{}, 0, 0, ""
+	}
+	changeset := d.delta(&d.st.changeset)
+	id, user, _ := bytes.Cut(d.string(true), []byte{0})
+	uid, _ := binary.Uvarint(id)
+	return version, time.Unix(t, 0).UTC(), osm.ChangesetID(changeset), osm.UserID(uid), string(user)
+}
+
+func (d *o5mDecoder) tags() osm.Tags {
+	var tags osm.Tags
+	for len(d.b) > 0 && d.err == nil {
+		k, v, _ := bytes.Cut(d.string(true), []byte{0})
+		tags = append(tags, osm.Tag{Key: string(k), Value: string(v)})
+	}
+	return tags
+}
+
+// A length prefixed section of the dataset, read with a decoder of its own. It is skipped in this one
+func (d *o5mDecoder) section() *o5mDecoder {
+	n := d.uvarint()
+	if n > uint64(len(d.b)) {
+		d.err = errO5MTruncated
+		return &o5mDecoder{st: d.st}
+	}
+	s := &o5mDecoder{st: d.st, b: d.b[:n]}
+	d.b = d.b[n:]
+	return s
+}
+
+func (d *o5mDecoder) uvarint() uint64 {
+	v, n := binary.Uvarint(d.b)
+	if n <= 0 {
+		d.err = errO5MTruncated
+		d.b = nil
+		return 0
+	}
+	d.b = d.b[n:]
+	return v
+}
+
+func (d *o5mDecoder) varint() int64 {
+	v, n := binary.Varint(d.b)
+	if n <= 0 {
+		d.err = errO5MTruncated
+		d.b = nil
+		return 0
+	}
+	d.b = d.b[n:]
+	return v
+}
+
+// Read a value written as the difference from the previous one
+func (d *o5mDecoder) delta(prev *int64) int64 {
+	*prev += d.varint()
+	return *prev
+}
+
+// Read a string, or string pair joined by a 0 byte, either written in place or as a reference to the table
+func (d *o5mDecoder) string(pair bool) []byte {
+	if len(d.b) == 0 {
+		d.err = errO5MTruncated
+		return nil
+	}
+	st := d.st
+	if d.b[0] != 0 {
+		ref := d.uvarint()
+		if ref == 0 || ref > uint64(min(st.count, o5mTableSize)) {
+			d.err = fmt.Errorf("invalid string reference %d", ref)
+			d.b = nil
+			return nil
+		}
+		return st.table[(st.count-int(ref))%o5mTableSize]
+	}
+	// In place strings are between 0 bytes, a pair has one more in the middle
+	zeros := 1
+	if pair {
+		zeros = 2
+	}
+	end := 1
+	for ; end < len(d.b); end++ {
+		if d.b[end] == 0 {
+			if zeros--; zeros == 0 {
+				break
+			}
+		}
+	}
+	if end >= len(d.b) {
+		d.err = errO5MTruncated
+		d.b = nil
+		return nil
+	}
+	s := d.b[1:end]
+	d.b = d.b[end+1:]
+	if o5mStringSize(s, pair) <= o5mMaxString {
+		if st.table == nil {
+			st.table = make([][]byte, o5mTableSize)
+		}
+		st.table[st.count%o5mTableSize] = s
+		st.count++
+	}
+	return s
+}
+
+// The length that decides if a string goes in the table, which does not count the 0 byte joining a pair
+func o5mStringSize(s []byte, pair bool) int {
+	if pair {
+		return len(s) - 1
+	}
+	return len(s)
+}
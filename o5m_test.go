@@ -0,0 +1,128 @@
+package gpkg2osm
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/paulmach/osm"
+)
+
+// The bytes of a small file, worked out by hand from the format description
+func TestO5MBytes(t *testing.T) {
+	tags := osm.Tags{{Key: "a", Value: "b"}}
+	file := &osm.OSM{
+		Nodes: osm.Nodes{
+			{ID: 1, Lon: 1e-7, Lat: -2e-7, Tags: tags, Visible: true},
+			{ID: 2, Lon: 1e-7, Lat: -2e-7, Tags: tags, Visible: true},
+		},
+		Ways: osm.Ways{{ID: 10, Nodes: osm.WayNodes{{ID: 1}, {ID: 2}}, Tags: tags, Visible: true}},
+		Relations: osm.Relations{{ID: 5, Visible: true, Members: osm.Members{
+			{Type: osm.TypeWay, Ref: 10, Role: "outer"},
+			{Type: osm.TypeNode, Ref: 1},
+		}}},
+	}
+	var buf bytes.Buffer
+	w := NewO5MWriter(&buf)
+	if err := w.Write(file); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	want := []byte{
+		0xff, 0xe0, 0x04, 'o', '5', 'm', '2',
+		// id +1, no version, lon +1, lat -2, a=b
+		0x10, 0x09, 0x02, 0x00, 0x02, 0x03, 0x00, 'a', 0x00, 'b', 0x00,
+		// id +1, no version, the same place, a=b as the last string in the table
+		0x10, 0x05, 0x02, 0x00, 0x00, 0x00, 0x01,
+		0xff,
+		// id +10, no version, 2 bytes of node references +1 and +1, a=b again since the reset
+		0x11, 0x0a, 0x14, 0x00, 0x02, 0x02, 0x02, 0x00, 'a', 0x00, 'b', 0x00,
+		0xff,
+		// id +5, no version, 13 bytes of members: way +10 as outer, node +1 without a role
+		0x12, 0x10, 0x0a, 0x00, 0x0d, 0x14, 0x00, '1', 'o', 'u', 't', 'e', 'r', 0x00, 0x02, 0x00, '0', 0x00,
+		0xfe,
+	}
+	if !bytes.Equal(buf.Bytes(), want) {
+		t.Errorf("wrote\n% x\nwant\n% x", buf.Bytes(), want)
+	}
+	if got := readOSM(t, buf.Bytes(), FormatO5M); fmt.Sprint(got.Relations[0].Members) != fmt.Sprint(file.Relations[0].Members) {
+		t.Errorf("read back members %v, want %v", got.Relations[0].Members, file.Relations[0].Members)
+	}
+}
+
+// Everything the writer can store comes back from the scanner as it was
+func TestO5MRoundTrip(t *testing.T) {
+	ts := time.Date(2024, 1, 2, 15, 4, 5, 0, time.UTC)
+	long := strings.Repeat("x", 300) // Never added to the string table
+	file := &osm.OSM{}
+	for i := range 20000 {
+		// More strings than the table holds, so the first ones are written again in full
+		n := &osm.Node{ID: osm.NodeID(-i - 1), Lon: -179.9999999 + float64(i)*0.01, Lat: 89.9999999 - float64(i)*0.001, Visible: true}
+		n.Tags = osm.Tags{{Key: "ref", Value: fmt.Sprint(i % 16000)}, {Key: "name", Value: "Straße"}}
+		if i%3 == 0 {
+			n.Tags = append(n.Tags, osm.Tag{Key: "note", Value: long})
+		}
+		file.Nodes = append(file.Nodes, n)
+	}
+	file.Nodes = append(file.Nodes,
+		&osm.Node{ID: 100, Version: 3, Timestamp: ts, ChangesetID: 42, UserID: 7, User: "mapper", Lon: 13.4, Lat: 52.5, Visible: true},
+		&osm.Node{ID: 101, Version: 2, Timestamp: ts.Add(time.Hour), User: "no uid", Lon: 13.5, Lat: 52.5, Visible: true},
+		&osm.Node{ID: 102, Version: 4, Timestamp: ts, ChangesetID: 43, UserID: 7, User: "mapper"},
+	)
+	file.Ways = osm.Ways{
+		{ID: -1, Nodes: osm.WayNodes{{ID: -1}, {ID: -20000}, {ID: 100}, {ID: -1}}, Tags: osm.Tags{{Key: "highway", Value: "path"}}, Visible: true},
+		{ID: -2, Nodes: osm.WayNodes{{ID: 101}, {ID: 100}}, Visible: true},
+		{ID: 9, Version: 1, Timestamp: ts},
+	}
+	file.Relations = osm.Relations{
+		{ID: -1, Visible: true, Tags: osm.Tags{{Key: "type", Value: "multipolygon"}}, Members: osm.Members{
+			{Type: osm.TypeWay, Ref: -1, Role: "outer"},
+			{Type: osm.TypeWay, Ref: -2, Role: "inner"},
+			{Type: osm.TypeNode, Ref: 100, Role: "label"},
+			{Type: osm.TypeRelation, Ref: -2},
+		}},
+		{ID: -2, Visible: true, Members: osm.Members{{Type: osm.TypeRelation, Ref: -1, Role: "subarea"}}},
+	}
+
+	var buf bytes.Buffer
+	w := NewO5MWriter(&buf)
+	// In two writes, as a conversion does with each feature
+	if err := w.Write(&osm.OSM{Nodes: file.Nodes[:10000]}); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Write(&osm.OSM{Nodes: file.Nodes[10000:], Ways: file.Ways, Relations: file.Relations}); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	got := readOSM(t, buf.Bytes(), FormatO5M)
+
+	if len(got.Nodes) != len(file.Nodes) || len(got.Ways) != len(file.Ways) || len(got.Relations) != len(file.Relations) {
+		t.Fatalf("read %d nodes, %d ways and %d relations, want %d, %d and %d",
+			len(got.Nodes), len(got.Ways), len(got.Relations), len(file.Nodes), len(file.Ways), len(file.Relations))
+	}
+	for i, n := range file.Nodes {
+		// Coordinates are kept to 1e-7 degrees
+		want := *n
+		want.Lon, want.Lat = math.Round(n.Lon*1e7)/1e7, math.Round(n.Lat*1e7)/1e7
+		if g := got.Nodes[i]; fmt.Sprint(*g) != fmt.Sprint(want) {
+			t.Fatalf("node %d read back as\n%+v\nwant\n%+v", n.ID, *g, want)
+		}
+	}
+	for i, w := range file.Ways {
+		if g := got.Ways[i]; fmt.Sprint(*g) != fmt.Sprint(*w) {
+			t.Errorf("way %d read back as\n%+v\nwant\n%+v", w.ID, *g, *w)
+		}
+	}
+	for i, r := range file.Relations {
+		if g := got.Relations[i]; fmt.Sprint(*g) != fmt.Sprint(*r) {
+			t.Errorf("relation %d read back as\n%+v\nwant\n%+v", r.ID, *g, *r)
+		}
+	}
+}
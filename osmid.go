@@ -0,0 +1,137 @@
+package gpkg2osm
+
+import (
+	"database/sql"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/paulmach/osm"
+	"github.com/twpayne/go-geom"
+)
+
+// The column that holds the version of the OSM element, next to the OSMIDColumn
+const osmVersionColumn = "osm_version"
+
+// OSMID is the OSM element a feature was made from, for GeoPackages that were themselves exported from OSM
+type OSMID struct {
+	Type    osm.Type // Empty when the column has just the number, see parseOSMID
+	Ref     int64    // Always positive
+	Version int      // 0 when the layer has no osm_version column or the row has none
+}
+
+// Parse the value of an OSM ID column: a plain number as most exports write it, or one with its type, such as
+// n123, w123 or r123 (osmium) and node/123, way/123 or relation/123. A negative plain number is a relation, as
+// osm2pgsql writes them. A plain positive number leaves the type to the element the feature becomes
+func parseOSMID(s string) (OSMID, error) {
+	s = strings.TrimSpace(s)
+	var id OSMID
+	if i := strings.IndexByte(s, '/'); i >= 0 {
+		id.Type, s = osm.Type(s[:i]), s[i+1:]
+	} else if s != "" {
+		switch s[0] {
+		case 'n':
+			id.Type = osm.TypeNode
+		case 'w':
+			id.Type = osm.TypeWay
+		case 'r':
+			id.Type = osm.TypeRelation
+		}
+		if id.Type != "" {
+			s = s[1:]
+		}
+	}
+	switch id.Type {
+	case "", osm.TypeNode, osm.TypeWay, osm.TypeRelation:
+	default:
+		return id, fmt.Errorf("unknown element type %q", id.Type)
+	}
+	ref, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		// Some tools store the IDs as REAL
+		f, ferr := strconv.ParseFloat(s, 64)
+		if ferr != nil || f != math.Trunc(f) || math.Abs(f) > 1<<53 {
+			return id, fmt.Errorf("%q is not an OSM ID", s)
+		}
+		ref = int64(f)
+	}
+	if ref < 0 && id.Type == "" {
+		id.Type, ref = osm.TypeRelation, -ref
+	}
+	if ref <= 0 {
+		return id, fmt.Errorf("%d is not an OSM ID, they are positive", ref)
+	}
+	id.Ref = ref
+	return id, nil
+}
+
+// Look for the column with the OSM IDs, and the osm_version column beside it. Names are matched ignoring case,
+// as SQLite does
+func (l *ExportLayer) findOSMIDColumn(db *sql.DB, column string) error {
+	l.OSMIDColumn, l.VersionColumn = "", ""
+	rows, err := db.Query("SELECT name FROM pragma_table_info(?)", l.Name)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return err
+		}
+		switch {
+		case strings.EqualFold(name, column):
+			l.OSMIDColumn = name
+		case strings.EqualFold(name, osmVersionColumn):
+			l.VersionColumn = name
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if l.OSMIDColumn == "" {
+		l.VersionColumn = ""
+	}
+	return nil
+}
+
+// Give the element that stands for the feature the ID of the OSM element it was made from, and its version, or
+// 1 if it is not known. That is the feature's relation, or its way if it has no relation, or its node if it has
+// neither; features that became several of them (a split way, a multipoint) cannot have it, and neither can an
+// element of another type than the ID says. It is an error too if another feature already used the ID. The
+// feature keeps the IDs it was given when there is an error
+func (b *Builder) useOSMID(file *osm.OSM, id *OSMID) error {
+	typ, n := osm.TypeNode, len(file.Nodes)
+	if len(file.Relations) > 0 {
+		typ, n = osm.TypeRelation, len(file.Relations)
+	} else if len(file.Ways) > 0 {
+		typ, n = osm.TypeWay, len(file.Ways)
+	}
+	if n != 1 {
+		return fmt.Errorf("the feature became %d %ss, only one can have the ID", n, typ)
+	}
+	if id.Type != "" && id.Type != typ {
+		return fmt.Errorf("the feature became a %s, the ID is of a %s", typ, id.Type)
+	}
+	if b.osmIDs[takenID{typ, id.Ref}] {
+		return fmt.Errorf("%s/%d is already used by another feature", typ, id.Ref)
+	}
+	b.osmIDs[takenID{typ, id.Ref}] = true
+
+	version := max(id.Version, 1)
+	switch typ {
+	case osm.TypeNode:
+		n := file.Nodes[0]
+		// Ways merged into the point use its node, they have to find it by the new ID
+		if k := newCoordKey(geom.Coord{n.Lon, n.Lat}); b.points != nil && b.points[k] == n.ID {
+			b.points[k] = osm.NodeID(id.Ref)
+		}
+		n.ID, n.Version = osm.NodeID(id.Ref), version
+	case osm.TypeWay:
+		file.Ways[0].ID, file.Ways[0].Version = osm.WayID(id.Ref), version
+	case osm.TypeRelation:
+		file.Relations[0].ID, file.Relations[0].Version = osm.RelationID(id.Ref), version
+	}
+	return nil
+}
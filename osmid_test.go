@@ -0,0 +1,113 @@
+package gpkg2osm
+
+import (
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/paulmach/osm"
+)
+
+func TestParseOSMID(t *testing.T) {
+	for _, tt := range []struct {
+		in   string
+		want OSMID // Zero for an error
+	}{
+		{"123", OSMID{Ref: 123}},
+		{" 123 ", OSMID{Ref: 123}},
+		{"123.0", OSMID{Ref: 123}},
+		{"-123", OSMID{Type: osm.TypeRelation, Ref: 123}},
+		{"n1", OSMID{Type: osm.TypeNode, Ref: 1}},
+		{"w22", OSMID{Type: osm.TypeWay, Ref: 22}},
+		{"r333", OSMID{Type: osm.TypeRelation, Ref: 333}},
+		{"node/1", OSMID{Type: osm.TypeNode, Ref: 1}},
+		{"way/22", OSMID{Type: osm.TypeWay, Ref: 22}},
+		{"relation/333", OSMID{Type: osm.TypeRelation, Ref: 333}},
+		{"0", OSMID{}},
+		{"n-1", OSMID{}},
+		{"w", OSMID{}},
+		{"123.5", OSMID{}},
+		{"1e300", OSMID{}},
+		{"changeset/1", OSMID{}},
+		{"abc", OSMID{}},
+		{"", OSMID{}},
+	} {
+		got, err := parseOSMID(tt.in)
+		if tt.want.Ref == 0 {
+			if err == nil {
+				t.Errorf("parseOSMID(%q) = %v, want an error", tt.in, got)
+			}
+		} else if err != nil || got != tt.want {
+			t.Errorf("parseOSMID(%q) = %v, %v, want %v", tt.in, got, err, tt.want)
+		}
+	}
+}
+
+func TestOSMIDColumn(t *testing.T) {
+	db := newGeoPackage(t)
+	addLayer(t, db, "pois", "POINT", "name", "OSM_ID", "osm_version")
+	addLayer(t, db, "roads", "LINESTRING", "highway", "osm_id")
+	addLayer(t, db, "areas", "POLYGON", "landuse", "osm_id", "osm_version")
+	exec(t, db, "DELETE FROM gpkg_data_columns WHERE lower(column_name) IN ('osm_id', 'osm_version')")
+	insert(t, db, "pois", point(0, 0), map[string]any{"name": "A", "OSM_ID": "n100", "osm_version": "3"})
+	insert(t, db, "pois", point(5, 5), map[string]any{"name": "B", "OSM_ID": "abc"})
+	insert(t, db, "roads", line(0, 0, 1, 1), map[string]any{"highway": "path", "osm_id": "200"})
+	insert(t, db, "roads", line(2, 2, 3, 3), map[string]any{"highway": "path", "osm_id": "w200"}) // Already taken
+	insert(t, db, "roads", line(4, 4, 5, 6), map[string]any{"highway": "path"})
+	hole := []float64{11, 1, 12, 1, 12, 2, 11, 1}
+	insert(t, db, "areas", polygon([]float64{10, 0, 14, 0, 14, 4, 10, 4, 10, 0}, hole), map[string]any{"landuse": "meadow", "osm_id": "-300", "osm_version": "7"})
+	insert(t, db, "areas", polygon([]float64{20, 0, 24, 0, 24, 4, 20, 4, 20, 0}, hole), map[string]any{"landuse": "meadow", "osm_id": "w400"})
+
+	logs := captureLogs(t)
+	file, _ := convert(t, db, &Options{OSMIDColumn: "osm_id", MergeCoincidentPoints: true})
+
+	nodes := taggedNodes(file)
+	if len(nodes) != 2 || nodes[0].ID != 100 || nodes[0].Version != 3 || nodes[1].ID >= 0 {
+		t.Errorf("tagged nodes %v, %v, want 100 version 3 and a new one", nodes[0], nodes[1])
+	}
+	checkTags(t, nodes[0].Tags, "name", "A")
+	// The ways of the areas, outer and inner to each, then the roads
+	if len(file.Ways) != 7 {
+		t.Fatalf("got %d ways, want 7", len(file.Ways))
+	}
+	roads := file.Ways[4:]
+	// Points are converted first, the road through A uses its node by the real ID
+	if w := roads[0]; w.ID != 200 || w.Version != 1 || w.Nodes[0].ID != 100 {
+		t.Errorf("way %d version %d from node %d, want way 200 version 1 from node 100", w.ID, w.Version, w.Nodes[0].ID)
+	}
+	checkTags(t, roads[0].Tags, "highway", "path")
+	for i, w := range file.Ways {
+		if i != 4 && w.ID >= 0 {
+			t.Errorf("way %d has a real ID, want a new one", w.ID)
+		}
+	}
+	if len(file.Relations) != 2 || file.Relations[0].ID != 300 || file.Relations[0].Version != 7 || file.Relations[1].ID >= 0 {
+		t.Errorf("relations %v, want 300 version 7 and a new one", elementIDs(file)[osm.TypeRelation])
+	}
+	for _, want := range []string{"bad OSM ID", "way/200 is already used", "the feature became a relation, the ID is of a way"} {
+		if !strings.Contains(logs.String(), want) {
+			t.Errorf("no warning with %q:\n%s", want, logs)
+		}
+	}
+
+	// Without the option the column is ignored
+	file, _ = convert(t, db, nil)
+	for _, ids := range elementIDs(file) {
+		for _, id := range ids {
+			if id >= 0 {
+				t.Fatalf("got ID %d without OSMIDColumn, want only new ones", id)
+			}
+		}
+	}
+
+	ids, err := NewIDGenerator(IDsPositive, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Convert(db, nopWriter{}, &Options{OSMIDColumn: "osm_id", IDs: ids}); err == nil {
+		t.Error("no error with positive IDs")
+	}
+	if _, err := Diff([]Input{{DB: db}}, []Input{{DB: db}}, io.Discard, &Options{OSMIDColumn: "osm_id"}); err == nil {
+		t.Error("no error for a diff")
+	}
+}
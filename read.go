@@ -0,0 +1,149 @@
+package gpkg2osm
+
+import (
+	"context"
+	"database/sql"
+)
+
+// Rows handed to a decoding goroutine at a time, so passing them around costs little next to parsing them
+const decodeBatchSize = 256
+
+// queryer runs a query on a *sql.DB or on one of its connections
+type queryer interface {
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+}
+
+// layerRead is a layer to read, and once it has been read the features in it
+type layerRead struct {
+	layer *ExportLayer
+	key   string // Name in the summary
+	ls    *LayerSummary
+	skip  skipper
+
+	results []*Feature
+	err     error
+	done    chan struct{}
+}
+
+// layerReader reads layers ahead of the conversion, at most workers at a time and each on a connection of its
+// own. The reads start in order and must be waited for in the same order. A layer holds its place until it is
+// waited for, so at most workers layers are read in memory and not yet converted. With a single worker nothing
+// happens in the background, each layer is read on the shared DB when it is waited for
+type layerReader struct {
+	db      *sql.DB
+	sem     chan struct{} // Places for layers being read or waiting, nil when reading one after another
+	stop    chan struct{}
+	threads int // Goroutines decoding the rows of each layer
+}
+
+func newLayerReader(db *sql.DB, reads []*layerRead, workers, threads int) *layerReader {
+	r := &layerReader{db: db, stop: make(chan struct{}), threads: threads}
+	if workers <= 1 {
+		return r
+	}
+	r.sem = make(chan struct{}, workers)
+	for _, lr := range reads {
+		lr.done = make(chan struct{})
+	}
+	go func() {
+		for _, lr := range reads {
+			select {
+			case r.sem <- struct{}{}:
+			case <-r.stop:
+				return
+			}
+			go r.read(lr)
+		}
+	}()
+	return r
+}
+
+// Read the layer on a connection that no other layer is using. sqlite allows any number of readers, and
+// nothing here writes
+func (r *layerReader) read(lr *layerRead) {
+	defer close(lr.done)
+	conn, err := r.db.Conn(context.Background())
+	if err != nil {
+		lr.err = err
+		return
+	}
+	defer conn.Close()
+	lr.results, lr.err = getResults(conn, lr.layer, lr.ls, lr.skip, r.threads)
+}
+
+// Wait for the layer to be read and make room for the next one
+func (r *layerReader) wait(lr *layerRead) ([]*Feature, error) {
+	if r.sem == nil {
+		return getResults(r.db, lr.layer, lr.ls, lr.skip, r.threads)
+	}
+	<-lr.done
+	<-r.sem
+	results := lr.results
+	lr.results = nil
+	return results, lr.err
+}
+
+// Stop starting reads, for when the conversion ends before every layer was waited for. Reads that already
+// started finish in the background
+func (r *layerReader) close() {
+	close(r.stop)
+}
+
+// Rows to decode, and once they are decoded what became of them
+type decodeBatch struct {
+	rows []row
+	out  []decoded
+	done chan struct{}
+}
+
+// Scan the rows on this goroutine and parse them on threads other goroutines. The batches are added to the results in the
+// order they were read, so the features, the counts and the skipped features are the same as reading one row
+// after another. Also returns the number of rows that were read
+func decodeRows(rows *sql.Rows, layer *ExportLayer, sources []string, ls *LayerSummary, skip skipper, threads int) ([]*Feature, int) {
+	jobs := make(chan *decodeBatch)
+	order := make(chan *decodeBatch, threads) // Bounds how far reading gets ahead of the oldest batch
+	for range threads {
+		go func() {
+			for b := range jobs {
+				b.out = make([]decoded, len(b.rows))
+				for i, r := range b.rows {
+					b.out[i] = layer.decodeRow(sources, r)
+				}
+				close(b.done)
+			}
+		}()
+	}
+	res := make([]*Feature, 0, 100)
+	collected := make(chan struct{})
+	go func() {
+		defer close(collected)
+		for b := range order {
+			<-b.done
+			for _, d := range b.out {
+				res = addResult(res, d, ls, skip)
+			}
+		}
+	}()
+
+	send := func(b *decodeBatch) {
+		order <- b
+		jobs <- b
+	}
+	b := &decodeBatch{done: make(chan struct{})}
+	read := 0
+	for rows.Next() {
+		b.rows = append(b.rows, layer.scanRow(rows, len(sources)))
+		read++
+		if len(b.rows) == decodeBatchSize {
+			send(b)
+			b = &decodeBatch{done: make(chan struct{})}
+		}
+	}
+	if len(b.rows) > 0 {
+		send(b)
+	}
+	close(jobs)
+	close(order)
+	<-collected
+	return res, read
+}
@@ -0,0 +1,82 @@
+package gpkg2osm
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/paulmach/osm"
+)
+
+// Reading layers on several connections and parsing rows on several goroutines changes nothing in the output
+func TestWorkersSameOutput(t *testing.T) {
+	db := gridGeoPackage(t, 12)
+	addLayer(t, db, "pois", "POINT", "amenity", "osm_tags")
+	for i := range 600 {
+		insert(t, db, "pois", point(float64(i)*0.0001, 0.5), map[string]any{"amenity": "bench", "osm_tags": fmt.Sprintf(`{"ref": %d}`, i)})
+	}
+
+	for _, scope := range []DedupScope{DedupLayer, DedupGlobal} {
+		want, wantSummary := convertTo(t, db, FormatXML, &Options{DedupScope: scope})
+		for _, tt := range []struct{ workers, threads int }{{4, 1}, {1, 4}, {4, 3}, {20, 2}} {
+			got, summary := convertTo(t, db, FormatXML, &Options{DedupScope: scope, Workers: tt.workers, ReadThreads: tt.threads})
+			if !bytes.Equal(got, want) {
+				t.Errorf("%s with %d workers and %d threads: the output differs from reading one layer after another", scope, tt.workers, tt.threads)
+			}
+			if fmt.Sprint(summary.Total()) != fmt.Sprint(wantSummary.Total()) {
+				t.Errorf("%s with %d workers and %d threads: summary %+v, want %+v", scope, tt.workers, tt.threads, summary.Total(), wantSummary.Total())
+			}
+		}
+	}
+}
+
+// failingWriter counts the files written to it and fails from the nth on
+type failingWriter struct {
+	n, written int
+}
+
+func (w *failingWriter) Write(*osm.OSM) error {
+	if w.written++; w.written >= w.n {
+		return errors.New("disk full")
+	}
+	return nil
+}
+
+func (w *failingWriter) Close() error {
+	return nil
+}
+
+// Writing on a goroutine of its own gives the same output, every file of a layer is written before LayerDone,
+// and an error of the writer still stops the conversion
+func TestWriteThread(t *testing.T) {
+	db := gridGeoPackage(t, 12)
+	for _, format := range []Format{FormatXML, FormatPBF, FormatO5M} {
+		want, _ := convertTo(t, db, format, nil)
+		if got, _ := convertTo(t, db, format, &Options{WriteThread: true, ReadThreads: 3}); !bytes.Equal(got, want) {
+			t.Errorf("%s: the output differs when written on a goroutine of its own", format)
+		}
+	}
+
+	w := &failingWriter{n: 1 << 30}
+	var layers int
+	_, err := Convert(db, w, &Options{WriteThread: true, LayerDone: func(string) error {
+		layers++
+		if w.written != 12*layers {
+			t.Errorf("%d files written when layer %d is done, want %d", w.written, layers, 12*layers)
+		}
+		return nil
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w = &failingWriter{n: 30}
+	if _, err := Convert(db, w, &Options{WriteThread: true}); err == nil || !strings.Contains(err.Error(), "disk full") {
+		t.Errorf("Convert: err = %v, want the writer's error", err)
+	}
+	if w.written != 30 {
+		t.Errorf("the writer was given %d files, want none after the one that failed", w.written)
+	}
+}
@@ -0,0 +1,107 @@
+package gpkg2osm
+
+import (
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"strings"
+)
+
+// RelatedTable is a table of attributes joined to a layer through a mapping table of the GeoPackage related
+// tables extension (gpkgext_relations). The columns of the related row become tags of the feature
+type RelatedTable struct {
+	Mapping       string   // Mapping table of base_id and related_id pairs
+	Table         string   // The related table
+	BaseColumn    string   // Column of the layer that base_id refers to
+	RelatedColumn string   // Column of the related table that related_id refers to
+	Columns       []string // Columns of the related table read as tags
+}
+
+// Marks the related table in the tag sources of a layer, it cannot be the name of a column
+const relatedSource = "\x00related"
+
+// The subquery that reads the related row of the current feature as a JSON object. Only one row is used, the
+// lowest related_id, so a feature mapped to several rows still gets a single set of tags
+func (r *RelatedTable) query(layer string) string {
+	pairs := make([]string, 0, len(r.Columns)*2)
+	for _, c := range r.Columns {
+		pairs = append(pairs, quoteLiteral(c), "r."+quoteIdent(c))
+	}
+	return fmt.Sprintf("(SELECT json_object(%s) FROM %s m JOIN %s r ON r.%s = m.related_id WHERE m.base_id = %s.%s ORDER BY m.related_id LIMIT 1)",
+		strings.Join(pairs, ", "), quoteIdent(r.Mapping), quoteIdent(r.Table), quoteIdent(r.RelatedColumn), quoteIdent(layer), quoteIdent(r.BaseColumn))
+}
+
+// Find the relations with the given mapping tables, keyed by the layer they add tags to. Only one relation per
+// layer is supported. A GeoPackage without the extension has no relations, which is not an error
+func readRelations(db *sql.DB, mappings []string) (map[string]*RelatedTable, error) {
+	related := make(map[string]*RelatedTable, len(mappings))
+	if len(mappings) == 0 {
+		return related, nil
+	}
+	ok, err := tableExists(db, "gpkgext_relations")
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		slog.Warn("no related tables in the GeoPackage, ignoring the related tags", "mappings", strings.Join(mappings, ","))
+		return related, nil
+	}
+
+	for _, mapping := range mappings {
+		r := &RelatedTable{Mapping: mapping}
+		var base string
+		err := db.QueryRow(`SELECT base_table_name, base_primary_column, related_table_name, related_primary_column
+		FROM gpkgext_relations WHERE mapping_table_name = ?`, mapping).Scan(&base, &r.BaseColumn, &r.Table, &r.RelatedColumn)
+		if err == sql.ErrNoRows {
+			slog.Warn("no relation uses the mapping table, ignoring it", "mapping", mapping)
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("relation %s: %w", mapping, err)
+		}
+		if prev, ok := related[base]; ok {
+			return nil, fmt.Errorf("relations %s and %s both add tags to %s, only one related table per layer is supported", prev.Mapping, mapping, base)
+		}
+		if err := r.readColumns(db); err != nil {
+			return nil, fmt.Errorf("relation %s: %w", mapping, err)
+		}
+
+		// The mapping table also checks here that it has the columns the extension requires
+		var many int
+		if err := db.QueryRow(fmt.Sprintf("SELECT count(*) FROM (SELECT base_id FROM %s GROUP BY base_id HAVING count(related_id) > 1)", quoteIdent(mapping))).Scan(&many); err != nil {
+			return nil, fmt.Errorf("relation %s: %w", mapping, err)
+		}
+		if many > 0 {
+			slog.Warn("features with several related rows only get the tags of the first", "mapping", mapping, "features", many)
+		}
+		slog.Info("adding tags from related table", "table", base, "related", r.Table, "cols", strings.Join(r.Columns, ","))
+		related[base] = r
+	}
+	return related, nil
+}
+
+// Find the columns of the related table that can be tags: everything but its key, blobs and geometries
+func (r *RelatedTable) readColumns(db *sql.DB) error {
+	rows, err := db.Query("SELECT name, upper(type) FROM pragma_table_info(?)", r.Table)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var name, typ string
+		if err := rows.Scan(&name, &typ); err != nil {
+			return err
+		}
+		if name == r.RelatedColumn || typ == "BLOB" || geometryColumnTypes[typ] {
+			continue
+		}
+		r.Columns = append(r.Columns, name)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if len(r.Columns) == 0 {
+		return fmt.Errorf("related table %s has no columns to use as tags", r.Table)
+	}
+	return nil
+}
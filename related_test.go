@@ -0,0 +1,61 @@
+package gpkg2osm
+
+import "testing"
+
+// The related tables extension, with roads mapped to the rows of a surveys attributes table
+const relatedSchema = `
+CREATE TABLE gpkgext_relations (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	base_table_name TEXT NOT NULL,
+	base_primary_column TEXT NOT NULL DEFAULT 'id',
+	related_table_name TEXT NOT NULL,
+	related_primary_column TEXT NOT NULL DEFAULT 'id',
+	relation_name TEXT NOT NULL,
+	mapping_table_name TEXT NOT NULL UNIQUE
+);
+CREATE TABLE surveys (id INTEGER PRIMARY KEY AUTOINCREMENT, surface TEXT, smoothness TEXT, photo BLOB);
+INSERT INTO gpkg_contents (table_name, data_type, identifier) VALUES ('surveys', 'attributes', 'surveys');
+CREATE TABLE roads_surveys (base_id INTEGER NOT NULL, related_id INTEGER NOT NULL);
+INSERT INTO gpkgext_relations (base_table_name, base_primary_column, related_table_name, related_primary_column, relation_name, mapping_table_name)
+	VALUES ('roads', 'fid', 'surveys', 'id', 'attributes', 'roads_surveys');
+`
+
+func TestRelatedTags(t *testing.T) {
+	db := newGeoPackage(t)
+	addLayer(t, db, "roads", "LINESTRING", "highway", "surface")
+	exec(t, db, relatedSchema)
+	for i, tags := range []map[string]any{
+		{"highway": "residential"},
+		{"highway": "track", "surface": "gravel"},
+		{"highway": "path"},
+		{"highway": "service"},
+	} {
+		insert(t, db, "roads", line(0, float64(i), 1, float64(i)), tags)
+	}
+	exec(t, db, `INSERT INTO surveys (id, surface, smoothness, photo) VALUES
+		(1, 'asphalt', 'good', X'FFD8'), (2, 'dirt', NULL, NULL), (3, 'sett', 'bad', NULL), (4, 'paving_stones', 'intermediate', NULL);
+		INSERT INTO roads_surveys VALUES (1, 1), (2, 2), (3, 4), (3, 3)`)
+
+	file, summary := convert(t, db, &Options{RelatedTags: []string{"roads_surveys"}})
+	if len(file.Ways) != 4 {
+		t.Fatalf("got %d ways, want 4", len(file.Ways))
+	}
+	// The photo BLOB and the key are not tags
+	checkTags(t, file.Ways[0].Tags, "highway", "residential", "surface", "asphalt", "smoothness", "good")
+	// The road's own tags win
+	checkTags(t, file.Ways[1].Tags, "highway", "track", "surface", "gravel")
+	// Mapped to two rows, the lowest related_id is used
+	checkTags(t, file.Ways[2].Tags, "highway", "path", "surface", "sett", "smoothness", "bad")
+	checkTags(t, file.Ways[3].Tags, "highway", "service")
+	if n := summary.Total().TagConflicts; n != 1 {
+		t.Errorf("%d tag conflicts, want the surface of the track", n)
+	}
+
+	// Without the extension the roads are converted with their own tags
+	exec(t, db, "DROP TABLE gpkgext_relations")
+	file, _ = convert(t, db, &Options{RelatedTags: []string{"roads_surveys"}})
+	if len(file.Ways) != 4 {
+		t.Fatalf("got %d ways without the extension, want 4", len(file.Ways))
+	}
+	checkTags(t, file.Ways[0].Tags, "highway", "residential")
+}
@@ -0,0 +1,151 @@
+package gpkg2osm
+
+import (
+	"database/sql"
+	"fmt"
+	"math"
+	"strings"
+
+	"github.com/twpayne/go-geom"
+)
+
+// WGS 84, the only coordinate system OSM uses
+const wgs84 = 4326
+
+// A projection converts coordinates in some coordinate system to WGS 84 longitude and latitude, or the reverse
+type projection func(x, y float64) (lon, lat float64)
+
+// The coordinate systems we can convert from, keyed by EPSG code
+var projections = map[int64]projection{
+	4326: func(x, y float64) (float64, float64) { return x, y },
+	3857: fromWebMercator,
+	3395: fromWorldMercator,
+}
+
+// The coordinate systems we can write, from WGS 84, keyed by EPSG code
+var outputProjections = map[int64]projection{
+	4326: func(lon, lat float64) (float64, float64) { return lon, lat },
+	3857: toWebMercator,
+	3395: toWorldMercator,
+}
+
+// Spherical (web) mercator, as used by most tile maps
+func fromWebMercator(x, y float64) (float64, float64) {
+	const r = 6378137.0
+	lon := x / r * 180 / math.Pi
+	lat := (2*math.Atan(math.Exp(y/r)) - math.Pi/2) * 180 / math.Pi
+	return lon, lat
+}
+
+// Ellipsoidal mercator on WGS 84. There is no closed form for the latitude, it is found by iterating
+func fromWorldMercator(x, y float64) (float64, float64) {
+	const a = 6378137.0
+	const e = 0.0818191908426215 // WGS 84 eccentricity
+	t := math.Exp(-y / a)
+	lat := math.Pi/2 - 2*math.Atan(t)
+	for range 10 {
+		es := e * math.Sin(lat)
+		lat = math.Pi/2 - 2*math.Atan(t*math.Pow((1-es)/(1+es), e/2))
+	}
+	return x / a * 180 / math.Pi, lat * 180 / math.Pi
+}
+
+func toWebMercator(lon, lat float64) (float64, float64) {
+	const r = 6378137.0
+	x := lon * math.Pi / 180 * r
+	y := math.Log(math.Tan(math.Pi/4+lat*math.Pi/360)) * r
+	return x, y
+}
+
+func toWorldMercator(lon, lat float64) (float64, float64) {
+	const a = 6378137.0
+	const e = 0.0818191908426215
+	phi := lat * math.Pi / 180
+	es := e * math.Sin(phi)
+	y := a * math.Log(math.Tan(math.Pi/4+phi/2)*math.Pow((1-es)/(1+es), e/2))
+	return lon * math.Pi / 180 * a, y
+}
+
+// reprojector converts geometries to WGS 84. Features in one layer may use different coordinate systems, so
+// the projection is looked up for the srs_id of every geometry and cached
+type reprojector struct {
+	db    *sql.DB
+	cache map[int32]cachedProjection
+}
+
+type cachedProjection struct {
+	p    projection
+	code int64 // EPSG code
+	err  error
+}
+
+func newReprojector(db *sql.DB) *reprojector {
+	return &reprojector{
+		db:    db,
+		cache: make(map[int32]cachedProjection),
+	}
+}
+
+// Find the projection for a GeoPackage srs_id. The srs_id is local to the GeoPackage, gpkg_spatial_ref_sys
+// says which EPSG code it stands for
+func (r *reprojector) projection(srsID int32) (projection, int64, error) {
+	c, ok := r.cache[srsID]
+	if !ok {
+		c.p, c.code, c.err = r.lookup(srsID)
+		r.cache[srsID] = c
+	}
+	return c.p, c.code, c.err
+}
+
+func (r *reprojector) lookup(srsID int32) (projection, int64, error) {
+	code := int64(srsID)
+	var org sql.NullString
+	var orgCode sql.NullInt64
+	err := r.db.QueryRow("SELECT organization, organization_coordsys_id FROM gpkg_spatial_ref_sys WHERE srs_id = ?", srsID).Scan(&org, &orgCode)
+	if err == nil && orgCode.Valid {
+		if !strings.EqualFold(org.String, "EPSG") {
+			return nil, 0, fmt.Errorf("unsupported SRS %d: %s:%d is not an EPSG code", srsID, org.String, orgCode.Int64)
+		}
+		code = orgCode.Int64
+	} else if err != nil && err != sql.ErrNoRows {
+		return nil, 0, fmt.Errorf("cannot look up SRS %d: %w", srsID, err)
+	}
+	p, ok := projections[code]
+	if !ok {
+		return nil, 0, fmt.Errorf("unsupported SRS %d (EPSG:%d), only EPSG:4326, EPSG:3857 and EPSG:3395 can be reprojected", srsID, code)
+	}
+	return p, code, nil
+}
+
+// Convert the coordinates of g, which are in srsID, to WGS 84 in place. Returns the EPSG code they were in
+func (r *reprojector) toWGS84(g geom.T, srsID int32) (int64, error) {
+	if srsID == wgs84 {
+		return wgs84, nil
+	}
+	p, code, err := r.projection(srsID)
+	if err != nil {
+		return 0, err
+	}
+	transform(g, p)
+	return code, nil
+}
+
+// Convert the coordinates of g in place
+func transform(g geom.T, p projection) {
+	flat := g.FlatCoords()
+	stride := g.Stride()
+	for i := 0; i+1 < len(flat); i += stride {
+		flat[i], flat[i+1] = p(flat[i], flat[i+1])
+	}
+}
+
+// Convert the coordinates of g from WGS 84 to the output coordinate system in place
+func toOutputSRS(g geom.T, p projection) error {
+	transform(g, p)
+	for _, v := range g.FlatCoords() {
+		if !finite(v) {
+			return fmt.Errorf("the coordinates cannot be written in the output SRS")
+		}
+	}
+	return nil
+}
@@ -0,0 +1,133 @@
+package gpkg2osm
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"testing"
+
+	"github.com/nullmonk/gpkg2osm/internal/gpkg"
+)
+
+// A layer in web mercator whose features are in the coordinate systems their own headers say
+func TestReprojectEachFeature(t *testing.T) {
+	db := newGeoPackage(t)
+	// The srs_id is local to the file, 900 stands for EPSG:3395
+	exec(t, db, `INSERT INTO gpkg_spatial_ref_sys VALUES
+		('WGS 84 / Pseudo-Mercator', 3857, 'EPSG', 3857, 'undefined', NULL),
+		('WGS 84 / World Mercator', 900, 'EPSG', 3395, 'undefined', NULL)`)
+	if err := gpkg.AddLayer(db, "pois", "POINT", 3857, "name"); err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range []struct {
+		name string
+		srs  int32
+		to   projection
+	}{
+		{"web", 3857, toWebMercator},
+		{"world", 900, toWorldMercator},
+		{"wgs84", wgs84, func(lon, lat float64) (float64, float64) { return lon, lat }},
+	} {
+		x, y := f.to(13.4, 52.5)
+		if err := gpkg.Insert(db, "pois", point(x, y), f.srs, map[string]any{"name": f.name}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	file, summary := convert(t, db, &Options{Reproject: true, SRSTagKey: "source:srs"})
+	if len(file.Nodes) != 3 {
+		t.Fatalf("got %d nodes, want 3", len(file.Nodes))
+	}
+	srs := map[string]string{"web": "EPSG:3857", "world": "EPSG:3395", "wgs84": ""}
+	for _, n := range file.Nodes {
+		name := n.Tags.Find("name")
+		if math.Abs(n.Lon-13.4) > 1e-7 || math.Abs(n.Lat-52.5) > 1e-7 {
+			t.Errorf("%s: node at %v,%v, want 13.4,52.5", name, n.Lon, n.Lat)
+		}
+		if got := n.Tags.Find("source:srs"); got != srs[name] {
+			t.Errorf("%s: source:srs=%q, want %q", name, got, srs[name])
+		}
+	}
+	if s := summary.Layer("pois").Skipped; s != 0 {
+		t.Errorf("%d features skipped", s)
+	}
+
+	// Without reprojecting, a layer that is not in WGS 84 is left out
+	if file, _ := convert(t, db, nil); len(file.Nodes) != 0 {
+		t.Errorf("got %d nodes without reprojecting, want none", len(file.Nodes))
+	}
+}
+
+// Only the features that were reprojected are tagged with their SRS
+func TestSRSTag(t *testing.T) {
+	db := newGeoPackage(t)
+	exec(t, db, "INSERT INTO gpkg_spatial_ref_sys VALUES ('WGS 84 / Pseudo-Mercator', 3857, 'EPSG', 3857, 'undefined', NULL)")
+	if err := gpkg.AddLayer(db, "mercator", "POINT", 3857, "name"); err != nil {
+		t.Fatal(err)
+	}
+	addLayer(t, db, "wgs84", "POINT", "name")
+	x, y := toWebMercator(13.4, 52.5)
+	if err := gpkg.Insert(db, "mercator", point(x, y), 3857, map[string]any{"name": "mercator"}); err != nil {
+		t.Fatal(err)
+	}
+	insert(t, db, "wgs84", point(13.4, 52.5), map[string]any{"name": "wgs84"})
+
+	for _, key := range []string{"source:srs", ""} {
+		file, _ := convert(t, db, &Options{Reproject: true, SRSTagKey: key})
+		if len(file.Nodes) != 2 {
+			t.Fatalf("got %d nodes, want 2", len(file.Nodes))
+		}
+		for _, n := range file.Nodes {
+			if n.Tags.Find("name") == "mercator" && key != "" {
+				checkTags(t, n.Tags, "name", "mercator", key, "EPSG:3857")
+			} else {
+				checkTags(t, n.Tags, "name", n.Tags.Find("name"))
+			}
+		}
+	}
+}
+
+// WGS 84 features written with mercator coordinates, in place of the longitude and latitude
+func TestOutputSRS(t *testing.T) {
+	db := newGeoPackage(t)
+	addLayer(t, db, "roads", "LINESTRING", "highway")
+	insert(t, db, "roads", line(13.4, 52.5, 13.5, 52.6), map[string]any{"highway": "path"})
+
+	for _, tt := range []struct {
+		srs int64
+		to  projection
+	}{
+		{3857, toWebMercator},
+		{3395, toWorldMercator},
+	} {
+		data, summary := convertTo(t, db, FormatXML, &Options{OutputSRS: tt.srs})
+		if comment := fmt.Sprintf("<!-- Coordinates are in EPSG:%d, not WGS 84 -->", tt.srs); !bytes.Contains(data, []byte(comment)) {
+			t.Errorf("EPSG:%d: the output does not say what its coordinates are", tt.srs)
+		}
+		file := readOSM(t, data, FormatXML)
+		if len(file.Nodes) != 2 {
+			t.Fatalf("EPSG:%d: got %d nodes, want 2", tt.srs, len(file.Nodes))
+		}
+		for i, lonlat := range [][2]float64{{13.4, 52.5}, {13.5, 52.6}} {
+			x, y := tt.to(lonlat[0], lonlat[1])
+			if n := file.Nodes[i]; math.Abs(n.Lon-x) > 1e-6 || math.Abs(n.Lat-y) > 1e-6 {
+				t.Errorf("EPSG:%d: node at %v,%v, want %v,%v", tt.srs, n.Lon, n.Lat, x, y)
+			}
+		}
+		// The bbox in the summary is of the coordinates as written
+		minX, minY := tt.to(13.4, 52.5)
+		maxX, maxY := tt.to(13.5, 52.6)
+		if b := summary.Bounds; summary.SRS != tt.srs || b == nil || math.Abs(b.MinLon-minX) > 1e-6 || math.Abs(b.MinLat-minY) > 1e-6 || math.Abs(b.MaxLon-maxX) > 1e-6 || math.Abs(b.MaxLat-maxY) > 1e-6 {
+			t.Errorf("EPSG:%d: summary bounds %v in EPSG:%d", tt.srs, b, summary.SRS)
+		}
+	}
+	// Sanity check of the web mercator formula, against the coordinates other tools give
+	if x, y := toWebMercator(13.4, 52.5); math.Abs(x-1491681.0) > 1 || math.Abs(y-6891041.0) > 1 {
+		t.Errorf("13.4,52.5 in web mercator is %v,%v", x, y)
+	}
+
+	var buf bytes.Buffer
+	if _, err := Convert(db, NewXMLWriter(&buf), &Options{OutputSRS: 2154}); err == nil {
+		t.Error("converted to an SRS it cannot project to")
+	}
+}
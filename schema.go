@@ -0,0 +1,64 @@
+package gpkg2osm
+
+import (
+	"database/sql"
+	"log/slog"
+	"strings"
+)
+
+// Read the enum constraints of the schema extension, keyed by constraint name. Each has the description of every
+// value that has one, values without a description are only in the map as an empty label set. A GeoPackage
+// without the extension has no constraints, which is not an error
+func readEnumConstraints(db *sql.DB) (map[string]map[string]string, error) {
+	ok, err := tableExists(db, "gpkg_data_column_constraints")
+	if err != nil || !ok {
+		return nil, err
+	}
+	rows, err := db.Query("SELECT constraint_name, value, description FROM gpkg_data_column_constraints WHERE lower(constraint_type) = 'enum'")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	enums := make(map[string]map[string]string)
+	for rows.Next() {
+		var name, value, desc sql.NullString
+		if err := rows.Scan(&name, &value, &desc); err != nil {
+			slog.Warn("error scanning data column constraint", "error", err)
+			continue
+		}
+		if enums[name.String] == nil {
+			enums[name.String] = make(map[string]string)
+		}
+		if label := strings.TrimSpace(desc.String); value.Valid && label != "" {
+			enums[name.String][value.String] = label
+		}
+	}
+	return enums, rows.Err()
+}
+
+// The ValueMap of the layer with the enum labels added, for Options.EnumLabels. Rules in values win over the
+// labels, and the map given is not changed
+func (l *ExportLayer) enumValueMap(values map[string]map[string]string, lower bool) map[string]map[string]string {
+	merged := make(map[string]map[string]string, len(values)+len(l.EnumLabels))
+	for col, labels := range l.EnumLabels {
+		key := col
+		if lower {
+			key = strings.ToLower(col)
+		}
+		m := make(map[string]string, len(labels))
+		for from, to := range labels {
+			m[from] = to
+		}
+		merged[key] = m
+	}
+	for key, rules := range values {
+		if merged[key] == nil {
+			merged[key] = rules
+			continue
+		}
+		for from, to := range rules {
+			merged[key][from] = to
+		}
+	}
+	return merged
+}
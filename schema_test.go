@@ -0,0 +1,44 @@
+package gpkg2osm
+
+import "testing"
+
+// Columns with an enum constraint become tags with EnumColumns, and EnumLabels replaces their codes with the
+// description of each value, unless a ValueMap rule says otherwise
+func TestEnumColumns(t *testing.T) {
+	db := newGeoPackage(t)
+	addLayer(t, db, "roads", "LINESTRING", "highway")
+	exec(t, db, "ALTER TABLE roads ADD COLUMN surface TEXT")
+	exec(t, db, "INSERT INTO gpkg_data_columns (table_name, column_name, name) VALUES ('roads', 'surface', 'surface')")
+	exec(t, db, "UPDATE gpkg_data_columns SET constraint_name = column_name || '_codes' WHERE table_name = 'roads'")
+	exec(t, db, `INSERT INTO gpkg_data_column_constraints (constraint_name, constraint_type, value, description) VALUES
+		('highway_codes', 'enum', '1', 'primary'), ('highway_codes', 'enum', '2', 'secondary'), ('highway_codes', 'enum', '3', NULL),
+		('surface_codes', 'enum', '1', 'asphalt'), ('surface_codes', 'glob', '*', 'anything')`)
+	for i, code := range []string{"1", "2", "3"} {
+		insert(t, db, "roads", line(0, float64(i), 1, float64(i)), map[string]any{"highway": code, "surface": "1"})
+	}
+
+	for _, tt := range []struct {
+		name string
+		opts *Options
+		want [][]string
+	}{
+		{"default", nil, [][]string{{"highway", "1"}, {"highway", "2"}, {"highway", "3"}}},
+		{"columns", &Options{EnumColumns: true}, [][]string{
+			{"highway", "1", "surface", "1"}, {"highway", "2", "surface", "1"}, {"highway", "3", "surface", "1"},
+		}},
+		{"labels", &Options{EnumLabels: true}, [][]string{{"highway", "primary"}, {"highway", "secondary"}, {"highway", "3"}}},
+		{"both", &Options{EnumColumns: true, EnumLabels: true, ValueMap: map[string]map[string]string{"highway": {"2": "tertiary"}}}, [][]string{
+			{"highway", "primary", "surface", "asphalt"}, {"highway", "tertiary", "surface", "asphalt"}, {"highway", "3", "surface", "asphalt"},
+		}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			file, _ := convert(t, db, tt.opts)
+			if len(file.Ways) != len(tt.want) {
+				t.Fatalf("got %d ways, want %d", len(file.Ways), len(tt.want))
+			}
+			for i, w := range file.Ways {
+				checkTags(t, w.Tags, tt.want[i]...)
+			}
+		})
+	}
+}
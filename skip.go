@@ -0,0 +1,58 @@
+package gpkg2osm
+
+import "sync"
+
+// SkippedFeature describes a feature that was skipped, for Options.Skipped
+type SkippedFeature struct {
+	Layer  string `json:"layer"`         // Name of the layer in the summary
+	FID    *int64 `json:"fid,omitempty"` // Primary key of the row, nil if the layer has none or it could not be read
+	Reason string `json:"reason"`        // One of the Skip constants
+	Err    string `json:"error,omitempty"`
+}
+
+// Reasons a feature is skipped
+const (
+	SkipScan                = "scan"                 // The row could not be read
+	SkipNullGeometry        = "null_geometry"        // The geometry column is NULL
+	SkipNoGeometry          = "no_geometry"          // The geometry column is a zero-length blob
+	SkipTagsJSON            = "tags_json"            // A JSON tag column is not valid
+	SkipGeometry            = "geometry"             // The geometry could not be parsed
+	SkipUnsupportedGeometry = "unsupported_geometry" // A geometry type that cannot be converted, such as a curve
+	SkipEmptyGeometry       = "empty_geometry"       // A geometry without any points
+	SkipReproject           = "reproject"            // The geometry could not be converted to WGS 84
+	SkipInvalidGeometry     = "invalid_geometry"     // The geometry failed the validity check
+	SkipConvert             = "convert"              // No OSM elements could be made from the feature
+	SkipUntagged            = "untagged"             // The feature has no tags, see Options.KeepUntagged
+)
+
+// skipReport passes skipped features to Options.Skipped, one at a time even when layers are read in parallel
+type skipReport struct {
+	fn func(SkippedFeature)
+	mu sync.Mutex
+}
+
+// The skipper for a layer, nil when nobody is listening
+func (r *skipReport) layer(name string) skipper {
+	if r.fn == nil {
+		return nil
+	}
+	return func(fid *int64, reason string, err error) {
+		s := SkippedFeature{Layer: name, FID: fid, Reason: reason}
+		if err != nil {
+			s.Err = err.Error()
+		}
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		r.fn(s)
+	}
+}
+
+// Records why features were skipped. A nil skipper only counts them
+type skipper func(fid *int64, reason string, err error)
+
+func (s skipper) skip(ls *LayerSummary, fid *int64, reason string, err error) {
+	ls.Skipped++
+	if s != nil {
+		s(fid, reason, err)
+	}
+}
@@ -0,0 +1,93 @@
+package gpkg2osm
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+)
+
+// Bytes a spool keeps in memory before it moves them to a temporary file
+var spoolMemory = 4 << 20
+
+// spool holds what is written to it until WriteTo copies it out, for the ways and relations that XML and O5M put
+// after every node. The first spoolMemory bytes stay in memory, so small conversions never touch the disk; past
+// that everything goes to a temporary file in os.TempDir, and memory stays bounded however large the output is
+type spool struct {
+	mem     bytes.Buffer
+	file    *os.File
+	buf     *bufio.Writer
+	removed bool  // The file is already unlinked, it goes away when it is closed
+	n       int64 // Bytes held
+}
+
+func (s *spool) Write(p []byte) (int, error) {
+	if s.file == nil && s.mem.Len()+len(p) > spoolMemory {
+		if err := s.spill(); err != nil {
+			return 0, err
+		}
+	}
+	var n int
+	var err error
+	if s.file == nil {
+		n, err = s.mem.Write(p)
+	} else {
+		n, err = s.buf.Write(p)
+	}
+	s.n += int64(n)
+	return n, err
+}
+
+// Move what is in memory to a new temporary file, which takes every later Write
+func (s *spool) spill() error {
+	f, err := os.CreateTemp("", "gpkg2osm-*")
+	if err != nil {
+		return fmt.Errorf("cannot create a temporary file: %w", err)
+	}
+	// Unlinked straight away where the system allows an open file to be, so nothing is left behind when the
+	// conversion fails and the writer is never closed
+	s.removed = os.Remove(f.Name()) == nil
+	s.file, s.buf = f, bufio.NewWriterSize(f, 64<<10)
+	if _, err := s.mem.WriteTo(s.buf); err != nil {
+		return err
+	}
+	s.mem = bytes.Buffer{}
+	return nil
+}
+
+// Bytes held, in memory and in the file
+func (s *spool) Len() int64 {
+	return s.n
+}
+
+// Copy everything that was written to w, and let go of it
+func (s *spool) WriteTo(w io.Writer) (int64, error) {
+	s.n = 0
+	if s.file == nil {
+		return s.mem.WriteTo(w)
+	}
+	defer s.close()
+	if err := s.buf.Flush(); err != nil {
+		return 0, err
+	}
+	if _, err := s.file.Seek(0, io.SeekStart); err != nil {
+		return 0, err
+	}
+	return io.Copy(w, s.file)
+}
+
+// Close and remove the temporary file, if there is one
+func (s *spool) close() error {
+	if s.file == nil {
+		return nil
+	}
+	err := s.file.Close()
+	if !s.removed {
+		if rerr := os.Remove(s.file.Name()); err == nil {
+			err = rerr
+		}
+	}
+	s.file, s.buf = nil, nil
+	return err
+}
@@ -0,0 +1,89 @@
+package gpkg2osm
+
+import (
+	"encoding/binary"
+	"hash/fnv"
+	"math"
+
+	"github.com/paulmach/osm"
+	"github.com/twpayne/go-geom"
+)
+
+// Coordinates are rounded to the 7 decimal places OSM stores before they are hashed
+const stableIDScale = 1e7
+
+// A coordinate rounded to OSM precision
+type coordKey struct {
+	lon, lat int64
+}
+
+func newCoordKey(c geom.Coord) coordKey {
+	return coordKey{
+		lon: int64(math.Round(c.X() * stableIDScale)),
+		lat: int64(math.Round(c.Y() * stableIDScale)),
+	}
+}
+
+// An ID already handed out, of one element type
+type takenID struct {
+	typ osm.Type
+	id  int64
+}
+
+// stableIDs gives elements IDs derived from a hash of where they came from, so they get the same IDs in every run
+// and every file: nodes from their coordinate, and the elements of a feature from its layer and fid. An ID that
+// is already used gets the next free one instead
+type stableIDs struct {
+	taken map[takenID]bool
+	step  int64 // Direction to probe in, and the sign of the IDs
+}
+
+func newStableIDs(ids *IDGenerator) *stableIDs {
+	s := &stableIDs{
+		taken: make(map[takenID]bool),
+		step:  -1,
+	}
+	if ids != nil && ids.step > 0 {
+		s.step = 1
+	}
+	return s
+}
+
+// The ID for a node at k. If the hashed ID is already used (a tagged node at the same place, or in the rare case
+// of a hash collision) the next free ID is used, which depends on the order the nodes were created in
+func (s *stableIDs) node(k coordKey) osm.NodeID {
+	b := make([]byte, 16)
+	binary.LittleEndian.PutUint64(b, uint64(k.lon))
+	binary.LittleEndian.PutUint64(b[8:], uint64(k.lat))
+	return osm.NodeID(s.id(osm.TypeNode, b))
+}
+
+// The ID for element n of the type that the feature fid of the layer creates. The layer name is part of the hash,
+// so the same fid in another layer gets another ID
+func (s *stableIDs) feature(typ osm.Type, layer string, fid int64, n int) int64 {
+	b := append([]byte(layer), 0)
+	b = binary.LittleEndian.AppendUint64(b, uint64(fid))
+	b = append(b, typ...)
+	b = binary.LittleEndian.AppendUint32(b, uint32(n))
+	return s.id(typ, b)
+}
+
+func (s *stableIDs) id(typ osm.Type, b []byte) int64 {
+	h := fnv.New64a()
+	h.Write(b)
+	// Keep well inside int64 so probing cannot overflow
+	id := s.step * (int64(h.Sum64()>>2) + 1)
+	for s.taken[takenID{typ, id}] {
+		id += s.step
+	}
+	s.taken[takenID{typ, id}] = true
+	return id
+}
+
+// The feature whose elements are being created, for Options.IDFromFID
+type fidSeed struct {
+	layer string
+	fid   int64
+
+	nodes, ways, relations int // Elements of each type created for it so far
+}
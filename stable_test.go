@@ -0,0 +1,121 @@
+package gpkg2osm
+
+import (
+	"maps"
+	"testing"
+
+	"github.com/paulmach/osm"
+)
+
+// The node IDs of the coordinates they are at
+func nodesAt(file *osm.OSM) map[[2]float64]osm.NodeID {
+	ids := make(map[[2]float64]osm.NodeID, len(file.Nodes))
+	for _, n := range file.Nodes {
+		ids[[2]float64{n.Lon, n.Lat}] = n.ID
+	}
+	return ids
+}
+
+func TestStableNodeIDs(t *testing.T) {
+	db := newGeoPackage(t)
+	addLayer(t, db, "roads", "LINESTRING", "highway")
+	insert(t, db, "roads", line(0, 0, 1, 1, 2, 0), map[string]any{"highway": "path"})
+
+	first, _ := convert(t, db, &Options{StableIDs: true})
+	again, _ := convert(t, db, &Options{StableIDs: true})
+	if len(first.Nodes) != 3 {
+		t.Fatalf("got %d nodes, want 3", len(first.Nodes))
+	}
+	for i, n := range first.Nodes {
+		if n.ID >= 0 || n.ID != again.Nodes[i].ID {
+			t.Errorf("node %d has the IDs %d and %d", i, n.ID, again.Nodes[i].ID)
+		}
+	}
+
+	// Another file with a feature in front, which would shift sequential IDs, still gives the same coordinates
+	// the same IDs
+	other := newGeoPackage(t)
+	addLayer(t, other, "roads", "LINESTRING", "highway")
+	insert(t, other, "roads", line(5, 5, 6, 6), map[string]any{"highway": "path"})
+	insert(t, other, "roads", line(2, 0, 1, 1, 0, 0), map[string]any{"highway": "path"})
+	merged, _ := convert(t, other, &Options{StableIDs: true})
+	want, got := nodesAt(first), nodesAt(merged)
+	for c, id := range want {
+		if got[c] != id {
+			t.Errorf("node at %v has the ID %d, want %d", c, got[c], id)
+		}
+	}
+
+	// Positive IDs keep the same hashes
+	ids, _ := NewIDGenerator(IDsPositive, 1)
+	positive, _ := convert(t, db, &Options{StableIDs: true, IDs: ids})
+	for i, n := range positive.Nodes {
+		if n.ID != -first.Nodes[i].ID {
+			t.Errorf("node %d has the positive ID %d, want %d", i, n.ID, -first.Nodes[i].ID)
+		}
+	}
+}
+
+// A hash that is already taken moves on to the next free ID, in the direction of the IDs
+func TestStableIDProbing(t *testing.T) {
+	s := newStableIDs(nil)
+	a := s.node(coordKey{1, 2})
+	s.taken = map[takenID]bool{{osm.TypeNode, int64(a)}: true, {osm.TypeNode, int64(a) - 1}: true}
+	if b := s.node(coordKey{1, 2}); b != a-2 {
+		t.Errorf("got %d, want %d", b, a-2)
+	}
+}
+
+// The tag values of the ways and tagged nodes, by their IDs
+func featureIDs(file *osm.OSM, key string) map[int64]string {
+	ids := make(map[int64]string)
+	for _, n := range taggedNodes(file) {
+		ids[int64(n.ID)] = "node " + n.Tags.Find(key)
+	}
+	for _, w := range file.Ways {
+		ids[int64(w.ID)] = "way " + w.Tags.Find(key)
+	}
+	return ids
+}
+
+// With IDFromFID a feature keeps its IDs when other rows are added or removed, and the same fid in another layer
+// gets other IDs
+func TestIDFromFID(t *testing.T) {
+	db := newGeoPackage(t)
+	addLayer(t, db, "pois", "POINT", "name")
+	addLayer(t, db, "roads", "LINESTRING", "name")
+	addLayer(t, db, "paths", "LINESTRING", "name")
+	for i, name := range []string{"a", "b", "c"} {
+		insert(t, db, "pois", point(float64(i), 0), map[string]any{"name": name})
+		insert(t, db, "roads", line(float64(i), 1, float64(i), 2), map[string]any{"name": name})
+		insert(t, db, "paths", line(float64(i), 3, float64(i), 4), map[string]any{"name": "path " + name})
+	}
+	opts := &Options{IDFromFID: true}
+	first, _ := convert(t, db, opts)
+	before := featureIDs(first, "name")
+	if len(before) != 9 {
+		t.Fatalf("got %d distinct IDs for 9 features: %v", len(before), before)
+	}
+
+	exec(t, db, "DELETE FROM pois WHERE name = 'a'")
+	exec(t, db, "DELETE FROM roads WHERE name = 'a'")
+	insert(t, db, "roads", line(5, 1, 5, 2), map[string]any{"name": "d"})
+	second, _ := convert(t, db, opts)
+	after := featureIDs(second, "name")
+	for id, name := range after {
+		if was, ok := before[id]; ok && was != name {
+			t.Errorf("%d was %s and is now %s", id, was, name)
+		}
+	}
+	for id, name := range before {
+		if name != "node a" && name != "way a" && after[id] != name {
+			t.Errorf("%s lost its ID %d", name, id)
+		}
+	}
+
+	// Counted IDs do shift
+	counted, _ := convert(t, db, nil)
+	if maps.Equal(featureIDs(counted, "name"), after) {
+		t.Error("the counted IDs are the same as the ones from the fids")
+	}
+}
@@ -0,0 +1,162 @@
+package gpkg2osm
+
+import (
+	"log/slog"
+	"sort"
+
+	"github.com/paulmach/osm"
+)
+
+// LayerSummary counts what was written for a single layer
+type LayerSummary struct {
+	Features    int
+	Skipped     int
+	Untagged    int // Features skipped because they have no tags, included in Skipped
+	Deleted     int // Features with Options.DeletedTag, written as deleted or left out with SkipDeleted
+	Unsupported int // Skipped features with geometry types we cannot convert (curves, surfaces), included in Skipped
+	Empty       int // Skipped features with an empty geometry, included in Skipped
+	Null        int // Skipped features with a NULL geometry, included in Skipped
+	NoData      int // Skipped features with a zero-length geometry blob, included in Skipped
+	Nodes       int
+	Ways        int
+	Relations   int
+	Split       int // Source ways that were split for having too many nodes
+
+	TagConflicts int // Keys set by more than one tag column with different values, the later column won
+	Mismatched   int // Features whose geometry type is not the one declared for the layer, they are still written
+
+	Invalid int // Skipped features whose geometry failed the validity check, included in Skipped
+	Fixed   int // Features whose geometry was repaired before being written
+}
+
+// Add the elements in the file to the counts
+func (s *LayerSummary) Add(file *osm.OSM) {
+	s.Features++
+	s.Nodes += len(file.Nodes)
+	s.Ways += len(file.Ways)
+	s.Relations += len(file.Relations)
+}
+
+// Summary is the report of everything that was written during a conversion
+type Summary struct {
+	Layers map[string]*LayerSummary
+	Inputs map[string][]string // Names of the layers each input contributed, only for named inputs
+	Bounds *osm.Bounds         // nil until the first node is written
+	SRS    int64               // EPSG code of the coordinates in Bounds, as written, so not degrees with Options.OutputSRS
+}
+
+func NewSummary() *Summary {
+	return &Summary{
+		Layers: make(map[string]*LayerSummary),
+		Inputs: make(map[string][]string),
+		SRS:    wgs84,
+	}
+}
+
+// Record which layers came from the input
+func (s *Summary) AddInput(name string, layers []string) {
+	s.Inputs[name] = append(s.Inputs[name], layers...)
+}
+
+// Layer gets the counts for the given layer, creating them if needed
+func (s *Summary) Layer(name string) *LayerSummary {
+	l, ok := s.Layers[name]
+	if !ok {
+		l = &LayerSummary{}
+		s.Layers[name] = l
+	}
+	return l
+}
+
+// Add the elements in the file to the layer counts, and extend the bounding box with the nodes
+func (s *Summary) Add(layer string, file *osm.OSM) {
+	s.Layer(layer).Add(file)
+	for _, n := range file.Nodes {
+		if s.Bounds == nil {
+			s.Bounds = &osm.Bounds{MinLat: n.Lat, MaxLat: n.Lat, MinLon: n.Lon, MaxLon: n.Lon}
+			continue
+		}
+		s.Bounds.MinLat = min(s.Bounds.MinLat, n.Lat)
+		s.Bounds.MaxLat = max(s.Bounds.MaxLat, n.Lat)
+		s.Bounds.MinLon = min(s.Bounds.MinLon, n.Lon)
+		s.Bounds.MaxLon = max(s.Bounds.MaxLon, n.Lon)
+	}
+}
+
+// Total sums the counts of all the layers
+func (s *Summary) Total() LayerSummary {
+	names := make([]string, 0, len(s.Layers))
+	for name := range s.Layers {
+		names = append(names, name)
+	}
+	return s.sum(names)
+}
+
+// Input sums the counts of the layers that came from the given input
+func (s *Summary) Input(name string) LayerSummary {
+	return s.sum(s.Inputs[name])
+}
+
+func (s *Summary) sum(layers []string) LayerSummary {
+	t := LayerSummary{}
+	for _, name := range layers {
+		l := s.Layers[name]
+		t.Features += l.Features
+		t.Skipped += l.Skipped
+		t.Untagged += l.Untagged
+		t.Deleted += l.Deleted
+		t.Unsupported += l.Unsupported
+		t.Empty += l.Empty
+		t.Null += l.Null
+		t.NoData += l.NoData
+		t.Nodes += l.Nodes
+		t.Ways += l.Ways
+		t.Relations += l.Relations
+		t.Split += l.Split
+		t.TagConflicts += l.TagConflicts
+		t.Mismatched += l.Mismatched
+		t.Invalid += l.Invalid
+		t.Fixed += l.Fixed
+	}
+	return t
+}
+
+// Log prints the per layer breakdown, followed by the totals
+func (s *Summary) Log() {
+	names := make([]string, 0, len(s.Layers))
+	for name := range s.Layers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		l := s.Layers[name]
+		slog.Info("layer summary", slog.String("name", name), slog.Int("features", l.Features), slog.Int("skipped", l.Skipped), slog.Int("untagged", l.Untagged), slog.Int("deleted", l.Deleted), slog.Int("unsupported", l.Unsupported), slog.Int("empty", l.Empty), slog.Int("null", l.Null), slog.Int("no_data", l.NoData),
+			slog.Int("nodes", l.Nodes), slog.Int("ways", l.Ways), slog.Int("relations", l.Relations), slog.Int("split", l.Split), slog.Int("tag_conflicts", l.TagConflicts), slog.Int("mismatched", l.Mismatched),
+			slog.Int("invalid", l.Invalid), slog.Int("fixed", l.Fixed))
+	}
+
+	// Only worth a line of its own when several files were converted together
+	if len(s.Inputs) > 1 {
+		inputs := make([]string, 0, len(s.Inputs))
+		for name := range s.Inputs {
+			inputs = append(inputs, name)
+		}
+		sort.Strings(inputs)
+		for _, name := range inputs {
+			t := s.Input(name)
+			slog.Info("input summary", slog.String("name", name), slog.Int("layers", len(s.Inputs[name])), slog.Int("features", t.Features), slog.Int("skipped", t.Skipped),
+				slog.Int("nodes", t.Nodes), slog.Int("ways", t.Ways), slog.Int("relations", t.Relations))
+		}
+	}
+
+	t := s.Total()
+	attrs := []any{slog.Int("features", t.Features), slog.Int("skipped", t.Skipped), slog.Int("untagged", t.Untagged), slog.Int("deleted", t.Deleted), slog.Int("unsupported", t.Unsupported), slog.Int("empty", t.Empty), slog.Int("null", t.Null), slog.Int("no_data", t.NoData),
+		slog.Int("nodes", t.Nodes), slog.Int("ways", t.Ways), slog.Int("relations", t.Relations), slog.Int("split", t.Split), slog.Int("tag_conflicts", t.TagConflicts), slog.Int("mismatched", t.Mismatched),
+		slog.Int("invalid", t.Invalid), slog.Int("fixed", t.Fixed)}
+	if s.Bounds != nil {
+		attrs = append(attrs, slog.Group("bbox",
+			slog.Float64("minlon", s.Bounds.MinLon), slog.Float64("minlat", s.Bounds.MinLat),
+			slog.Float64("maxlon", s.Bounds.MaxLon), slog.Float64("maxlat", s.Bounds.MaxLat), slog.Int64("srs", s.SRS)))
+	}
+	slog.Info("conversion complete", attrs...)
+}
@@ -0,0 +1,59 @@
+package gpkg2osm
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/paulmach/osm"
+)
+
+func TestSummary(t *testing.T) {
+	db := newGeoPackage(t)
+	addLayer(t, db, "pois", "POINT", "amenity")
+	addLayer(t, db, "parks", "POLYGON", "leisure")
+	insert(t, db, "pois", point(-3, 2), map[string]any{"amenity": "cafe"})
+	insert(t, db, "pois", point(1, 1), nil)
+	insert(t, db, "parks", polygon([]float64{0, 0, 4, 0, 4, 5, 0, 0}), map[string]any{"leisure": "park"})
+	insert(t, db, "parks", polygon([]float64{10, 0, 14, 0, 14, 4, 10, 4, 10, 0}, []float64{11, 1, 12, 1, 12, 2, 11, 1}), map[string]any{"leisure": "park"})
+
+	logs := captureLogs(t)
+	file, summary := convert(t, db, nil)
+	want := map[string]LayerSummary{
+		"pois":  {Features: 1, Skipped: 1, Untagged: 1, Nodes: 1},
+		"parks": {Features: 2, Nodes: 10, Ways: 3, Relations: 1},
+	}
+	for name, w := range want {
+		if got := *summary.Layer(name); got != w {
+			t.Errorf("%s: %+v, want %+v", name, got, w)
+		}
+	}
+	// The counts are of what was written
+	total := summary.Total()
+	if total.Features != 3 || total.Skipped != 1 || total.Nodes != len(file.Nodes) || total.Ways != len(file.Ways) || total.Relations != len(file.Relations) {
+		t.Errorf("total %+v, for %d nodes, %d ways and %d relations", total, len(file.Nodes), len(file.Ways), len(file.Relations))
+	}
+	if b := summary.Bounds; b == nil || *b != (osm.Bounds{MinLat: 0, MaxLat: 5, MinLon: -3, MaxLon: 14}) {
+		t.Errorf("bounds %v, want -3,0 to 14,5", b)
+	}
+
+	summary.Log()
+	for _, line := range []string{
+		`msg="layer summary" name=parks features=2 skipped=0`,
+		`msg="layer summary" name=pois features=1 skipped=1 untagged=1`,
+		`msg="conversion complete" features=3 skipped=1 untagged=1`,
+		`nodes=11 ways=3 relations=1`,
+		`bbox.minlon=-3 bbox.minlat=0 bbox.maxlon=14 bbox.maxlat=5 bbox.srs=4326`,
+	} {
+		if !strings.Contains(logs.String(), line) {
+			t.Errorf("the log has no %q:\n%s", line, logs)
+		}
+	}
+	// One input is not worth a line of its own
+	if strings.Contains(logs.String(), "input summary") {
+		t.Errorf("an input summary was logged for a single input")
+	}
+
+	if empty := NewSummary(); empty.Bounds != nil || empty.Total() != (LayerSummary{}) {
+		t.Errorf("an empty summary has %v and %+v", empty.Bounds, empty.Total())
+	}
+}
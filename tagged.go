@@ -0,0 +1,29 @@
+package gpkg2osm
+
+import "github.com/paulmach/osm"
+
+// TaggedFeature is a feature with the tags it would be written with, for Options.Tagged
+type TaggedFeature struct {
+	Layer    string            `json:"layer"`         // Name of the layer in the summary
+	FID      *int64            `json:"fid,omitempty"` // Primary key of the row, nil if the layer has none
+	Geometry string            `json:"geometry"`      // Type of the feature's own geometry, such as POINT
+	Tags     map[string]string `json:"tags"`
+	Deleted  bool              `json:"deleted,omitempty"` // Would be written as deleted, see Options.DeletedTag
+}
+
+func (f *Feature) tagged(layer string) TaggedFeature {
+	tags := f.OSMTags()
+	return TaggedFeature{
+		Layer:    layer,
+		FID:      f.FID,
+		Geometry: geomTypeName(f.G),
+		Tags:     tags.Map(),
+		Deleted:  f.Deleted,
+	}
+}
+
+// nopWriter is the OSMWriter when nothing is written, see Options.Tagged
+type nopWriter struct{}
+
+func (nopWriter) Write(*osm.OSM) error { return nil }
+func (nopWriter) Close() error         { return nil }
@@ -0,0 +1,64 @@
+package gpkg2osm
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/paulmach/osm"
+)
+
+func TestTagged(t *testing.T) {
+	db := newGeoPackage(t)
+	addLayer(t, db, "pois", "POINT", "amenity", "name", "deleted")
+	addLayer(t, db, "parks", "POLYGON", "leisure")
+	insert(t, db, "pois", point(1, 1), map[string]any{"amenity": "cafe", "name": "Kaffee"})
+	insert(t, db, "pois", point(2, 2), map[string]any{"amenity": "bar", "deleted": "yes"})
+	insert(t, db, "pois", point(3, 3), nil) // Untagged, skipped as usual
+	insert(t, db, "parks", polygon([]float64{0, 0, 1, 0, 1, 1, 0, 0}), map[string]any{"leisure": "park"})
+
+	var got []TaggedFeature
+	opts := &Options{
+		LayerTagKey: "source:layer",
+		DeletedTag:  osm.Tag{Key: "deleted", Value: "yes"},
+		Tagged: func(f TaggedFeature) error {
+			got = append(got, f)
+			return nil
+		},
+	}
+	// Nothing is written, so there is no need for a writer
+	summary, err := Convert(db, nil, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 3 {
+		t.Fatalf("got %d features, want 3: %v", len(got), got)
+	}
+	one, two := int64(1), int64(2)
+	want := []TaggedFeature{
+		// Without the area=yes that the way gets when it is written
+		{Layer: "parks", FID: &one, Geometry: "POLYGON", Tags: map[string]string{"leisure": "park", "source:layer": "parks"}},
+		{Layer: "pois", FID: &one, Geometry: "POINT", Tags: map[string]string{"amenity": "cafe", "name": "Kaffee", "source:layer": "pois"}},
+		{Layer: "pois", FID: &two, Geometry: "POINT", Tags: map[string]string{"amenity": "bar", "source:layer": "pois"}, Deleted: true},
+	}
+	for i := range want {
+		g, w := got[i], want[i]
+		if g.Layer != w.Layer || g.FID == nil || *g.FID != *w.FID || g.Geometry != w.Geometry || g.Deleted != w.Deleted || fmt.Sprint(g.Tags) != fmt.Sprint(w.Tags) {
+			t.Errorf("feature %d = %+v, want %+v", i, g, w)
+		}
+	}
+	if l := summary.Layer("pois"); l.Features != 2 || l.Untagged != 1 || l.Nodes != 0 {
+		t.Errorf("pois: %d features, %d untagged and %d nodes, want 2, 1 and 0", l.Features, l.Untagged, l.Nodes)
+	}
+
+	// An error from Tagged stops the conversion
+	stop := errors.New("stop")
+	calls := 0
+	_, err = Convert(db, nil, &Options{Tagged: func(TaggedFeature) error {
+		calls++
+		return stop
+	}})
+	if !errors.Is(err, stop) || calls != 1 {
+		t.Errorf("err = %v after %d calls, want stop after 1", err, calls)
+	}
+}
@@ -0,0 +1,194 @@
+package gpkg2osm
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"path"
+	"sort"
+	"strings"
+)
+
+// TagPrecedence is the kind of tag column that wins when both set the same key
+type TagPrecedence string
+
+const (
+	PrecedenceOSMTags TagPrecedence = "osm_tags" // The JSON columns, the default
+	PrecedenceColumns TagPrecedence = "columns"  // The descriptive columns, one per key
+)
+
+// Keys of bookkeeping columns that GIS tools add to every table, which mean nothing in OSM
+var DefaultDropTags = []string{"fid", "ogc_fid", "objectid", "gid", "shape_length", "shape_leng", "shape_area"}
+
+// Column names that LayerOptions.HeuristicTags takes as tags, compared without regard to case, and the OSM key
+// of each. Columns starting with addr_ are tags too, addr_street becomes addr:street. type is not here, in OSM
+// it is the kind of a relation
+var HeuristicTagColumns = map[string]string{
+	"name": "name", "ref": "ref", "highway": "highway", "building": "building", "amenity": "amenity",
+	"landuse": "landuse", "natural": "natural", "waterway": "waterway", "railway": "railway", "leisure": "leisure",
+	"shop": "shop", "tourism": "tourism", "barrier": "barrier", "power": "power", "man_made": "man_made",
+	"place": "place", "boundary": "boundary", "admin_level": "admin_level", "surface": "surface",
+	"oneway": "oneway", "maxspeed": "maxspeed", "lanes": "lanes", "bridge": "bridge", "tunnel": "tunnel",
+	"layer": "layer", "height": "height", "ele": "ele", "operator": "operator", "opening_hours": "opening_hours",
+	"website": "website", "phone": "phone", "population": "population",
+	"street": "addr:street", "housenumber": "addr:housenumber", "postcode": "addr:postcode",
+	"zip": "addr:postcode", "city": "addr:city",
+}
+
+// The OSM key for a column under LayerOptions.HeuristicTags, false if it is not taken as a tag
+func heuristicKey(column string) (string, bool) {
+	c := strings.ToLower(column)
+	if key, ok := HeuristicTagColumns[c]; ok {
+		return key, true
+	}
+	if rest, ok := strings.CutPrefix(c, "addr_"); ok && rest != "" {
+		return "addr:" + rest, true
+	}
+	return "", false
+}
+
+// tagDropper removes the keys that match any of its patterns, without regard to case
+type tagDropper []string
+
+func newTagDropper(patterns []string) (tagDropper, error) {
+	d := make(tagDropper, len(patterns))
+	for i, p := range patterns {
+		d[i] = strings.ToLower(p)
+		if _, err := path.Match(d[i], ""); err != nil {
+			return nil, fmt.Errorf("pattern %q: %w", p, err)
+		}
+	}
+	return d, nil
+}
+
+func (d tagDropper) drop(tags map[string]any) {
+	for k := range tags {
+		key := strings.ToLower(k)
+		for _, p := range d {
+			if ok, _ := path.Match(p, key); ok {
+				delete(tags, k)
+				break
+			}
+		}
+	}
+}
+
+// The tags with the prefix in front of every key, see Options.KeyPrefix
+func prefixKeys(tags map[string]any, prefix string) map[string]any {
+	prefixed := make(map[string]any, len(tags))
+	for k, v := range tags {
+		prefixed[prefix+k] = v
+	}
+	return prefixed
+}
+
+// TagConflictError is reported when two sources set the same OSM key to different values, and the later one wins
+type TagConflictError struct {
+	Key        string
+	Source     string // Column the kept value came from
+	Overridden string // Column the lost value came from
+}
+
+func (e *TagConflictError) Error() string {
+	return fmt.Sprintf("tag %s from %s overrides the value from %s", e.Key, e.Source, e.Overridden)
+}
+
+// tagMerger builds the flat tags of a feature from its tag columns, remembering which column every key came from
+type tagMerger struct {
+	tags      map[string]any
+	from      map[string]string
+	conflicts []*TagConflictError
+
+	values map[string]map[string]string // Replacement values by key, see Options.ValueMap
+	lower  bool                         // Lowercase every key
+}
+
+func newTagMerger(values map[string]map[string]string, lower bool) *tagMerger {
+	return &tagMerger{
+		tags:   make(map[string]any),
+		from:   make(map[string]string),
+		values: values,
+		lower:  lower,
+	}
+}
+
+// Add all the tags of an object in key order, a later value for a key replaces the earlier one
+func (m *tagMerger) addAll(source string, tags map[string]any) {
+	keys := make([]string, 0, len(tags))
+	for k := range tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		m.add(source, k, tags[k])
+	}
+}
+
+// Add a tag, flattening any nested objects in the value into colon joined keys
+func (m *tagMerger) add(source, key string, v any) {
+	switch v := v.(type) {
+	case nil:
+		// Same as json_patch, null removes the key
+		delete(m.tags, key)
+		delete(m.from, key)
+		return
+	case map[string]any:
+		// An empty key is the value of the parent itself, {"name":{"":"A","en":"B"}}
+		sub := make(map[string]any, len(v))
+		for k, val := range v {
+			if k != "" {
+				k = key + ":" + k
+			} else {
+				k = key
+			}
+			sub[k] = val
+		}
+		m.addAll(source, sub)
+		return
+	case []any:
+		// There is no sensible way to write a list of objects as one value
+		for _, e := range v {
+			if _, ok := e.(map[string]any); ok {
+				slog.Warn("dropping tag, arrays of objects are not supported", "key", key)
+				return
+			}
+		}
+	}
+	if m.lower {
+		key = strings.ToLower(key)
+	}
+	if to, ok := m.values[key][tagValue(v)]; ok {
+		v = to
+	}
+	if prev, ok := m.tags[key]; ok && tagValue(prev) != tagValue(v) {
+		m.conflicts = append(m.conflicts, &TagConflictError{Key: key, Source: source, Overridden: m.from[key]})
+	}
+	m.tags[key] = v
+	m.from[key] = source
+}
+
+// Parse a JSON tags column. This is normally an object, but some exporters write a list of [key, value] pairs
+// instead: [["highway","residential"],["name","Main St"]]. A key that is listed twice keeps the last value
+func parseTagsJSON(data []byte) (map[string]any, error) {
+	tags := make(map[string]any)
+	if t := bytes.TrimSpace(data); len(t) == 0 || t[0] != '[' {
+		err := json.Unmarshal(data, &tags)
+		return tags, err
+	}
+	var pairs [][]any
+	if err := json.Unmarshal(data, &pairs); err != nil {
+		return nil, fmt.Errorf("tags must be an object or a list of [key, value] pairs: %w", err)
+	}
+	for _, p := range pairs {
+		if len(p) != 2 {
+			return nil, fmt.Errorf("tag pair %v must be a key and a value", p)
+		}
+		k, ok := p[0].(string)
+		if !ok {
+			return nil, fmt.Errorf("tag pair %v must have a string key", p)
+		}
+		tags[k] = p[1]
+	}
+	return tags, nil
+}
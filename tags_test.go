@@ -0,0 +1,390 @@
+package gpkg2osm
+
+import (
+	"cmp"
+	"errors"
+	"io"
+	"maps"
+	"slices"
+	"testing"
+
+	"github.com/paulmach/osm"
+)
+
+// JSON columns described as OSM tags are merged in the order they are described in, so the later one wins the key
+// they share
+func TestJSONColumnsMerged(t *testing.T) {
+	db := newGeoPackage(t)
+	addLayer(t, db, "pois", "POINT", "addr_tags", "poi_tags")
+	exec(t, db, "UPDATE gpkg_data_columns SET mime_type = 'application/json'")
+	insert(t, db, "pois", point(1, 2), map[string]any{
+		"addr_tags": `{"addr:street": "Main Street", "name": "Address"}`,
+		"poi_tags":  `{"amenity": "cafe", "name": "Café"}`,
+	})
+
+	file, summary := convert(t, db, nil)
+	if len(file.Nodes) != 1 {
+		t.Fatalf("got %d nodes, want 1", len(file.Nodes))
+	}
+	checkTags(t, file.Nodes[0].Tags, "addr:street", "Main Street", "amenity", "cafe", "name", "Café")
+	if c := summary.Layer("pois").TagConflicts; c != 1 {
+		t.Errorf("summary has %d tag conflicts, want 1", c)
+	}
+}
+
+func TestNestedJSONTags(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		json string
+		want []string
+	}{
+		{"one level", `{"amenity": "cafe", "addr": {"street": "Main", "city": "X"}}`,
+			[]string{"amenity", "cafe", "addr:street", "Main", "addr:city", "X"}},
+		{"two levels", `{"name": {"": "Vienna", "de": "Wien", "old": {"en": "Vindobona"}}}`,
+			[]string{"name", "Vienna", "name:de", "Wien", "name:old:en", "Vindobona"}},
+		{"array of scalars", `{"cuisine": ["pizza", "pasta"], "seats": [2, 4]}`,
+			[]string{"cuisine", "pizza;pasta", "seats", "2;4"}},
+		{"array of objects", `{"amenity": "cafe", "hours": [{"mo": "8-18"}]}`,
+			[]string{"amenity", "cafe"}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			db := newGeoPackage(t)
+			addLayer(t, db, "pois", "POINT", "osm_tags")
+			insert(t, db, "pois", point(1, 2), map[string]any{"osm_tags": tt.json})
+
+			file, _ := convert(t, db, nil)
+			if len(file.Nodes) != 1 {
+				t.Fatalf("got %d nodes, want 1", len(file.Nodes))
+			}
+			checkTags(t, file.Nodes[0].Tags, tt.want...)
+		})
+	}
+}
+
+// A column and a key of the JSON column that both become addr:street once the keys are lowercased
+func TestDuplicateKeys(t *testing.T) {
+	db := newGeoPackage(t)
+	addLayer(t, db, "houses", "POINT", "addr:street", "osm_tags")
+	insert(t, db, "houses", point(1, 2), map[string]any{"addr:street": "Main Street", "osm_tags": `{"Addr:Street": "High Street", "building": "house"}`})
+	insert(t, db, "houses", point(2, 2), map[string]any{"addr:street": "Main Street", "osm_tags": `{"Addr:Street": "Main Street", "building": "house"}`})
+
+	file, summary := convert(t, db, &Options{LowercaseKeys: true})
+	if len(file.Nodes) != 2 {
+		t.Fatalf("got %d nodes, want 2", len(file.Nodes))
+	}
+	// The JSON column wins by default, and the same value twice is no conflict
+	checkTags(t, file.Nodes[0].Tags, "addr:street", "High Street", "building", "house")
+	if c := summary.Layer("houses").TagConflicts; c != 1 {
+		t.Errorf("summary has %d tag conflicts, want 1", c)
+	}
+
+	_, err := Convert(db, nopWriter{}, &Options{LowercaseKeys: true, Strict: true})
+	var conflict *TagConflictError
+	if !errors.As(err, &conflict) || conflict.Key != "addr:street" || conflict.Source != "osm_tags" {
+		t.Errorf("strict: err = %v, want a conflict over addr:street", err)
+	}
+}
+
+// Integer road classes become highway values, whatever type SQLite stores them as
+func TestValueMap(t *testing.T) {
+	db := newGeoPackage(t)
+	addLayer(t, db, "roads", "LINESTRING", "name")
+	exec(t, db, "ALTER TABLE roads ADD COLUMN class INTEGER")
+	exec(t, db, "INSERT INTO gpkg_data_columns (table_name, column_name, description) VALUES ('roads', 'class', 'OSM tag')")
+	for i, class := range []any{1, 2, 3, "2"} {
+		insert(t, db, "roads", line(0, float64(i), 1, float64(i)), map[string]any{"class": class, "name": "1"})
+	}
+
+	file, _ := convert(t, db, &Options{ValueMap: map[string]map[string]string{
+		"class": {"1": "motorway", "2": "primary"},
+	}})
+	var got []string
+	for _, w := range file.Ways {
+		got = append(got, w.Tags.Find("class"))
+		// Only the values of the key are mapped
+		if w.Tags.Find("name") != "1" {
+			t.Errorf("way %d: name=%s", w.ID, w.Tags.Find("name"))
+		}
+	}
+	if !slices.Equal(got, []string{"motorway", "primary", "3", "primary"}) {
+		t.Errorf("classes %v, want motorway, primary, 3 (unmapped) and primary", got)
+	}
+}
+
+// JSON tags stored as a BLOB (or in a BLOB column) read the same as TEXT
+func TestJSONTagsBlob(t *testing.T) {
+	db := newGeoPackage(t)
+	addLayer(t, db, "pois", "POINT", "amenity")
+	exec(t, db, "ALTER TABLE pois ADD COLUMN osm_tags BLOB")
+	exec(t, db, "INSERT INTO gpkg_data_columns (table_name, column_name, mime_type) VALUES ('pois', 'osm_tags', 'application/json')")
+	insert(t, db, "pois", point(1, 2), map[string]any{"osm_tags": []byte(`{"amenity": "cafe", "name": "Blob"}`)})
+	insert(t, db, "pois", point(2, 2), map[string]any{"osm_tags": `{"amenity": "bench"}`})
+
+	layers, err := GetGeoPackageLayers(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(layers["pois"].JSONTags, []string{"osm_tags"}) {
+		t.Errorf("JSON tag columns %v, want osm_tags", layers["pois"].JSONTags)
+	}
+	file, _ := convert(t, db, nil)
+	if len(file.Nodes) != 2 {
+		t.Fatalf("got %d nodes, want 2", len(file.Nodes))
+	}
+	checkTags(t, file.Nodes[0].Tags, "amenity", "cafe", "name", "Blob")
+	checkTags(t, file.Nodes[1].Tags, "amenity", "bench")
+}
+
+func TestLowercaseKeys(t *testing.T) {
+	db := newGeoPackage(t)
+	addLayer(t, db, "roads", "LINESTRING", "HIGHWAY", "Name", "osm_tags")
+	insert(t, db, "roads", line(0, 0, 1, 1), map[string]any{"HIGHWAY": "primary", "Name": "Main", "osm_tags": `{"Ref": "B1", "NAME": "Main"}`})
+
+	file, summary := convert(t, db, nil)
+	checkTags(t, file.Ways[0].Tags, "HIGHWAY", "primary", "Name", "Main", "Ref", "B1", "NAME", "Main")
+
+	file, summary = convert(t, db, &Options{LowercaseKeys: true})
+	checkTags(t, file.Ways[0].Tags, "highway", "primary", "name", "Main", "ref", "B1")
+	// Name and NAME are the same key now, but with the same value
+	if c := summary.Layer("roads").TagConflicts; c != 0 {
+		t.Errorf("summary has %d tag conflicts, want 0", c)
+	}
+}
+
+// Default tags go on every feature of their layer, unless the feature has the key itself
+func TestDefaultTags(t *testing.T) {
+	db := newGeoPackage(t)
+	addLayer(t, db, "hydrants", "POINT", "emergency", "colour")
+	addLayer(t, db, "pois", "POINT", "amenity")
+	insert(t, db, "hydrants", point(0, 0), map[string]any{"colour": "red"})
+	insert(t, db, "hydrants", point(1, 0), map[string]any{"emergency": "suction_point"})
+	insert(t, db, "hydrants", point(2, 0), map[string]any{"emergency": "", "colour": "yellow"})
+	insert(t, db, "pois", point(3, 0), map[string]any{"amenity": "cafe"})
+
+	file, _ := convert(t, db, &Options{
+		StripEmptyValues: true,
+		DefaultTags:      map[string]map[string]string{"hydrants": {"emergency": "fire_hydrant"}},
+	})
+	nodes := taggedNodes(file)
+	if len(nodes) != 4 {
+		t.Fatalf("got %d tagged nodes, want 4", len(nodes))
+	}
+	slices.SortFunc(nodes, func(a, b *osm.Node) int { return cmp.Compare(a.Lon, b.Lon) })
+	checkTags(t, nodes[0].Tags, "emergency", "fire_hydrant", "colour", "red")
+	checkTags(t, nodes[1].Tags, "emergency", "suction_point")
+	// The empty value is stripped first, so the default replaces it
+	checkTags(t, nodes[2].Tags, "emergency", "fire_hydrant", "colour", "yellow")
+	checkTags(t, nodes[3].Tags, "amenity", "cafe")
+}
+
+// A JSON tag column can hold a list of [key, value] pairs instead of an object. Anything else in a list is not tags
+func TestJSONTagPairs(t *testing.T) {
+	db := newGeoPackage(t)
+	addLayer(t, db, "roads", "LINESTRING", "osm_tags")
+	for i, tags := range []string{
+		`[["highway", "residential"], ["name", "Main St"]]`,
+		` [["highway", "path"], ["highway", "footway"], ["lit", true]]`,
+		`{"highway": "service"}`,
+		`[["highway"]]`,
+		`[[1, "one"]]`,
+		`["highway", "track"]`,
+	} {
+		insert(t, db, "roads", line(0, float64(i), 1, float64(i)), map[string]any{"osm_tags": tags})
+	}
+
+	file, summary := convert(t, db, nil)
+	if len(file.Ways) != 3 {
+		t.Fatalf("got %d ways, want 3", len(file.Ways))
+	}
+	checkTags(t, file.Ways[0].Tags, "highway", "residential", "name", "Main St")
+	// The last value of a key wins
+	checkTags(t, file.Ways[1].Tags, "highway", "footway", "lit", "yes")
+	checkTags(t, file.Ways[2].Tags, "highway", "service")
+	if n := summary.Total().Skipped; n != 3 {
+		t.Errorf("%d features skipped, want the 3 that are not tags", n)
+	}
+}
+
+// The transform gets the tags as they were parsed, and what it returns is cleaned up like any other tags
+func TestTagTransform(t *testing.T) {
+	db := newGeoPackage(t)
+	addLayer(t, db, "roads", "LINESTRING", "osm_tags")
+	insert(t, db, "roads", line(0, 0, 1, 0), map[string]any{"osm_tags": `{"highway": "primary", "lanes:forward": 2, "lanes:backward": 1, "name": ""}`})
+	addLayer(t, db, "paths", "LINESTRING", "osm_tags")
+	insert(t, db, "paths", line(0, 1, 1, 1), map[string]any{"osm_tags": `{"highway": "path"}`})
+
+	var seen []map[string]any
+	file, summary := convert(t, db, &Options{
+		StripEmptyValues: true,
+		DefaultTags:      map[string]map[string]string{"roads": {"surface": "asphalt"}},
+		DropTags:         []string{"debug:*"},
+		TagTransform: func(layer string, tags map[string]any) map[string]any {
+			seen = append(seen, maps.Clone(tags))
+			if layer != "roads" {
+				return nil
+			}
+			// Still the JSON numbers
+			tags["lanes"] = tags["lanes:forward"].(float64) + tags["lanes:backward"].(float64)
+			tags["note"] = ""
+			tags["debug:lanes"] = "computed"
+			return tags
+		},
+	})
+	if len(seen) != 2 {
+		t.Fatalf("the transform was called %d times, want 2", len(seen))
+	}
+	// Layers are converted in name order
+	if _, ok := seen[1]["name"]; !ok {
+		t.Error("the empty name was stripped before the transform")
+	}
+	if _, ok := seen[1]["surface"]; ok {
+		t.Error("the default tags were added before the transform")
+	}
+	if len(file.Ways) != 1 {
+		t.Fatalf("got %d ways, want 1", len(file.Ways))
+	}
+	checkTags(t, file.Ways[0].Tags, "highway", "primary", "lanes", "3", "lanes:forward", "2", "lanes:backward", "1", "surface", "asphalt")
+	if n := summary.Total().Untagged; n != 1 {
+		t.Errorf("%d untagged features, want the path the transform emptied", n)
+	}
+}
+
+// Empty values are tags unless they are stripped, and a feature left with none is untagged
+func TestStripEmptyValues(t *testing.T) {
+	db := newGeoPackage(t)
+	addLayer(t, db, "pois", "POINT", "amenity", "name", "osm_tags")
+	insert(t, db, "pois", point(0, 0), map[string]any{"amenity": "bench", "name": "", "osm_tags": `{"material": "", "colour": []}`})
+	insert(t, db, "pois", point(1, 0), map[string]any{"amenity": "", "name": nil})
+
+	file, summary := convert(t, db, nil)
+	if nodes := taggedNodes(file); len(nodes) != 2 {
+		t.Fatalf("got %d tagged nodes, want 2", len(nodes))
+	}
+	checkTags(t, file.Nodes[0].Tags, "amenity", "bench", "name", "", "material", "", "colour", "")
+	checkTags(t, file.Nodes[1].Tags, "amenity", "")
+	if n := summary.Total().Untagged; n != 0 {
+		t.Errorf("%d untagged features, want none", n)
+	}
+
+	file, summary = convert(t, db, &Options{StripEmptyValues: true})
+	if len(file.Nodes) != 1 {
+		t.Fatalf("got %d nodes with empty values stripped, want 1", len(file.Nodes))
+	}
+	checkTags(t, file.Nodes[0].Tags, "amenity", "bench")
+	if n := summary.Total().Untagged; n != 1 {
+		t.Errorf("%d untagged features, want the one with only an empty amenity", n)
+	}
+}
+
+// osm_tags wins a key it shares with a tag column by default, the column wins with PrecedenceColumns, and a NULL
+// column never removes a tag
+func TestTagPrecedence(t *testing.T) {
+	db := newGeoPackage(t)
+	addLayer(t, db, "shops", "POINT", "shop", "name", "osm_tags")
+	insert(t, db, "shops", point(1, 2), map[string]any{"shop": "bakery", "osm_tags": `{"shop": "pastry", "name": "Brot"}`})
+
+	for _, tt := range []struct {
+		precedence TagPrecedence
+		shop       string
+	}{
+		{"", "pastry"},
+		{PrecedenceOSMTags, "pastry"},
+		{PrecedenceColumns, "bakery"},
+	} {
+		file, summary := convert(t, db, &Options{TagPrecedence: tt.precedence})
+		if len(file.Nodes) != 1 {
+			t.Fatalf("%q: got %d nodes, want 1", tt.precedence, len(file.Nodes))
+		}
+		checkTags(t, file.Nodes[0].Tags, "shop", tt.shop, "name", "Brot")
+		if c := summary.Layer("shops").TagConflicts; c != 1 {
+			t.Errorf("%q: summary has %d tag conflicts, want 1", tt.precedence, c)
+		}
+	}
+
+	w, err := NewWriter(io.Discard, FormatXML)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Convert(db, w, &Options{TagPrecedence: "json"}); err == nil {
+		t.Error("converted with an unknown tag precedence")
+	}
+}
+
+// The bookkeeping keys are dropped by default, DropTags replaces them with exact keys and globs, and an empty list
+// keeps every key. The layer name tag is added after, so it is never dropped
+func TestDropTags(t *testing.T) {
+	db := newGeoPackage(t)
+	addLayer(t, db, "roads", "LINESTRING", "highway", "OBJECTID", "Shape_Length", "internal:id")
+	insert(t, db, "roads", line(0, 0, 1, 0), map[string]any{"highway": "primary", "OBJECTID": 7, "Shape_Length": 1.5, "internal:id": "x"})
+
+	for _, tt := range []struct {
+		name string
+		drop []string
+		want []string
+	}{
+		{"default", nil, []string{"highway", "primary", "internal:id", "x", "source:layer", "roads"}},
+		{"globs", []string{"shape_*", "INTERNAL:*", "source:*"}, []string{"highway", "primary", "OBJECTID", "7", "source:layer", "roads"}},
+		{"none", []string{}, []string{"highway", "primary", "OBJECTID", "7", "Shape_Length", "1.5", "internal:id", "x", "source:layer", "roads"}},
+	} {
+		file, _ := convert(t, db, &Options{DropTags: tt.drop, LayerTagKey: "source:layer"})
+		if len(file.Ways) != 1 {
+			t.Fatalf("%s: got %d ways, want 1", tt.name, len(file.Ways))
+		}
+		checkTags(t, file.Ways[0].Tags, tt.want...)
+	}
+
+	w, err := NewWriter(io.Discard, FormatXML)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Convert(db, w, &Options{DropTags: []string{"shape_["}}); err == nil {
+		t.Error("converted with a malformed glob")
+	}
+}
+
+// KeyPrefix goes in front of the feature's keys and the area tag, after the options that take the plain keys,
+// and not in front of the type of relations or the layer tag
+func TestKeyPrefix(t *testing.T) {
+	db := newGeoPackage(t)
+	addLayer(t, db, "parks", "POLYGON", "leisure", "OBJECTID", "highway")
+	insert(t, db, "parks", polygon([]float64{0, 0, 1, 0, 1, 1, 0, 0}), map[string]any{"leisure": "park", "OBJECTID": 1})
+	insert(t, db, "parks", polygon([]float64{10, 0, 14, 0, 14, 4, 10, 4, 10, 0}, []float64{11, 1, 12, 1, 12, 2, 11, 1}), map[string]any{"leisure": "park"})
+	insert(t, db, "parks", polygon([]float64{20, 0, 21, 0, 21, 1, 20, 0}), map[string]any{"highway": "pedestrian"})
+
+	file, _ := convert(t, db, &Options{KeyPrefix: "gpkg:", LayerTagKey: "source:layer", ValueMap: map[string]map[string]string{"leisure": {"park": "garden"}}})
+	if len(file.Ways) != 4 || len(file.Relations) != 1 {
+		t.Fatalf("got %d ways and %d relations, want 4 and 1", len(file.Ways), len(file.Relations))
+	}
+	checkTags(t, file.Ways[0].Tags, "gpkg:leisure", "garden", "gpkg:area", "yes", "source:layer", "parks")
+	checkTags(t, file.Relations[0].Tags, "gpkg:leisure", "garden", "type", "multipolygon", "source:layer", "parks")
+	// highway is not an area key, with or without the prefix
+	checkTags(t, file.Ways[3].Tags, "gpkg:highway", "pedestrian", "source:layer", "parks")
+}
+
+func TestHeuristicTags(t *testing.T) {
+	db := newGeoPackage(t)
+	addLayer(t, db, "roads", "LINESTRING", "HIGHWAY", "Name", "zip", "postcode", "addr_street", "shape_len")
+	// Nothing describes the columns as tags, only their names tell
+	exec(t, db, "DELETE FROM gpkg_data_columns")
+	insert(t, db, "roads", line(0, 0, 1, 1), map[string]any{"HIGHWAY": "residential", "Name": "Main Street", "zip": "12345", "shape_len": 1.4})
+	insert(t, db, "roads", line(2, 0, 3, 1), map[string]any{"HIGHWAY": "service", "zip": "12345", "postcode": "54321", "addr_street": "Main Street"})
+
+	file, summary := convert(t, db, &Options{HeuristicTags: true})
+	if len(file.Ways) != 2 {
+		t.Fatalf("got %d ways, want 2", len(file.Ways))
+	}
+	checkTags(t, file.Ways[0].Tags, "highway", "residential", "name", "Main Street", "addr:postcode", "12345")
+	// zip and postcode are both addr:postcode, the later column wins and the conflict is counted
+	checkTags(t, file.Ways[1].Tags, "highway", "service", "addr:postcode", "54321", "addr:street", "Main Street")
+	if c := summary.Layer("roads").TagConflicts; c != 1 {
+		t.Errorf("TagConflicts = %d, want 1", c)
+	}
+
+	// Without the option the layer has no tag columns at all
+	file, _ = convert(t, db, nil)
+	for _, w := range file.Ways {
+		if len(w.Tags) != 0 {
+			t.Errorf("way %d has tags %v, want none", w.ID, w.Tags)
+		}
+	}
+}
@@ -0,0 +1,222 @@
+package gpkg2osm
+
+import (
+	"cmp"
+	"fmt"
+	"math"
+	"slices"
+
+	"github.com/twpayne/go-geom"
+)
+
+// InvalidGeometryError is returned by the geometry check for geometries that would make broken OSM elements
+type InvalidGeometryError struct {
+	Reason string
+}
+
+func (e *InvalidGeometryError) Error() string {
+	return "invalid geometry: " + e.Reason
+}
+
+func invalid(format string, args ...any) error {
+	return &InvalidGeometryError{Reason: fmt.Sprintf(format, args...)}
+}
+
+// Check that a geometry can be written as valid OSM elements: finite coordinates, lines with at least two
+// distinct points, and closed rings that do not cross themselves. With fix, the problems that have an obvious
+// repair are repaired instead (unclosed rings are closed, repeated points are dropped) and the fixed geometry
+// is returned, along with whether anything changed. There is no repair for self intersections
+func checkGeometry(g geom.T, fix bool) (geom.T, bool, error) {
+	switch g := g.(type) {
+	case *geom.Point:
+		return g, false, checkFinite(g.Coords())
+	case *geom.MultiPoint:
+		for i := 0; i < g.NumPoints(); i++ {
+			if err := checkFinite(g.Point(i).Coords()); err != nil {
+				return nil, false, err
+			}
+		}
+		return g, false, nil
+	case *geom.LineString:
+		coords, changed, err := checkLine(g.Coords(), fix)
+		if err != nil || !changed {
+			return g, false, err
+		}
+		l, err := geom.NewLineString(g.Layout()).SetCoords(coords)
+		return l, true, err
+	case *geom.MultiLineString:
+		lines := make([][]geom.Coord, g.NumLineStrings())
+		var changed bool
+		for i := range lines {
+			c, ch, err := checkLine(g.LineString(i).Coords(), fix)
+			if err != nil {
+				return nil, false, err
+			}
+			lines[i], changed = c, changed || ch
+		}
+		if !changed {
+			return g, false, nil
+		}
+		ml, err := geom.NewMultiLineString(g.Layout()).SetCoords(lines)
+		return ml, true, err
+	case *geom.Polygon:
+		rings, changed, err := checkPolygon(g, fix)
+		if err != nil || !changed {
+			return g, false, err
+		}
+		p, err := geom.NewPolygon(g.Layout()).SetCoords(rings)
+		return p, true, err
+	case *geom.MultiPolygon:
+		polys := make([][][]geom.Coord, g.NumPolygons())
+		var changed bool
+		for i := range polys {
+			r, ch, err := checkPolygon(g.Polygon(i), fix)
+			if err != nil {
+				return nil, false, err
+			}
+			polys[i], changed = r, changed || ch
+		}
+		if !changed {
+			return g, false, nil
+		}
+		mp, err := geom.NewMultiPolygon(g.Layout()).SetCoords(polys)
+		return mp, true, err
+	}
+	// Anything else is reported when it is converted
+	return g, false, nil
+}
+
+func checkFinite(coords ...geom.Coord) error {
+	for _, c := range coords {
+		for _, v := range c {
+			if math.IsNaN(v) || math.IsInf(v, 0) {
+				return invalid("coordinate %v is not a number", c)
+			}
+		}
+	}
+	return nil
+}
+
+// Drop points that repeat the one before them, which say nothing and would repeat a node in the way
+func dedupe(coords []geom.Coord) []geom.Coord {
+	out := make([]geom.Coord, 0, len(coords))
+	for _, c := range coords {
+		if len(out) > 0 && c.Equal(geom.XY, out[len(out)-1]) {
+			continue
+		}
+		out = append(out, c)
+	}
+	return out
+}
+
+func checkLine(coords []geom.Coord, fix bool) ([]geom.Coord, bool, error) {
+	if err := checkFinite(coords...); err != nil {
+		return nil, false, err
+	}
+	d := dedupe(coords)
+	if len(d) < 2 {
+		return nil, false, invalid("line has fewer than 2 distinct points")
+	}
+	if fix && len(d) != len(coords) {
+		return d, true, nil
+	}
+	return coords, false, nil
+}
+
+func checkPolygon(p *geom.Polygon, fix bool) ([][]geom.Coord, bool, error) {
+	rings := p.Coords()
+	var changed bool
+	for i, r := range rings {
+		if err := checkFinite(r...); err != nil {
+			return nil, false, err
+		}
+		if len(r) > 0 && !r[0].Equal(geom.XY, r[len(r)-1]) {
+			if !fix {
+				return nil, false, invalid("ring %d is not closed", i)
+			}
+			r = append(r, r[0])
+			changed = true
+		}
+		if fix {
+			if d := dedupe(r); len(d) != len(r) {
+				r = d
+				changed = true
+			}
+		}
+		// A closed ring repeats its first point, so a triangle has 4
+		if len(dedupe(r)) < 4 {
+			return nil, false, invalid("ring %d has fewer than 3 distinct points", i)
+		}
+		if err := checkSelfIntersection(r); err != nil {
+			return nil, false, fmt.Errorf("ring %d: %w", i, err)
+		}
+		rings[i] = r
+	}
+	return rings, changed, nil
+}
+
+// Look for two segments of a closed ring that touch or cross, other than neighbours sharing their end point.
+// The segments are swept from west to east, and each is only compared with the ones before it whose
+// bounding boxes overlap its own, so a ring of many thousands of points takes about as long as sorting them
+func checkSelfIntersection(ring []geom.Coord) error {
+	r := dedupe(ring)
+	n := len(r) - 1 // Number of segments
+	segs := make([]int, n)
+	for i := range segs {
+		segs[i] = i
+	}
+	minX := func(i int) float64 { return min(r[i].X(), r[i+1].X()) }
+	maxX := func(i int) float64 { return max(r[i].X(), r[i+1].X()) }
+	slices.SortFunc(segs, func(a, b int) int { return cmp.Compare(minX(a), minX(b)) })
+
+	var active []int // Segments that start west of the current one and reach at least as far east
+	for _, j := range segs {
+		active = slices.DeleteFunc(active, func(i int) bool { return maxX(i) < minX(j) })
+		for _, i := range active {
+			a, b := min(i, j), max(i, j)
+			if b == a+1 || (a == 0 && b == n-1) {
+				continue // Neighbours, they share a point
+			}
+			if max(r[i].Y(), r[i+1].Y()) < min(r[j].Y(), r[j+1].Y()) || max(r[j].Y(), r[j+1].Y()) < min(r[i].Y(), r[i+1].Y()) {
+				continue
+			}
+			if segmentsIntersect(r[a], r[a+1], r[b], r[b+1]) {
+				return invalid("ring crosses itself near %.7f,%.7f", r[b].X(), r[b].Y())
+			}
+		}
+		active = append(active, j)
+	}
+	return nil
+}
+
+// Whether segment ab and segment cd have any point in common
+func segmentsIntersect(a, b, c, d geom.Coord) bool {
+	d1 := orientation(c, d, a)
+	d2 := orientation(c, d, b)
+	d3 := orientation(a, b, c)
+	d4 := orientation(a, b, d)
+	if d1 != d2 && d3 != d4 {
+		return true
+	}
+	// Collinear, they only meet if they overlap
+	return (d1 == 0 && onSegment(c, d, a)) || (d2 == 0 && onSegment(c, d, b)) ||
+		(d3 == 0 && onSegment(a, b, c)) || (d4 == 0 && onSegment(a, b, d))
+}
+
+// -1, 0 or 1 for c being clockwise of, on, or counter clockwise of the line through a and b
+func orientation(a, b, c geom.Coord) int {
+	v := (b.X()-a.X())*(c.Y()-a.Y()) - (b.Y()-a.Y())*(c.X()-a.X())
+	switch {
+	case v > 0:
+		return 1
+	case v < 0:
+		return -1
+	}
+	return 0
+}
+
+// Whether c, which is on the line through a and b, is between them
+func onSegment(a, b, c geom.Coord) bool {
+	return min(a.X(), b.X()) <= c.X() && c.X() <= max(a.X(), b.X()) &&
+		min(a.Y(), b.Y()) <= c.Y() && c.Y() <= max(a.Y(), b.Y())
+}
@@ -0,0 +1,77 @@
+package gpkg2osm
+
+import (
+	"errors"
+	"math"
+	"testing"
+
+	"github.com/twpayne/go-geom"
+)
+
+func ring(flat ...float64) []geom.Coord {
+	coords := make([]geom.Coord, 0, len(flat)/2)
+	for i := 0; i+1 < len(flat); i += 2 {
+		coords = append(coords, geom.Coord{flat[i], flat[i+1]})
+	}
+	return coords
+}
+
+func TestSelfIntersection(t *testing.T) {
+	for _, tt := range []struct {
+		name  string
+		ring  []geom.Coord
+		valid bool
+	}{
+		{"square", ring(0, 0, 1, 0, 1, 1, 0, 1, 0, 0), true},
+		{"repeated point", ring(0, 0, 1, 0, 1, 0, 1, 1, 0, 1, 0, 0), true},
+		{"concave", ring(0, 0, 4, 0, 4, 4, 2, 1, 0, 4, 0, 0), true},
+		{"bowtie", ring(0, 0, 1, 1, 1, 0, 0, 1, 0, 0), false},
+		{"figure eight", ring(0, 0, 2, 2, 4, 0, 4, 4, 2, 2, 0, 4, 0, 0), false},
+		{"touching its own side", ring(0, 0, 4, 0, 4, 4, 2, 0, 0, 4, 0, 0), false},
+		{"doubling back", ring(0, 0, 4, 0, 4, 1, 2, 1, 6, 1, 6, 2, 0, 2, 0, 0), false},
+	} {
+		err := checkSelfIntersection(tt.ring)
+		var ie *InvalidGeometryError
+		if tt.valid && err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+		} else if !tt.valid && !errors.As(err, &ie) {
+			t.Errorf("%s: got %v, want an invalid geometry", tt.name, err)
+		}
+	}
+}
+
+// Rings too large to compare every pair of segments of
+func TestSelfIntersectionLargeRing(t *testing.T) {
+	const n = 200000
+	circle := make([]geom.Coord, n+1)
+	for i := range n {
+		a := 2 * math.Pi * float64(i) / n
+		circle[i] = geom.Coord{math.Cos(a), math.Sin(a)}
+	}
+	circle[n] = circle[0]
+	if err := checkSelfIntersection(circle); err != nil {
+		t.Errorf("circle: %v", err)
+	}
+	// Pull one point across to the other side, so its segments cross the whole ring
+	circle[n/4] = geom.Coord{0, -2}
+	if err := checkSelfIntersection(circle); err == nil {
+		t.Error("the ring with a point pulled across it is valid")
+	}
+}
+
+func TestBowtieSkipped(t *testing.T) {
+	db := newGeoPackage(t)
+	addLayer(t, db, "parks", "POLYGON", "leisure")
+	insert(t, db, "parks", polygon([]float64{0, 0, 1, 1, 1, 0, 0, 1, 0, 0}), map[string]any{"leisure": "park"})
+	insert(t, db, "parks", polygon([]float64{2, 0, 3, 0, 3, 1, 2, 1, 2, 0}), map[string]any{"leisure": "garden"})
+
+	for _, opts := range []*Options{{ValidateGeometry: true}, {FixGeometry: true}} {
+		file, summary := convert(t, db, opts)
+		if len(file.Ways) != 1 || file.Ways[0].Tags.Find("leisure") != "garden" {
+			t.Errorf("got ways %v, want only the garden", file.Ways)
+		}
+		if s := summary.Total(); s.Invalid != 1 || s.Skipped != 1 || s.Fixed != 0 {
+			t.Errorf("summary has %d invalid, %d skipped and %d fixed, want the bowtie invalid", s.Invalid, s.Skipped, s.Fixed)
+		}
+	}
+}
@@ -0,0 +1,65 @@
+package gpkg2osm
+
+import (
+	"fmt"
+
+	"github.com/paulmach/osm"
+)
+
+// Verify reads back an OSM file and checks that it is self consistent: there are no duplicate IDs, every node a
+// way uses was written, and every relation member exists. One error is returned for each problem found, the
+// final error is only set if the file could not be read
+func Verify(s osm.Scanner) ([]error, error) {
+	seen := map[osm.Type]map[int64]bool{
+		osm.TypeNode:     {},
+		osm.TypeWay:      {},
+		osm.TypeRelation: {},
+	}
+	type ref struct {
+		fromType osm.Type
+		from     int64
+		typ      osm.Type
+		id       int64
+	}
+	var problems []error
+	var pending []ref // References to elements that were not written yet when the reference was read
+
+	add := func(typ osm.Type, id int64) {
+		if seen[typ][id] {
+			problems = append(problems, fmt.Errorf("duplicate %s id %d", typ, id))
+		}
+		seen[typ][id] = true
+	}
+	check := func(r ref) {
+		if !seen[r.typ][r.id] {
+			pending = append(pending, r)
+		}
+	}
+
+	for s.Scan() {
+		switch o := s.Object().(type) {
+		case *osm.Node:
+			add(osm.TypeNode, int64(o.ID))
+		case *osm.Way:
+			add(osm.TypeWay, int64(o.ID))
+			for _, n := range o.Nodes {
+				check(ref{fromType: osm.TypeWay, from: int64(o.ID), typ: osm.TypeNode, id: int64(n.ID)})
+			}
+		case *osm.Relation:
+			add(osm.TypeRelation, int64(o.ID))
+			for _, m := range o.Members {
+				check(ref{fromType: osm.TypeRelation, from: int64(o.ID), typ: m.Type, id: m.Ref})
+			}
+		}
+	}
+	if err := s.Err(); err != nil {
+		return problems, err
+	}
+
+	for _, r := range pending {
+		if !seen[r.typ][r.id] {
+			problems = append(problems, fmt.Errorf("%s %d references missing %s %d", r.fromType, r.from, r.typ, r.id))
+		}
+	}
+	return problems, nil
+}
@@ -0,0 +1,69 @@
+package gpkg2osm
+
+import (
+	"bytes"
+	"slices"
+	"testing"
+
+	"github.com/paulmach/osm"
+)
+
+func TestVerifyConverted(t *testing.T) {
+	db := newGeoPackage(t)
+	addLayer(t, db, "roads", "LINESTRING", "highway")
+	addLayer(t, db, "parks", "POLYGON", "leisure")
+	insert(t, db, "roads", line(0, 0, 1, 1, 2, 0), map[string]any{"highway": "path"})
+	insert(t, db, "roads", line(2, 0, 3, 3), map[string]any{"highway": "path"})
+	insert(t, db, "parks", polygon(
+		[]float64{0, 0, 4, 0, 4, 4, 0, 4, 0, 0},
+		[]float64{1, 1, 2, 1, 2, 2, 1, 1},
+	), map[string]any{"leisure": "park"})
+
+	for _, format := range []Format{FormatXML, FormatPBF, FormatO5M} {
+		data, _ := convertTo(t, db, format, &Options{DedupScope: DedupGlobal})
+		problems, err := Verify(NewScanner(bytes.NewReader(data), format))
+		if err != nil || len(problems) > 0 {
+			t.Errorf("%s: %v %v", format, problems, err)
+		}
+	}
+}
+
+func TestVerifyProblems(t *testing.T) {
+	file := &osm.OSM{
+		Nodes: osm.Nodes{{ID: -1}, {ID: -2}, {ID: -2}},
+		Ways: osm.Ways{
+			{ID: -1, Nodes: osm.WayNodes{{ID: -1}, {ID: -2}}},
+			{ID: -2, Nodes: osm.WayNodes{{ID: -1}, {ID: -3}}},
+		},
+		Relations: osm.Relations{{ID: -1, Members: osm.Members{
+			{Type: osm.TypeWay, Ref: -1},
+			{Type: osm.TypeWay, Ref: -5},
+			{Type: osm.TypeRelation, Ref: -2}, // Written later, which is fine
+		}}, {ID: -2}},
+	}
+	var buf bytes.Buffer
+	w := NewXMLWriter(&buf)
+	if err := w.Write(file); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	problems, err := Verify(NewScanner(&buf, FormatXML))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, p := range problems {
+		got = append(got, p.Error())
+	}
+	want := []string{
+		"duplicate node id -2",
+		"way -2 references missing node -3",
+		"relation -1 references missing way -5",
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("problems:\n%q\nwant\n%q", got, want)
+	}
+}
@@ -0,0 +1,418 @@
+package gpkg2osm
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"math"
+	"time"
+
+	"github.com/lc-dmx/osm-go/osmpbf"
+	"github.com/lc-dmx/osm-go/osmpbf/entity"
+	"github.com/paulmach/osm"
+)
+
+// OSMWriter writes converted elements to the output file
+type OSMWriter interface {
+	// Write all the elements in the file to the output
+	Write(file *osm.OSM) error
+	// Close finishes the output. It does not close the underlying writer
+	Close() error
+}
+
+// NewWriter returns the OSMWriter for the format. Any io.Writer works, a bytes.Buffer is enough to convert in
+// memory and read the result back with NewScanner
+func NewWriter(w io.Writer, format Format) (OSMWriter, error) {
+	switch format {
+	case FormatPBF:
+		return NewPBFWriter(w, nil)
+	case FormatXML:
+		return NewXMLWriter(w), nil
+	case FormatO5M:
+		return NewO5MWriter(w), nil
+	}
+	return nil, fmt.Errorf("unknown output format %q", format)
+}
+
+// Elements per PBF data block, the same as osmium
+const DefaultPBFBlockSize = 8000
+
+// PBFOptions control how the PBF file is written
+type PBFOptions struct {
+	// Elements per data block. Smaller blocks use less memory while writing, larger ones compress better.
+	// Defaults to DefaultPBFBlockSize. Blocks are also cut short if they near the 16MB the format allows
+	BlockSize int
+	// zlib level of the blocks, from 1 to 9 (smallest, the default when 0). PBFUncompressed stores
+	// them as they are. The blocks are always compressed at 9 first, so any other level writes more slowly
+	CompressLevel int
+	// Write every node, then every way, then every relation, for readers that expect a way's nodes before it.
+	// Without it the elements of each feature are written together as they come. The ways and relations are held
+	// in memory until Close, and Flush only writes out the nodes
+	Sorted bool
+}
+
+// pbfWriter streams elements into a PBF file. PBF stores coordinates as integers in units of the block's
+// granularity from its lon and lat offsets. The encoder always writes a granularity of 100 nanodegrees and zero
+// offsets into each block, so readers never fall back to defaults that could differ. That is 1e-7 degrees (about
+// 1cm), the precision of OSM itself, anything finer is rounded to the closest unit
+type pbfWriter struct {
+	pbf       *osmpbf.Writer
+	blockSize int
+	pending   int // Elements in the block that is being built
+
+	sorted    bool
+	ways      []*osm.Way // Held back for Close when sorted
+	relations []*osm.Relation
+}
+
+func NewPBFWriter(w io.Writer, opts *PBFOptions) (*pbfWriter, error) {
+	if err := opts.check(); err != nil {
+		return nil, err
+	}
+	pbf, err := osmpbf.NewWriter(context.Background(), opts.output(w))
+	if err != nil {
+		return nil, err
+	}
+	return newPBFWriter(pbf, opts), nil
+}
+
+func newPBFWriter(pbf *osmpbf.Writer, opts *PBFOptions) *pbfWriter {
+	p := &pbfWriter{pbf: pbf, blockSize: DefaultPBFBlockSize}
+	if opts != nil && opts.BlockSize > 0 {
+		p.blockSize = opts.BlockSize
+	}
+	if opts != nil {
+		p.sorted = opts.Sorted
+	}
+	return p
+}
+
+// Write one element, finishing the block once it is full
+func (p *pbfWriter) writeEntity(e entity.Exporter) error {
+	if err := p.pbf.WriteEntity(e); err != nil {
+		return err
+	}
+	p.pending++
+	if p.pending >= p.blockSize {
+		return p.Flush()
+	}
+	return nil
+}
+
+// Flush ends the block being built early and writes it out, so everything written so far is in the output
+func (p *pbfWriter) Flush() error {
+	p.pending = 0
+	return p.pbf.Flush()
+}
+
+func (p *pbfWriter) Write(file *osm.OSM) error {
+	for _, n := range file.Nodes {
+		if err := p.writeNode(n); err != nil {
+			return err
+		}
+	}
+	if p.sorted {
+		p.ways = append(p.ways, file.Ways...)
+		p.relations = append(p.relations, file.Relations...)
+		return nil
+	}
+	return p.writeRest(file.Ways, file.Relations)
+}
+
+func (p *pbfWriter) writeNode(n *osm.Node) error {
+	// Converting these to integers gives nonsense, not an error
+	if !finite(n.Lon) || !finite(n.Lat) {
+		return fmt.Errorf("node %d has an invalid coordinate %v,%v", n.ID, n.Lon, n.Lat)
+	}
+	e := entity.NewNode(int64(n.ID))
+	setInfo(e.Entity, n.Version, n.Timestamp, n.User)
+	e.SetLon(n.Lon)
+	e.SetLat(n.Lat)
+	e.SetVisible(n.Visible)
+	e.SetTags(entityTags(n.Tags))
+	return p.writeEntity(e)
+}
+
+// Write the ways and then the relations
+func (p *pbfWriter) writeRest(ways []*osm.Way, relations []*osm.Relation) error {
+	for _, w := range ways {
+		e := entity.NewWay(int64(w.ID))
+		setInfo(e.Entity, w.Version, w.Timestamp, w.User)
+		nodes := make([]*entity.Node, len(w.Nodes))
+		for i, n := range w.Nodes {
+			nodes[i] = entity.NewNode(int64(n.ID))
+		}
+		e.SetNodes(nodes)
+		e.SetVisible(w.Visible)
+		e.SetTags(entityTags(w.Tags))
+		if err := p.writeEntity(e); err != nil {
+			return err
+		}
+	}
+	for _, r := range relations {
+		e := entity.NewRelation(int64(r.ID))
+		setInfo(e.Entity, r.Version, r.Timestamp, r.User)
+		members := make([]*entity.RelationMember, len(r.Members))
+		for i, m := range r.Members {
+			var ref entity.Exporter
+			switch m.Type {
+			case osm.TypeNode:
+				ref = entity.NewNode(m.Ref)
+			case osm.TypeWay:
+				ref = entity.NewWay(m.Ref)
+			default:
+				ref = entity.NewRelation(m.Ref)
+			}
+			members[i] = entity.NewRelationMember(ref, m.Role)
+		}
+		e.SetRelationMembers(members)
+		e.SetVisible(r.Visible)
+		e.SetTags(entityTags(r.Tags))
+		if err := p.writeEntity(e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *pbfWriter) Close() error {
+	if p.sorted {
+		// Each type starts a block of its own, as osmium writes them
+		if err := p.Flush(); err != nil {
+			return err
+		}
+		if err := p.writeRest(p.ways, nil); err != nil {
+			return err
+		}
+		if err := p.Flush(); err != nil {
+			return err
+		}
+		if err := p.writeRest(nil, p.relations); err != nil {
+			return err
+		}
+		p.ways, p.relations = nil, nil
+	}
+	return p.pbf.Close()
+}
+
+func finite(v float64) bool {
+	return !math.IsNaN(v) && !math.IsInf(v, 0)
+}
+
+// Copy the element metadata to the entity. A zero timestamp is left unset, Unix() of the zero time is far
+// outside what PBF can hold
+func setInfo(e *entity.Entity, version int, ts time.Time, user string) {
+	e.SetVersion(int32(version))
+	if !ts.IsZero() {
+		e.SetTimestamp(ts.Unix()) // The encoder keeps the default date granularity of a second
+	}
+	e.SetUser(user)
+}
+
+// The PBF encoder expects every tag value to be a string
+func entityTags(tags osm.Tags) map[string]any {
+	m := make(map[string]any, len(tags))
+	for _, t := range tags {
+		m[t.Key] = t.Value
+	}
+	return m
+}
+
+// srsWriter is a writer that can record the coordinate system of the output, when it is not WGS 84
+type srsWriter interface {
+	setSRS(code int64)
+}
+
+// xmlWriter streams the elements into an OSM XML document. OSM XML lists every node, then every way, then every
+// relation, so nodes are written as they come while the ways and relations are encoded into spools that are
+// copied out on Close. The elements are never kept, only their XML, and that goes to a temporary file once it
+// outgrows spoolMemory
+type xmlWriter struct {
+	w       io.Writer
+	started bool
+	srs     int64 // EPSG code of the coordinates, noted in a comment when set before the first Write
+
+	nodes, ways, relations xmlSection
+	wayBuf, relBuf         spool
+}
+
+func (x *xmlWriter) setSRS(code int64) {
+	x.srs = code
+}
+
+func NewXMLWriter(w io.Writer) *xmlWriter {
+	x := &xmlWriter{w: w}
+	x.nodes = newXMLSection(w)
+	x.ways = newXMLSection(&x.wayBuf)
+	x.relations = newXMLSection(&x.relBuf)
+	return x
+}
+
+// Write the XML header and the opening osm tag, once
+func (x *xmlWriter) start() error {
+	if x.started {
+		return nil
+	}
+	x.started = true
+	if _, err := io.WriteString(x.w, xml.Header); err != nil {
+		return err
+	}
+	// OSM XML has nowhere to say this, a comment at least warns anyone who opens the file
+	if x.srs != 0 {
+		if _, err := fmt.Fprintf(x.w, "<!-- Coordinates are in EPSG:%d, not WGS 84 -->\n", x.srs); err != nil {
+			return err
+		}
+	}
+	enc := xml.NewEncoder(x.w)
+	err := enc.EncodeToken(xml.StartElement{Name: xml.Name{Local: "osm"}, Attr: []xml.Attr{
+		{Name: xml.Name{Local: "version"}, Value: "0.6"},
+		{Name: xml.Name{Local: "generator"}, Value: "gpkg2osm " + Version},
+	}})
+	if err != nil {
+		return err
+	}
+	return enc.Flush()
+}
+
+func (x *xmlWriter) Write(file *osm.OSM) error {
+	if err := x.start(); err != nil {
+		return err
+	}
+	for _, n := range file.Nodes {
+		if err := x.nodes.encode(n); err != nil {
+			return err
+		}
+	}
+	for _, w := range file.Ways {
+		if err := x.ways.encode(w); err != nil {
+			return err
+		}
+	}
+	for _, r := range file.Relations {
+		if err := x.relations.encode(r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (x *xmlWriter) Close() error {
+	if err := x.start(); err != nil {
+		return err
+	}
+	for _, b := range []*spool{&x.wayBuf, &x.relBuf} {
+		if _, err := b.WriteTo(x.w); err != nil {
+			return err
+		}
+	}
+	end := "</osm>\n"
+	if x.nodes.n+x.ways.n+x.relations.n > 0 {
+		end = "\n" + end
+	}
+	_, err := io.WriteString(x.w, end)
+	return err
+}
+
+// xmlSection encodes elements one after the other, each on a line of its own indented inside the osm tag
+type xmlSection struct {
+	w   io.Writer
+	enc *xml.Encoder
+	n   int // Elements written
+}
+
+func newXMLSection(w io.Writer) xmlSection {
+	enc := xml.NewEncoder(w)
+	enc.Indent("  ", "  ")
+	return xmlSection{w: w, enc: enc}
+}
+
+// The encoder only puts a newline between elements, not before the first one
+func (s *xmlSection) encode(v any) error {
+	if s.n == 0 {
+		if _, err := io.WriteString(s.w, "\n"); err != nil {
+			return err
+		}
+	}
+	s.n++
+	return s.enc.Encode(v)
+}
+
+// Features the conversion can get ahead of an asyncWriter by
+const writeQueueSize = 256
+
+// asyncWriter passes the files to the writer on a goroutine of its own, so encoding and compressing them happens
+// while the next features are converted. An error is returned by a later Write, sync or Close
+type asyncWriter struct {
+	out    OSMWriter
+	files  chan *osm.OSM // A nil file asks for synced to be sent the first error so far
+	synced chan error
+	failed chan struct{} // Closed once err is set
+	done   chan struct{}
+	err    error
+	closed bool
+}
+
+func newAsyncWriter(out OSMWriter) *asyncWriter {
+	a := &asyncWriter{
+		out:    out,
+		files:  make(chan *osm.OSM, writeQueueSize),
+		synced: make(chan error),
+		failed: make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	go a.run()
+	return a
+}
+
+func (a *asyncWriter) run() {
+	defer close(a.done)
+	var err error
+	for file := range a.files {
+		if file == nil {
+			a.synced <- err
+			continue
+		}
+		// After an error the queue is still emptied, so nothing waiting on it blocks
+		if err == nil {
+			if err = a.out.Write(file); err != nil {
+				a.err = err
+				close(a.failed)
+			}
+		}
+	}
+}
+
+func (a *asyncWriter) Write(file *osm.OSM) error {
+	select {
+	case <-a.failed:
+		return a.err
+	default:
+	}
+	a.files <- file
+	return nil
+}
+
+// Wait until every file before has been written
+func (a *asyncWriter) sync() error {
+	a.files <- nil
+	return <-a.synced
+}
+
+// Write what is queued and then close the writer
+func (a *asyncWriter) Close() error {
+	a.stop()
+	if a.err != nil {
+		return a.err
+	}
+	return a.out.Close()
+}
+
+// End the goroutine without closing the writer, for a conversion that stopped early. It can be called again
+func (a *asyncWriter) stop() {
+	if !a.closed {
+		a.closed = true
+		close(a.files)
+		<-a.done
+	}
+}
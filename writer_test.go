@@ -0,0 +1,332 @@
+package gpkg2osm
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"runtime"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/paulmach/osm"
+)
+
+// The whole conversion into a bytes.Buffer and back, for every format
+func TestBufferRoundTrip(t *testing.T) {
+	db := newGeoPackage(t)
+	addLayer(t, db, "pois", "POINT", "amenity", "name")
+	addLayer(t, db, "parks", "POLYGON", "leisure")
+	insert(t, db, "pois", point(13.4, 52.5), map[string]any{"amenity": "cafe", "name": "Kaffee & Kuchen <3>"})
+	insert(t, db, "parks", polygon(
+		[]float64{0, 0, 4, 0, 4, 4, 0, 4, 0, 0},
+		[]float64{1, 1, 2, 1, 2, 2, 1, 1},
+	), map[string]any{"leisure": "park"})
+
+	for _, format := range []Format{FormatXML, FormatPBF, FormatO5M} {
+		t.Run(string(format), func(t *testing.T) {
+			var buf bytes.Buffer
+			w, err := NewWriter(&buf, format)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := Convert(db, w, nil); err != nil {
+				t.Fatal(err)
+			}
+			if buf.Len() == 0 {
+				t.Fatal("nothing was written")
+			}
+			file := readOSM(t, buf.Bytes(), format)
+			if len(file.Nodes) != 8 || len(file.Ways) != 2 || len(file.Relations) != 1 {
+				t.Fatalf("got %d nodes, %d ways and %d relations, want 8, 2 and 1", len(file.Nodes), len(file.Ways), len(file.Relations))
+			}
+			poi := taggedNodes(file)
+			if len(poi) != 1 || poi[0].Lon != 13.4 || poi[0].Lat != 52.5 {
+				t.Fatalf("tagged nodes %v, want the cafe at 13.4,52.5", poi)
+			}
+			checkTags(t, poi[0].Tags, "amenity", "cafe", "name", "Kaffee & Kuchen <3>")
+			r := file.Relations[0]
+			checkTags(t, r.Tags, "leisure", "park", "type", "multipolygon")
+			roles := map[string]int{}
+			for _, m := range r.Members {
+				if m.Type != osm.TypeWay {
+					t.Errorf("member %v is not a way", m)
+				}
+				roles[m.Role]++
+			}
+			if roles["outer"] != 1 || roles["inner"] != 1 {
+				t.Errorf("member roles %v, want an outer and an inner", roles)
+			}
+		})
+	}
+}
+
+func TestPBFBlockSize(t *testing.T) {
+	db := newGeoPackage(t)
+	addLayer(t, db, "roads", "LINESTRING", "highway")
+	for i := range 20 {
+		insert(t, db, "roads", line(0, float64(i), 1, float64(i), 2, float64(i)), map[string]any{"highway": "path"})
+	}
+
+	var sizes []int
+	for _, size := range []int{1, 7, DefaultPBFBlockSize} {
+		var buf bytes.Buffer
+		w, err := NewPBFWriter(&buf, &PBFOptions{BlockSize: size})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := Convert(db, w, nil); err != nil {
+			t.Fatal(err)
+		}
+		file := readOSM(t, buf.Bytes(), FormatPBF)
+		if len(file.Nodes) != 60 || len(file.Ways) != 20 {
+			t.Errorf("block size %d: got %d nodes and %d ways, want 60 and 20", size, len(file.Nodes), len(file.Ways))
+		}
+		sizes = append(sizes, buf.Len())
+	}
+	// Every block has a header of its own
+	if sizes[0] <= sizes[1] || sizes[1] <= sizes[2] {
+		t.Errorf("file sizes %v, want smaller blocks to make larger files", sizes)
+	}
+}
+
+// The type of each element of a PBF file, in the order they were written
+func elementOrder(t *testing.T, data []byte) []osm.Type {
+	t.Helper()
+	var types []osm.Type
+	s := NewScanner(bytes.NewReader(data), FormatPBF)
+	for s.Scan() {
+		switch s.Object().(type) {
+		case *osm.Node:
+			types = append(types, osm.TypeNode)
+		case *osm.Way:
+			types = append(types, osm.TypeWay)
+		case *osm.Relation:
+			types = append(types, osm.TypeRelation)
+		}
+	}
+	if err := s.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return types
+}
+
+func TestPBFSorted(t *testing.T) {
+	db := newGeoPackage(t)
+	addLayer(t, db, "features", "GEOMETRY", "name")
+	insert(t, db, "features", line(0, 0, 1, 0), map[string]any{"name": "line"})
+	insert(t, db, "features", polygon([]float64{0, 0, 4, 0, 4, 4, 0, 4, 0, 0}, []float64{1, 1, 2, 1, 2, 2, 1, 1}), map[string]any{"name": "area"})
+	insert(t, db, "features", point(9, 9), map[string]any{"name": "point"})
+	insert(t, db, "features", line(5, 5, 6, 6), map[string]any{"name": "another line"})
+
+	convertPBF := func(opts *PBFOptions) []byte {
+		var buf bytes.Buffer
+		w, err := NewPBFWriter(&buf, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := Convert(db, w, nil); err != nil {
+			t.Fatal(err)
+		}
+		return buf.Bytes()
+	}
+	rank := map[osm.Type]int{osm.TypeNode: 0, osm.TypeWay: 1, osm.TypeRelation: 2}
+	isSorted := func(types []osm.Type) bool {
+		return slices.IsSortedFunc(types, func(a, b osm.Type) int { return rank[a] - rank[b] })
+	}
+
+	unsorted := convertPBF(&PBFOptions{BlockSize: 3})
+	if isSorted(elementOrder(t, unsorted)) {
+		t.Fatalf("the elements are already in order without Sorted: %v", elementOrder(t, unsorted))
+	}
+	for _, size := range []int{3, DefaultPBFBlockSize} {
+		data := convertPBF(&PBFOptions{BlockSize: size, Sorted: true})
+		if types := elementOrder(t, data); !isSorted(types) {
+			t.Errorf("block size %d: elements in the order %v, want nodes, ways, relations", size, types)
+		}
+		// The same elements, only in another order
+		if got, want := elementIDs(readOSM(t, data, FormatPBF)), elementIDs(readOSM(t, unsorted, FormatPBF)); fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Errorf("block size %d: got %v, want %v", size, got, want)
+		}
+	}
+}
+
+// The version, timestamp and user are on every element, in every format
+func TestElementMetadata(t *testing.T) {
+	db := newGeoPackage(t)
+	addLayer(t, db, "parks", "POLYGON", "leisure")
+	insert(t, db, "parks", polygon(
+		[]float64{0, 0, 4, 0, 4, 4, 0, 4, 0, 0},
+		[]float64{1, 1, 2, 1, 2, 2, 1, 1},
+	), map[string]any{"leisure": "park"})
+	ts := time.Date(2024, 1, 2, 15, 4, 5, 0, time.UTC)
+
+	for _, format := range []Format{FormatXML, FormatPBF, FormatO5M} {
+		t.Run(string(format), func(t *testing.T) {
+			data, _ := convertTo(t, db, format, &Options{Version: 3, Timestamp: ts, User: "importer"})
+			file := readOSM(t, data, format)
+			var elements []osm.Element
+			for _, n := range file.Nodes {
+				elements = append(elements, n)
+			}
+			for _, w := range file.Ways {
+				elements = append(elements, w)
+			}
+			for _, r := range file.Relations {
+				elements = append(elements, r)
+			}
+			if len(file.Relations) != 1 || len(elements) != 10 {
+				t.Fatalf("got %d elements, want the 7 nodes, 2 ways and the relation", len(elements))
+			}
+			for _, e := range elements {
+				var version int
+				var timestamp time.Time
+				var user string
+				switch e := e.(type) {
+				case *osm.Node:
+					version, timestamp, user = e.Version, e.Timestamp, e.User
+				case *osm.Way:
+					version, timestamp, user = e.Version, e.Timestamp, e.User
+				case *osm.Relation:
+					version, timestamp, user = e.Version, e.Timestamp, e.User
+				}
+				if version != 3 || !timestamp.Equal(ts) || user != "importer" {
+					t.Errorf("%v has version %d, timestamp %v and user %q", e.FeatureID(), version, timestamp, user)
+				}
+			}
+		})
+	}
+}
+
+// PBF keeps coordinates to the closest 1e-7 degrees, all the way to the edges of the map
+func TestPBFCoordinates(t *testing.T) {
+	coords := [][2]float64{
+		{13.3777041, 52.5162746},
+		{13.123456789, -52.987654321},
+		{180, 90},
+		{-180, -90},
+		{179.9999999, -89.9999999},
+		{0.00000004, -0.00000006},
+	}
+	file := &osm.OSM{}
+	for i, c := range coords {
+		file.Nodes = append(file.Nodes, &osm.Node{ID: osm.NodeID(-i - 1), Lon: c[0], Lat: c[1], Visible: true})
+	}
+	var buf bytes.Buffer
+	w, err := NewWriter(&buf, FormatPBF)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Write(file); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	got := readOSM(t, buf.Bytes(), FormatPBF)
+	if len(got.Nodes) != len(coords) {
+		t.Fatalf("got %d nodes, want %d", len(got.Nodes), len(coords))
+	}
+	for i, n := range got.Nodes {
+		c := coords[i]
+		if math.Abs(n.Lon-c[0]) > 0.5e-7 || math.Abs(n.Lat-c[1]) > 0.5e-7 {
+			t.Errorf("%v,%v came back as %v,%v", c[0], c[1], n.Lon, n.Lat)
+		}
+	}
+
+	w, err = NewWriter(io.Discard, FormatPBF)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Write(&osm.OSM{Nodes: osm.Nodes{{ID: -1, Lon: math.NaN(), Lat: 0}}}); err == nil {
+		t.Error("a node that is not a number was written")
+	}
+}
+
+// countingWriter throws away what is written to it, but counts it
+type countingWriter struct {
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	c.n += int64(len(p))
+	return len(p), nil
+}
+
+// The bytes an XML or O5M writer holds for Close
+func spooled(w OSMWriter) int64 {
+	switch w := w.(type) {
+	case *xmlWriter:
+		return w.wayBuf.Len() + w.relBuf.Len()
+	case *o5mWriter:
+		return w.wayBuf.Len() + w.relBuf.Len()
+	}
+	return 0
+}
+
+// The ways and relations that XML and O5M hold until the nodes are done go to a temporary file past spoolMemory,
+// so the heap stays the same however many of them there are
+func TestBoundedMemory(t *testing.T) {
+	defer func(n int) { spoolMemory = n }(spoolMemory)
+	spoolMemory = 1 << 20
+	const held = 32 << 20
+
+	for _, format := range []Format{FormatXML, FormatO5M} {
+		t.Run(string(format), func(t *testing.T) {
+			var out countingWriter
+			w, err := NewWriter(&out, format)
+			if err != nil {
+				t.Fatal(err)
+			}
+			way := &osm.Way{Visible: true, Version: 1, Tags: osm.Tags{{Key: "highway", Value: "residential"}}}
+			for i := range 500 {
+				way.Nodes = append(way.Nodes, osm.WayNode{ID: osm.NodeID(i*1_000_003 + 1)})
+			}
+
+			var before, after runtime.MemStats
+			runtime.GC()
+			runtime.ReadMemStats(&before)
+			var ways int
+			for ways = 1; spooled(w) < held; ways++ {
+				way.ID = osm.WayID(ways)
+				err := w.Write(&osm.OSM{
+					Nodes:     osm.Nodes{{ID: osm.NodeID(ways), Lon: 1, Lat: 2, Visible: true}},
+					Ways:      osm.Ways{way},
+					Relations: osm.Relations{{ID: osm.RelationID(ways), Visible: true, Members: osm.Members{{Type: osm.TypeWay, Ref: int64(ways), Role: "outer"}}}},
+				})
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			runtime.GC()
+			runtime.ReadMemStats(&after)
+			if grown := int64(after.HeapAlloc) - int64(before.HeapAlloc); grown > 8<<20 {
+				t.Errorf("the heap grew by %dMB to hold %dMB of %d ways", grown>>20, held>>20, ways)
+			}
+
+			nodes := out.n
+			if err := w.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if out.n-nodes < held {
+				t.Errorf("Close wrote %d bytes after the nodes, want the %d that were held", out.n-nodes, held)
+			}
+		})
+	}
+}
+
+// Spilling to the temporary file changes nothing in the output
+func TestSpoolSpill(t *testing.T) {
+	db := gridGeoPackage(t, 10)
+	for _, format := range []Format{FormatXML, FormatO5M} {
+		want, _ := convertTo(t, db, format, nil)
+		func() {
+			defer func(n int) { spoolMemory = n }(spoolMemory)
+			spoolMemory = 100
+			if got, _ := convertTo(t, db, format, nil); !bytes.Equal(got, want) {
+				t.Errorf("%s output differs once the ways and relations are in a temporary file", format)
+			}
+		}()
+	}
+}